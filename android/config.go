@@ -1285,6 +1285,12 @@ func (c *config) ModulesLoadedByPrivilegedModules() []string {
 	return c.productVariables.ModulesLoadedByPrivilegedModules
 }
 
+// ConfiguredJarLocationOverrides returns the configured jar location overrides, as
+// <old_apex>:<old_jar>:<new_apex>:<new_jar> entries, see OverrideConfiguredJarLocationFor.
+func (c *config) ConfiguredJarLocationOverrides() []string {
+	return c.productVariables.ConfiguredJarLocationOverrides
+}
+
 // DexpreoptGlobalConfigPath returns the path to the dexpreopt.config file in
 // the output directory, if it was created during the product configuration
 // phase by Kati.
@@ -18,7 +18,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/google/blueprint"
 
@@ -30,10 +32,16 @@ import (
 type GlobalConfig struct {
 	DisablePreopt           bool     // disable preopt for all modules (excluding boot images)
 	DisablePreoptBootImages bool     // disable prepot for boot images
-	DisablePreoptModules    []string // modules with preopt disabled by product-specific config
+	DisablePreoptModules    []string // modules with preopt disabled by product-specific config, see PreoptDenylist
+
+	AllowUnmatchedDisablePreoptModules bool // don't fail on patterns in DisablePreoptModules that match no module
 
 	OnlyPreoptArtBootImage bool // only preopt jars in the ART boot image
 
+	OnDeviceImageGeneration bool // build no boot images, they are generated on device at first boot
+
+	DisableBootImageSymbols bool // don't generate the unstripped boot image files
+
 	PreoptWithUpdatableBcp bool // If updatable boot jars are included in dexpreopt or not.
 
 	HasSystemOther        bool     // store odex files that match PatternsOnSystemOther on the system_other partition
@@ -45,16 +53,177 @@ type GlobalConfig struct {
 	BootJars     android.ConfiguredJarList // modules for jars that form the boot class path
 	ApexBootJars android.ConfiguredJarList // jars within apex that form the boot class path
 
+	// Structured alternatives to ApexBootJars and ApexSystemServerJars, with the attributes of each
+	// jar in the entry rather than in the attribute maps keyed by jar, like StemFallbacks. When set,
+	// they are converted into the legacy lists and attribute maps when the config is parsed.
+	ApexBootJarEntries         []ApexJar
+	ApexSystemServerJarEntries []ApexJar
+
+	// The maximum number of entries in each boot jar list and in each system server jar list, or
+	// zero for the defaults. They catch broken config generators before any work is done on the
+	// lists.
+	MaxBootJarListSize         int
+	MaxSystemServerJarListSize int
+
+	// Product-specific seed that is part of the identity of the boot images, so that they are
+	// regenerated when it changes even if their jars do not.
+	BootImageSeed string
+
+	// Whether to check that the make variables that export the boot class path can be parsed back
+	// into the boot image configs they are derived from. It is always checked in eng builds.
+	VerifyExportedMakeVars bool
+
+	// If true, the make variables that export build paths, e.g. DEXPREOPT_IMAGE_ZIP_<image>, are
+	// relative to the out directory rather than including it. The variables that export on-device
+	// locations are not affected.
+	MakeVarsRelativePaths bool
+
+	// Whether the device loads the ART boot image from the image directory of the ART apex, i.e.
+	// /apex/com.android.art/javalib/<arch>, in which case the default boot image is not installed
+	// on the system partition.
+	UsesArtApexBootImage bool
+
+	// Whether to write a manifest of the sha256 and size of each staged boot dex jar for each boot
+	// image variant, for hermeticity audits, and whether to also check the staged jars against the
+	// hashes provided by the modules that supply them.
+	AuditBootDexInputs       bool
+	VerifyBootDexInputHashes bool
+
+	// Apexes whose boot jars are taken from the prebuilt apex rather than from the build, for boot
+	// class paths that mix prebuilt and source apexes.
+	PrebuiltBootJarApexes []string
+
+	// The modules that provide boot jars whose module was renamed, by jar name, e.g. "framework" ->
+	// "framework-minus-apex". The providing module is used to get the dex jar of the boot jar, while
+	// the class paths, stems and locations keep using the jar name. Aliases must not be chained.
+	BootJarModuleAliases map[string]string
+
+	// Paths relative to the Soong output directory of the dex jars that the modules of boot jars are
+	// known to produce, by jar name. If SkipStagingOfStableBootJars is set, the boot images use the
+	// paths directly rather than copies of the jars staged in their input directories, for the jars
+	// whose path has the name of the staged jar.
+	SkipStagingOfStableBootJars bool
+	StableBootDexJarPaths       map[string]string
+
+	// Boot jars that are stored uncompressed in the zips of the boot images that include them, for
+	// faster access on device. All jars are compressed if empty.
+	UncompressedBootJars []string
+
+	// Boot jars that are profiled when the boot image profiles are generated, e.g. those that ship
+	// a profile. All jars are profiled if empty.
+	ProfiledBootModules []string
+
+	// Whether not to generate the init.environ.rc fragment that exports the class paths, on devices
+	// that get the class paths from the classpaths proto fragments instead.
+	DisableInitClasspathExports bool
+
+	// The directories of the java libraries in apexes that do not install them in the default
+	// "javalib" directory, by apex name, e.g. "javalib64" for /apex/<name>/javalib64. Each must be
+	// the name of a directory in the root of the apex.
+	ApexJavalibDirOverrides map[string]string
+
+	// Whether to put the outputs of each boot image in a directory named after the content hash of
+	// its config, rather than in the directory of the device, so that builds of identical configs
+	// can share the outputs through a cache.
+	ContentAddressedBootImageDir bool
+
+	// Whether the default boot image is built as an extension of the ART boot image, in which case
+	// the modules of the ART boot image must be a strict prefix of those of the default boot image.
+	ExtendArtBootImage bool
+
+	// The API level that the dexpreopt targets are expected to have, e.g. "35". It is not checked if
+	// empty.
+	ExpectedPreoptApiLevel string
+
+	// Jars that the ART runtime requires at the front of the art boot image, in the required order,
+	// e.g. ["core-oj", "core-libart"]. It is not checked if empty.
+	RequiredArtModuleOrder []string
+
+	// Names of the boot images to build, e.g. "art" or "mainline". All of them are built if empty. The
+	// default boot image is always built.
+	EnabledBootImageVariants []string
+
+	// Partition images other than system, e.g. "recovery", that dexpreopt artifacts are installed
+	// into. By default they are only installed into the system partition image.
+	DexpreoptArtifactPartitions []string
+
+	// Jars whose preopt rules are registered first, in priority order, so that the most expensive
+	// dex2oat actions can be scheduled early. The order of the other jars does not change.
+	PreoptPriorityJars []string
+
+	// Serialize the build paths in the artifacts written by the dexpreopt singletons relative to the
+	// build root, with the output directory as "out", so that the artifacts do not change when the
+	// output directory is relocated.
+	RelativeArtifactPaths bool
+
+	// Prefix prepended to the on-device locations of the boot and system server class path jars, so
+	// that host tests can load them from a staged tree. Empty by default.
+	OnDeviceLocationPrefix string
+
+	// Path to a checked-in file that lists the jars that are approved to be on the boot class path,
+	// as apex:jar, one per line. If set, the build fails if any other jar is on the boot class path.
+	BootclasspathAllowlist string
+
+	// Apex boot jars that are compiled into the secondary boot image, which is layered on the
+	// default boot image. All the apex boot jars are if empty.
+	SecondaryBootImageModules []string
+
+	// Apexes that are allowed to contribute apex boot jars. Any apex is allowed if empty.
+	AllowedBootJarApexes []string
+
+	// Jars within apex that are on the boot class path but are never preopted nor included in
+	// any boot image, e.g. because their apex forbids build-time compilation.
+	ClasspathOnlyApexJars android.ConfiguredJarList
+
+	// Apex system server jars that may also be on the boot class path while they are migrated from
+	// one to the other.
+	DualClaimAllowlist DualClaimAllowlist
+
+	// The on-device locations of the apex boot jars, as precomputed by Make. Deprecated: they are
+	// derived from ApexBootJars. While this is set, both are computed and any difference between
+	// them is reported, so that it can be dropped once they match on all products.
+	ProductUpdatableBootLocations []string
+
+	// Whether the boot class path uses ProductUpdatableBootLocations, if it is set, rather than the
+	// locations derived from ApexBootJars.
+	UseLegacyUpdatableBootLocations bool
+
 	ArtApexJars              android.ConfiguredJarList // modules for jars that are in the ART APEX
 	TestOnlyArtBootImageJars android.ConfiguredJarList // modules for jars to be included in the ART boot image for testing
 
+	StemFallbacks map[string]string // jar -> stem to use when the stem of the jar's module cannot be resolved yet
+
 	SystemServerJars               android.ConfiguredJarList // system_server classpath jars on the platform
 	SystemServerApps               []string                  // apps that are loaded into system server
 	ApexSystemServerJars           android.ConfiguredJarList // system_server classpath jars delivered via apex
 	StandaloneSystemServerJars     android.ConfiguredJarList // jars on the platform that system_server loads dynamically using separate classloaders
 	ApexStandaloneSystemServerJars android.ConfiguredJarList // jars delivered via apex that system_server loads dynamically using separate classloaders
+	ApkInApexSystemServerJars      []string                  // system_server classpath apks delivered via apex, as apex:apk:path with the path relative to the apex root
 	SpeedApps                      []string                  // apps that should be speed optimized
 
+	SystemServerJarsWithProfiles []string           // system server jars that install a profile next to the jar on device
+	SystemServerPreoptArches     []android.ArchType // arches to preopt system server jars for, the primary arch if empty
+
+	UpdatableJarVersions map[string]string // apex jar -> version to append to its system_server classpath entry
+
+	// Warnings about the use of deprecated fields, see DeprecationWarnings.
+	deprecationWarnings []string
+
+	// If true, the system server class path is sorted rather than in config order. This is only
+	// meant for comparing the class path against a reference tool that sorts it, and must not be
+	// used to build a device.
+	SortSystemServerClasspath bool
+
+	// The on-device locations of the jars on the system server class path, for products that compute
+	// it out-of-band. If set, it is used verbatim instead of the class path computed from the system
+	// server jars, and every entry must be an absolute path.
+	SystemServerClasspathOverride []string
+
+	// The apexes whose system server jars fragments are merged first, in this order, see
+	// RegisterSystemServerJarsFragment. The fragments of the other apexes follow, sorted by apex
+	// name.
+	SystemServerJarsFragmentApexOrder []string
+
 	BrokenSuboptimalOrderOfSystemServerJars bool // if true, sub-optimal order does not cause a build error
 
 	PreoptFlags []string // global dex2oat flags that should be used if no module-specific dex2oat flags are specified
@@ -83,11 +252,30 @@ type GlobalConfig struct {
 
 	CpuVariant             map[android.ArchType]string // cpu variant for each architecture
 	InstructionSetFeatures map[android.ArchType]string // instruction set for each architecture
-
-	BootImageProfiles android.Paths // path to a boot-image-profile.txt file
-	BootFlags         string        // extra flags to pass to dex2oat for the boot image
-	Dex2oatImageXmx   string        // max heap size for dex2oat for the boot image
-	Dex2oatImageXms   string        // initial heap size for dex2oat for the boot image
+	Dex2oatBinaryByArch    map[android.ArchType]string // dex2oat binary for each architecture, if not the default one
+
+	BootImageProfiles    android.Paths     // path to a boot-image-profile.txt file
+	BootImageProfileText map[string]string // boot image name -> path to its human readable text profile
+	BootFlags            string            // extra flags to pass to dex2oat for the boot image
+	Dex2oatImageXmx      string            // max heap size for dex2oat for the boot image
+	Dex2oatImageXms      string            // initial heap size for dex2oat for the boot image
+
+	// The number of threads that dex2oat uses for the boot images, e.g. "8", and the cpus that it
+	// runs on, as a comma separated list, e.g. "0,1,2,3". The dex2oat defaults are used if empty. The
+	// by-arch settings override them for the variants of each architecture.
+	Dex2oatImageThreads       string
+	Dex2oatImageCpuSet        string
+	Dex2oatImageThreadsByArch map[android.ArchType]string
+	Dex2oatImageCpuSetByArch  map[android.ArchType]string
+
+	// Whether each architecture has its own boot image profile, as in some layouts, rather than one
+	// profile that is shared by all architectures.
+	PerArchBootImageProfiles bool
+
+	// The architectures that dex2oat supports, for products whose targets include architectures that
+	// are still being brought up. Device targets of other architectures are not dexpreopted. All
+	// architectures are supported if empty.
+	SupportedPreoptArches []android.ArchType
 
 	// If true, downgrade the compiler filter of dexpreopt to "verify" when verify_uses_libraries
 	// check fails, instead of failing the build. This will disable any AOT-compilation.
@@ -116,11 +304,141 @@ func (g *GlobalConfig) AllPlatformSystemServerJars(ctx android.PathContext) *and
 
 var allApexSystemServerJarsKey = android.NewOnceKey("allApexSystemServerJars")
 
+// DefaultApexJavalibDir is the directory of the java libraries in an apex, relative to its root.
+const DefaultApexJavalibDir = "javalib"
+
+// ApexJavalibDir returns the directory of the java libraries in the given apex, relative to its
+// root, see ApexJavalibDirOverrides.
+func (g *GlobalConfig) ApexJavalibDir(apex string) string {
+	if dir, ok := g.ApexJavalibDirOverrides[apex]; ok {
+		return dir
+	}
+	return DefaultApexJavalibDir
+}
+
+// BootJarModule returns the name of the module that provides the given boot jar, see
+// BootJarModuleAliases.
+func (g *GlobalConfig) BootJarModule(jar string) string {
+	if module, ok := g.BootJarModuleAliases[jar]; ok {
+		return module
+	}
+	return jar
+}
+
+// SystemServerJarsFragment is the system server jars that an apex owns, in classpath order.
+type SystemServerJarsFragment struct {
+	Apex string
+	Jars []string
+}
+
+var systemServerJarsFragmentsKey = android.NewOnceKey("systemServerJarsFragments")
+
+// systemServerJarsFragments is the registry of the system server jars fragments of a config.
+type systemServerJarsFragments struct {
+	mutex     sync.Mutex
+	fragments []SystemServerJarsFragment
+	read      bool
+}
+
+func getSystemServerJarsFragments(config android.Config) *systemServerJarsFragments {
+	return config.Once(systemServerJarsFragmentsKey, func() interface{} {
+		return &systemServerJarsFragments{}
+	}).(*systemServerJarsFragments)
+}
+
+// RegisterSystemServerJarsFragment registers the system server jars that the given apex owns, so
+// that they are on the system server class path after the platform SystemServerJars, as if they
+// were listed in ApexSystemServerJars. Registering several fragments for the same apex appends to
+// its jars.
+//
+// It must be called before the system server jars are first read, and panics otherwise, as the
+// class paths that were already computed would not include the jars. The fragments of
+// systemserverclasspath_fragment modules with an owner_apex are registered from a mutator that runs
+// before the arch mutator, which is before any reader.
+func RegisterSystemServerJarsFragment(config android.Config, apex string, jars ...string) {
+	registry := getSystemServerJarsFragments(config)
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	if registry.read {
+		panic(fmt.Errorf("system server jars fragment of apex %q registered after the system server jars were read", apex))
+	}
+	for i := range registry.fragments {
+		if registry.fragments[i].Apex == apex {
+			registry.fragments[i].Jars = append(registry.fragments[i].Jars, jars...)
+			return
+		}
+	}
+	registry.fragments = append(registry.fragments, SystemServerJarsFragment{apex, append([]string(nil), jars...)})
+}
+
+// SystemServerJarsFragments returns the registered system server jars fragments, in the order they
+// are merged, see SystemServerJarsFragmentApexOrder. No fragment can be registered afterwards.
+func (g *GlobalConfig) SystemServerJarsFragments(ctx android.PathContext) []SystemServerJarsFragment {
+	registry := getSystemServerJarsFragments(ctx.Config())
+	registry.mutex.Lock()
+	registry.read = true
+	fragments := append([]SystemServerJarsFragment(nil), registry.fragments...)
+	registry.mutex.Unlock()
+
+	rank := func(apex string) int {
+		if i := android.IndexList(apex, g.SystemServerJarsFragmentApexOrder); i >= 0 {
+			return i
+		}
+		return len(g.SystemServerJarsFragmentApexOrder)
+	}
+	sort.SliceStable(fragments, func(i, j int) bool {
+		if ri, rj := rank(fragments[i].Apex), rank(fragments[j].Apex); ri != rj {
+			return ri < rj
+		}
+		return fragments[i].Apex < fragments[j].Apex
+	})
+	return fragments
+}
+
+// MergedApexSystemServerJars returns ApexSystemServerJars followed by the jars of the system server
+// jars fragments, see SystemServerJarsFragments. A jar of a fragment that is already listed in
+// ApexSystemServerJars or in an earlier fragment is skipped, and reported as a conflict by
+// SystemServerJarsFragmentConflicts.
+func (g *GlobalConfig) MergedApexSystemServerJars(ctx android.PathContext) android.ConfiguredJarList {
+	merged := g.ApexSystemServerJars
+	for _, fragment := range g.SystemServerJarsFragments(ctx) {
+		for _, jar := range fragment.Jars {
+			if !merged.ContainsJar(jar) {
+				merged = merged.Append(fragment.Apex, jar)
+			}
+		}
+	}
+	return merged
+}
+
+// SystemServerJarsFragmentConflicts returns an error for each jar of a system server jars fragment
+// that is also listed in ApexSystemServerJars or in another fragment, as each jar must have one
+// source.
+func (g *GlobalConfig) SystemServerJarsFragmentConflicts(ctx android.PathContext) []error {
+	var errs []error
+	claimedBy := make(map[string]string)
+	for _, fragment := range g.SystemServerJarsFragments(ctx) {
+		for _, jar := range fragment.Jars {
+			if g.ApexSystemServerJars.ContainsJar(jar) {
+				errs = append(errs, fmt.Errorf("system server jar %q is claimed by both ApexSystemServerJars, as %s:%s, and the fragment of apex %q",
+					jar, g.ApexSystemServerJars.ApexOfJar(jar), jar, fragment.Apex))
+			} else if other, ok := claimedBy[jar]; ok {
+				errs = append(errs, fmt.Errorf("system server jar %q is claimed by the fragments of both apex %q and apex %q",
+					jar, other, fragment.Apex))
+			} else {
+				claimedBy[jar] = fragment.Apex
+			}
+		}
+	}
+	return errs
+}
+
 // Returns all jars delivered via apex that system_server loads, including those on classpath and
 // those loaded dynamically.
 func (g *GlobalConfig) AllApexSystemServerJars(ctx android.PathContext) *android.ConfiguredJarList {
 	return ctx.Config().Once(allApexSystemServerJarsKey, func() interface{} {
-		res := g.ApexSystemServerJars.AppendList(&g.ApexStandaloneSystemServerJars)
+		merged := g.MergedApexSystemServerJars(ctx)
+		res := merged.AppendList(&g.ApexStandaloneSystemServerJars)
 		return &res
 	}).(*android.ConfiguredJarList)
 }
@@ -130,7 +448,8 @@ var allSystemServerClasspathJarsKey = android.NewOnceKey("allSystemServerClasspa
 // Returns all system_server classpath jars.
 func (g *GlobalConfig) AllSystemServerClasspathJars(ctx android.PathContext) *android.ConfiguredJarList {
 	return ctx.Config().Once(allSystemServerClasspathJarsKey, func() interface{} {
-		res := g.SystemServerJars.AppendList(&g.ApexSystemServerJars)
+		merged := g.MergedApexSystemServerJars(ctx)
+		res := g.SystemServerJars.AppendList(&merged)
 		return &res
 	}).(*android.ConfiguredJarList)
 }
@@ -247,12 +566,220 @@ func ParseGlobalConfig(ctx android.PathContext, data []byte) (*GlobalConfig, err
 		return config.GlobalConfig, err
 	}
 
+	if err := config.GlobalConfig.applyApexJarEntries(); err != nil {
+		return config.GlobalConfig, err
+	}
+
+	if err := config.GlobalConfig.checkJarListSizes(); err != nil {
+		return config.GlobalConfig, err
+	}
+
 	// Construct paths that require a PathContext.
 	config.GlobalConfig.BootImageProfiles = constructPaths(ctx, config.BootImageProfiles)
 
 	return config.GlobalConfig, nil
 }
 
+// DualClaimAllowlist lists the jars that are temporarily claimed by both the boot class path and
+// the classpath fragment of an apex, see GlobalConfig.DualClaimAllowlist.
+type DualClaimAllowlist struct {
+	// The claims of the classpath fragments of apexes that are allowed, as apex:jar pairs.
+	Jars android.ConfiguredJarList
+
+	// The last day on which the jars may be claimed twice, in the YYYY-MM-DD format. The migration
+	// of the jars must be finished by then.
+	Expiry string
+}
+
+// ApexJar is a jar delivered via an apex and its attributes, in the structured form of the apex
+// jar lists, see GlobalConfig.ApexBootJarEntries.
+type ApexJar struct {
+	Apex string
+	Jar  string
+
+	// The stem of the jar, see GlobalConfig.StemFallbacks.
+	Stem string `json:",omitempty"`
+
+	// The version appended to the system server class path entry of the jar, see
+	// GlobalConfig.UpdatableJarVersions.
+	Version string `json:",omitempty"`
+
+	// Whether the jar installs a profile, see GlobalConfig.SystemServerJarsWithProfiles. Only for
+	// system server jars.
+	Profile bool `json:",omitempty"`
+
+	// Whether the jar is only on the class path, see GlobalConfig.ClasspathOnlyApexJars. Only for
+	// boot jars.
+	ClasspathOnly bool `json:",omitempty"`
+}
+
+// applyApexJarEntries converts ApexBootJarEntries and ApexSystemServerJarEntries into the legacy
+// lists and attribute maps, which must not also list the same jars with different attributes.
+func (g *GlobalConfig) applyApexJarEntries() error {
+	if len(g.ApexBootJarEntries) == 0 && len(g.ApexSystemServerJarEntries) == 0 {
+		return nil
+	}
+
+	for _, deprecated := range []struct {
+		name string
+		used bool
+	}{
+		{"StemFallbacks", len(g.StemFallbacks) > 0},
+		{"UpdatableJarVersions", len(g.UpdatableJarVersions) > 0},
+		{"SystemServerJarsWithProfiles", len(g.SystemServerJarsWithProfiles) > 0},
+	} {
+		if deprecated.used {
+			g.deprecationWarnings = append(g.deprecationWarnings, fmt.Sprintf(
+				"%s is deprecated when ApexBootJarEntries or ApexSystemServerJarEntries is set, "+
+					"set the attributes of the entries instead", deprecated.name))
+		}
+	}
+
+	setAttribute := func(list, attribute string, m *map[string]string, entry ApexJar, value string) error {
+		if value == "" {
+			return nil
+		}
+		if existing, ok := (*m)[entry.Jar]; ok && existing != value {
+			return fmt.Errorf("%s sets the %s of %q to %q, which conflicts with %q", list, attribute, entry.Jar, value, existing)
+		}
+		if *m == nil {
+			*m = make(map[string]string)
+		}
+		(*m)[entry.Jar] = value
+		return nil
+	}
+
+	if len(g.ApexBootJarEntries) > 0 {
+		if g.ApexBootJars.Len() > 0 || g.ClasspathOnlyApexJars.Len() > 0 {
+			return fmt.Errorf("ApexBootJarEntries cannot be set with ApexBootJars or ClasspathOnlyApexJars")
+		}
+		bootJars, classpathOnlyJars := android.EmptyConfiguredJarList(), android.EmptyConfiguredJarList()
+		for _, entry := range g.ApexBootJarEntries {
+			if entry.Profile {
+				return fmt.Errorf("ApexBootJarEntries sets Profile for %q, which is only supported for system server jars", entry.Jar)
+			}
+			if entry.ClasspathOnly {
+				classpathOnlyJars = classpathOnlyJars.Append(entry.Apex, entry.Jar)
+			} else {
+				bootJars = bootJars.Append(entry.Apex, entry.Jar)
+			}
+			if err := setAttribute("ApexBootJarEntries", "Stem", &g.StemFallbacks, entry, entry.Stem); err != nil {
+				return err
+			}
+			if err := setAttribute("ApexBootJarEntries", "Version", &g.UpdatableJarVersions, entry, entry.Version); err != nil {
+				return err
+			}
+		}
+		g.ApexBootJars, g.ClasspathOnlyApexJars = bootJars, classpathOnlyJars
+	}
+
+	if len(g.ApexSystemServerJarEntries) > 0 {
+		if g.ApexSystemServerJars.Len() > 0 {
+			return fmt.Errorf("ApexSystemServerJarEntries cannot be set with ApexSystemServerJars")
+		}
+		jars := android.EmptyConfiguredJarList()
+		for _, entry := range g.ApexSystemServerJarEntries {
+			if entry.ClasspathOnly {
+				return fmt.Errorf("ApexSystemServerJarEntries sets ClasspathOnly for %q, which is only supported for boot jars", entry.Jar)
+			}
+			jars = jars.Append(entry.Apex, entry.Jar)
+			if err := setAttribute("ApexSystemServerJarEntries", "Stem", &g.StemFallbacks, entry, entry.Stem); err != nil {
+				return err
+			}
+			if err := setAttribute("ApexSystemServerJarEntries", "Version", &g.UpdatableJarVersions, entry, entry.Version); err != nil {
+				return err
+			}
+			if entry.Profile && !android.InList(entry.Jar, g.SystemServerJarsWithProfiles) {
+				g.SystemServerJarsWithProfiles = append(g.SystemServerJarsWithProfiles, entry.Jar)
+			}
+		}
+		g.ApexSystemServerJars = jars
+	}
+	return nil
+}
+
+// apexJarEntries returns the jars in the given list with their attributes, as set by the legacy
+// attribute maps.
+func (g *GlobalConfig) apexJarEntries(jars *android.ConfiguredJarList, classpathOnly bool) []ApexJar {
+	entries := make([]ApexJar, 0, jars.Len())
+	for i := 0; i < jars.Len(); i++ {
+		jar := jars.Jar(i)
+		entries = append(entries, ApexJar{
+			Apex:          jars.Apex(i),
+			Jar:           jar,
+			Stem:          g.StemFallbacks[jar],
+			Version:       g.UpdatableJarVersions[jar],
+			Profile:       android.InList(jar, g.SystemServerJarsWithProfiles),
+			ClasspathOnly: classpathOnly,
+		})
+	}
+	return entries
+}
+
+// AllApexBootJarEntries returns the apex boot jars and the classpath-only apex jars with their
+// attributes, regardless of the form they are configured in.
+func (g *GlobalConfig) AllApexBootJarEntries() []ApexJar {
+	entries := append(g.apexJarEntries(&g.ApexBootJars, false), g.apexJarEntries(&g.ClasspathOnlyApexJars, true)...)
+	for i := range entries {
+		// Profiles are only installed for system server jars.
+		entries[i].Profile = false
+	}
+	return entries
+}
+
+// AllApexSystemServerJarEntries returns the apex system server jars with their attributes,
+// regardless of the form they are configured in.
+func (g *GlobalConfig) AllApexSystemServerJarEntries() []ApexJar {
+	return g.apexJarEntries(&g.ApexSystemServerJars, false)
+}
+
+const (
+	defaultMaxBootJarListSize         = 500
+	defaultMaxSystemServerJarListSize = 1000
+
+	// The number of entries of an oversized jar list that are included in the error.
+	oversizedJarListSample = 5
+)
+
+// checkJarListSizes returns an error if any of the boot jar or system server jar lists has more
+// entries than allowed by MaxBootJarListSize or MaxSystemServerJarListSize.
+func (g *GlobalConfig) checkJarListSizes() error {
+	maxBootJars := g.MaxBootJarListSize
+	if maxBootJars == 0 {
+		maxBootJars = defaultMaxBootJarListSize
+	}
+	maxSystemServerJars := g.MaxSystemServerJarListSize
+	if maxSystemServerJars == 0 {
+		maxSystemServerJars = defaultMaxSystemServerJarListSize
+	}
+
+	lists := []struct {
+		name  string
+		jars  *android.ConfiguredJarList
+		limit int
+	}{
+		{"BootJars", &g.BootJars, maxBootJars},
+		{"ApexBootJars", &g.ApexBootJars, maxBootJars},
+		{"ClasspathOnlyApexJars", &g.ClasspathOnlyApexJars, maxBootJars},
+		{"SystemServerJars", &g.SystemServerJars, maxSystemServerJars},
+		{"ApexSystemServerJars", &g.ApexSystemServerJars, maxSystemServerJars},
+		{"StandaloneSystemServerJars", &g.StandaloneSystemServerJars, maxSystemServerJars},
+		{"ApexStandaloneSystemServerJars", &g.ApexStandaloneSystemServerJars, maxSystemServerJars},
+	}
+	for _, list := range lists {
+		if list.jars.Len() <= list.limit {
+			continue
+		}
+		sample := list.jars.CopyOfApexJarPairs()
+		if len(sample) > oversizedJarListSample {
+			sample = append(sample[:oversizedJarListSample], "...")
+		}
+		return fmt.Errorf("%s has %d entries, more than the limit of %d: %s",
+			list.name, list.jars.Len(), list.limit, strings.Join(sample, ", "))
+	}
+	return nil
+}
+
 type globalConfigAndRaw struct {
 	global     *GlobalConfig
 	data       []byte
@@ -301,12 +828,18 @@ func getGlobalConfigRaw(ctx android.PathContext) globalConfigAndRaw {
 
 		// No global config filename set, see if there is a test config set
 		return ctx.Config().Once(testGlobalConfigOnceKey, func() interface{} {
-			// Nope, return a config with preopting disabled
+			// Nope, return a config with preopting disabled, unless the build requires dexpreopt,
+			// e.g. for a release.
+			var errs []error
+			if ctx.Config().IsEnvTrue("REQUIRE_DEXPREOPT") {
+				errs = append(errs, fmt.Errorf("REQUIRE_DEXPREOPT is set, but there is no dexpreopt config, "+
+					"so dexpreopt would be disabled"))
+			}
 			return globalConfigAndRaw{&GlobalConfig{
 				DisablePreopt:           true,
 				DisablePreoptBootImages: true,
 				DisableGenerateProfile:  true,
-			}, nil, nil}
+			}, nil, errs}
 		})
 	}).(globalConfigAndRaw)
 
@@ -620,6 +1153,12 @@ func ParseGlobalSoongConfig(ctx android.PathContext, data []byte) (*GlobalSoongC
 	return config, nil
 }
 
+// DeprecationWarnings returns the warnings about the use of deprecated fields of the config. They
+// are reported with the other warnings about the dexpreopt config by the dex_bootjars singleton.
+func (g *GlobalConfig) DeprecationWarnings() []string {
+	return g.deprecationWarnings
+}
+
 // checkBootJarsConfigConsistency checks the consistency of BootJars and ApexBootJars fields in
 // DexpreoptGlobalConfig and Config.productVariables.
 func checkBootJarsConfigConsistency(ctx android.SingletonContext, dexpreoptConfig *GlobalConfig, config android.Config) {
@@ -731,6 +1270,7 @@ func GlobalConfigForTests(ctx android.PathContext) *GlobalConfig {
 		ProfileDir:                     "",
 		BootJars:                       android.EmptyConfiguredJarList(),
 		ApexBootJars:                   android.EmptyConfiguredJarList(),
+		ClasspathOnlyApexJars:          android.EmptyConfiguredJarList(),
 		ArtApexJars:                    android.EmptyConfiguredJarList(),
 		TestOnlyArtBootImageJars:       android.EmptyConfiguredJarList(),
 		SystemServerJars:               android.EmptyConfiguredJarList(),
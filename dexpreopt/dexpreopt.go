@@ -115,7 +115,7 @@ func dexpreoptDisabled(ctx android.PathContext, global *GlobalConfig, module *Mo
 		return true
 	}
 
-	if contains(global.DisablePreoptModules, module.Name) {
+	if _, ok := global.PreoptDenylist().Match(module.Name); ok {
 		return true
 	}
 
@@ -128,6 +128,11 @@ func dexpreoptDisabled(ctx android.PathContext, global *GlobalConfig, module *Mo
 		return true
 	}
 
+	// There are no boot images at build time to compile against.
+	if global.OnDeviceImageGeneration {
+		return true
+	}
+
 	return false
 }
 
@@ -208,7 +213,7 @@ func bootProfileCommand(ctx android.PathContext, globalSoong *GlobalSoongConfig,
 // Returns the dex location of a system server java library.
 func GetSystemServerDexLocation(ctx android.PathContext, global *GlobalConfig, lib string) string {
 	if apex := global.AllApexSystemServerJars(ctx).ApexOfJar(lib); apex != "" {
-		return fmt.Sprintf("/apex/%s/javalib/%s.jar", apex, lib)
+		return fmt.Sprintf("/apex/%s/%s/%s.jar", apex, global.ApexJavalibDir(apex), lib)
 	}
 
 	if apex := global.AllPlatformSystemServerJars(ctx).ApexOfJar(lib); apex == "system_ext" {
@@ -393,13 +398,7 @@ func dexpreoptCommand(ctx android.BuilderContext, globalSoong *GlobalSoongConfig
 		FlagWithArg("--no-inline-from=", "core-oj.jar").
 		Text("$(cat").Input(globalSoong.UffdGcFlag).Text(")")
 
-	var preoptFlags []string
-	if len(module.PreoptFlags) > 0 {
-		preoptFlags = module.PreoptFlags
-	} else if len(global.PreoptFlags) > 0 {
-		preoptFlags = global.PreoptFlags
-	}
-
+	preoptFlags := preoptFlags(global, module)
 	if len(preoptFlags) > 0 {
 		cmd.Text(strings.Join(preoptFlags, " "))
 	}
@@ -409,30 +408,7 @@ func dexpreoptCommand(ctx android.BuilderContext, globalSoong *GlobalSoongConfig
 	}
 
 	if !android.PrefixInList(preoptFlags, "--compiler-filter=") {
-		var compilerFilter string
-		if systemServerJars.ContainsJar(module.Name) {
-			if global.SystemServerCompilerFilter != "" {
-				// Use the product option if it is set.
-				compilerFilter = global.SystemServerCompilerFilter
-			} else if profile != nil {
-				// Use "speed-profile" for system server jars that have a profile.
-				compilerFilter = "speed-profile"
-			} else {
-				// Use "speed" for system server jars that do not have a profile.
-				compilerFilter = "speed"
-			}
-		} else if contains(global.SpeedApps, module.Name) || contains(global.SystemServerApps, module.Name) {
-			// Apps loaded into system server, and apps the product default to being compiled with the
-			// 'speed' compiler filter.
-			compilerFilter = "speed"
-		} else if profile != nil {
-			// For non system server jars, use speed-profile when we have a profile.
-			compilerFilter = "speed-profile"
-		} else if global.DefaultCompilerFilter != "" {
-			compilerFilter = global.DefaultCompilerFilter
-		} else {
-			compilerFilter = "quicken"
-		}
+		compilerFilter := compilerFilter(global, module, systemServerJars, profile != nil)
 		if module.EnforceUsesLibraries {
 			// If the verify_uses_libraries check failed (in this case status file contains a
 			// non-empty error message), then use "verify" compiler filter to avoid compiling any
@@ -511,6 +487,62 @@ func dexpreoptCommand(ctx android.BuilderContext, globalSoong *GlobalSoongConfig
 	rule.Install(vdexPath, vdexInstallPath)
 }
 
+// preoptFlags returns the dex2oat flags of the module, which override those of the product.
+func preoptFlags(global *GlobalConfig, module *ModuleConfig) []string {
+	if len(module.PreoptFlags) > 0 {
+		return module.PreoptFlags
+	}
+	return global.PreoptFlags
+}
+
+// compilerFilter returns the compiler filter that dexpreopt chooses for the module when its dex2oat
+// flags do not set one.
+func compilerFilter(global *GlobalConfig, module *ModuleConfig, systemServerJars android.ConfiguredJarList, hasProfile bool) string {
+	if systemServerJars.ContainsJar(module.Name) {
+		if global.SystemServerCompilerFilter != "" {
+			// Use the product option if it is set.
+			return global.SystemServerCompilerFilter
+		} else if hasProfile {
+			// Use "speed-profile" for system server jars that have a profile.
+			return "speed-profile"
+		}
+		// Use "speed" for system server jars that do not have a profile.
+		return "speed"
+	} else if contains(global.SpeedApps, module.Name) || contains(global.SystemServerApps, module.Name) {
+		// Apps loaded into system server, and apps the product default to being compiled with the
+		// 'speed' compiler filter.
+		return "speed"
+	} else if hasProfile {
+		// For non system server jars, use speed-profile when we have a profile.
+		return "speed-profile"
+	} else if global.DefaultCompilerFilter != "" {
+		return global.DefaultCompilerFilter
+	}
+	return "quicken"
+}
+
+// CompilerFilter returns the compiler filter that GenerateDexpreoptRule passes to dex2oat for the
+// module, or false if the module is not dexpreopted. A --compiler-filter= in the dex2oat flags of
+// the module or the product takes precedence over the filter chosen by dexpreopt.
+//
+// If the module enforces its uses libraries, the filter is downgraded to "verify" when the
+// verify_uses_libraries check fails, which is only known when the rule runs.
+func CompilerFilter(ctx android.PathContext, global *GlobalConfig, module *ModuleConfig) (string, bool) {
+	if dexpreoptDisabled(ctx, global, module) || len(module.Archs) == 0 {
+		return "", false
+	}
+	if valid, err := validateClassLoaderContext(module.ClassLoaderContexts); err != nil || !valid {
+		return "", false
+	}
+	for _, flag := range preoptFlags(global, module) {
+		if strings.HasPrefix(flag, "--compiler-filter=") {
+			return strings.TrimPrefix(flag, "--compiler-filter="), true
+		}
+	}
+	hasProfile := module.ProfileClassListing.Valid() && !global.DisableGenerateProfile
+	return compilerFilter(global, module, global.AllSystemServerJars(ctx), hasProfile), true
+}
+
 func shouldGenerateDM(module *ModuleConfig, global *GlobalConfig) bool {
 	// Generating DM files only makes sense for verify, avoid doing for non verify compiler filter APKs.
 	// No reason to use a dm file if the dex is already uncompressed.
@@ -614,6 +646,93 @@ func UsesLibrariesStatusFile(ctx android.ModuleContext) android.WritablePath {
 	return android.PathForModuleOut(ctx, "enforce_uses_libraries.status")
 }
 
+// PreoptDenylist matches module names against the entries of GlobalConfig.DisablePreoptModules.
+// An entry is either a module name, or a simple glob pattern with a leading and/or trailing "*",
+// e.g. "*-testing".
+type PreoptDenylist struct {
+	literals map[string]bool
+	patterns []preoptDenylistPattern
+}
+
+type preoptDenylistPattern struct {
+	entry string
+	// The entry without the stars, and whether it had a leading or trailing one.
+	text      string
+	anyPrefix bool
+	anySuffix bool
+}
+
+func (p preoptDenylistPattern) match(name string) bool {
+	switch {
+	case p.anyPrefix && p.anySuffix:
+		return strings.Contains(name, p.text)
+	case p.anyPrefix:
+		return strings.HasSuffix(name, p.text)
+	default:
+		return strings.HasPrefix(name, p.text)
+	}
+}
+
+func newPreoptDenylist(entries []string) *PreoptDenylist {
+	d := &PreoptDenylist{literals: make(map[string]bool)}
+	for _, entry := range entries {
+		text := strings.TrimPrefix(entry, "*")
+		anyPrefix := text != entry
+		text, anySuffix := strings.CutSuffix(text, "*")
+		if !anyPrefix && !anySuffix {
+			d.literals[entry] = true
+			continue
+		}
+		d.patterns = append(d.patterns, preoptDenylistPattern{
+			entry:     entry,
+			text:      text,
+			anyPrefix: anyPrefix,
+			anySuffix: anySuffix,
+		})
+	}
+	return d
+}
+
+// PreoptDenylist returns the denylist compiled from DisablePreoptModules. It is not cached on the
+// build config, as callers may pass a GlobalConfig other than the one of the build.
+func (g *GlobalConfig) PreoptDenylist() *PreoptDenylist {
+	return newPreoptDenylist(g.DisablePreoptModules)
+}
+
+// Match returns the entry that matches the given module name, if any. A module name entry takes
+// precedence over patterns, and patterns are tried in config order.
+func (d *PreoptDenylist) Match(name string) (string, bool) {
+	if d.literals[name] {
+		return name, true
+	}
+	for _, p := range d.patterns {
+		if p.match(name) {
+			return p.entry, true
+		}
+	}
+	return "", false
+}
+
+// MatchingPatterns returns the pattern entries that match the given module name, in config order.
+func (d *PreoptDenylist) MatchingPatterns(name string) []string {
+	var patterns []string
+	for _, p := range d.patterns {
+		if p.match(name) {
+			patterns = append(patterns, p.entry)
+		}
+	}
+	return patterns
+}
+
+// Patterns returns the pattern entries of the denylist, in config order.
+func (d *PreoptDenylist) Patterns() []string {
+	patterns := make([]string, 0, len(d.patterns))
+	for _, p := range d.patterns {
+		patterns = append(patterns, p.entry)
+	}
+	return patterns
+}
+
 func contains(l []string, s string) bool {
 	for _, e := range l {
 		if e == s {
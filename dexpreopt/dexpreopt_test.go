@@ -16,7 +16,9 @@ package dexpreopt
 
 import (
 	"android/soong/android"
+	"encoding/json"
 	"fmt"
+	"strings"
 	"testing"
 )
 
@@ -371,3 +373,363 @@ func TestUffdGcFlagBogus(t *testing.T) {
 			"Unknown value of PRODUCT_ENABLE_UFFD_GC: bogus")).
 		RunTest(t)
 }
+
+func TestRequireDexpreopt(t *testing.T) {
+	// Without the flag, a missing config silently disables dexpreopt.
+	PrepareForTestWithDexpreoptConfig.RunTest(t)
+
+	android.GroupFixturePreparers(
+		PrepareForTestWithDexpreoptConfig,
+		android.FixtureMergeEnv(map[string]string{"REQUIRE_DEXPREOPT": "true"}),
+	).ExtendWithErrorHandler(android.FixtureExpectsAtLeastOneErrorMatchingPattern(
+		"REQUIRE_DEXPREOPT is set, but there is no dexpreopt config, so dexpreopt would be disabled")).
+		RunTest(t)
+
+	// A config that disables dexpreopt explicitly is accepted.
+	android.GroupFixturePreparers(
+		PrepareForTestWithDexpreoptConfig,
+		FixtureDisableDexpreopt(true),
+		android.FixtureMergeEnv(map[string]string{"REQUIRE_DEXPREOPT": "true"}),
+	).RunTest(t)
+}
+
+func TestPreoptDenylist(t *testing.T) {
+	denylist := newPreoptDenylist([]string{"*-testing", "foo-testing", "bar-*", "*core*"})
+
+	for _, tc := range []struct {
+		name  string
+		entry string
+		ok    bool
+	}{
+		{name: "foo-testing", entry: "foo-testing", ok: true},
+		{name: "baz-testing", entry: "*-testing", ok: true},
+		{name: "bar-testing", entry: "*-testing", ok: true},
+		{name: "bar-lib", entry: "bar-*", ok: true},
+		{name: "libcore-oj", entry: "*core*", ok: true},
+		{name: "foo", ok: false},
+		{name: "testing-foo", ok: false},
+	} {
+		entry, ok := denylist.Match(tc.name)
+		android.AssertStringEquals(t, tc.name+" entry", tc.entry, entry)
+		android.AssertBoolEquals(t, tc.name+" ok", tc.ok, ok)
+	}
+
+	android.AssertDeepEquals(t, "patterns", []string{"*-testing", "bar-*", "*core*"}, denylist.Patterns())
+	android.AssertDeepEquals(t, "matching patterns", []string{"*-testing", "bar-*"}, denylist.MatchingPatterns("bar-testing"))
+}
+
+func TestDexPreoptDisabledByPattern(t *testing.T) {
+	config := android.TestConfig("out", nil, "", nil)
+	ctx := android.BuilderContextForTesting(config)
+	global := GlobalConfigForTests(ctx)
+	global.DisablePreoptModules = []string{"*-testing"}
+
+	android.AssertBoolEquals(t, "foo-testing", true, dexpreoptDisabled(ctx, global, testSystemModuleConfig(ctx, "foo-testing")))
+	android.AssertBoolEquals(t, "foo", false, dexpreoptDisabled(ctx, global, testSystemModuleConfig(ctx, "foo")))
+
+	// The denylist of another global config for the same build config is compiled separately.
+	other := GlobalConfigForTests(ctx)
+	other.DisablePreoptModules = []string{"foo"}
+	android.AssertBoolEquals(t, "foo in other", true, dexpreoptDisabled(ctx, other, testSystemModuleConfig(ctx, "foo")))
+	android.AssertBoolEquals(t, "foo-testing in other", false, dexpreoptDisabled(ctx, other, testSystemModuleConfig(ctx, "foo-testing")))
+}
+
+func TestCompilerFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		global func(global *GlobalConfig)
+		module func(module *ModuleConfig)
+		filter string
+	}{
+		{
+			name:   "default",
+			filter: "quicken",
+		},
+		{
+			name: "product default",
+			global: func(global *GlobalConfig) {
+				global.DefaultCompilerFilter = "space"
+			},
+			filter: "space",
+		},
+		{
+			name: "profile over product default",
+			global: func(global *GlobalConfig) {
+				global.DefaultCompilerFilter = "space"
+			},
+			module: func(module *ModuleConfig) {
+				module.ProfileClassListing = android.OptionalPathForPath(android.PathForTesting("profile"))
+			},
+			filter: "speed-profile",
+		},
+		{
+			name: "speed app over profile",
+			global: func(global *GlobalConfig) {
+				global.SpeedApps = []string{"test"}
+			},
+			module: func(module *ModuleConfig) {
+				module.ProfileClassListing = android.OptionalPathForPath(android.PathForTesting("profile"))
+			},
+			filter: "speed",
+		},
+		{
+			name: "system server jar",
+			global: func(global *GlobalConfig) {
+				global.SystemServerJars = android.CreateTestConfiguredJarList([]string{"platform:test"})
+				global.DefaultCompilerFilter = "space"
+			},
+			filter: "speed",
+		},
+		{
+			name: "system server jar with profile",
+			global: func(global *GlobalConfig) {
+				global.SystemServerJars = android.CreateTestConfiguredJarList([]string{"platform:test"})
+			},
+			module: func(module *ModuleConfig) {
+				module.ProfileClassListing = android.OptionalPathForPath(android.PathForTesting("profile"))
+			},
+			filter: "speed-profile",
+		},
+		{
+			name: "system server filter over profile",
+			global: func(global *GlobalConfig) {
+				global.SystemServerJars = android.CreateTestConfiguredJarList([]string{"platform:test"})
+				global.SystemServerCompilerFilter = "verify"
+			},
+			module: func(module *ModuleConfig) {
+				module.ProfileClassListing = android.OptionalPathForPath(android.PathForTesting("profile"))
+			},
+			filter: "verify",
+		},
+		{
+			name: "product flags over the chosen filter",
+			global: func(global *GlobalConfig) {
+				global.SystemServerJars = android.CreateTestConfiguredJarList([]string{"platform:test"})
+				global.SystemServerCompilerFilter = "verify"
+				global.PreoptFlags = []string{"--compiler-filter=everything"}
+			},
+			filter: "everything",
+		},
+		{
+			name: "module flags over product flags",
+			global: func(global *GlobalConfig) {
+				global.PreoptFlags = []string{"--compiler-filter=everything"}
+			},
+			module: func(module *ModuleConfig) {
+				module.PreoptFlags = []string{"--compiler-filter=space-profile"}
+			},
+			filter: "space-profile",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := android.TestConfig("out", nil, "", nil)
+			ctx := android.BuilderContextForTesting(config)
+			globalSoong := globalSoongConfigForTests(ctx)
+			global := GlobalConfigForTests(ctx)
+			module := testPlatformSystemServerModuleConfig(ctx, "test")
+			if test.global != nil {
+				test.global(global)
+			}
+			if test.module != nil {
+				test.module(module)
+			}
+
+			filter, ok := CompilerFilter(ctx, global, module)
+			android.AssertBoolEquals(t, "dexpreopted", true, ok)
+			android.AssertStringEquals(t, "compiler filter", test.filter, filter)
+
+			// The dexpreopt rule must use the same filter.
+			rule, err := GenerateDexpreoptRule(ctx, globalSoong, global, module, android.PathForTesting("product_packages.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			android.AssertStringDoesContain(t, "rule", strings.Join(rule.Commands(), "\n"), "--compiler-filter="+test.filter+" ")
+		})
+	}
+
+	t.Run("not dexpreopted", func(t *testing.T) {
+		config := android.TestConfig("out", nil, "", nil)
+		ctx := android.BuilderContextForTesting(config)
+		global := GlobalConfigForTests(ctx)
+		global.DisablePreopt = true
+		_, ok := CompilerFilter(ctx, global, testSystemModuleConfig(ctx, "test"))
+		android.AssertBoolEquals(t, "dexpreopted", false, ok)
+	})
+}
+
+func syntheticJarList(prefix string, n int) []string {
+	jars := make([]string, n)
+	for i := range jars {
+		jars[i] = fmt.Sprintf("platform:%s%d", prefix, i)
+	}
+	return jars
+}
+
+func TestParseGlobalConfigJarListSizes(t *testing.T) {
+	ctx := android.PathContextForTesting(android.TestConfig("out", nil, "", nil))
+
+	parse := func(t *testing.T, config map[string]interface{}) error {
+		t.Helper()
+		data, err := json.Marshal(config)
+		if err != nil {
+			t.Fatalf("Failed to marshal config: %v", err)
+		}
+		_, err = ParseGlobalConfig(ctx, data)
+		return err
+	}
+
+	t.Run("boot jars over the default limit", func(t *testing.T) {
+		err := parse(t, map[string]interface{}{
+			"BootJars": syntheticJarList("boot", 501),
+		})
+		android.AssertStringEquals(t, "error",
+			"BootJars has 501 entries, more than the limit of 500: "+
+				"platform:boot0, platform:boot1, platform:boot2, platform:boot3, platform:boot4, ...",
+			fmt.Sprint(err))
+	})
+
+	t.Run("system server jars over the default limit", func(t *testing.T) {
+		err := parse(t, map[string]interface{}{
+			"BootJars":                   syntheticJarList("boot", 500),
+			"StandaloneSystemServerJars": syntheticJarList("service", 1001),
+		})
+		android.AssertStringDoesContain(t, "error", fmt.Sprint(err),
+			"StandaloneSystemServerJars has 1001 entries, more than the limit of 1000: platform:service0,")
+	})
+
+	t.Run("raised limit", func(t *testing.T) {
+		err := parse(t, map[string]interface{}{
+			"BootJars":           syntheticJarList("boot", 600),
+			"MaxBootJarListSize": 600,
+		})
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("lowered limit", func(t *testing.T) {
+		err := parse(t, map[string]interface{}{
+			"SystemServerJars":           syntheticJarList("service", 3),
+			"MaxSystemServerJarListSize": 2,
+		})
+		android.AssertStringEquals(t, "error",
+			"SystemServerJars has 3 entries, more than the limit of 2: "+
+				"platform:service0, platform:service1, platform:service2",
+			fmt.Sprint(err))
+	})
+}
+
+func TestParseGlobalConfigApexJarEntries(t *testing.T) {
+	ctx := android.PathContextForTesting(android.TestConfig("out", nil, "", nil))
+
+	parse := func(t *testing.T, data string) (*GlobalConfig, error) {
+		t.Helper()
+		return ParseGlobalConfig(ctx, []byte(data))
+	}
+
+	legacy, err := parse(t, `{
+		"ApexBootJars": ["com.android.foo:framework-foo"],
+		"ClasspathOnlyApexJars": ["com.android.bar:framework-bar"],
+		"ApexSystemServerJars": ["com.android.foo:service-foo", "com.android.bar:service-bar"],
+		"StemFallbacks": {"framework-foo": "foo-stem"},
+		"UpdatableJarVersions": {"service-foo": "340000000"},
+		"SystemServerJarsWithProfiles": ["service-bar"]
+	}`)
+	if err != nil {
+		t.Fatalf("Failed to parse legacy config: %v", err)
+	}
+	structured, err := parse(t, `{
+		"ApexBootJarEntries": [
+			{"Apex": "com.android.foo", "Jar": "framework-foo", "Stem": "foo-stem"},
+			{"Apex": "com.android.bar", "Jar": "framework-bar", "ClasspathOnly": true}
+		],
+		"ApexSystemServerJarEntries": [
+			{"Apex": "com.android.foo", "Jar": "service-foo", "Version": "340000000"},
+			{"Apex": "com.android.bar", "Jar": "service-bar", "Profile": true}
+		]
+	}`)
+	if err != nil {
+		t.Fatalf("Failed to parse structured config: %v", err)
+	}
+
+	android.AssertDeepEquals(t, "ApexBootJars", legacy.ApexBootJars.CopyOfApexJarPairs(), structured.ApexBootJars.CopyOfApexJarPairs())
+	android.AssertDeepEquals(t, "ClasspathOnlyApexJars", legacy.ClasspathOnlyApexJars.CopyOfApexJarPairs(), structured.ClasspathOnlyApexJars.CopyOfApexJarPairs())
+	android.AssertDeepEquals(t, "ApexSystemServerJars", legacy.ApexSystemServerJars.CopyOfApexJarPairs(), structured.ApexSystemServerJars.CopyOfApexJarPairs())
+	android.AssertDeepEquals(t, "StemFallbacks", legacy.StemFallbacks, structured.StemFallbacks)
+	android.AssertDeepEquals(t, "UpdatableJarVersions", legacy.UpdatableJarVersions, structured.UpdatableJarVersions)
+	android.AssertDeepEquals(t, "SystemServerJarsWithProfiles", legacy.SystemServerJarsWithProfiles, structured.SystemServerJarsWithProfiles)
+
+	android.AssertDeepEquals(t, "boot entries", []ApexJar{
+		{Apex: "com.android.foo", Jar: "framework-foo", Stem: "foo-stem"},
+		{Apex: "com.android.bar", Jar: "framework-bar", ClasspathOnly: true},
+	}, structured.AllApexBootJarEntries())
+	android.AssertDeepEquals(t, "legacy boot entries", structured.AllApexBootJarEntries(), legacy.AllApexBootJarEntries())
+	android.AssertDeepEquals(t, "system server entries", []ApexJar{
+		{Apex: "com.android.foo", Jar: "service-foo", Version: "340000000"},
+		{Apex: "com.android.bar", Jar: "service-bar", Profile: true},
+	}, structured.AllApexSystemServerJarEntries())
+	android.AssertDeepEquals(t, "legacy system server entries", structured.AllApexSystemServerJarEntries(), legacy.AllApexSystemServerJarEntries())
+
+	android.AssertIntEquals(t, "legacy warnings", 0, len(legacy.deprecationWarnings))
+	android.AssertIntEquals(t, "structured warnings", 0, len(structured.deprecationWarnings))
+
+	t.Run("deprecated maps", func(t *testing.T) {
+		config, err := parse(t, `{
+			"ApexBootJarEntries": [{"Apex": "com.android.foo", "Jar": "framework-foo", "Stem": "foo-stem"}],
+			"StemFallbacks": {"framework-foo": "foo-stem", "framework": "framework-stem"}
+		}`)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		android.AssertDeepEquals(t, "warnings", []string{
+			"StemFallbacks is deprecated when ApexBootJarEntries or ApexSystemServerJarEntries is set, set the attributes of the entries instead",
+		}, config.deprecationWarnings)
+	})
+
+	for _, tc := range []struct {
+		name string
+		data string
+		err  string
+	}{
+		{
+			name: "conflicting stem",
+			data: `{
+				"ApexBootJarEntries": [{"Apex": "com.android.foo", "Jar": "framework-foo", "Stem": "foo-stem"}],
+				"StemFallbacks": {"framework-foo": "other-stem"}
+			}`,
+			err: `ApexBootJarEntries sets the Stem of "framework-foo" to "foo-stem", which conflicts with "other-stem"`,
+		},
+		{
+			name: "conflicting version",
+			data: `{
+				"ApexSystemServerJarEntries": [
+					{"Apex": "com.android.foo", "Jar": "service-foo", "Version": "1"},
+					{"Apex": "com.android.bar", "Jar": "service-foo", "Version": "2"}
+				]
+			}`,
+			err: `ApexSystemServerJarEntries sets the Version of "service-foo" to "2", which conflicts with "1"`,
+		},
+		{
+			name: "both forms",
+			data: `{
+				"ApexBootJars": ["com.android.foo:framework-foo"],
+				"ApexBootJarEntries": [{"Apex": "com.android.foo", "Jar": "framework-foo"}]
+			}`,
+			err: "ApexBootJarEntries cannot be set with ApexBootJars or ClasspathOnlyApexJars",
+		},
+		{
+			name: "profile on boot jar",
+			data: `{
+				"ApexBootJarEntries": [{"Apex": "com.android.foo", "Jar": "framework-foo", "Profile": true}]
+			}`,
+			err: `ApexBootJarEntries sets Profile for "framework-foo", which is only supported for system server jars`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parse(t, tc.data)
+			android.AssertStringEquals(t, "error", tc.err, fmt.Sprint(err))
+		})
+	}
+}
@@ -113,6 +113,14 @@ func FixtureModifyGlobalConfig(configModifier func(ctx android.PathContext, dexp
 	})
 }
 
+// FixtureRegisterSystemServerJarsFragment registers the system server jars fragment of the given
+// apex, see RegisterSystemServerJarsFragment.
+func FixtureRegisterSystemServerJarsFragment(apex string, jars ...string) android.FixturePreparer {
+	return android.FixtureModifyConfig(func(config android.Config) {
+		RegisterSystemServerJarsFragment(config, apex, jars...)
+	})
+}
+
 // FixtureSetArtBootJars enables dexpreopt and sets the ArtApexJars property.
 func FixtureSetArtBootJars(bootJars ...string) android.FixturePreparer {
 	return FixtureModifyGlobalConfig(func(_ android.PathContext, dexpreoptConfig *GlobalConfig) {
@@ -141,6 +149,13 @@ func FixtureSetApexBootJars(bootJars ...string) android.FixturePreparer {
 	})
 }
 
+// FixtureSetClasspathOnlyApexJars sets the ClasspathOnlyApexJars property in the global config.
+func FixtureSetClasspathOnlyApexJars(jars ...string) android.FixturePreparer {
+	return FixtureModifyGlobalConfig(func(_ android.PathContext, dexpreoptConfig *GlobalConfig) {
+		dexpreoptConfig.ClasspathOnlyApexJars = android.CreateTestConfiguredJarList(jars)
+	})
+}
+
 // FixtureSetStandaloneSystemServerJars sets the StandaloneSystemServerJars property.
 func FixtureSetStandaloneSystemServerJars(jars ...string) android.FixturePreparer {
 	return FixtureModifyGlobalConfig(func(_ android.PathContext, dexpreoptConfig *GlobalConfig) {
@@ -1721,12 +1721,11 @@ func (u *usesLibrary) verifyUsesLibraries(ctx android.ModuleContext, inputFile a
 
 	statusFile := dexpreopt.UsesLibrariesStatusFile(ctx)
 
-	// Disable verify_uses_libraries check if dexpreopt is globally disabled. Without dexpreopt the
-	// check is not necessary, and although it is good to have, it is difficult to maintain on
-	// non-linux build platforms where dexpreopt is generally disabled (the check may fail due to
-	// various unrelated reasons, such as a failure to get manifest from an APK).
-	global := dexpreopt.GetGlobalConfig(ctx)
-	if global.DisablePreopt || global.OnlyPreoptArtBootImage {
+	// Disable verify_uses_libraries check if apps are not dexpreopted, see dexpreoptStatus. Without
+	// dexpreopt the check is not necessary, and although it is good to have, it is difficult to
+	// maintain on non-linux build platforms where dexpreopt is generally disabled (the check may fail
+	// due to various unrelated reasons, such as a failure to get manifest from an APK).
+	if !getDexpreoptStatus(ctx).appsPreopted {
 		return inputFile
 	}
 
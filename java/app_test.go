@@ -3360,6 +3360,45 @@ func TestUsesLibraries(t *testing.T) {
 		"--product-packages=out/soong/.intermediates/app/android_common/dexpreopt/app/product_packages.txt")
 }
 
+func TestUsesLibrariesNotVerifiedIfAppsNotPreopted(t *testing.T) {
+	bp := `
+		java_sdk_library {
+			name: "foo",
+			srcs: ["a.java"],
+			api_packages: ["foo"],
+			sdk_version: "current",
+		}
+
+		android_app {
+			name: "app",
+			srcs: ["a.java"],
+			libs: ["foo"],
+			uses_libs: ["foo"],
+			sdk_version: "current",
+		}
+	`
+
+	preparer := android.GroupFixturePreparers(
+		prepareForJavaTest,
+		PrepareForTestWithJavaSdkLibraryFiles,
+		FixtureWithLastReleaseApis("foo"),
+	)
+
+	result := preparer.RunTestWithBp(t, bp)
+	app := result.ModuleForTests("app", "android_common")
+	android.AssertBoolEquals(t, "verified", true, app.MaybeRule("verify_uses_libraries").Rule != nil)
+
+	// The boot images that the apps would be preopted against are generated on device.
+	result = android.GroupFixturePreparers(
+		preparer,
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.OnDeviceImageGeneration = true
+		}),
+	).RunTestWithBp(t, bp)
+	app = result.ModuleForTests("app", "android_common")
+	android.AssertBoolEquals(t, "verified", false, app.MaybeRule("verify_uses_libraries").Rule != nil)
+}
+
 func TestDexpreoptBcp(t *testing.T) {
 	bp := `
 		java_sdk_library {
@@ -2081,6 +2081,11 @@ func (j *Module) Stem() string {
 	return j.stem
 }
 
+// resolvedStem returns the stem of the module and true, or false if the stem has not been set yet.
+func (j *Module) resolvedStem() (string, bool) {
+	return j.stem, j.stem != ""
+}
+
 func (j *Module) JacocoReportClassesFile() android.Path {
 	return j.jacocoReportClassesFile
 }
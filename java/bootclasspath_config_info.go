@@ -0,0 +1,147 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package java
+
+import (
+	"github.com/google/blueprint"
+
+	"android/soong/android"
+	"android/soong/dexpreopt"
+)
+
+// The boot class path data that is derived from the dexpreopt config, for the module types that
+// model the boot class path as Soong modules. The data is published by the dex_bootjars singleton
+// module in BootclasspathConfigInfoProvider, so that consumers do not need to duplicate the logic in
+// this package.
+
+// BootclasspathConfigModuleName is the name of the module that publishes
+// BootclasspathConfigInfoProvider. Consumers must add a dependency on it to retrieve the provider.
+const BootclasspathConfigModuleName = "dex_bootjars"
+
+// BootclasspathJarOrigin identifies the dexpreopt config list that a boot class path jar comes from.
+type BootclasspathJarOrigin string
+
+const (
+	// The jar is in GlobalConfig.BootJars.
+	BootclasspathJarOriginBootJars BootclasspathJarOrigin = "BootJars"
+	// The jar is in GlobalConfig.ApexBootJars, i.e. it is updatable.
+	BootclasspathJarOriginApexBootJars BootclasspathJarOrigin = "ApexBootJars"
+	// The jar is in GlobalConfig.ClasspathOnlyApexJars.
+	BootclasspathJarOriginClasspathOnly BootclasspathJarOrigin = "ClasspathOnlyApexJars"
+)
+
+// BootclasspathConfigJar is a jar on the boot class path.
+type BootclasspathConfigJar struct {
+	// The apex that contains the jar, or "platform".
+	Apex string
+
+	// The name of the module that provides the jar.
+	Jar string
+
+	// The dexpreopt config list that the jar comes from.
+	Origin BootclasspathJarOrigin
+}
+
+// BootImageVariantSummary describes an arch-specific variant of a boot image.
+type BootImageVariantSummary struct {
+	// The name of the boot image, e.g. "art" or "boot".
+	Image string
+
+	// The arch of the variant.
+	Arch android.ArchType
+
+	// The path of the first image file on device.
+	ImagePathOnDevice string
+
+	// The modules in the boot image, as apex:jar pairs.
+	Modules []string
+
+	// Whether the boot image files are generated at build time.
+	Built bool
+
+	// Whether the boot image files are installed on device.
+	Installed bool
+
+	// The locations that the device loads the boot image and the images it depends on from, as
+	// exported to Make.
+	ImageLocationsOnDevice []string
+}
+
+// BootclasspathConfigInfo is the boot class path data that is derived from the dexpreopt config.
+type BootclasspathConfigInfo struct {
+	// The jars on the boot class path, in classpath order.
+	Jars []BootclasspathConfigJar
+
+	// The updatable jars on the boot class path, as apex:jar pairs.
+	UpdatableJars []string
+
+	// The variants of all the boot images, in image order and then in target order.
+	ImageVariants []BootImageVariantSummary
+}
+
+var BootclasspathConfigInfoProvider = blueprint.NewProvider[BootclasspathConfigInfo]()
+
+// bootclasspathConfigInfo returns the boot class path data that is derived from the dexpreopt config.
+// It is loaded from the dexpreopt state cache if the cache is enabled and matches.
+func bootclasspathConfigInfo(ctx android.PathContext) BootclasspathConfigInfo {
+	return dexpreoptData(ctx).BootclasspathConfigInfo
+}
+
+// computeBootclasspathConfigInfo computes the boot class path data from the dexpreopt config.
+func computeBootclasspathConfigInfo(ctx android.PathContext) BootclasspathConfigInfo {
+	global := dexpreopt.GetGlobalConfig(ctx)
+
+	var info BootclasspathConfigInfo
+	for _, list := range []struct {
+		jars   *android.ConfiguredJarList
+		origin BootclasspathJarOrigin
+	}{
+		{&global.BootJars, BootclasspathJarOriginBootJars},
+		{&global.ApexBootJars, BootclasspathJarOriginApexBootJars},
+		{&global.ClasspathOnlyApexJars, BootclasspathJarOriginClasspathOnly},
+	} {
+		for i := 0; i < list.jars.Len(); i++ {
+			info.Jars = append(info.Jars, BootclasspathConfigJar{
+				Apex:   list.jars.Apex(i),
+				Jar:    list.jars.Jar(i),
+				Origin: list.origin,
+			})
+		}
+	}
+	info.UpdatableJars = global.ApexBootJars.CopyOfApexJarPairs()
+
+	for _, name := range getImageNames() {
+		image := genBootImageConfigs(ctx)[name]
+		for _, variant := range image.variants {
+			info.ImageVariants = append(info.ImageVariants, BootImageVariantSummary{
+				Image:                  name,
+				Arch:                   variant.target.Arch.ArchType,
+				ImagePathOnDevice:      variant.imagePathOnDevice,
+				Modules:                image.modules.CopyOfApexJarPairs(),
+				Built:                  image.isBuilt(ctx),
+				Installed:              image.isInstalled(ctx),
+				ImageLocationsOnDevice: variant.imageLocationsOnDevice(ctx),
+			})
+		}
+	}
+	return info
+}
+
+// BootclasspathJarDepNames returns the names of the modules that provide the jars on the boot
+// class path, in classpath order, so that module types that model the boot class path can add
+// dependencies on them. The apex of each jar is available from BootclasspathConfigInfo.
+func BootclasspathJarDepNames(ctx android.PathContext) []string {
+	return allBootclasspathJars(dexpreopt.GetGlobalConfig(ctx)).CopyOfJars()
+}
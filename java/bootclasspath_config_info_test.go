@@ -0,0 +1,87 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package java
+
+import (
+	"testing"
+
+	"github.com/google/blueprint"
+
+	"android/soong/android"
+)
+
+var testBootclasspathConfigDepTag = struct{ blueprint.BaseDependencyTag }{}
+
+// testBootclasspathConfigConsumer is a fake module type that consumes BootclasspathConfigInfo.
+type testBootclasspathConfigConsumer struct {
+	android.ModuleBase
+
+	info     BootclasspathConfigInfo
+	depNames []string
+}
+
+func testBootclasspathConfigConsumerFactory() android.Module {
+	m := &testBootclasspathConfigConsumer{}
+	android.InitAndroidArchModule(m, android.DeviceSupported, android.MultilibCommon)
+	return m
+}
+
+func (m *testBootclasspathConfigConsumer) DepsMutator(ctx android.BottomUpMutatorContext) {
+	ctx.AddDependency(ctx.Module(), testBootclasspathConfigDepTag, BootclasspathConfigModuleName)
+	m.depNames = BootclasspathJarDepNames(ctx)
+}
+
+func (m *testBootclasspathConfigConsumer) GenerateAndroidBuildActions(ctx android.ModuleContext) {
+	ctx.VisitDirectDepsWithTag(testBootclasspathConfigDepTag, func(dep android.Module) {
+		m.info, _ = android.OtherModuleProvider(ctx, dep, BootclasspathConfigInfoProvider)
+	})
+}
+
+func TestBootclasspathConfigInfo(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		FixtureConfigureApexBootJars("com.android.foo:framework-foo"),
+		android.PrepareForTestWithAllowMissingDependencies,
+		android.FixtureRegisterWithContext(func(ctx android.RegistrationContext) {
+			ctx.RegisterModuleType("test_bootclasspath_config_consumer", testBootclasspathConfigConsumerFactory)
+		}),
+		android.FixtureAddTextFile("consumer/Android.bp", `
+			test_bootclasspath_config_consumer {
+				name: "consumer",
+			}
+		`),
+	).RunTest(t)
+
+	consumer := result.ModuleForTests("consumer", "android_common").Module().(*testBootclasspathConfigConsumer)
+
+	android.AssertDeepEquals(t, "dep names", []string{"core1", "core2", "framework", "framework-foo"}, consumer.depNames)
+
+	android.AssertDeepEquals(t, "jars", []BootclasspathConfigJar{
+		{Apex: "com.android.art", Jar: "core1", Origin: BootclasspathJarOriginBootJars},
+		{Apex: "com.android.art", Jar: "core2", Origin: BootclasspathJarOriginBootJars},
+		{Apex: "platform", Jar: "framework", Origin: BootclasspathJarOriginBootJars},
+		{Apex: "com.android.foo", Jar: "framework-foo", Origin: BootclasspathJarOriginApexBootJars},
+	}, consumer.info.Jars)
+	android.AssertDeepEquals(t, "updatable jars", []string{"com.android.foo:framework-foo"}, consumer.info.UpdatableJars)
+
+	var artArches []string
+	for _, variant := range consumer.info.ImageVariants {
+		if variant.Image == "art" {
+			artArches = append(artArches, variant.Arch.String())
+			android.AssertDeepEquals(t, "art modules", []string{"com.android.art:core1", "com.android.art:core2", "platform:extra1"}, variant.Modules)
+		}
+	}
+	android.AssertDeepEquals(t, "art arches", []string{"arm64", "arm", "x86_64", "x86"}, artArches)
+}
@@ -139,6 +139,11 @@ type dexpreopter struct {
 	// The path to the profile that dexpreopter accepts. It must be in the binary format. If this is
 	// set, it overrides the profile settings in `dexpreoptProperties`.
 	inputProfilePathOnHost android.Path
+
+	// The name that the module is dexpreopted as and the compiler filter that its dexpreopt rule
+	// passes to dex2oat, if it is dexpreopted. See dexpreopt.CompilerFilter.
+	compilerFilterName string
+	compilerFilter     string
 }
 
 type DexpreoptProperties struct {
@@ -377,17 +382,16 @@ func (d *dexpreopter) dexpreopt(ctx android.ModuleContext, libName string, dexJa
 	targets := ctx.MultiTargets()
 	if len(targets) == 0 {
 		// assume this is a java library, dexpreopt for all arches for now
-		for _, target := range ctx.Config().Targets[android.Android] {
-			if target.NativeBridge == android.NativeBridgeDisabled {
-				targets = append(targets, target)
-			}
-		}
+		targets = dexpreoptDeviceTargets(ctx)
 		if isSystemServerJar && libName != "com.android.location.provider" {
 			// If the module is a system server jar, only preopt for the primary arch because the jar can
 			// only be loaded by system server. "com.android.location.provider" is a special case because
 			// it's also used by apps as a shared library.
-			targets = targets[:1]
+			targets = systemServerPreoptTargets(ctx)
 		}
+	} else {
+		// Only dexpreopt for the architectures that dex2oat supports.
+		targets = supportedPreoptTargets(ctx, targets)
 	}
 
 	var archs []android.ArchType
@@ -510,6 +514,11 @@ func (d *dexpreopter) dexpreopt(ctx android.ModuleContext, libName string, dexJa
 
 	dexpreoptRule.Build("dexpreopt"+"."+dexJarStem, "dexpreopt")
 
+	if filter, ok := dexpreopt.CompilerFilter(ctx, global, dexpreoptConfig); ok {
+		d.compilerFilterName = libName
+		d.compilerFilter = filter
+	}
+
 	// The current ctx might be of a deapexer module created by a prebuilt apex
 	// Use the path of the dex file to determine the library name
 	isApexSystemServerJar := global.AllApexSystemServerJars(ctx).ContainsJar(dexJarStem)
@@ -553,6 +562,12 @@ func (d *dexpreopter) dexpreopt(ctx android.ModuleContext, libName string, dexJa
 	}
 }
 
+// dexpreoptCompilerFilter returns the name that the module is dexpreopted as and the compiler
+// filter it is dexpreopted with, or false if it is not dexpreopted.
+func (d *dexpreopter) dexpreoptCompilerFilter() (string, string, bool) {
+	return d.compilerFilterName, d.compilerFilter, d.compilerFilter != ""
+}
+
 func (d *dexpreopter) DexpreoptBuiltInstalledForApex() []dexpreopterInstall {
 	return d.builtInstalledForApex
 }
@@ -0,0 +1,120 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package java
+
+import (
+	"encoding/json"
+
+	"android/soong/android"
+	"android/soong/bazel"
+)
+
+// An export of the data that is derived from the dexpreopt config, for the Bazel-converted java
+// modules in mixed builds. It is written to the soong_injection directory that the mixed build glue
+// reads, and it is export-only: nothing in the Make or ninja build depends on it.
+
+// The version of the schema of dexpreoptBazelExport. Changes to the schema must be additive, so that
+// consumers of older versions can still parse it.
+const dexpreoptBazelExportSchemaVersion = 1
+
+// dexpreoptBazelExport is the content of the file returned by dexpreoptBazelExportPath.
+type dexpreoptBazelExport struct {
+	SchemaVersion int `json:"schema_version"`
+
+	// The on-device locations of the jars on the boot class path, see defaultBootclasspath.
+	BootClasspath []string `json:"boot_classpath"`
+
+	// The on-device locations of the jars on the system server class path, see
+	// systemServerClasspath.
+	SystemServerClasspath []string `json:"system_server_classpath"`
+
+	// The jars on the boot class path, in classpath order.
+	BootJars []dexpreoptBazelExportJar `json:"boot_jars"`
+
+	// The boot images, in the order of getImageNames.
+	Images []dexpreoptBazelExportImage `json:"images"`
+}
+
+// dexpreoptBazelExportJar is a jar on the boot class path.
+type dexpreoptBazelExportJar struct {
+	Apex   string `json:"apex"`
+	Jar    string `json:"jar"`
+	Stem   string `json:"stem"`
+	Origin string `json:"origin"`
+}
+
+// dexpreoptBazelExportImage is a boot image.
+type dexpreoptBazelExportImage struct {
+	Name string `json:"name"`
+
+	// The modules in the boot image, as apex:jar pairs.
+	Modules []string `json:"modules"`
+
+	// The path of the first image file on device, by device arch.
+	ImagePathsOnDevice map[string]string `json:"image_paths_on_device"`
+}
+
+// dexpreoptBazelExportData returns the content of the file returned by dexpreoptBazelExportPath.
+func dexpreoptBazelExportData(ctx android.PathContext) dexpreoptBazelExport {
+	info := bootclasspathConfigInfo(ctx)
+	export := dexpreoptBazelExport{
+		SchemaVersion:         dexpreoptBazelExportSchemaVersion,
+		BootClasspath:         append([]string{}, defaultBootclasspath(ctx)...),
+		SystemServerClasspath: append([]string{}, systemServerClasspath(ctx)...),
+		BootJars:              []dexpreoptBazelExportJar{},
+		Images:                []dexpreoptBazelExportImage{},
+	}
+	for _, jar := range info.Jars {
+		export.BootJars = append(export.BootJars, dexpreoptBazelExportJar{
+			Apex:   jar.Apex,
+			Jar:    jar.Jar,
+			Stem:   stemOfModule(ctx, nil, jar.Apex, jar.Jar),
+			Origin: string(jar.Origin),
+		})
+	}
+	for _, name := range getImageNames() {
+		image := genBootImageConfigs(ctx)[name]
+		paths := make(map[string]string)
+		for _, variant := range image.variants {
+			if variant.target.Os == android.Android {
+				paths[variant.target.Arch.ArchType.String()] = variant.imagePathOnDevice
+			}
+		}
+		export.Images = append(export.Images, dexpreoptBazelExportImage{
+			Name:               name,
+			Modules:            append([]string{}, image.modules.CopyOfApexJarPairs()...),
+			ImagePathsOnDevice: paths,
+		})
+	}
+	return export
+}
+
+// dexpreoptBazelExportPath returns the path to the export of the dexpreopt config data for mixed
+// builds.
+func dexpreoptBazelExportPath(ctx android.PathContext) android.WritablePath {
+	return android.PathForOutput(ctx, bazel.SoongInjectionDirName, "dexpreopt", "dexpreopt_config.json")
+}
+
+// buildDexpreoptBazelExport generates a rule to write the file returned by
+// dexpreoptBazelExportPath. The rule restats its output, so the file is only rewritten, and the
+// mixed build glue only reruns, when its content changes.
+func buildDexpreoptBazelExport(ctx android.SingletonContext) {
+	data, err := json.MarshalIndent(dexpreoptBazelExportData(ctx), "", "    ")
+	if err != nil {
+		ctx.Errorf("failed to JSON marshal the dexpreopt config for Bazel: %v", err)
+		return
+	}
+	android.WriteFileRule(ctx, dexpreoptBazelExportPath(ctx), string(data))
+}
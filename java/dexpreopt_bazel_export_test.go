@@ -0,0 +1,120 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package java
+
+import (
+	"testing"
+
+	"android/soong/android"
+	"android/soong/dexpreopt"
+)
+
+func TestDexpreoptBazelExport(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		PrepareApexBootJarConfigs,
+		dexpreopt.FixtureSetSystemServerJars("platform:services"),
+	).RunTest(t)
+
+	export := result.SingletonForTests("dex_bootjars").Output("out/soong/soong_injection/dexpreopt/dexpreopt_config.json")
+	android.AssertStringEquals(t, "export", `{
+    "schema_version": 1,
+    "boot_classpath": [
+        "/apex/com.android.art/javalib/core1.jar",
+        "/apex/com.android.art/javalib/core2.jar",
+        "/system/framework/framework.jar",
+        "/apex/com.android.foo/javalib/framework-foo.jar",
+        "/apex/com.android.bar/javalib/framework-bar.jar"
+    ],
+    "system_server_classpath": [
+        "/system/framework/services.jar"
+    ],
+    "boot_jars": [
+        {
+            "apex": "com.android.art",
+            "jar": "core1",
+            "stem": "core1",
+            "origin": "BootJars"
+        },
+        {
+            "apex": "com.android.art",
+            "jar": "core2",
+            "stem": "core2",
+            "origin": "BootJars"
+        },
+        {
+            "apex": "platform",
+            "jar": "framework",
+            "stem": "framework",
+            "origin": "BootJars"
+        },
+        {
+            "apex": "com.android.foo",
+            "jar": "framework-foo",
+            "stem": "framework-foo",
+            "origin": "ApexBootJars"
+        },
+        {
+            "apex": "com.android.bar",
+            "jar": "framework-bar",
+            "stem": "framework-bar",
+            "origin": "ApexBootJars"
+        }
+    ],
+    "images": [
+        {
+            "name": "art",
+            "modules": [
+                "com.android.art:core1",
+                "com.android.art:core2",
+                "platform:extra1"
+            ],
+            "image_paths_on_device": {
+                "arm": "/apex/art_boot_images/javalib/arm/boot.art",
+                "arm64": "/apex/art_boot_images/javalib/arm64/boot.art"
+            }
+        },
+        {
+            "name": "boot",
+            "modules": [
+                "com.android.art:core1",
+                "com.android.art:core2",
+                "platform:framework"
+            ],
+            "image_paths_on_device": {
+                "arm": "/system/framework/arm/boot.art",
+                "arm64": "/system/framework/arm64/boot.art"
+            }
+        },
+        {
+            "name": "mainline",
+            "modules": [
+                "com.android.foo:framework-foo",
+                "com.android.bar:framework-bar"
+            ],
+            "image_paths_on_device": {
+                "arm": "/system/framework/arm/boot-framework-foo.art",
+                "arm64": "/system/framework/arm64/boot-framework-foo.art"
+            }
+        }
+    ]
+}
+`, android.ContentFromFileRuleForTests(t, result.TestContext, export))
+
+	// The file is copied into place by a rule that only touches it when its content changes, so an
+	// unchanged export does not rerun the mixed build glue.
+	android.AssertBoolEquals(t, "restat", true, export.RuleParams.Restat)
+	android.AssertStringDoesContain(t, "command", export.RuleParams.Command, "if ! cmp -s $in $out; then cp $in $out; fi")
+}
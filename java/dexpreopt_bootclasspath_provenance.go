@@ -0,0 +1,149 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package java
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"path/filepath"
+
+	"android/soong/android"
+	"android/soong/dexpreopt"
+)
+
+// The provenance of each entry of BOOTCLASSPATH, for compliance tooling that must show that the
+// shipped boot class path corresponds to the reviewed product config. Each entry is annotated with
+// its origin and transformations while the boot class path is computed, rather than reconstructed
+// afterwards, and defaultBootclasspath is derived from the same annotated entries.
+
+// The version of the schema of bootclasspathProvenance. Changes to the schema must be additive, so
+// that consumers of older versions can still parse it.
+const bootclasspathProvenanceSchemaVersion = 1
+
+// The kinds of jarTransformation.
+const (
+	// ConfiguredJarLocationOverrides moved the jar to another apex.
+	jarTransformationLocationOverride = "location_override"
+	// ConfiguredJarLocationOverrides or GlobalConfig.StemFallbacks changed the stem of the jar.
+	jarTransformationStem = "stem"
+	// GlobalConfig.ApexJavalibDirOverrides changed the directory of the jar in its apex.
+	jarTransformationJavalibDirOverride = "javalib_dir_override"
+	// GlobalConfig.ProductUpdatableBootLocations replaced the derived location of an apex boot jar,
+	// see useLegacyUpdatableBootLocations.
+	jarTransformationLegacyLocation = "legacy_location"
+)
+
+// jarTransformation is a step that changed the on-device location of a jar from the one that its
+// apex and name imply.
+type jarTransformation struct {
+	Kind string `json:"kind"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// annotatedClasspathEntry is an entry of the boot class path together with where it comes from.
+type annotatedClasspathEntry struct {
+	// The on-device location of the jar, as exported in BOOTCLASSPATH.
+	Location string `json:"location"`
+
+	// The dexpreopt config list that the jar comes from.
+	Origin BootclasspathJarOrigin `json:"origin"`
+
+	// The apex:jar pair in the dexpreopt config list.
+	ConfigValue string `json:"config_value"`
+
+	// The name of the module that provides the jar, see GlobalConfig.BootJarModuleAliases.
+	Module string `json:"module"`
+
+	// The transformations that were applied to the location of the jar, in the order they were
+	// applied.
+	Transformations []jarTransformation `json:"transformations"`
+}
+
+var annotatedBootclasspathKey = newDexpreoptOnceKey("annotatedBootclasspath")
+
+// annotatedBootclasspathFromSource returns the entries of the boot class path, in classpath order.
+func annotatedBootclasspathFromSource(src dexpreoptConfigSource) []annotatedClasspathEntry {
+	return src.once(annotatedBootclasspathKey, func() interface{} {
+		global := src.globalConfig()
+		var entries []annotatedClasspathEntry
+		annotate := func(jars *android.ConfiguredJarList, origin BootclasspathJarOrigin) {
+			for i := 0; i < jars.Len(); i++ {
+				apex, jar := jars.Apex(i), jars.Jar(i)
+				dir, filename, transformations := resolveAnnotatedInstalledJar(src.pathContext(), global, bootclasspathOrigin, apex, jar)
+				entry := annotatedClasspathEntry{
+					Location:        filepath.Join(dir, filename),
+					Origin:          origin,
+					ConfigValue:     apex + ":" + jar,
+					Module:          global.BootJarModule(jar),
+					Transformations: append([]jarTransformation{}, transformations...),
+				}
+				if origin == BootclasspathJarOriginApexBootJars && useLegacyUpdatableBootLocations(global) {
+					legacy := global.ProductUpdatableBootLocations[i]
+					entry.Transformations = append(entry.Transformations,
+						jarTransformation{jarTransformationLegacyLocation, entry.Location, legacy})
+					entry.Location = legacy
+				}
+				entries = append(entries, entry)
+			}
+		}
+		annotate(&global.BootJars, BootclasspathJarOriginBootJars)
+		annotate(&global.ApexBootJars, BootclasspathJarOriginApexBootJars)
+		annotate(&global.ClasspathOnlyApexJars, BootclasspathJarOriginClasspathOnly)
+		return entries
+	}).([]annotatedClasspathEntry)
+}
+
+// bootclasspathProvenance is the content of the file returned by bootclasspathProvenancePath.
+type bootclasspathProvenance struct {
+	SchemaVersion int `json:"schema_version"`
+
+	// The hex encoded sha256 of the dexpreopt config file, or empty if there is none, e.g. in tests.
+	ConfigSha256 string `json:"config_sha256"`
+
+	// The entries of BOOTCLASSPATH, in classpath order.
+	Entries []annotatedClasspathEntry `json:"entries"`
+}
+
+// bootclasspathProvenanceData returns the content of the file returned by
+// bootclasspathProvenancePath.
+func bootclasspathProvenanceData(ctx android.PathContext) bootclasspathProvenance {
+	provenance := bootclasspathProvenance{
+		SchemaVersion: bootclasspathProvenanceSchemaVersion,
+		Entries:       append([]annotatedClasspathEntry{}, annotatedBootclasspathFromSource(configSource(ctx))...),
+	}
+	if data := dexpreopt.GetGlobalConfigRawData(ctx); data != nil {
+		sum := sha256.Sum256(data)
+		provenance.ConfigSha256 = hex.EncodeToString(sum[:])
+	}
+	return provenance
+}
+
+// bootclasspathProvenancePath returns the path to the provenance of the entries of BOOTCLASSPATH.
+func bootclasspathProvenancePath(ctx android.PathContext) android.WritablePath {
+	return android.PathForOutput(ctx, dexpreopt.GetDexpreoptDirName(ctx), "bootclasspath_provenance.json")
+}
+
+// buildBootclasspathProvenance generates a rule to write the file returned by
+// bootclasspathProvenancePath.
+func buildBootclasspathProvenance(ctx android.SingletonContext) {
+	data, err := json.MarshalIndent(bootclasspathProvenanceData(ctx), "", "    ")
+	if err != nil {
+		ctx.Errorf("failed to JSON marshal the boot class path provenance: %v", err)
+		return
+	}
+	android.WriteFileRule(ctx, bootclasspathProvenancePath(ctx), string(data))
+}
@@ -0,0 +1,80 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package java
+
+import (
+	"testing"
+
+	"android/soong/android"
+	"android/soong/dexpreopt"
+)
+
+func TestBootclasspathProvenance(t *testing.T) {
+	t.Run("golden", func(t *testing.T) {
+		result := android.GroupFixturePreparers(
+			PrepareForBootImageConfigTest,
+			PrepareApexBootJarConfigs,
+			dexpreopt.FixtureSetClasspathOnlyApexJars("com.android.baz:framework-baz"),
+			dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+				c.ApexJavalibDirOverrides = map[string]string{"com.android.foo": "javalib64"}
+			}),
+			android.FixtureModifyProductVariables(func(variables android.FixtureProductVariables) {
+				variables.ConfiguredJarLocationOverrides = []string{
+					"com.android.bar:framework-bar:com.android.bar:bar-stem",
+					"com.android.baz:framework-baz:com.android.qux:framework-baz",
+				}
+			}),
+		).RunTest(t)
+		CheckBootclasspathProvenanceGolden(t, result, "testdata/bootclasspath_provenance/customized.json")
+
+		ctx := &android.TestPathContext{TestResult: result}
+		var locations []string
+		for _, entry := range bootclasspathProvenanceData(ctx).Entries {
+			locations = append(locations, entry.Location)
+		}
+		android.AssertDeepEquals(t, "locations", defaultBootclasspath(ctx), locations)
+
+		file := result.SingletonForTests("dex_bootjars").Output("out/soong/dexpreopt_arm64/bootclasspath_provenance.json")
+		android.AssertStringDoesContain(t, "provenance file", android.ContentFromFileRuleForTests(t, result.TestContext, file),
+			`"schema_version": 1`)
+	})
+
+	t.Run("legacy updatable boot locations", func(t *testing.T) {
+		result := android.GroupFixturePreparers(
+			PrepareForBootImageConfigTest,
+			PrepareApexBootJarConfigs,
+			dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+				c.ProductUpdatableBootLocations = []string{
+					"/system/framework/framework-foo.jar",
+					"/apex/com.android.bar/javalib/framework-bar.jar",
+				}
+				c.UseLegacyUpdatableBootLocations = true
+			}),
+		).RunTest(t)
+		entries := bootclasspathProvenanceData(&android.TestPathContext{TestResult: result}).Entries
+
+		android.AssertIntEquals(t, "entries", 5, len(entries))
+		android.AssertDeepEquals(t, "framework-foo", annotatedClasspathEntry{
+			Location:    "/system/framework/framework-foo.jar",
+			Origin:      BootclasspathJarOriginApexBootJars,
+			ConfigValue: "com.android.foo:framework-foo",
+			Module:      "framework-foo",
+			Transformations: []jarTransformation{
+				{jarTransformationLegacyLocation, "/apex/com.android.foo/javalib/framework-foo.jar", "/system/framework/framework-foo.jar"},
+			},
+		}, entries[3])
+		android.AssertDeepEquals(t, "framework transformations", []jarTransformation{}, entries[2].Transformations)
+	})
+}
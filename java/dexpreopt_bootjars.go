@@ -15,7 +15,14 @@
 package java
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 
 	"android/soong/android"
@@ -226,7 +233,7 @@ var artApexNames = []string{
 
 var (
 	dexpreoptBootJarDepTag          = bootclasspathDependencyTag{name: "dexpreopt-boot-jar"}
-	dexBootJarsFragmentsKey         = android.NewOnceKey("dexBootJarsFragments")
+	dexBootJarsFragmentsKey         = newDexpreoptOnceKey("dexBootJarsFragments")
 	apexContributionsMetadataDepTag = dependencyTag{name: "all_apex_contributions"}
 )
 
@@ -255,9 +262,13 @@ type bootImageConfig struct {
 	// Output directory for the image files.
 	dir android.OutputPath
 
-	// Output directory for the image files with debug symbols.
+	// Output directory for the image files with debug symbols, unset if
+	// GlobalConfig.DisableBootImageSymbols is set, see hasSymbols.
 	symbolsDir android.OutputPath
 
+	// Output directory that the jars of the image are copied to before they are compiled.
+	inputDir android.OutputPath
+
 	// The relative location where the image files are installed. On host, the location is relative to
 	// $ANDROID_PRODUCT_OUT.
 	//
@@ -275,6 +286,23 @@ type bootImageConfig struct {
 	// Map from module name (without prebuilt_ prefix) to the predefined build path.
 	dexPathsByModule map[string]android.WritablePath
 
+	// Map from the name of each jar of this image that is in one of
+	// GlobalConfig.PrebuiltBootJarApexes to the path of its dex file relative to the root of the
+	// prebuilt apex. The jars are copied to their predefined build paths from the prebuilt apex.
+	prebuiltInputJars map[string]string
+
+	// Map from the name of each jar of this image that is not staged in the input directory to the
+	// path of the dex jar of its module, see GlobalConfig.SkipStagingOfStableBootJars. dexPaths and
+	// dexPathsByModule refer to the path of the module rather than a staged copy.
+	unstagedJars map[string]android.WritablePath
+
+	// The jars of this image that are stored uncompressed in its zip, in the order of modules, see
+	// GlobalConfig.UncompressedBootJars.
+	uncompressedModules []string
+
+	// The jars of the modules of this image that are profiled, see GlobalConfig.ProfiledBootModules.
+	profiledModules []string
+
 	// File path to a zip archive with all image files (or nil, if not needed).
 	zip android.WritablePath
 
@@ -293,6 +321,13 @@ type bootImageConfig struct {
 	// Profiles imported from APEXes, in addition to the profile at the default path. Each entry must
 	// be the name of an APEX module.
 	profileImports []string
+
+	// Paths to the dex2oat binaries to use for the architectures of the dexpreopt targets, if not the
+	// default dex2oat.
+	dex2oatBinaryByArch map[android.ArchType]string
+
+	// Product-specific seed that is part of the identity of the image, see GlobalConfig.BootImageSeed.
+	seed string
 }
 
 // Target-dependent description of a boot image.
@@ -346,6 +381,34 @@ type bootImageVariant struct {
 	//
 	// Deprecated: Not initialized correctly, see struct comment.
 	licenseMetadataFile android.OptionalPath
+
+	// The number of threads and the cpu set that dex2oat uses for this variant, or empty for the
+	// dex2oat defaults, see GlobalConfig.Dex2oatImageThreads and GlobalConfig.Dex2oatImageCpuSet.
+	dex2oatThreads string
+	dex2oatCpuSet  string
+}
+
+// variantName returns the name of the variant, which is the name of its image followed by "_host"
+// for host variants and by its arch, e.g. "boot_arm64" or "art_host_x86_64". It is the suffix of the
+// make variables of the variant.
+func (variant *bootImageVariant) variantName() string {
+	suffix := ""
+	if variant.target.Os.Class == android.Host {
+		suffix = "_host"
+	}
+	return variant.name + suffix + "_" + variant.target.Arch.ArchType.String()
+}
+
+// Dex2oatThreads returns the number of threads that dex2oat uses for this variant, or an empty
+// string for the dex2oat default.
+func (variant *bootImageVariant) Dex2oatThreads() string {
+	return variant.dex2oatThreads
+}
+
+// Dex2oatCpuSet returns the comma separated cpus that dex2oat runs on for this variant, or an empty
+// string for any cpu.
+func (variant *bootImageVariant) Dex2oatCpuSet() string {
+	return variant.dex2oatCpuSet
 }
 
 // Get target-specific boot image variant for the given boot image config and target.
@@ -368,6 +431,29 @@ func (image bootImageConfig) getAnyAndroidVariant() *bootImageVariant {
 	return nil
 }
 
+// Targets returns the targets that the variants of the boot image are built for, in variant order.
+// Callers should use it rather than dexpreoptTargets, as the boot image configs may be generated
+// for other targets.
+func (image *bootImageConfig) Targets() []android.Target {
+	targets := make([]android.Target, 0, len(image.variants))
+	for _, variant := range image.variants {
+		targets = append(targets, variant.target)
+	}
+	return targets
+}
+
+// InstallDir returns the directory on device that the image files of the boot image for the given
+// architecture are installed in, e.g. /system/framework/arm64, or false if the boot image has no
+// android variant for the architecture.
+func (image *bootImageConfig) InstallDir(arch android.ArchType) (string, bool) {
+	for _, variant := range image.variants {
+		if variant.target.Os == android.Android && variant.target.Arch.ArchType == arch {
+			return filepath.Dir(variant.imagePathOnDevice), true
+		}
+	}
+	return "", false
+}
+
 // Return the name of a boot image module given a boot image config and a component (module) index.
 // A module name is a combination of the Java library name, and the boot image stem (that is stored
 // in the config).
@@ -377,7 +463,7 @@ func (image bootImageConfig) moduleName(ctx android.PathContext, idx int) string
 	m := image.modules.Jar(idx)
 	name := image.stem
 	if idx != 0 || image.extends != nil {
-		name += "-" + android.ModuleStem(ctx.Config(), image.modules.Apex(idx), m)
+		name += "-" + stemOfModule(ctx, nil, image.modules.Apex(idx), m)
 	}
 	return name
 }
@@ -447,12 +533,412 @@ func (image *bootImageVariant) imageLocations() (imageLocationsOnHost []string,
 		append(imageLocationsOnDevice, dexpreopt.PathStringToLocation(image.imagePathOnDevice, image.target.Arch.ArchType))
 }
 
+// imageLocationsOnDevice returns the on-device locations of the boot image and the images it
+// depends on, as exported to Make. They are in the image directory of the ART apex for the ART boot
+// image if the device loads it from there, see usesApexImage.
+func (image *bootImageVariant) imageLocationsOnDevice(ctx android.PathContext) []string {
+	if image.name == "art" && usesApexImage(ctx) {
+		arch := image.target.Arch.ArchType
+		path := filepath.Join(artApexRef(ctx).imageDir(arch), filepath.Base(image.imagePathOnDevice))
+		return []string{dexpreopt.PathStringToLocation(path, arch)}
+	}
+	_, imageLocationsOnDevice := image.imageLocations()
+	return imageLocationsOnDevice
+}
+
+// RuntimeBootImageLocation returns the value of the -Ximage argument of the runtime on the device
+// for the given arch, which is the on-device locations of the boot images that it loads, separated
+// by ":". It is the boot image in the ART apex if the device loads it from there, the default boot
+// image followed by the mainline boot image extension if the latter has modules, and the default
+// boot image alone otherwise. It is empty if there is no boot image for the arch.
+func RuntimeBootImageLocation(ctx android.PathContext, arch android.ArchType) string {
+	image := defaultBootImageConfig(ctx)
+	if usesApexImage(ctx) {
+		image = genBootImageConfigs(ctx)["art"]
+	} else if mainline := mainlineBootImageConfig(ctx); mainline.isEnabledByConfig(ctx) && mainline.modules.Len() > 0 {
+		image = mainline
+	}
+	variant := image.getVariant(android.Target{Os: android.Android, Arch: android.Arch{ArchType: arch}})
+	if variant == nil {
+		return ""
+	}
+	return strings.Join(variant.imageLocationsOnDevice(ctx), ":")
+}
+
+// moduleLocation is a module of a boot image and its on-device location.
+type moduleLocation struct {
+	Module   string
+	Location string
+}
+
+// ModuleLocations returns the modules of the boot image variant and their on-device locations, in
+// boot image order.
+func (image *bootImageVariant) ModuleLocations() []moduleLocation {
+	if image.modules.Len() != len(image.dexLocations) {
+		panic(fmt.Errorf("boot image %q variant %s has %d modules but %d dex locations",
+			image.name, image.target.Arch.ArchType, image.modules.Len(), len(image.dexLocations)))
+	}
+	pairs := make([]moduleLocation, 0, len(image.dexLocations))
+	for i, location := range image.dexLocations {
+		pairs = append(pairs, moduleLocation{Module: image.modules.Jar(i), Location: location})
+	}
+	return pairs
+}
+
+// ModuleLocations returns the modules of the boot image and their on-device locations, which are the
+// same for all the android variants.
+func (image *bootImageConfig) ModuleLocations() []moduleLocation {
+	return image.getAnyAndroidVariant().ModuleLocations()
+}
+
 func (image *bootImageConfig) isProfileGuided() bool {
 	return image.compilerFilter == "speed-profile"
 }
 
+// isAotCompiled returns true if the compiler filter of the boot image compiles code ahead of time,
+// rather than only verifying the dex code and leaving the compilation to the JIT.
+func (image *bootImageConfig) isAotCompiled() bool {
+	switch image.compilerFilter {
+	case "assume-verified", "extract", "verify", "quicken":
+		return false
+	}
+	return true
+}
+
+// hasSymbols returns true if the unstripped boot image files are generated.
+func (image *bootImageConfig) hasSymbols() bool {
+	return image.symbolsDir != android.OutputPath{}
+}
+
+// LogFields returns a summary of the boot image config as key-value pairs in a stable order, for
+// structured logs. It has the number of modules rather than the modules to keep the logs small.
+func (image *bootImageConfig) LogFields() []struct{ Key, Value string } {
+	return []struct{ Key, Value string }{
+		{"name", image.name},
+		{"stem", image.stem},
+		{"module_count", strconv.Itoa(image.modules.Len())},
+		{"arch_count", strconv.Itoa(len(image.variants))},
+		{"has_zip", strconv.FormatBool(image.zip != nil)},
+		{"has_symbols", strconv.FormatBool(image.hasSymbols())},
+	}
+}
+
+// isInstalled returns true if the boot image files are installed on device. They are not installed
+// into partitions that dexpreopt artifacts are not allowed in, and the default boot image is not
+// installed if the device loads the boot image from the ART apex.
+func (image *bootImageConfig) isInstalled(ctx android.PathContext) bool {
+	if image.name == frameworkBootImageName && usesApexImage(ctx) {
+		return false
+	}
+	return dexpreoptArtifactsAllowedFor(ctx, image.partition())
+}
+
+// installedInApex returns true if the boot image is installed into an apex rather than onto a
+// partition.
+func (image *bootImageConfig) installedInApex() bool {
+	return strings.HasPrefix(image.installDir, "apex/")
+}
+
+// partition returns the partition image that the boot image is installed into.
+func (image *bootImageConfig) partition() string {
+	return partitionOfLocation(image.installDir)
+}
+
+// isBuilt returns true if the boot image files are generated at build time, see dexpreoptStatus.
+func (image *bootImageConfig) isBuilt(ctx android.PathContext) bool {
+	return getDexpreoptStatus(ctx).bootImageBuilt
+}
+
+// ProfileTextPath returns the path to the human readable text profile of the boot image, if one is
+// configured in GlobalConfig.BootImageProfileText. It is a source file, unlike the compiled profile.
+func (image *bootImageConfig) ProfileTextPath(ctx android.PathContext) (android.Path, bool) {
+	path, ok := dexpreopt.GetGlobalConfig(ctx).BootImageProfileText[image.name]
+	if !ok {
+		return nil, false
+	}
+	ctx.AddNinjaFileDeps(path)
+	return android.PathForSource(ctx, path), true
+}
+
+// ProfiledModules returns the jars of the modules of the boot image that are profiled when its
+// profile is generated, in the order of the modules.
+func (image *bootImageConfig) ProfiledModules() []string {
+	return image.profiledModules
+}
+
+// profiledDexPathsAndLocations returns the dex files and the on-device locations that the profile of
+// the boot image is generated from. They are those of the images it depends on, followed by those of
+// its profiled modules.
+func (image *bootImageConfig) profiledDexPathsAndLocations() (android.Paths, []string) {
+	dexPaths := image.dexPathsDeps.Paths()
+	dexLocations := image.getAnyAndroidVariant().dexLocationsDeps
+	// The dex files of the images that this image depends on come first.
+	deps := len(dexPaths) - image.modules.Len()
+	var profiledPaths android.Paths
+	var profiledLocations []string
+	for i := range dexPaths {
+		if i < deps || android.InList(image.modules.Jar(i-deps), image.profiledModules) {
+			profiledPaths = append(profiledPaths, dexPaths[i])
+			profiledLocations = append(profiledLocations, dexLocations[i])
+		}
+	}
+	return profiledPaths, profiledLocations
+}
+
+// ProfilePath returns the path to the compiled profile of the boot image that is shared by all
+// architectures, or false if the boot image has no profile.
+func (image *bootImageConfig) ProfilePath(ctx android.PathContext) (android.OutputPath, bool) {
+	if !image.isProfileGuided() || dexpreopt.GetGlobalConfig(ctx).DisableGenerateProfile {
+		return android.OutputPath{}, false
+	}
+	return image.dir.Join(ctx, "boot.prof"), true
+}
+
+// ProfilePathForArch returns the path to the compiled profile of the boot image for the given
+// architecture, or false if the boot image has no profile for it. It is in the directory of the
+// image files for the architecture if GlobalConfig.PerArchBootImageProfiles is set, and is the path
+// returned by ProfilePath otherwise.
+func (image *bootImageConfig) ProfilePathForArch(ctx android.PathContext, arch android.ArchType) (android.OutputPath, bool) {
+	path, ok := image.ProfilePath(ctx)
+	if !ok || !dexpreopt.GetGlobalConfig(ctx).PerArchBootImageProfiles {
+		return path, ok
+	}
+	for _, variant := range image.variants {
+		if variant.target.Os == android.Android && variant.target.Arch.ArchType == arch {
+			return variant.imagePathOnHost.InSameDir(ctx, "boot.prof"), true
+		}
+	}
+	return android.OutputPath{}, false
+}
+
+// ArchIndependentOutputs returns the outputs of the boot image that are shared by all
+// architectures, unlike the image files of each variant in imagesDeps. They are the zip of the
+// android variants, if the image files are generated, and the profile, unless there is one per
+// architecture.
+func (image *bootImageConfig) ArchIndependentOutputs(ctx android.PathContext) android.Paths {
+	global := dexpreopt.GetGlobalConfig(ctx)
+	var outputs android.Paths
+	if image.zip != nil && !SkipDexpreoptBootJars(ctx) && !(global.OnlyPreoptArtBootImage && image.name != "art") {
+		outputs = append(outputs, image.zip)
+	}
+	if profile, ok := image.ProfilePath(ctx); ok && !global.PerArchBootImageProfiles {
+		outputs = append(outputs, profile)
+	}
+	return outputs
+}
+
+var allBootImageProfilesKey = newDexpreoptOnceKey("allBootImageProfiles")
+
+// allBootImageProfiles returns the compiled profiles of the android variants of all the boot images
+// that are enabled by the config, see ProfilePathForArch, deduplicated and sorted, so that they can
+// be disted and cleaned along with the image files.
+func allBootImageProfiles(ctx android.PathContext) android.Paths {
+	return ctx.Config().Once(allBootImageProfilesKey, func() interface{} {
+		var profiles android.Paths
+		for _, name := range getImageNames() {
+			image := genBootImageConfigs(ctx)[name]
+			if !image.isEnabledByConfig(ctx) {
+				continue
+			}
+			for _, variant := range image.variants {
+				if variant.target.Os != android.Android {
+					continue
+				}
+				if profile, ok := image.ProfilePathForArch(ctx, variant.target.Arch.ArchType); ok {
+					profiles = append(profiles, profile)
+				}
+			}
+		}
+		return android.SortedUniquePaths(profiles)
+	}).(android.Paths)
+}
+
+// seedHash returns the identity hash of the boot image, which changes when its name, its modules or
+// its seed change.
+func (image *bootImageConfig) seedHash() string {
+	h := sha256.New()
+	fmt.Fprintln(h, image.name)
+	for _, pair := range image.modules.CopyOfApexJarPairs() {
+		fmt.Fprintln(h, pair)
+	}
+	fmt.Fprintln(h, image.seed)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ContentHash returns the hash of everything in the config of the boot image that affects its
+// outputs when built for the given targets: its modules, its layout, its compiler settings, those
+// of the image it extends, and the global dex2oat flags for boot images. It does not depend on the
+// output directory, so identical configs of different devices have the same hash.
+func (image *bootImageConfig) ContentHash(global *dexpreopt.GlobalConfig, targets []android.Target) string {
+	h := sha256.New()
+	if image.extends != nil {
+		fmt.Fprintln(h, "extends", image.extends.ContentHash(global, targets))
+	}
+	fmt.Fprintln(h, "name", image.name)
+	fmt.Fprintln(h, "stem", image.stem)
+	fmt.Fprintln(h, "install_dir", image.installDir)
+	for _, pair := range image.modules.CopyOfApexJarPairs() {
+		fmt.Fprintln(h, "module", pair)
+	}
+	fmt.Fprintln(h, "preloaded_classes", image.preloadedClassesFile)
+	fmt.Fprintln(h, "compiler_filter", image.compilerFilter)
+	fmt.Fprintln(h, "single_image", image.singleImage)
+	for _, profile := range image.profileImports {
+		fmt.Fprintln(h, "profile_import", profile)
+	}
+	var dex2oatBinaries []string
+	for arch, binary := range image.dex2oatBinaryByArch {
+		dex2oatBinaries = append(dex2oatBinaries, arch.String()+"="+binary)
+	}
+	sort.Strings(dex2oatBinaries)
+	for _, binary := range dex2oatBinaries {
+		fmt.Fprintln(h, "dex2oat", binary)
+	}
+	fmt.Fprintln(h, "seed", image.seed)
+	for _, target := range targets {
+		fmt.Fprintln(h, "target", target.Os, target.Arch.ArchType)
+	}
+	fmt.Fprintln(h, "boot_flags", global.BootFlags)
+	fmt.Fprintln(h, "xmx", global.Dex2oatImageXmx)
+	fmt.Fprintln(h, "xms", global.Dex2oatImageXms)
+	fmt.Fprintln(h, "symbols", !global.DisableBootImageSymbols)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// identityPath returns the path to the file that records the identity of the boot image. It is an
+// input of the rules that compile the image if a seed is configured, so that they are rerun when the
+// seed changes.
+func (image *bootImageConfig) identityPath(ctx android.PathContext) android.WritablePath {
+	return image.dir.Join(ctx, image.name+"_identity.json")
+}
+
+// The version of the schema of bootImageIdentity. Changes to the schema must be additive, so that
+// consumers of older versions can still parse it.
+//
+// Version 2 adds the optional inputs of the boot image and their provenance.
+// Version 3 adds the extension modules of the default boot image.
+// Version 4 adds the boot class path indices of the modules.
+const bootImageIdentitySchemaVersion = 4
+
+// bootImageIdentity is the content of the file returned by bootImageConfig.identityPath.
+type bootImageIdentity struct {
+	SchemaVersion int      `json:"schema_version"`
+	Name          string   `json:"name"`
+	Modules       []string `json:"modules"`
+	Seed          string   `json:"seed"`
+	SeedHash      string   `json:"seed_hash"`
+
+	// The index of each of the modules on the boot class path, see bootclasspathIndex, or -1 for the
+	// modules that are not on it.
+	BootclasspathIndices []int `json:"bootclasspath_indices,omitempty"`
+
+	// The optional inputs of the boot image that are in use, by kind, e.g. "profile".
+	Inputs map[string]bootImageInput `json:"inputs,omitempty"`
+
+	// The modules of the default boot image that are not in the art boot image, if the default boot
+	// image extends the art boot image, see extensionModules.
+	ExtensionModules []string `json:"extension_modules,omitempty"`
+}
+
+// The provenances of the optional inputs of a boot image.
+const (
+	// The input is configured by the product.
+	inputFromProductConfig = "product_config"
+	// The input is the default one.
+	inputFromDefault = "default"
+	// The input is configured for the boot image only, overriding the product-wide one.
+	inputFromOverride = "override"
+)
+
+// bootImageInput is an optional input of a boot image, and where it comes from.
+type bootImageInput struct {
+	Paths      []string `json:"paths"`
+	Provenance string   `json:"provenance"`
+}
+
+// parseBootImageIdentity parses the content of the file returned by bootImageConfig.identityPath.
+// The files written before the schema was versioned are version 1.
+func parseBootImageIdentity(data []byte) (bootImageIdentity, error) {
+	var identity bootImageIdentity
+	if err := json.Unmarshal(data, &identity); err != nil {
+		return identity, err
+	}
+	if identity.SchemaVersion == 0 {
+		identity.SchemaVersion = 1
+	}
+	return identity, nil
+}
+
+// bootImageInputs returns the optional inputs of the given boot image that are in use, by kind.
+func bootImageInputs(ctx android.PathGlobContext, image *bootImageConfig) map[string]bootImageInput {
+	inputs := make(map[string]bootImageInput)
+	add := func(kind string, paths android.Paths, provenance string) {
+		if len(paths) > 0 {
+			inputs[kind] = bootImageInput{
+				Paths:      android.SortedUniqueStrings(paths.Strings()),
+				Provenance: provenance,
+			}
+		}
+	}
+	if image.isProfileGuided() && !dexpreopt.GetGlobalConfig(ctx).DisableGenerateProfile {
+		profiles, provenance := resolveBootImageProfiles(ctx)
+		add("profile", profiles, provenance)
+	}
+	if path, ok := image.ProfileTextPath(ctx); ok {
+		add("profile_text", android.Paths{path}, inputFromOverride)
+	}
+	dirtyImageObjects, provenance := resolveDirtyImageObjects(ctx)
+	if dirtyImageObjects.Valid() {
+		add("dirty_image_objects", android.Paths{dirtyImageObjects.Path()}, provenance)
+	}
+	return inputs
+}
+
+// buildBootImageIdentity generates a rule to write the file returned by
+// bootImageConfig.identityPath.
+func buildBootImageIdentity(ctx android.ModuleContext, image *bootImageConfig) {
+	identity := bootImageIdentity{
+		SchemaVersion: bootImageIdentitySchemaVersion,
+		Name:          image.name,
+		Modules:       image.modules.CopyOfApexJarPairs(),
+		Seed:          image.seed,
+		SeedHash:      image.seedHash(),
+		Inputs:        bootImageInputs(ctx, image),
+	}
+	for _, pair := range identity.Modules {
+		index, ok := bootclasspathIndexOf(ctx, pair)
+		if !ok {
+			index = -1
+		}
+		identity.BootclasspathIndices = append(identity.BootclasspathIndices, index)
+	}
+	if image == defaultBootImageConfig(ctx) && dexpreopt.GetGlobalConfig(ctx).ExtendArtBootImage {
+		extension := extensionModules(ctx)
+		identity.ExtensionModules = extension.CopyOfApexJarPairs()
+	}
+	data, err := json.MarshalIndent(identity, "", "    ")
+	if err != nil {
+		ctx.ModuleErrorf("failed to JSON marshal boot image identity: %v", err)
+		return
+	}
+	android.WriteFileRule(ctx, image.identityPath(ctx), string(data))
+}
+
+// usesApexImage returns true if the device loads the ART boot image from the ART apex, see
+// GlobalConfig.UsesArtApexBootImage.
+func usesApexImage(ctx android.PathContext) bool {
+	return dexpreopt.GetGlobalConfig(ctx).UsesArtApexBootImage
+}
+
 func (image *bootImageConfig) isEnabled(ctx android.BaseModuleContext) bool {
-	return ctx.OtherModuleExists(image.enabledIfExists)
+	return ctx.OtherModuleExists(image.enabledIfExists) && image.isEnabledByConfig(ctx)
+}
+
+// isEnabledByConfig returns true if the boot image is listed in
+// GlobalConfig.EnabledBootImageVariants, if the list is empty, or if it is the default boot image.
+func (image *bootImageConfig) isEnabledByConfig(ctx android.PathContext) bool {
+	enabled := dexpreopt.GetGlobalConfig(ctx).EnabledBootImageVariants
+	return len(enabled) == 0 || image.name == frameworkBootImageName || android.InList(image.name, enabled)
 }
 
 func dexpreoptBootJarsFactory() android.SingletonModule {
@@ -532,7 +1018,7 @@ func DexpreoptBootJarsMutator(ctx android.BottomUpMutatorContext) {
 	} else if ctx.OtherModuleExists("art-bootclasspath-fragment") {
 		// For accessing the ART bootclasspath fragment on a thin manifest (e.g., master-art) where
 		// platform-bootclasspath doesn't exist.
-		addDependencyOntoApexModulePair(ctx, "com.android.art", "art-bootclasspath-fragment", bootclasspathFragmentDepTag)
+		addDependencyOntoApexModulePair(ctx, artApexRef(ctx).name, "art-bootclasspath-fragment", bootclasspathFragmentDepTag)
 	}
 }
 
@@ -592,12 +1078,20 @@ func (d *dexpreoptBootJars) GenerateAndroidBuildActions(ctx android.ModuleContex
 	d.defaultBootImage = defaultBootImageConfig(ctx)
 	d.otherImages = make([]*bootImageConfig, 0, len(imageConfigs)-1)
 	var profileInstalls android.RuleBuilderInstalls
+	if d.defaultBootImage.isEnabled(ctx) {
+		validateDexpreoptModulesExist(ctx)
+	}
+	android.SetProvider(ctx, BootclasspathConfigInfoProvider, bootclasspathConfigInfo(ctx))
+
+	// In a dry run only the configs are needed, for the make variables, and in an analysis only run
+	// not even those.
+	skipRules := dexpreoptDryRun(ctx.Config()) || dexpreoptAnalysisOnly(ctx.Config())
 	for _, name := range getImageNames() {
 		config := imageConfigs[name]
 		if config != d.defaultBootImage {
 			d.otherImages = append(d.otherImages, config)
 		}
-		if !config.isEnabled(ctx) {
+		if !config.isEnabled(ctx) || !getDexpreoptStatus(ctx).bootJarsStaged || skipRules {
 			continue
 		}
 		installs := generateBootImage(ctx, config)
@@ -617,9 +1111,34 @@ func (d *dexpreoptBootJars) GenerateAndroidBuildActions(ctx android.ModuleContex
 
 // GenerateSingletonBuildActions generates build rules for the dexpreopt config for Make.
 func (d *dexpreoptBootJars) GenerateSingletonBuildActions(ctx android.SingletonContext) {
+	if dexpreoptAnalysisOnly(ctx.Config()) {
+		return
+	}
+
 	d.dexpreoptConfigForMake =
 		android.PathForOutput(ctx, dexpreopt.GetDexpreoptDirName(ctx), "dexpreopt.config")
 	writeGlobalConfigForMake(ctx, d.dexpreoptConfigForMake)
+
+	if dexpreoptDryRun(ctx.Config()) {
+		fmt.Fprint(os.Stderr, dexpreoptDryRunSummary(ctx))
+	}
+
+	checkDexpreoptConfig(ctx)
+	checkExportedMakeVars(ctx)
+	buildSystemServerJarsManifest(ctx)
+	buildInitClasspathExports(ctx)
+	buildBootJarPathsByLocation(ctx)
+	buildBootJarsList(ctx)
+	buildBootImageInputsDepFile(ctx)
+	printBootImageModulesChanges(ctx)
+	buildDexpreoptMetrics(ctx)
+	buildDexpreoptCompilerFilters(ctx)
+	writeBootImageModulesState(ctx)
+	writeDexpreoptStateCache(ctx)
+	android.WriteFileRule(ctx, dexpreoptExplainPath(ctx), strings.Join(dexpreoptExplain(ctx), "\n"))
+	buildDexpreoptBazelExport(ctx)
+	buildBootclasspathProvenance(ctx)
+	buildDexpreoptWarnings(ctx)
 }
 
 // shouldBuildBootImages determines whether boot images should be built.
@@ -637,16 +1156,26 @@ func shouldBuildBootImages(config android.Config, global *dexpreopt.GlobalConfig
 func generateBootImage(ctx android.ModuleContext, imageConfig *bootImageConfig) android.RuleBuilderInstalls {
 	apexJarModulePairs := getModulesForImage(ctx, imageConfig)
 
+	if imageConfig.seed != "" {
+		buildBootImageIdentity(ctx, imageConfig)
+	}
+
 	// Copy module dex jars to their predefined locations.
 	bootDexJarsByModule := extractEncodedDexJarsFromModulesOrBootclasspathFragments(ctx, apexJarModulePairs)
-	copyBootJarsToPredefinedLocations(ctx, bootDexJarsByModule, imageConfig.dexPathsByModule)
+	usePrebuiltInputJars(ctx, imageConfig, apexJarModulePairs, bootDexJarsByModule)
+	stagedBootDexJarsByModule, stagedDexPathsByModule := withoutUnstagedJars(ctx, imageConfig, bootDexJarsByModule)
+	copyBootJarsToPredefinedLocations(ctx, stagedBootDexJarsByModule, stagedDexPathsByModule)
+
+	global := dexpreopt.GetGlobalConfig(ctx)
+	if global.AuditBootDexInputs {
+		buildBootDexInputsManifests(ctx, imageConfig, expectedBootDexJarHashes(ctx, apexJarModulePairs))
+	}
 
 	// Build a profile for the image config from the profile at the default path. The profile will
 	// then be used along with profiles imported from APEXes to build the boot image.
 	profile, profileInstalls := bootImageProfileRule(ctx, imageConfig)
 
 	// If dexpreopt of boot image jars should be skipped, stop after generating a profile.
-	global := dexpreopt.GetGlobalConfig(ctx)
 	if SkipDexpreoptBootJars(ctx) || (global.OnlyPreoptArtBootImage && imageConfig.name != "art") {
 		return profileInstalls
 	}
@@ -669,18 +1198,24 @@ func generateBootImage(ctx android.ModuleContext, imageConfig *bootImageConfig)
 type apexJarModulePair struct {
 	apex      string
 	jarModule android.Module
+
+	// The configured name of the jar, which is not the name of jarModule if the jar is in
+	// BootJarModuleAliases.
+	jar string
 }
 
 func getModulesForImage(ctx android.ModuleContext, imageConfig *bootImageConfig) []apexJarModulePair {
+	global := dexpreopt.GetGlobalConfig(ctx)
 	modules := make([]apexJarModulePair, 0, imageConfig.modules.Len())
 	for i := 0; i < imageConfig.modules.Len(); i++ {
 		found := false
 		for _, module := range gatherApexModulePairDepsWithTag(ctx, dexpreoptBootJarDepTag) {
 			name := android.RemoveOptionalPrebuiltPrefix(module.Name())
-			if name == imageConfig.modules.Jar(i) {
+			if name == global.BootJarModule(imageConfig.modules.Jar(i)) {
 				modules = append(modules, apexJarModulePair{
 					apex:      imageConfig.modules.Apex(i),
 					jarModule: module,
+					jar:       imageConfig.modules.Jar(i),
 				})
 				found = true
 				break
@@ -704,11 +1239,34 @@ func extractEncodedDexJarsFromModulesOrBootclasspathFragments(ctx android.Module
 	encodedDexJarsByModuleName := bootDexJarByModule{}
 	for _, pair := range apexJarModulePairs {
 		dexJarPath := getDexJarForApex(ctx, pair, apexNameToApexExportInfoMap)
-		encodedDexJarsByModuleName.addPath(pair.jarModule, dexJarPath)
+		encodedDexJarsByModuleName[pair.jar] = dexJarPath
 	}
 	return encodedDexJarsByModuleName
 }
 
+// usePrebuiltInputJars replaces the dex jars of the modules whose jars are in
+// image.prebuiltInputJars with the dex jars exported by their prebuilt apexes. It is an error if a
+// prebuilt apex does not export the dex jar, rather than falling back to the jar from the build.
+func usePrebuiltInputJars(ctx android.ModuleContext, image *bootImageConfig, apexJarModulePairs []apexJarModulePair, bootDexJarsByModule bootDexJarByModule) {
+	if len(image.prebuiltInputJars) == 0 {
+		return
+	}
+	apexNameToApexExportsInfoMap := getApexNameToApexExportsInfoMap(ctx)
+	for _, pair := range apexJarModulePairs {
+		path, ok := image.prebuiltInputJars[pair.jar]
+		if !ok {
+			continue
+		}
+		dex, ok := apexNameToApexExportsInfoMap[pair.apex].LibraryNameToDexJarPathOnHost[ModuleStemForDeapexing(pair.jarModule)]
+		if !ok {
+			ctx.ModuleErrorf("Boot jar %q is in apex %q, which is in PrebuiltBootJarApexes, but no prebuilt apex %q exports %s",
+				pair.jarModule.Name(), pair.apex, pair.apex, path)
+			continue
+		}
+		bootDexJarsByModule[pair.jar] = dex
+	}
+}
+
 type apexNameToApexExportsInfoMap map[string]android.ApexExportsInfo
 
 // javaLibraryPathOnHost returns the path to the java library which is exported by the apex for hiddenapi and dexpreopt and a boolean indicating whether the java library exists
@@ -769,6 +1327,42 @@ func getDexJarForApex(ctx android.ModuleContext, pair apexJarModulePair, apexNam
 	return nil
 }
 
+// withoutUnstagedJars returns the dex jars of the modules and the predefined paths of the image
+// without the jars that are not staged, see bootImageConfig.unstagedJars. It is an error if the
+// module of a jar that is not staged does not produce the dex jar at the predefined path.
+func withoutUnstagedJars(ctx android.ModuleContext, image *bootImageConfig, bootDexJarsByModule bootDexJarByModule) (bootDexJarByModule, map[string]android.WritablePath) {
+	if len(image.unstagedJars) == 0 {
+		return bootDexJarsByModule, image.dexPathsByModule
+	}
+	staged := bootDexJarByModule{}
+	for name, path := range bootDexJarsByModule {
+		if _, ok := image.unstagedJars[name]; !ok {
+			staged[name] = path
+		}
+	}
+	stagedPaths := make(map[string]android.WritablePath)
+	for name, path := range image.dexPathsByModule {
+		if _, ok := image.unstagedJars[name]; !ok {
+			stagedPaths[name] = path
+		}
+	}
+	for _, name := range android.SortedKeys(image.unstagedJars) {
+		expected := image.unstagedJars[name]
+		actual := bootDexJarsByModule[name]
+		if actual == nil {
+			if !ctx.Config().AllowMissingDependencies() {
+				ctx.ModuleErrorf("module %s does not provide a dex boot jar", name)
+			} else {
+				ctx.AddMissingDependencies([]string{name})
+			}
+		} else if actual.String() != expected.String() {
+			ctx.ModuleErrorf("boot jar %q is not staged as SkipStagingOfStableBootJars is set, but its module produces %s rather than %s",
+				name, actual, expected)
+		}
+	}
+	return staged, stagedPaths
+}
+
 // copyBootJarsToPredefinedLocations generates commands that will copy boot jars to predefined
 // paths in the global config.
 func copyBootJarsToPredefinedLocations(ctx android.ModuleContext, srcBootDexJarsByModule bootDexJarByModule, dstBootJarsByModule map[string]android.WritablePath) {
@@ -777,6 +1371,7 @@ func copyBootJarsToPredefinedLocations(ctx android.ModuleContext, srcBootDexJars
 	names = append(names, android.SortedKeys(srcBootDexJarsByModule)...)
 	names = append(names, android.SortedKeys(dstBootJarsByModule)...)
 	names = android.SortedUniqueStrings(names)
+	sortByPreoptPriority(ctx, names)
 	for _, name := range names {
 		src := srcBootDexJarsByModule[name]
 		dst := dstBootJarsByModule[name]
@@ -937,8 +1532,6 @@ func buildBootImageVariant(ctx android.ModuleContext, image *bootImageVariant, p
 
 	arch := image.target.Arch.ArchType
 	os := image.target.Os.String() // We need to distinguish host-x86 and device-x86.
-	symbolsDir := image.symbolsDir.Join(ctx, os, image.installDir, arch.String())
-	symbolsFile := symbolsDir.Join(ctx, image.stem+".oat")
 	outputDir := image.dir.Join(ctx, os, image.installDir, arch.String())
 	outputPath := outputDir.Join(ctx, image.stem+".oat")
 	oatLocation := dexpreopt.PathToLocation(outputPath, arch)
@@ -946,12 +1539,16 @@ func buildBootImageVariant(ctx android.ModuleContext, image *bootImageVariant, p
 
 	rule := android.NewRuleBuilder(pctx, ctx)
 
-	rule.Command().Text("mkdir").Flag("-p").Flag(symbolsDir.String())
-	rule.Command().Text("rm").Flag("-f").
-		Flag(symbolsDir.Join(ctx, "*.art").String()).
-		Flag(symbolsDir.Join(ctx, "*.oat").String()).
-		Flag(symbolsDir.Join(ctx, "*.vdex").String()).
-		Flag(symbolsDir.Join(ctx, "*.invocation").String())
+	var symbolsDir android.OutputPath
+	if image.hasSymbols() {
+		symbolsDir = image.symbolsDir.Join(ctx, os, image.installDir, arch.String())
+		rule.Command().Text("mkdir").Flag("-p").Flag(symbolsDir.String())
+		rule.Command().Text("rm").Flag("-f").
+			Flag(symbolsDir.Join(ctx, "*.art").String()).
+			Flag(symbolsDir.Join(ctx, "*.oat").String()).
+			Flag(symbolsDir.Join(ctx, "*.vdex").String()).
+			Flag(symbolsDir.Join(ctx, "*.invocation").String())
+	}
 	rule.Command().Text("rm").Flag("-f").
 		Flag(outputDir.Join(ctx, "*.art").String()).
 		Flag(outputDir.Join(ctx, "*.oat").String()).
@@ -973,12 +1570,23 @@ func buildBootImageVariant(ctx android.ModuleContext, image *bootImageVariant, p
 
 	apexNameToApexExportsInfoMap := getApexNameToApexExportsInfoMap(ctx)
 
+	if image.seed != "" {
+		cmd.Implicit(image.identityPath(ctx))
+	}
+
 	cmd.Tool(globalSoong.Dex2oat).
 		Flag("--avoid-storing-invocation").
 		FlagWithOutput("--write-invocation-to=", invocationPath).ImplicitOutput(invocationPath).
 		Flag("--runtime-arg").FlagWithArg("-Xms", global.Dex2oatImageXms).
 		Flag("--runtime-arg").FlagWithArg("-Xmx", global.Dex2oatImageXmx)
 
+	if image.dex2oatThreads != "" {
+		cmd.FlagWithArg("-j", image.dex2oatThreads)
+	}
+	if image.dex2oatCpuSet != "" {
+		cmd.FlagWithArg("--cpu-set=", image.dex2oatCpuSet)
+	}
+
 	if image.isProfileGuided() && !global.DisableGenerateProfile {
 		if profile != nil {
 			cmd.FlagWithInput("--profile-file=", profile)
@@ -997,9 +1605,7 @@ func buildBootImageVariant(ctx android.ModuleContext, image *bootImageVariant, p
 		}
 	}
 
-	dirtyImageFile := "frameworks/base/config/dirty-image-objects"
-	dirtyImagePath := android.ExistentPathForSource(ctx, dirtyImageFile)
-	if dirtyImagePath.Valid() {
+	if dirtyImagePath, _ := resolveDirtyImageObjects(ctx); dirtyImagePath.Valid() {
 		cmd.FlagWithInput("--dirty-image-objects=", dirtyImagePath.Path())
 	}
 
@@ -1040,8 +1646,11 @@ func buildBootImageVariant(ctx android.ModuleContext, image *bootImageVariant, p
 		FlagForEachArg("--dex-location=", image.dexLocations).
 		Flag("--generate-debug-info").
 		Flag("--generate-build-id").
-		Flag("--image-format=lz4hc").
-		FlagWithArg("--oat-symbols=", symbolsFile.String()).
+		Flag("--image-format=lz4hc")
+	if image.hasSymbols() {
+		cmd.FlagWithArg("--oat-symbols=", symbolsDir.Join(ctx, image.stem+".oat").String())
+	}
+	cmd.
 		FlagWithArg("--oat-file=", outputPath.String()).
 		FlagWithArg("--oat-location=", oatLocation).
 		FlagWithArg("--image=", imagePath.String()).
@@ -1108,12 +1717,14 @@ func buildBootImageVariant(ctx android.ModuleContext, image *bootImageVariant, p
 			android.RuleBuilderInstall{vdex, filepath.Join(installDir, vdex.Base())})
 	}
 
-	for _, unstrippedOat := range image.moduleFiles(ctx, symbolsDir, ".oat") {
-		cmd.ImplicitOutput(unstrippedOat)
+	if image.hasSymbols() {
+		for _, unstrippedOat := range image.moduleFiles(ctx, symbolsDir, ".oat") {
+			cmd.ImplicitOutput(unstrippedOat)
 
-		// Install the unstripped oat files.  The Make rules will put these in $(TARGET_OUT_UNSTRIPPED)
-		unstrippedInstalls = append(unstrippedInstalls,
-			android.RuleBuilderInstall{unstrippedOat, filepath.Join(installDir, unstrippedOat.Base())})
+			// Install the unstripped oat files.  The Make rules will put these in $(TARGET_OUT_UNSTRIPPED)
+			unstrippedInstalls = append(unstrippedInstalls,
+				android.RuleBuilderInstall{unstrippedOat, filepath.Join(installDir, unstrippedOat.Base())})
+		}
 	}
 
 	rule.Build(image.name+"JarsDexpreopt_"+image.target.String(), "dexpreopt "+image.name+" jars "+arch.String())
@@ -1146,25 +1757,16 @@ func bootImageProfileRuleCommon(ctx android.ModuleContext, name string, dexFiles
 		return nil
 	}
 
-	defaultProfile := "frameworks/base/config/boot-image-profile.txt"
-	extraProfile := "frameworks/base/config/boot-image-profile-extra.txt"
-
-	rule := android.NewRuleBuilder(pctx, ctx)
-
-	var profiles android.Paths
-	if len(global.BootImageProfiles) > 0 {
-		profiles = append(profiles, global.BootImageProfiles...)
-	} else if path := android.ExistentPathForSource(ctx, defaultProfile); path.Valid() {
-		profiles = append(profiles, path.Path())
-	} else {
+	profiles, _ := resolveBootImageProfiles(ctx)
+	if len(profiles) == 0 {
 		// No profile (not even a default one, which is the case on some branches
 		// like master-art-host that don't have frameworks/base).
 		// Return nil and continue without profile.
 		return nil
 	}
-	if path := android.ExistentPathForSource(ctx, extraProfile); path.Valid() {
-		profiles = append(profiles, path.Path())
-	}
+
+	rule := android.NewRuleBuilder(pctx, ctx)
+
 	bootImageProfile := android.PathForModuleOut(ctx, name, "boot-image-profile.txt")
 	rule.Command().Text("cat").Inputs(profiles).Text(">").Output(bootImageProfile)
 
@@ -1184,6 +1786,36 @@ func bootImageProfileRuleCommon(ctx android.ModuleContext, name string, dexFiles
 	return profile
 }
 
+// resolveBootImageProfiles returns the text profiles that the boot image profile is created from,
+// and their provenance. They are the profiles in GlobalConfig.BootImageProfiles, or the default
+// profile if there are none, followed by the extra profile if it exists.
+func resolveBootImageProfiles(ctx android.PathGlobContext) (android.Paths, string) {
+	defaultProfile := "frameworks/base/config/boot-image-profile.txt"
+	extraProfile := "frameworks/base/config/boot-image-profile-extra.txt"
+
+	var profiles android.Paths
+	var provenance string
+	if global := dexpreopt.GetGlobalConfig(ctx); len(global.BootImageProfiles) > 0 {
+		profiles = append(profiles, global.BootImageProfiles...)
+		provenance = inputFromProductConfig
+	} else if path := android.ExistentPathForSource(ctx, defaultProfile); path.Valid() {
+		profiles = append(profiles, path.Path())
+		provenance = inputFromDefault
+	} else {
+		return nil, ""
+	}
+	if path := android.ExistentPathForSource(ctx, extraProfile); path.Valid() {
+		profiles = append(profiles, path.Path())
+	}
+	return profiles, provenance
+}
+
+// resolveDirtyImageObjects returns the dirty image objects file of the boot images, if it exists,
+// and its provenance.
+func resolveDirtyImageObjects(ctx android.PathGlobContext) (android.OptionalPath, string) {
+	return android.ExistentPathForSource(ctx, "frameworks/base/config/dirty-image-objects"), inputFromDefault
+}
+
 type profileInstallInfo struct {
 	// Rules which should be used in make to install the outputs.
 	profileInstalls android.RuleBuilderInstalls
@@ -1199,7 +1831,8 @@ func bootImageProfileRule(ctx android.ModuleContext, image *bootImageConfig) (an
 		return nil, nil
 	}
 
-	profile := bootImageProfileRuleCommon(ctx, image.name, image.dexPathsDeps.Paths(), image.getAnyAndroidVariant().dexLocationsDeps)
+	dexPaths, dexLocations := image.profiledDexPathsAndLocations()
+	profile := bootImageProfileRuleCommon(ctx, image.name, dexPaths, dexLocations)
 
 	if image == defaultBootImageConfig(ctx) {
 		rule := android.NewRuleBuilder(pctx, ctx)
@@ -1298,9 +1931,13 @@ func writeGlobalConfigForMake(ctx android.SingletonContext, path android.Writabl
 // (make/core/dex_preopt_libart.mk) to generate install rules that copy boot image files to the
 // correct output directories.
 func (d *dexpreoptBootJars) MakeVars(ctx android.MakeVarsContext) {
+	if dexpreoptAnalysisOnly(ctx.Config()) {
+		return
+	}
+
 	if d.dexpreoptConfigForMake != nil && !SkipDexpreoptBootJars(ctx) {
-		ctx.Strict("DEX_PREOPT_CONFIG_FOR_MAKE", d.dexpreoptConfigForMake.String())
-		ctx.Strict("DEX_PREOPT_SOONG_CONFIG_FOR_MAKE", android.PathForOutput(ctx, "dexpreopt_soong.config").String())
+		ctx.Strict("DEX_PREOPT_CONFIG_FOR_MAKE", makeVarPath(ctx, d.dexpreoptConfigForMake))
+		ctx.Strict("DEX_PREOPT_SOONG_CONFIG_FOR_MAKE", makeVarPath(ctx, android.PathForOutput(ctx, "dexpreopt_soong.config")))
 	}
 
 	image := d.defaultBootImage
@@ -1308,7 +1945,7 @@ func (d *dexpreoptBootJars) MakeVars(ctx android.MakeVarsContext) {
 		if profileInstallInfo, ok := android.SingletonModuleProvider(ctx, d, profileInstallInfoProvider); ok {
 			ctx.Strict("DEXPREOPT_IMAGE_PROFILE_BUILT_INSTALLED", profileInstallInfo.profileInstalls.String())
 			if profileInstallInfo.profileLicenseMetadataFile.Valid() {
-				ctx.Strict("DEXPREOPT_IMAGE_PROFILE_LICENSE_METADATA", profileInstallInfo.profileLicenseMetadataFile.String())
+				ctx.Strict("DEXPREOPT_IMAGE_PROFILE_LICENSE_METADATA", makeVarPath(ctx, profileInstallInfo.profileLicenseMetadataFile.Path()))
 			}
 		}
 
@@ -1316,34 +1953,65 @@ func (d *dexpreoptBootJars) MakeVars(ctx android.MakeVarsContext) {
 			return
 		}
 
-		global := dexpreopt.GetGlobalConfig(ctx)
-		dexPaths, dexLocations := bcpForDexpreopt(ctx, global.PreoptWithUpdatableBcp)
-		ctx.Strict("DEXPREOPT_BOOTCLASSPATH_DEX_FILES", strings.Join(dexPaths.Strings(), " "))
-		ctx.Strict("DEXPREOPT_BOOTCLASSPATH_DEX_LOCATIONS", strings.Join(dexLocations, " "))
+		if dexpreopt.GetGlobalConfig(ctx).OnDeviceImageGeneration {
+			// There are no boot image files for Make to install. The boot images that are only not built
+			// for other reasons, e.g. because there are no device targets, still have host variants and
+			// names that Make refers to.
+			return
+		}
 
 		// The primary ART boot image is exposed to Make for testing (gtests) and benchmarking
 		// (golem) purposes.
 		for _, current := range append(d.otherImages, image) {
+			if !current.isEnabledByConfig(ctx) {
+				continue
+			}
+			installed := current.isInstalled(ctx)
 			for _, variant := range current.variants {
-				suffix := ""
-				if variant.target.Os.Class == android.Host {
-					suffix = "_host"
+				var installs, vdexInstalls, unstrippedInstalls android.RuleBuilderInstalls
+				if installed {
+					installs, vdexInstalls, unstrippedInstalls = variant.installs, variant.vdexInstalls, variant.unstrippedInstalls
 				}
-				sfx := variant.name + suffix + "_" + variant.target.Arch.ArchType.String()
-				ctx.Strict("DEXPREOPT_IMAGE_VDEX_BUILT_INSTALLED_"+sfx, variant.vdexInstalls.String())
-				ctx.Strict("DEXPREOPT_IMAGE_"+sfx, variant.imagePathOnHost.String())
-				ctx.Strict("DEXPREOPT_IMAGE_DEPS_"+sfx, strings.Join(variant.imagesDeps.Strings(), " "))
-				ctx.Strict("DEXPREOPT_IMAGE_BUILT_INSTALLED_"+sfx, variant.installs.String())
-				ctx.Strict("DEXPREOPT_IMAGE_UNSTRIPPED_BUILT_INSTALLED_"+sfx, variant.unstrippedInstalls.String())
+				sfx := variant.variantName()
+				ctx.Strict("DEXPREOPT_IMAGE_VDEX_BUILT_INSTALLED_"+sfx, vdexInstalls.String())
+				ctx.Strict("DEXPREOPT_IMAGE_"+sfx, makeVarPath(ctx, variant.imagePathOnHost))
+				ctx.Strict("DEXPREOPT_IMAGE_DEPS_"+sfx, makeVarPaths(ctx, variant.imagesDeps.Paths()))
+				ctx.Strict("DEXPREOPT_IMAGE_BUILT_INSTALLED_"+sfx, installs.String())
+				ctx.Strict("DEXPREOPT_IMAGE_UNSTRIPPED_BUILT_INSTALLED_"+sfx, unstrippedInstalls.String())
 				if variant.licenseMetadataFile.Valid() {
-					ctx.Strict("DEXPREOPT_IMAGE_LICENSE_METADATA_"+sfx, variant.licenseMetadataFile.String())
+					ctx.Strict("DEXPREOPT_IMAGE_LICENSE_METADATA_"+sfx, makeVarPath(ctx, variant.licenseMetadataFile.Path()))
+				}
+				if variant.dex2oatThreads != "" {
+					ctx.Strict("DEXPREOPT_IMAGE_DEX2OAT_THREADS_"+sfx, variant.dex2oatThreads)
+				}
+				if variant.dex2oatCpuSet != "" {
+					ctx.Strict("DEXPREOPT_IMAGE_DEX2OAT_CPU_SET_"+sfx, variant.dex2oatCpuSet)
 				}
 			}
-			imageLocationsOnHost, imageLocationsOnDevice := current.getAnyAndroidVariant().imageLocations()
-			ctx.Strict("DEXPREOPT_IMAGE_LOCATIONS_ON_HOST"+current.name, strings.Join(imageLocationsOnHost, ":"))
-			ctx.Strict("DEXPREOPT_IMAGE_LOCATIONS_ON_DEVICE"+current.name, strings.Join(imageLocationsOnDevice, ":"))
-			ctx.Strict("DEXPREOPT_IMAGE_ZIP_"+current.name, current.zip.String())
+			if androidVariant := current.getAnyAndroidVariant(); androidVariant != nil {
+				imageLocationsOnHost, _ := androidVariant.imageLocations()
+				imageLocationsOnDevice := androidVariant.imageLocationsOnDevice(ctx)
+				ctx.Strict("DEXPREOPT_IMAGE_LOCATIONS_ON_HOST"+current.name, strings.Join(imageLocationsOnHost, ":"))
+				ctx.Strict("DEXPREOPT_IMAGE_LOCATIONS_ON_DEVICE"+current.name, strings.Join(imageLocationsOnDevice, ":"))
+			}
+			ctx.Strict("DEXPREOPT_IMAGE_ZIP_"+current.name, makeVarPath(ctx, current.zip))
+			if current.seed != "" {
+				ctx.Strict("DEXPREOPT_IMAGE_SEED_HASH_"+current.name, current.seedHash())
+			}
+		}
+		var names []string
+		for _, name := range getImageNames() {
+			if genBootImageConfigs(ctx)[name].isEnabledByConfig(ctx) {
+				names = append(names, name)
+			}
+		}
+		ctx.Strict("DEXPREOPT_IMAGE_NAMES", strings.Join(names, " "))
+
+		for _, variant := range image.variants {
+			if variant.target.Os == android.Android {
+				arch := variant.target.Arch.ArchType
+				ctx.Strict("DEXPREOPT_IMAGE_LOCATIONS_ON_DEVICE_"+arch.String(), RuntimeBootImageLocation(ctx, arch))
+			}
 		}
-		ctx.Strict("DEXPREOPT_IMAGE_NAMES", strings.Join(getImageNames(), " "))
 	}
 }
@@ -64,21 +64,25 @@ func getInstallPath(ctx android.ModuleContext, location string) android.InstallP
 
 func (m *dexpreoptSystemserverCheck) GenerateAndroidBuildActions(ctx android.ModuleContext) {
 	global := dexpreopt.GetGlobalConfig(ctx)
-	targets := ctx.Config().Targets[android.Android]
+	targets := systemServerPreoptTargets(ctx)
 
 	// The check should be skipped on unbundled builds because system server jars are not preopted on
 	// unbundled builds since the artifacts are installed into the system image, not the APEXes.
-	if global.DisablePreopt || global.OnlyPreoptArtBootImage || len(targets) == 0 || ctx.Config().UnbundledBuild() {
+	if !getDexpreoptStatus(ctx).systemServerPreopted {
 		return
 	}
 
 	systemServerJars := global.AllSystemServerJars(ctx)
 	for _, jar := range systemServerJars.CopyOfJars() {
 		dexLocation := dexpreopt.GetSystemServerDexLocation(ctx, global, jar)
-		odexLocation := dexpreopt.ToOdexPath(dexLocation, targets[0].Arch.ArchType)
-		odexPath := getInstallPath(ctx, odexLocation)
-		vdexPath := getInstallPath(ctx, pathtools.ReplaceExtension(odexLocation, "vdex"))
-		m.artifactsByModuleName[jar] = []string{odexPath.String(), vdexPath.String()}
+		var artifacts []string
+		for _, target := range targets {
+			odexLocation := dexpreopt.ToOdexPath(dexLocation, target.Arch.ArchType)
+			odexPath := getInstallPath(ctx, odexLocation)
+			vdexPath := getInstallPath(ctx, pathtools.ReplaceExtension(odexLocation, "vdex"))
+			artifacts = append(artifacts, odexPath.String(), vdexPath.String())
+		}
+		m.artifactsByModuleName[jar] = artifacts
 	}
 }
 
@@ -0,0 +1,95 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package java
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"android/soong/android"
+	"android/soong/dexpreopt"
+)
+
+// The report of the compiler filters that the jars and apps of the build are dexpreopted with, for
+// the performance sign-off of a build. The filters are the ones recorded by the dexpreopt rules of
+// the modules, so the report cannot diverge from the rules.
+
+// compilerFilterReporter is implemented by the modules that embed a dexpreopter.
+type compilerFilterReporter interface {
+	dexpreoptCompilerFilter() (string, string, bool)
+}
+
+// moduleVisitorContext is the part of android.SingletonContext and android.MakeVarsContext that
+// dexpreoptCompilerFilters needs.
+type moduleVisitorContext interface {
+	VisitAllModules(visit func(android.Module))
+}
+
+// dexpreoptCompilerFilters returns the names of the modules that are dexpreopted with each compiler
+// filter, sorted by name.
+func dexpreoptCompilerFilters(ctx moduleVisitorContext) map[string][]string {
+	filters := make(map[string][]string)
+	ctx.VisitAllModules(func(module android.Module) {
+		if !isActiveModule(module) {
+			return
+		}
+		if m, ok := module.(compilerFilterReporter); ok {
+			if name, filter, ok := m.dexpreoptCompilerFilter(); ok {
+				filters[filter] = append(filters[filter], name)
+			}
+		}
+	})
+	for filter, names := range filters {
+		filters[filter] = android.SortedUniqueStrings(names)
+	}
+	return filters
+}
+
+// dexpreoptCompilerFiltersPath returns the path to the compiler filter report.
+func dexpreoptCompilerFiltersPath(ctx android.PathContext) android.WritablePath {
+	return android.PathForOutput(ctx, dexpreopt.GetDexpreoptDirName(ctx), "compiler_filters.json")
+}
+
+// buildDexpreoptCompilerFilters generates a rule to write the compiler filter report.
+func buildDexpreoptCompilerFilters(ctx android.SingletonContext) {
+	data, err := json.MarshalIndent(dexpreoptCompilerFilters(ctx), "", "    ")
+	if err != nil {
+		ctx.Errorf("failed to JSON marshal dexpreopt compiler filters: %v", err)
+		return
+	}
+	android.WriteFileRule(ctx, dexpreoptCompilerFiltersPath(ctx), string(data))
+}
+
+// compilerFilterCounts returns the number of modules that are dexpreopted with each compiler filter,
+// as filter=count pairs sorted by filter.
+func compilerFilterCounts(filters map[string][]string) string {
+	var counts []string
+	for _, filter := range android.SortedKeys(filters) {
+		counts = append(counts, fmt.Sprintf("%s=%d", filter, len(filters[filter])))
+	}
+	return strings.Join(counts, " ")
+}
+
+func init() {
+	android.RegisterMakeVarsProvider(pctx, dexpreoptCompilerFiltersMakeVars)
+}
+
+func dexpreoptCompilerFiltersMakeVars(ctx android.MakeVarsContext) {
+	if dexpreoptAnalysisOnly(ctx.Config()) {
+		return
+	}
+	ctx.Strict("DEX_PREOPT_COMPILER_FILTER_COUNTS", compilerFilterCounts(dexpreoptCompilerFilters(ctx)))
+}
@@ -0,0 +1,98 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package java
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"android/soong/android"
+	"android/soong/dexpreopt"
+)
+
+func TestDexpreoptCompilerFilters(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForTestWithDexpreopt,
+		android.PrepareForTestAccessingMakeVars,
+		dexpreopt.FixtureSetSystemServerJars("platform:service-a"),
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.DefaultCompilerFilter = "space"
+			c.SpeedApps = []string{"speed-app"}
+		}),
+		android.FixtureAddFile("bar.prof", nil),
+	).RunTestWithBp(t, `
+		java_library {
+			name: "foo",
+			installable: true,
+			srcs: ["a.java"],
+		}
+
+		java_library {
+			name: "bar",
+			installable: true,
+			srcs: ["a.java"],
+			dex_preopt: {
+				profile: "bar.prof",
+			},
+		}
+
+		java_library {
+			name: "service-a",
+			installable: true,
+			srcs: ["a.java"],
+		}
+
+		android_app {
+			name: "speed-app",
+			srcs: ["a.java"],
+			sdk_version: "current",
+		}
+	`)
+
+	// The report must match the filters of the dexpreopt rules. The filter of modules that enforce
+	// their uses libraries is only downgraded to verify if the check fails when the rule runs.
+	for name, filter := range map[string]string{
+		"foo":       "space",
+		"bar":       "speed-profile",
+		"service-a": "speed",
+		"speed-app": "speed",
+	} {
+		command := result.ModuleForTests(name, "android_common").Rule("dexpreopt").RuleParams.Command
+		if !strings.Contains(command, "--compiler-filter="+filter+" ") && !strings.Contains(command, "else echo "+filter+" ; fi)") {
+			t.Errorf("%s: expected the dexpreopt rule to use the %s compiler filter, got %q", name, filter, command)
+		}
+	}
+
+	singleton := result.SingletonForTests("dex_bootjars")
+	report := android.ContentFromFileRuleForTests(t, result.TestContext, singleton.Output("out/soong/dexpreopt_arm64/compiler_filters.json"))
+	var filters map[string][]string
+	if err := json.Unmarshal([]byte(report), &filters); err != nil {
+		t.Fatalf("failed to parse the report: %s", err)
+	}
+	android.AssertArrayString(t, "space", []string{"foo"}, filters["space"])
+	android.AssertArrayString(t, "speed", []string{"service-a", "speed-app"}, filters["speed"])
+	android.AssertArrayString(t, "speed-profile", []string{"bar"}, filters["speed-profile"])
+
+	metrics := android.ContentFromFileRuleForTests(t, result.TestContext, singleton.Output("out/soong/dexpreopt_arm64/dexpreopt_metrics.json"))
+	android.AssertStringDoesContain(t, "metrics", metrics, `"compiler_filter_speed_count": 2`)
+
+	vars := result.MakeVarsForTesting(func(variable android.MakeVarVariable) bool {
+		return variable.Name() == "DEX_PREOPT_COMPILER_FILTER_COUNTS"
+	})
+	android.AssertIntEquals(t, "make vars", 1, len(vars))
+	android.AssertStringEquals(t, "DEX_PREOPT_COMPILER_FILTER_COUNTS", compilerFilterCounts(filters), vars[0].Value())
+	android.AssertStringDoesContain(t, "DEX_PREOPT_COMPILER_FILTER_COUNTS", vars[0].Value(), "speed=2 speed-profile=1")
+}
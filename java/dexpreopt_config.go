@@ -15,7 +15,14 @@
 package java
 
 import (
+	"encoding/json"
+	"fmt"
+	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 
 	"android/soong/android"
@@ -23,31 +30,210 @@ import (
 )
 
 // dexpreoptTargets returns the list of targets that are relevant to dexpreopting, which excludes architectures
-// supported through native bridge.
+// supported through native bridge and those that dex2oat does not support.
 func dexpreoptTargets(ctx android.PathContext) []android.Target {
+	targets := dexpreoptDeviceTargets(ctx)
+	// We may also need the images on host in order to run host-based tests.
+	for _, target := range ctx.Config().Targets[ctx.Config().BuildOS] {
+		targets = append(targets, target)
+	}
+
+	return targets
+}
+
+// dexpreoptDeviceTargets returns the device targets that are dexpreopted for, which excludes
+// architectures supported through native bridge and, if GlobalConfig.SupportedPreoptArches is set,
+// those that dex2oat does not support.
+func dexpreoptDeviceTargets(ctx android.PathContext) []android.Target {
 	var targets []android.Target
 	for _, target := range ctx.Config().Targets[android.Android] {
 		if target.NativeBridge == android.NativeBridgeDisabled {
 			targets = append(targets, target)
 		}
 	}
-	// We may also need the images on host in order to run host-based tests.
-	for _, target := range ctx.Config().Targets[ctx.Config().BuildOS] {
-		targets = append(targets, target)
+	return supportedPreoptTargets(ctx, targets)
+}
+
+// supportedPreoptTargets returns the given targets without those of architectures that are not in
+// GlobalConfig.SupportedPreoptArches, if it is set.
+func supportedPreoptTargets(ctx android.PathContext, targets []android.Target) []android.Target {
+	supported := dexpreopt.GetGlobalConfig(ctx).SupportedPreoptArches
+	if len(supported) == 0 {
+		return targets
+	}
+	var selected []android.Target
+	for _, target := range targets {
+		if android.InList(target.Arch.ArchType, supported) {
+			selected = append(selected, target)
+		}
+	}
+	return selected
+}
+
+// checkSupportedPreoptArches adds a warning for each device target that is not dexpreopted for as
+// its architecture is not in SupportedPreoptArches.
+func checkSupportedPreoptArches(ctx android.PathContext, global *dexpreopt.GlobalConfig) {
+	if len(global.SupportedPreoptArches) == 0 {
+		return
+	}
+	for _, target := range ctx.Config().Targets[android.Android] {
+		if target.NativeBridge == android.NativeBridgeDisabled && !android.InList(target.Arch.ArchType, global.SupportedPreoptArches) {
+			getDexpreoptWarnings(ctx).add(dexpreoptWarningUnsupportedPreoptArch, "SupportedPreoptArches",
+				fmt.Sprintf("target arch %s is not in SupportedPreoptArches, it is not dexpreopted", target.Arch.ArchType))
+		}
 	}
+}
 
-	return targets
+// systemServerPreoptTargets returns the device targets that system server jars are preopted for.
+// Unlike the boot images, they are only preopted for the primary target by default, as they are
+// only loaded by system_server, unless GlobalConfig.SystemServerPreoptArches is set.
+func systemServerPreoptTargets(ctx android.PathContext) []android.Target {
+	targets := dexpreoptDeviceTargets(ctx)
+
+	arches := dexpreopt.GetGlobalConfig(ctx).SystemServerPreoptArches
+	if len(arches) == 0 {
+		if len(targets) > 1 {
+			targets = targets[:1]
+		}
+		return targets
+	}
+	var selected []android.Target
+	for _, target := range targets {
+		if android.InList(target.Arch.ArchType, arches) {
+			selected = append(selected, target)
+		}
+	}
+	return selected
+}
+
+// dexpreoptConfigSource is the part of the build config that the boot image configs and the
+// classpaths are computed from. The real one is backed by the config of a PathContext, and tests can
+// use a fake to compute them for arbitrary global configs and targets.
+type dexpreoptConfigSource interface {
+	// pathContext returns the context to construct paths in.
+	pathContext() android.PathContext
+
+	globalConfig() *dexpreopt.GlobalConfig
+
+	// targets returns the targets that are relevant to dexpreopting, see dexpreoptTargets.
+	targets() []android.Target
+
+	// dexpreoptDirName returns the name of the directory for the dexpreopt outputs of the device.
+	dexpreoptDirName() string
+
+	// once returns the value for the key, computing it on first use.
+	once(key android.OnceKey, value func() interface{}) interface{}
+}
+
+// configSource returns the dexpreoptConfigSource backed by the config of the given context.
+func configSource(ctx android.PathContext) dexpreoptConfigSource {
+	return pathContextConfigSource{ctx}
+}
+
+type pathContextConfigSource struct {
+	ctx android.PathContext
+}
+
+func (s pathContextConfigSource) pathContext() android.PathContext {
+	return s.ctx
+}
+
+func (s pathContextConfigSource) globalConfig() *dexpreopt.GlobalConfig {
+	return dexpreopt.GetGlobalConfig(s.ctx)
+}
+
+func (s pathContextConfigSource) targets() []android.Target {
+	return dexpreoptTargets(s.ctx)
+}
+
+func (s pathContextConfigSource) dexpreoptDirName() string {
+	return dexpreopt.GetDexpreoptDirName(s.ctx)
+}
+
+func (s pathContextConfigSource) once(key android.OnceKey, value func() interface{}) interface{} {
+	return s.ctx.Config().Once(key, value)
+}
+
+// dexpreoptOnceKeys maps the names of the Once keys of the dexpreopt code in this package to the
+// places where they are defined.
+var dexpreoptOnceKeys = make(map[string]string)
+
+// newDexpreoptOnceKey returns a new Once key with the given name, and panics if the name is already
+// used by another dexpreopt Once key, so that a key that is copied without renaming it is caught at
+// init time rather than showing up as a confusing cached value.
+func newDexpreoptOnceKey(name string) android.OnceKey {
+	_, file, line, _ := runtime.Caller(1)
+	registerDexpreoptOnceKey(dexpreoptOnceKeys, name, fmt.Sprintf("%s:%d", filepath.Base(file), line))
+	return android.NewOnceKey(name)
+}
+
+func registerDexpreoptOnceKey(keys map[string]string, name, site string) {
+	if existing, ok := keys[name]; ok {
+		panic(fmt.Errorf("dexpreopt Once key %q is defined at both %s and %s", name, existing, site))
+	}
+	keys[name] = site
 }
 
 var (
-	bootImageConfigKey       = android.NewOnceKey("bootImageConfig")
-	bootImageConfigRawKey    = android.NewOnceKey("bootImageConfigRaw")
+	bootImageConfigKey       = newDexpreoptOnceKey("bootImageConfig")
+	bootImageConfigRawKey    = newDexpreoptOnceKey("bootImageConfigRaw")
 	frameworkBootImageName   = "boot"
 	mainlineBootImageName    = "mainline"
 	bootImageStem            = "boot"
 	ProfileInstallPathInApex = "etc/boot-image.prof"
 )
 
+// apexRef refers to an apex by the name under which it is activated on device (/apex/<name>), and
+// constructs the on-device paths of the files in it.
+type apexRef struct {
+	name string
+
+	// The directory of the jars in the apex, relative to its root, see
+	// GlobalConfig.ApexJavalibDirOverrides.
+	javalibSubdir string
+}
+
+func newApexRef(global *dexpreopt.GlobalConfig, name string) apexRef {
+	return apexRef{name: name, javalibSubdir: global.ApexJavalibDir(name)}
+}
+
+// javalibDir returns the on-device directory of the jars in the apex.
+func (a apexRef) javalibDir() string {
+	return filepath.Join("/apex", a.name, a.javalibSubdir)
+}
+
+// fileLocation returns the on-device location of the file at the given path relative to the root
+// of the apex. The files in the default directory of the jars are in the overridden one, if any.
+func (a apexRef) fileLocation(path string) string {
+	if rel, ok := strings.CutPrefix(path, dexpreopt.DefaultApexJavalibDir+"/"); ok {
+		return filepath.Join(a.javalibDir(), rel)
+	}
+	return filepath.Join("/apex", a.name, path)
+}
+
+// jarLocation returns the on-device location of the jar with the given stem in the apex.
+func (a apexRef) jarLocation(stem string) string {
+	return filepath.Join(a.javalibDir(), stem+".jar")
+}
+
+// imageDir returns the on-device directory of the boot image files for the given arch in the apex.
+func (a apexRef) imageDir(arch android.ArchType) string {
+	return filepath.Join(a.javalibDir(), arch.String())
+}
+
+var artApexRefKey = newDexpreoptOnceKey("artApexRef")
+
+// artApexRef returns a reference to the ART apex.
+func artApexRef(ctx android.PathContext) apexRef {
+	return artApexRefFromSource(configSource(ctx))
+}
+
+func artApexRefFromSource(src dexpreoptConfigSource) apexRef {
+	return src.once(artApexRefKey, func() interface{} {
+		return newApexRef(src.globalConfig(), artApexNames[0])
+	}).(apexRef)
+}
+
 // getImageNames returns an ordered list of image names. The order doesn't matter but needs to be
 // deterministic. The names listed here must match the map keys returned by genBootImageConfigs.
 func getImageNames() []string {
@@ -55,15 +241,22 @@ func getImageNames() []string {
 }
 
 func genBootImageConfigRaw(ctx android.PathContext) map[string]*bootImageConfig {
-	return ctx.Config().Once(bootImageConfigRawKey, func() interface{} {
-		global := dexpreopt.GetGlobalConfig(ctx)
+	return genBootImageConfigRawFromSource(configSource(ctx))
+}
+
+func genBootImageConfigRawFromSource(src dexpreoptConfigSource) map[string]*bootImageConfig {
+	return src.once(bootImageConfigRawKey, func() interface{} {
+		global := src.globalConfig()
 
 		artBootImageName := "art"           // Keep this local to avoid accidental references.
 		frameworkModules := global.BootJars // This includes `global.ArtApexJars`.
 		mainlineBcpModules := global.ApexBootJars
+		if len(global.SecondaryBootImageModules) > 0 {
+			mainlineBcpModules, _ = global.ApexBootJars.Filter(global.SecondaryBootImageModules)
+		}
 		frameworkSubdir := "system/framework"
 
-		profileImports := []string{"com.android.art"}
+		profileImports := []string{artApexRefFromSource(src).name}
 
 		// ART boot image for testing only. Do not rely on it to make any build-time decision.
 		artCfg := bootImageConfig{
@@ -111,17 +304,88 @@ func genBootImageConfigRaw(ctx android.PathContext) map[string]*bootImageConfig
 	}).(map[string]*bootImageConfig)
 }
 
+// prebuiltInputJars returns the map from the name of each of the jars that are in one of the given
+// prebuilt apexes to the path of its dex file relative to the root of the apex, or nil if there
+// are none.
+func prebuiltInputJars(modules android.ConfiguredJarList, prebuiltApexes []string) map[string]string {
+	var jars map[string]string
+	for i := 0; i < modules.Len(); i++ {
+		if android.InList(modules.Apex(i), prebuiltApexes) {
+			if jars == nil {
+				jars = make(map[string]string)
+			}
+			jars[modules.Jar(i)] = ApexRootRelativePathToJavaLib(modules.Jar(i))
+		}
+	}
+	return jars
+}
+
+// useStableBootDexJarPaths replaces the staged paths of the jars of the image in dexPaths and
+// dexPathsByModule with the paths in GlobalConfig.StableBootDexJarPaths, and records the jars in
+// image.unstagedJars. A jar is still staged if its stable path does not have the name of the staged
+// jar, or if it comes from a prebuilt apex. dexPaths stays aligned with the modules of the image.
+func useStableBootDexJarPaths(ctx android.PathContext, image *bootImageConfig, global *dexpreopt.GlobalConfig) {
+	if !global.SkipStagingOfStableBootJars {
+		return
+	}
+	for i := 0; i < image.modules.Len(); i++ {
+		jar := image.modules.Jar(i)
+		path, ok := global.StableBootDexJarPaths[jar]
+		if !ok || filepath.Base(path) != image.dexPaths[i].Base() {
+			continue
+		}
+		if _, prebuilt := image.prebuiltInputJars[jar]; prebuilt {
+			continue
+		}
+		output := android.PathForOutput(ctx, path)
+		image.dexPaths[i] = output
+		image.dexPathsByModule[jar] = output
+		if image.unstagedJars == nil {
+			image.unstagedJars = make(map[string]android.WritablePath)
+		}
+		image.unstagedJars[jar] = output
+	}
+}
+
 // Construct the global boot image configs.
 func genBootImageConfigs(ctx android.PathContext) map[string]*bootImageConfig {
-	return ctx.Config().Once(bootImageConfigKey, func() interface{} {
-		targets := dexpreoptTargets(ctx)
-		deviceDir := android.PathForOutput(ctx, dexpreopt.GetDexpreoptDirName(ctx))
+	return genBootImageConfigsFromSource(configSource(ctx))
+}
+
+func genBootImageConfigsFromSource(src dexpreoptConfigSource) map[string]*bootImageConfig {
+	return src.once(bootImageConfigKey, func() interface{} {
+		ctx := src.pathContext()
+		targets := src.targets()
+		deviceDir := android.PathForOutput(ctx, src.dexpreoptDirName())
+
+		configs := genBootImageConfigRawFromSource(src)
+
+		// Set the fields that ContentHash covers before any of the hashes is taken, as the hash of an
+		// image covers the image it extends.
+		for _, c := range configs {
+			c.seed = src.globalConfig().BootImageSeed
 
-		configs := genBootImageConfigRaw(ctx)
+			c.dex2oatBinaryByArch = make(map[android.ArchType]string)
+			for _, target := range targets {
+				arch := target.Arch.ArchType
+				if binary, ok := src.globalConfig().Dex2oatBinaryByArch[arch]; ok {
+					c.dex2oatBinaryByArch[arch] = binary
+				}
+			}
+		}
 
 		for _, c := range configs {
 			c.dir = deviceDir.Join(ctx, "dex_"+c.name+"jars")
-			c.symbolsDir = deviceDir.Join(ctx, "dex_"+c.name+"jars_unstripped")
+			if !src.globalConfig().DisableBootImageSymbols {
+				c.symbolsDir = deviceDir.Join(ctx, "dex_"+c.name+"jars_unstripped")
+			}
+			if src.globalConfig().ContentAddressedBootImageDir {
+				hash := c.ContentHash(src.globalConfig(), targets)
+				c.dir = c.dir.Join(ctx, hash)
+				if c.hasSymbols() {
+					c.symbolsDir = c.symbolsDir.Join(ctx, hash)
+				}
+			}
 
 			// expands to <stem>.art for primary image and <stem>-<1st module>.art for extension
 			imageName := c.firstModuleNameOrStem(ctx) + ".art"
@@ -130,9 +394,19 @@ func genBootImageConfigs(ctx android.PathContext) map[string]*bootImageConfig {
 			// GenerateAndroidBuildAction time, before the bootclasspath modules have been compiled.
 			// Set up known paths for them, the singleton rules will copy them there.
 			// TODO(b/143682396): use module dependencies instead
-			inputDir := deviceDir.Join(ctx, "dex_"+c.name+"jars_input")
-			c.dexPaths = c.modules.BuildPaths(ctx, inputDir)
-			c.dexPathsByModule = c.modules.BuildPathsByModule(ctx, inputDir)
+			c.inputDir = deviceDir.Join(ctx, "dex_"+c.name+"jars_input")
+			c.dexPaths, c.dexPathsByModule = bootJarBuildPaths(ctx, src.globalConfig(), c.modules, c.inputDir)
+			c.prebuiltInputJars = prebuiltInputJars(c.modules, src.globalConfig().PrebuiltBootJarApexes)
+			useStableBootDexJarPaths(ctx, c, src.globalConfig())
+			c.uncompressedModules = android.FilterListPred(c.modules.CopyOfJars(), func(jar string) bool {
+				return android.InList(jar, src.globalConfig().UncompressedBootJars)
+			})
+			c.profiledModules = c.modules.CopyOfJars()
+			if profiled := src.globalConfig().ProfiledBootModules; len(profiled) > 0 {
+				c.profiledModules = android.FilterListPred(c.profiledModules, func(jar string) bool {
+					return android.InList(jar, profiled)
+				})
+			}
 			c.dexPathsDeps = c.dexPaths
 
 			// Create target-specific variants.
@@ -145,13 +419,18 @@ func genBootImageConfigs(ctx android.PathContext) map[string]*bootImageConfig {
 					imagePathOnHost:   imageDir.Join(ctx, imageName),
 					imagePathOnDevice: filepath.Join("/", c.installDir, arch.String(), imageName),
 					imagesDeps:        c.moduleFiles(ctx, imageDir, ".art", ".oat", ".vdex"),
-					dexLocations:      c.modules.DevicePaths(ctx.Config(), target.Os),
+					dexLocations:      withOnDeviceLocationPrefix(src.globalConfig(), installedJarLocationsFromSource(src, bootclasspathOrigin, c.modules)),
 				}
 				variant.dexLocationsDeps = variant.dexLocations
+				variant.dex2oatThreads = dex2oatImageSetting(src.globalConfig().Dex2oatImageThreads, src.globalConfig().Dex2oatImageThreadsByArch, arch)
+				variant.dex2oatCpuSet = dex2oatImageSetting(src.globalConfig().Dex2oatImageCpuSet, src.globalConfig().Dex2oatImageCpuSetByArch, arch)
 				c.variants = append(c.variants, variant)
 			}
 
-			c.zip = c.dir.Join(ctx, c.name+".zip")
+			// The zip is built from the boot image files, so there is none when they are not generated.
+			if !src.globalConfig().DisablePreoptBootImages && shouldBuildBootImages(ctx.Config(), src.globalConfig()) {
+				c.zip = c.dir.Join(ctx, c.name+".zip")
+			}
 		}
 
 		visited := make(map[string]bool)
@@ -163,6 +442,15 @@ func genBootImageConfigs(ctx android.PathContext) map[string]*bootImageConfig {
 	}).(map[string]*bootImageConfig)
 }
 
+// dex2oatImageSetting returns the setting for the given architecture in byArch, if any, and the
+// default one otherwise.
+func dex2oatImageSetting(setting string, byArch map[android.ArchType]string, arch android.ArchType) string {
+	if value, ok := byArch[arch]; ok {
+		return value
+	}
+	return setting
+}
+
 // calculateDepsRecursive calculates the dependencies of the given boot image config and all its
 // ancestors, if they are not visited.
 // The boot images are supposed to form a tree, where the root is the primary boot image. We do not
@@ -194,6 +482,8 @@ func defaultBootImageConfig(ctx android.PathContext) *bootImageConfig {
 	return genBootImageConfigs(ctx)[frameworkBootImageName]
 }
 
+// mainlineBootImageConfig returns the config of the secondary boot image, which extends the default
+// boot image with the apex boot jars, or those in GlobalConfig.SecondaryBootImageModules.
 func mainlineBootImageConfig(ctx android.PathContext) *bootImageConfig {
 	return genBootImageConfigs(ctx)[mainlineBootImageName]
 }
@@ -225,12 +515,1511 @@ func bcpForDexpreopt(ctx android.PathContext, withUpdatable bool) (android.Writa
 	return dexPaths, dexLocations
 }
 
-var defaultBootclasspathKey = android.NewOnceKey("defaultBootclasspath")
+var allDexpreoptOutputDirsKey = newDexpreoptOnceKey("allDexpreoptOutputDirs")
 
-func init() {
-	android.RegisterMakeVarsProvider(pctx, dexpreoptConfigMakevars)
+// allDexpreoptOutputDirs returns the output directories of all the boot image configs, i.e. the
+// directories of the image files, of the image files with debug symbols and of the input jars,
+// deduplicated and sorted, for setting up and cleaning the output tree.
+func allDexpreoptOutputDirs(ctx android.PathContext) []android.OutputPath {
+	return ctx.Config().Once(allDexpreoptOutputDirsKey, func() interface{} {
+		dirsByPath := make(map[string]android.OutputPath)
+		for _, name := range getImageNames() {
+			image := genBootImageConfigs(ctx)[name]
+			dirs := []android.OutputPath{image.dir, image.inputDir}
+			if image.hasSymbols() {
+				dirs = append(dirs, image.symbolsDir)
+			}
+			for _, dir := range dirs {
+				dirsByPath[dir.String()] = dir
+			}
+		}
+		dirs := make([]android.OutputPath, 0, len(dirsByPath))
+		for _, path := range android.SortedKeys(dirsByPath) {
+			dirs = append(dirs, dirsByPath[path])
+		}
+		return dirs
+	}).([]android.OutputPath)
 }
 
-func dexpreoptConfigMakevars(ctx android.MakeVarsContext) {
-	ctx.Strict("DEXPREOPT_BOOT_JARS_MODULES", strings.Join(defaultBootImageConfig(ctx).modules.CopyOfApexJarPairs(), ":"))
+// allBootInputJars returns the destinations that the boot jars are copied to before they are
+// compiled into the boot images, by module name, merged across all the boot image configs.
+//
+// Each boot image config copies its jars into its own input directory, so a module that is in more
+// than one boot image is copied more than once. In that case the destination for the default boot
+// image is returned. It is an error for such copies to have different file names.
+func allBootInputJars(ctx android.PathContext) map[string]android.WritablePath {
+	configs := genBootImageConfigs(ctx)
+	images := []*bootImageConfig{defaultBootImageConfig(ctx)}
+	for _, name := range getImageNames() {
+		if configs[name] != images[0] {
+			images = append(images, configs[name])
+		}
+	}
+	jars, err := mergeBootInputJars(images)
+	if err != nil {
+		android.ReportPathErrorf(ctx, "%s", err)
+	}
+	return jars
+}
+
+// sharedInputJars returns the input jars that the two given boot image configs have in common, by
+// module name, i.e. the modules whose dex jar is at the same path in both, so that the jar needs to
+// be copied only once.
+func sharedInputJars(a, b *bootImageConfig) map[string]android.WritablePath {
+	shared := make(map[string]android.WritablePath)
+	for module, path := range a.dexPathsByModule {
+		if other, ok := b.dexPathsByModule[module]; ok && other.String() == path.String() {
+			shared[module] = path
+		}
+	}
+	return shared
+}
+
+// bootJarImpact returns the names of the boot image variants whose modules change if the given
+// boot jar is removed, i.e. the variants of the images that contain it, in image and variant order.
+// See removalBreaksRequiredArtModuleOrder for whether the removal breaks RequiredArtModuleOrder.
+func bootJarImpact(ctx android.PathContext, module string) []string {
+	var variants []string
+	for _, name := range getImageNames() {
+		image := genBootImageConfigs(ctx)[name]
+		if android.InList(module, image.modules.CopyOfJars()) {
+			for _, variant := range image.variants {
+				variants = append(variants, variant.variantName())
+			}
+		}
+	}
+	return variants
+}
+
+// removalBreaksRequiredArtModuleOrder returns true if the modules of the art boot image start with
+// GlobalConfig.RequiredArtModuleOrder, but would not if the given boot jar was removed.
+func removalBreaksRequiredArtModuleOrder(ctx android.PathContext, module string) bool {
+	required := dexpreopt.GetGlobalConfig(ctx).RequiredArtModuleOrder
+	if len(required) == 0 {
+		return false
+	}
+	startsWithRequired := func(modules []string) bool {
+		return len(modules) >= len(required) && slices.Equal(modules[:len(required)], required)
+	}
+	modules := genBootImageConfigs(ctx)["art"].modules.CopyOfJars()
+	return startsWithRequired(modules) && !startsWithRequired(android.RemoveListFromList(modules, []string{module}))
+}
+
+// bootImageInputsDepFilePath returns the path to the dependency file that lists all the boot image
+// input jars, for tools outside of the build that package the boot images.
+func bootImageInputsDepFilePath(ctx android.PathContext) android.WritablePath {
+	return android.PathForOutput(ctx, dexpreopt.GetDexpreoptDirName(ctx), "bootimage.inputs.d")
+}
+
+// buildBootImageInputsDepFile generates a rule to write the file returned by
+// bootImageInputsDepFilePath, in the Make dependency file format, with the file itself as the
+// target and the jars returned by allBootInputJars as its dependencies, sorted by module name.
+func buildBootImageInputsDepFile(ctx android.SingletonContext) {
+	path := bootImageInputsDepFilePath(ctx)
+	jars := allBootInputJars(ctx)
+	lines := []string{artifactPathString(ctx, path) + ":"}
+	for _, module := range android.SortedKeys(jars) {
+		lines = append(lines, " "+artifactPathString(ctx, jars[module]))
+	}
+	android.WriteFileRule(ctx, path, strings.Join(lines, " \\\n"))
+}
+
+// mergeBootInputJars merges the destinations of the boot jars of the given boot image configs,
+// preferring the destinations of the earlier configs.
+func mergeBootInputJars(images []*bootImageConfig) (map[string]android.WritablePath, error) {
+	jars := make(map[string]android.WritablePath)
+	for _, image := range images {
+		for _, module := range android.SortedKeys(image.dexPathsByModule) {
+			path := image.dexPathsByModule[module]
+			if existing, ok := jars[module]; !ok {
+				jars[module] = path
+			} else if existing.Base() != path.Base() {
+				return nil, fmt.Errorf("boot jar %q is copied to conflicting destinations %s and %s",
+					module, existing, path)
+			}
+		}
+	}
+	return jars, nil
+}
+
+// stemOfModule returns the stem of the given jar, taking into account the module that provides it.
+//
+// The module may be nil, or its stem may not have been resolved yet, e.g. in early mutator phases.
+// In that case the stem is the one returned by jarStem.
+func stemOfModule(ctx android.PathContext, module android.Module, apex, jar string) string {
+	if m, ok := module.(interface{ resolvedStem() (string, bool) }); ok {
+		if stem, ok := m.resolvedStem(); ok {
+			return stem
+		}
+	}
+	return jarStem(ctx, dexpreopt.GetGlobalConfig(ctx), apex, jar)
+}
+
+// jarStem returns the stem of the given boot class path jar when the module that provides it is not
+// known, which is the case for all the paths in the boot image configs. It is the one in
+// GlobalConfig.StemFallbacks, and otherwise the configured stem of the jar, which is the module name
+// unless it is overridden.
+func jarStem(ctx android.PathContext, global *dexpreopt.GlobalConfig, apex, jar string) string {
+	if stem, ok := global.StemFallbacks[jar]; ok {
+		return stem
+	}
+	return android.ModuleStem(ctx.Config(), apex, jar)
+}
+
+// bootJarBuildPaths returns the paths in the given directory that the given jars are staged to,
+// in order and by module, named after their stems, see jarStem.
+func bootJarBuildPaths(ctx android.PathContext, global *dexpreopt.GlobalConfig, jars *android.ConfiguredJarList,
+	dir android.OutputPath) (android.WritablePaths, map[string]android.WritablePath) {
+	paths := make(android.WritablePaths, jars.Len())
+	byModule := make(map[string]android.WritablePath, jars.Len())
+	for i := 0; i < jars.Len(); i++ {
+		paths[i] = dir.Join(ctx, jarStem(ctx, global, jars.Apex(i), jars.Jar(i))+".jar")
+		byModule[jars.Jar(i)] = paths[i]
+	}
+	return paths, byModule
+}
+
+var defaultBootclasspathKey = newDexpreoptOnceKey("defaultBootclasspath")
+
+// allBootclasspathJars returns the (apex, jar) pairs for all the jars on the boot class path, in
+// classpath order. Unlike the boot image configs, this includes the classpath-only apex jars.
+func allBootclasspathJars(global *dexpreopt.GlobalConfig) android.ConfiguredJarList {
+	jars := global.BootJars.AppendList(&global.ApexBootJars)
+	return jars.AppendList(&global.ClasspathOnlyApexJars)
+}
+
+// defaultBootclasspath returns the on-device locations of all the jars on the boot class path, in
+// classpath order. They are the locations of the entries of annotatedBootclasspathFromSource.
+func defaultBootclasspath(ctx android.PathContext) []string {
+	return defaultBootclasspathFromSource(configSource(ctx))
+}
+
+func defaultBootclasspathFromSource(src dexpreoptConfigSource) []string {
+	return src.once(defaultBootclasspathKey, func() interface{} {
+		entries := annotatedBootclasspathFromSource(src)
+		locations := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			locations = append(locations, entry.Location)
+		}
+		return locations
+	}).([]string)
+}
+
+// isBootclasspathJar returns true if the jar is on the boot class path, regardless of whether it is
+// compiled into a boot image or not.
+func isBootclasspathJar(ctx android.PathContext, jar string) bool {
+	jars := allBootclasspathJars(dexpreopt.GetGlobalConfig(ctx))
+	return jars.ContainsJar(jar)
+}
+
+var bootclasspathIndexKey = newDexpreoptOnceKey("bootclasspathIndex")
+
+// bootclasspathIndex returns the index of each jar on the boot class path, in classpath order. The
+// indices count the classpath entries, including the classpath-only apex jars, rather than the
+// modules of a boot image. Each jar is keyed by its apex:jar pair, by its name and by its stem,
+// where the first jar on the boot class path wins if several have the same name or stem.
+func bootclasspathIndex(ctx android.PathContext) map[string]int {
+	return ctx.Config().Once(bootclasspathIndexKey, func() interface{} {
+		jars := allBootclasspathJars(dexpreopt.GetGlobalConfig(ctx))
+		index := make(map[string]int, 2*jars.Len())
+		add := func(key string, i int) {
+			if _, ok := index[key]; !ok {
+				index[key] = i
+			}
+		}
+		for i := 0; i < jars.Len(); i++ {
+			add(jars.Apex(i)+":"+jars.Jar(i), i)
+			add(jars.Jar(i), i)
+		}
+		// The stems come last, so that they do not shadow the name of another jar.
+		for i := 0; i < jars.Len(); i++ {
+			add(stemOfModule(ctx, nil, jars.Apex(i), jars.Jar(i)), i)
+		}
+		return index
+	}).(map[string]int)
+}
+
+// bootclasspathIndexOf returns the index of the given jar on the boot class path, see
+// bootclasspathIndex, or false if it is not on the boot class path. The jar may be given by its
+// apex:jar pair, its name or its stem.
+func bootclasspathIndexOf(ctx android.PathContext, jar string) (int, bool) {
+	i, ok := bootclasspathIndex(ctx)[jar]
+	return i, ok
+}
+
+// stringSet returns a set of the given strings, for lookups that would otherwise be linear in the
+// length of a jar list.
+func stringSet(list []string) map[string]bool {
+	set := make(map[string]bool, len(list))
+	for _, s := range list {
+		set[s] = true
+	}
+	return set
+}
+
+// bootclasspathFragments returns the jars of the default boot image grouped by the apex that
+// contributes them, in boot image order. The apex is derived from the on-device location of each
+// jar, and jars that are not in an apex are grouped under "platform".
+func bootclasspathFragments(ctx android.PathContext) map[string][]string {
+	fragments := make(map[string][]string)
+	for _, pair := range defaultBootImageConfig(ctx).ModuleLocations() {
+		apex := "platform"
+		location := trimOnDeviceLocationPrefix(dexpreopt.GetGlobalConfig(ctx), pair.Location)
+		if rest, ok := strings.CutPrefix(location, "/apex/"); ok {
+			apex, _, _ = strings.Cut(rest, "/")
+		}
+		fragments[apex] = append(fragments[apex], pair.Module)
+	}
+	return fragments
+}
+
+var bootJarApexCountKey = newDexpreoptOnceKey("bootJarApexCount")
+
+// bootJarApexCount returns the number of distinct apexes that contribute jars to the default boot
+// image, counting "platform" as one.
+func bootJarApexCount(ctx android.PathContext) int {
+	return ctx.Config().Once(bootJarApexCountKey, func() interface{} {
+		return len(bootclasspathFragments(ctx))
+	}).(int)
+}
+
+var totalBootJarCountKey = newDexpreoptOnceKey("totalBootJarCount")
+
+// totalBootJarCount returns the number of distinct jars in the boot jars, the ART apex jars and the
+// apex boot jars, including the apex boot jars that are not in any boot image.
+func totalBootJarCount(ctx android.PathContext) int {
+	return ctx.Config().Once(totalBootJarCountKey, func() interface{} {
+		global := dexpreopt.GetGlobalConfig(ctx)
+		var jars []string
+		jars = append(jars, global.BootJars.CopyOfJars()...)
+		jars = append(jars, global.ArtApexJars.CopyOfJars()...)
+		jars = append(jars, global.ApexBootJars.CopyOfJars()...)
+		return len(android.FirstUniqueStrings(jars))
+	}).(int)
+}
+
+var bootJarPathByLocationKey = newDexpreoptOnceKey("bootJarPathByLocation")
+
+// unavailableBootJarPath is written to the boot jar paths file for the locations that have no
+// build-time jar.
+const unavailableBootJarPath = "UNAVAILABLE"
+
+// bootJarLocationsAndPaths returns the on-device locations of the jars of the default boot image and
+// of the classpath-only apex jars, in classpath order, and the build-time paths of the jars. The
+// classpath-only apex jars have no build-time jar, so their paths are nil.
+func bootJarLocationsAndPaths(ctx android.PathContext) ([]string, android.Paths) {
+	image := defaultBootImageConfig(ctx)
+	locations := append([]string(nil), image.getAnyAndroidVariant().dexLocations...)
+	paths := append(android.Paths(nil), image.dexPaths.Paths()...)
+	global := dexpreopt.GetGlobalConfig(ctx)
+	classpathOnlyLocations := installedJarLocations(ctx, bootclasspathOrigin, &global.ClasspathOnlyApexJars)
+	for _, location := range withOnDeviceLocationPrefix(global, classpathOnlyLocations) {
+		locations = append(locations, location)
+		paths = append(paths, nil)
+	}
+	return locations, paths
+}
+
+// bootJarPathByLocation returns the build-time paths of the boot jars by on-device location, for
+// constructing -Xbootclasspath arguments on host. The locations that have no build-time jar map to
+// nil.
+func bootJarPathByLocation(ctx android.PathContext) map[string]android.Path {
+	return ctx.Config().Once(bootJarPathByLocationKey, func() interface{} {
+		locations, paths := bootJarLocationsAndPaths(ctx)
+		pathByLocation := make(map[string]android.Path, len(locations))
+		for i, location := range locations {
+			pathByLocation[location] = paths[i]
+		}
+		return pathByLocation
+	}).(map[string]android.Path)
+}
+
+// bootJarPathsByLocationPath returns the path to the file that lists the on-device location and the
+// build-time path of each boot jar, in classpath order, one per line.
+func bootJarPathsByLocationPath(ctx android.PathContext) android.WritablePath {
+	return android.PathForOutput(ctx, dexpreopt.GetDexpreoptDirName(ctx), "boot_jar_paths_by_location.txt")
+}
+
+// buildBootJarPathsByLocation generates a rule to write the file returned by
+// bootJarPathsByLocationPath.
+func buildBootJarPathsByLocation(ctx android.SingletonContext) {
+	locations, paths := bootJarLocationsAndPaths(ctx)
+	lines := make([]string, 0, len(locations))
+	for i, location := range locations {
+		path := unavailableBootJarPath
+		if paths[i] != nil {
+			path = artifactPathString(ctx, paths[i])
+		}
+		lines = append(lines, location+" "+path)
+	}
+	android.WriteFileRule(ctx, bootJarPathsByLocationPath(ctx), strings.Join(lines, "\n"))
+}
+
+// bootJarsListPath returns the path to the file that lists the modules of the default boot image,
+// in image order, one per line.
+func bootJarsListPath(ctx android.PathContext) android.WritablePath {
+	return android.PathForOutput(ctx, dexpreopt.GetDexpreoptDirName(ctx), "boot_jars.txt")
+}
+
+// buildBootJarsList generates a rule to write the file returned by bootJarsListPath.
+func buildBootJarsList(ctx android.SingletonContext) {
+	android.WriteFileRule(ctx, bootJarsListPath(ctx), strings.Join(defaultBootImageConfig(ctx).modules.CopyOfJars(), "\n"))
+}
+
+// artifactPathString returns the given build path as it is serialized in the artifacts written by
+// this package. If GlobalConfig.RelativeArtifactPaths is set, paths in the output directory are
+// made relative to the build root, with the output directory as "out".
+func artifactPathString(ctx android.PathContext, path android.Path) string {
+	if !dexpreopt.GetGlobalConfig(ctx).RelativeArtifactPaths {
+		return path.String()
+	}
+	rel, err := filepath.Rel(ctx.Config().OutDir(), path.String())
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return path.String()
+	}
+	return filepath.Join("out", rel)
+}
+
+var systemServerClasspathKey = newDexpreoptOnceKey("systemServerClasspath")
+
+// systemServerClasspath returns the on-device locations of the jars on the system server class path
+// (SYSTEMSERVERCLASSPATH), in classpath order, or sorted if GlobalConfig.SortSystemServerClasspath
+// is set. If GlobalConfig.SystemServerClasspathOverride is set, it is returned verbatim instead.
+func systemServerClasspath(ctx android.PathContext) []string {
+	return systemServerClasspathFromSource(configSource(ctx))
+}
+
+func systemServerClasspathFromSource(src dexpreoptConfigSource) []string {
+	return src.once(systemServerClasspathKey, func() interface{} {
+		global := src.globalConfig()
+		if len(global.SystemServerClasspathOverride) > 0 {
+			return append([]string(nil), global.SystemServerClasspathOverride...)
+		}
+		apexJars := global.MergedApexSystemServerJars(src.pathContext())
+		jars := global.SystemServerJars.AppendList(&apexJars)
+		locations := installedJarLocationsFromSource(src, systemServerOrigin, &jars)
+		for _, entry := range global.ApkInApexSystemServerJars {
+			apex, _, path, err := parseApkInApexSystemServerJar(entry)
+			if err != nil {
+				android.ReportPathErrorf(src.pathContext(), "ApkInApexSystemServerJars: %s", err)
+				continue
+			}
+			locations = append(locations, newApexRef(global, apex).fileLocation(path))
+		}
+		if global.SortSystemServerClasspath {
+			sort.Strings(locations)
+		}
+		return withOnDeviceLocationPrefix(global, locations)
+	}).([]string)
+}
+
+// systemServerClasspathByApex returns the jars on the system server class path grouped by the apex
+// that contributes them, in classpath order. The jars in GlobalConfig.SystemServerJars are grouped
+// under "platform".
+func systemServerClasspathByApex(ctx android.PathContext) map[string][]string {
+	global := dexpreopt.GetGlobalConfig(ctx)
+	byApex := make(map[string][]string)
+	if jars := global.SystemServerJars.CopyOfJars(); len(jars) > 0 {
+		byApex["platform"] = jars
+	}
+	apexJars := global.MergedApexSystemServerJars(ctx)
+	for i := 0; i < apexJars.Len(); i++ {
+		apex := apexJars.Apex(i)
+		byApex[apex] = append(byApex[apex], apexJars.Jar(i))
+	}
+	return byApex
+}
+
+// parseApkInApexSystemServerJar parses an entry of GlobalConfig.ApkInApexSystemServerJars, e.g.
+// "com.android.foo:FooService:app/FooService/FooService.apk", into the apex, the apk and the path of
+// the apk relative to the root of the apex.
+func parseApkInApexSystemServerJar(entry string) (apex, apk, path string, err error) {
+	parts := strings.SplitN(entry, ":", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return "", "", "", fmt.Errorf("%q is not an apex:apk:path entry", entry)
+	}
+	apex, apk, path = parts[0], parts[1], parts[2]
+	if filepath.IsAbs(path) || path != filepath.Clean(path) || strings.HasPrefix(path, "../") {
+		return "", "", "", fmt.Errorf("the path %q of %q must be relative to the root of the apex", path, entry)
+	}
+	return apex, apk, path, nil
+}
+
+var allDexLocationsToModulesKey = newDexpreoptOnceKey("allDexLocationsToModules")
+
+// allDexLocationsToModules returns the module of every on-device dex location of the boot images
+// and the system server class path, by location, for attributing classes to modules offline.
+func allDexLocationsToModules(ctx android.PathContext) map[string]string {
+	return ctx.Config().Once(allDexLocationsToModulesKey, func() interface{} {
+		var pairs []moduleLocation
+		for _, name := range getImageNames() {
+			pairs = append(pairs, genBootImageConfigs(ctx)[name].ModuleLocations()...)
+		}
+		global := dexpreopt.GetGlobalConfig(ctx)
+		jars := global.AllSystemServerClasspathJars(ctx)
+		for i := 0; i < jars.Len(); i++ {
+			location := installedJarLocation(ctx, systemServerOrigin, jars.Apex(i), jars.Jar(i))
+			pairs = append(pairs, moduleLocation{
+				Module:   jars.Jar(i),
+				Location: withOnDeviceLocationPrefix(global, []string{location})[0],
+			})
+		}
+		locations, err := mergeDexLocationsToModules(pairs)
+		if err != nil {
+			android.ReportPathErrorf(ctx, "%s", err)
+		}
+		return locations
+	}).(map[string]string)
+}
+
+// mergeDexLocationsToModules returns the modules of the given pairs by location. A location may be
+// listed more than once, e.g. in more than one boot image, but only for the same module.
+func mergeDexLocationsToModules(pairs []moduleLocation) (map[string]string, error) {
+	locations := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		if existing, ok := locations[pair.Location]; !ok {
+			locations[pair.Location] = pair.Module
+		} else if existing != pair.Module {
+			return nil, fmt.Errorf("dex location %q is mapped to both %q and %q", pair.Location, existing, pair.Module)
+		}
+	}
+	return locations, nil
+}
+
+// jarOrigin is the kind of dexpreopt config list that a jar comes from, which determines how its
+// on-device location is resolved.
+type jarOrigin int
+
+const (
+	// The boot class path lists and the boot image modules. Their locations follow the
+	// ConfiguredJarLocationOverrides of the product and GlobalConfig.StemFallbacks.
+	bootclasspathOrigin jarOrigin = iota
+
+	// The system server jar lists. Their locations do not follow the overrides.
+	systemServerOrigin
+)
+
+// resolveInstalledJar returns the on-device directory and file name of the given jar from a list of
+// the given origin. All the on-device locations of jars in this package are derived from it, and for
+// system server jars it gives the same result as dexpreopt.GetSystemServerDexLocation.
+func resolveInstalledJar(ctx android.PathContext, origin jarOrigin, apex, jar string) (dir, filename string) {
+	dir, filename, _ = resolveAnnotatedInstalledJar(ctx, dexpreopt.GetGlobalConfig(ctx), origin, apex, jar)
+	return dir, filename
+}
+
+// resolveAnnotatedInstalledJar is like resolveInstalledJar for the given global config, but also
+// returns the transformations that moved the jar away from the location that its apex and name
+// imply, in the order they were applied.
+func resolveAnnotatedInstalledJar(ctx android.PathContext, global *dexpreopt.GlobalConfig, origin jarOrigin, apex, jar string) (dir, filename string, transformations []jarTransformation) {
+	if origin == bootclasspathOrigin {
+		newApex, _ := android.OverrideConfiguredJarLocationFor(ctx.Config(), apex, jar)
+		newJar := jarStem(ctx, global, apex, jar)
+		if newApex != apex {
+			transformations = append(transformations, jarTransformation{jarTransformationLocationOverride, apex, newApex})
+		}
+		if newJar != jar {
+			transformations = append(transformations, jarTransformation{jarTransformationStem, jar, newJar})
+		}
+		apex, jar = newApex, newJar
+	}
+	switch apex {
+	case "platform":
+		dir = "/system/framework"
+	case "system_ext":
+		dir = "/system_ext/framework"
+	default:
+		ref := newApexRef(global, apex)
+		if ref.javalibSubdir != dexpreopt.DefaultApexJavalibDir {
+			transformations = append(transformations, jarTransformation{jarTransformationJavalibDirOverride,
+				dexpreopt.DefaultApexJavalibDir, ref.javalibSubdir})
+		}
+		dir = ref.javalibDir()
+	}
+	return dir, jar + ".jar", transformations
+}
+
+// installedJarLocation returns the on-device location of the given jar, see resolveInstalledJar.
+func installedJarLocation(ctx android.PathContext, origin jarOrigin, apex, jar string) string {
+	return filepath.Join(resolveInstalledJar(ctx, origin, apex, jar))
+}
+
+// installedJarLocations returns the on-device locations of the given jars, see resolveInstalledJar.
+func installedJarLocations(ctx android.PathContext, origin jarOrigin, jars *android.ConfiguredJarList) []string {
+	return installedJarLocationsFromSource(configSource(ctx), origin, jars)
+}
+
+// installedJarLocationsFromSource is like installedJarLocations, but resolves the locations with the
+// global config of the given source.
+func installedJarLocationsFromSource(src dexpreoptConfigSource, origin jarOrigin, jars *android.ConfiguredJarList) []string {
+	locations := make([]string, 0, jars.Len())
+	for i := 0; i < jars.Len(); i++ {
+		dir, filename, _ := resolveAnnotatedInstalledJar(src.pathContext(), src.globalConfig(), origin, jars.Apex(i), jars.Jar(i))
+		locations = append(locations, filepath.Join(dir, filename))
+	}
+	return locations
+}
+
+// dexpreoptArtifactPartitions returns the partition images that dexpreopt artifacts are installed
+// into, which are "system" and the ones in GlobalConfig.DexpreoptArtifactPartitions.
+func dexpreoptArtifactPartitions(ctx android.PathContext) []string {
+	global := dexpreopt.GetGlobalConfig(ctx)
+	return android.FirstUniqueStrings(append([]string{"system"}, global.DexpreoptArtifactPartitions...))
+}
+
+// dexpreoptArtifactsAllowedFor returns true if dexpreopt artifacts are installed into the given
+// partition image.
+func dexpreoptArtifactsAllowedFor(ctx android.PathContext, partition string) bool {
+	return android.InList(partition, dexpreoptArtifactPartitions(ctx))
+}
+
+// partitionOfLocation returns the partition image that contains the given on-device location,
+// which may be relative to the root. Apexes are in the system partition image.
+func partitionOfLocation(location string) string {
+	partition, _, _ := strings.Cut(strings.TrimPrefix(location, "/"), "/")
+	if partition == "apex" {
+		return "system"
+	}
+	return partition
+}
+
+// withOnDeviceLocationPrefix returns the given on-device locations with
+// GlobalConfig.OnDeviceLocationPrefix prepended, or the locations unchanged if there is no prefix.
+func withOnDeviceLocationPrefix(global *dexpreopt.GlobalConfig, locations []string) []string {
+	if global.OnDeviceLocationPrefix == "" {
+		return locations
+	}
+	prefixed := make([]string, 0, len(locations))
+	for _, location := range locations {
+		prefixed = append(prefixed, filepath.Join(global.OnDeviceLocationPrefix, location))
+	}
+	return prefixed
+}
+
+// trimOnDeviceLocationPrefix returns the absolute on-device location for a location returned by
+// withOnDeviceLocationPrefix.
+func trimOnDeviceLocationPrefix(global *dexpreopt.GlobalConfig, location string) string {
+	if global.OnDeviceLocationPrefix == "" {
+		return location
+	}
+	return filepath.Join("/", strings.TrimPrefix(location, filepath.Clean(global.OnDeviceLocationPrefix)))
+}
+
+// versionedSystemServerClasspath is like systemServerClasspath, but the entries of jars delivered via
+// apex have an "@<version>" suffix if a version is configured for them in
+// GlobalConfig.UpdatableJarVersions.
+func versionedSystemServerClasspath(ctx android.PathContext) []string {
+	global := dexpreopt.GetGlobalConfig(ctx)
+	versions := make(map[string]string)
+	apexJars := global.MergedApexSystemServerJars(ctx)
+	for i := 0; i < apexJars.Len(); i++ {
+		jar := apexJars.Jar(i)
+		if version, ok := global.UpdatableJarVersions[jar]; ok {
+			location := installedJarLocation(ctx, systemServerOrigin, apexJars.Apex(i), jar)
+			versions[withOnDeviceLocationPrefix(global, []string{location})[0]] = version
+		}
+	}
+
+	classpath := systemServerClasspath(ctx)
+	versioned := make([]string, 0, len(classpath))
+	for _, location := range classpath {
+		if version, ok := versions[location]; ok {
+			location += "@" + version
+		}
+		versioned = append(versioned, location)
+	}
+	return versioned
+}
+
+// dexpreoptDryRun returns true if SOONG_DEXPREOPT_DRY_RUN is set, in which case the dexpreopt config
+// is computed and printed, and the make variables are emitted, but no boot image rules are
+// generated.
+func dexpreoptDryRun(config android.Config) bool {
+	return config.IsEnvTrue("SOONG_DEXPREOPT_DRY_RUN")
+}
+
+// dexpreoptAnalysisOnly returns true if soong_build only answers queries about the module graph,
+// e.g. writes the JSON module graph, rather than generating the build. The make variables, the
+// checks and the debug outputs of the dexpreopt config are then skipped, and no boot image rules are
+// generated, but the lazily computed config still works for anything that asks for it.
+func dexpreoptAnalysisOnly(config android.Config) bool {
+	switch config.BuildMode {
+	case android.GenerateQueryView, android.GenerateModuleGraph, android.GenerateDocFile:
+		return true
+	}
+	return false
+}
+
+// dexpreoptDryRunSummary returns the classpaths and the boot image module lists that are printed
+// in a dry run.
+func dexpreoptDryRunSummary(ctx android.PathContext) string {
+	exports := getClasspathExports(ctx)
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "PRODUCT_BOOTCLASSPATH=%s\n", strings.Join(exports.bootclasspath, ":"))
+	fmt.Fprintf(&sb, "DEX2OAT_BOOTCLASSPATH=%s\n", strings.Join(exports.dex2oatBootclasspath, ":"))
+	fmt.Fprintf(&sb, "SYSTEMSERVERCLASSPATH=%s\n", strings.Join(exports.systemServerClasspath, ":"))
+	for _, name := range getImageNames() {
+		modules := genBootImageConfigs(ctx)[name].modules
+		fmt.Fprintf(&sb, "DEXPREOPT_IMAGE_MODULES_%s=%s\n", name, strings.Join(modules.CopyOfApexJarPairs(), " "))
+	}
+	if dexpreopt.GetGlobalConfig(ctx).ExtendArtBootImage {
+		extension := extensionModules(ctx)
+		fmt.Fprintf(&sb, "DEXPREOPT_IMAGE_EXTENSION_MODULES=%s\n", strings.Join(extension.CopyOfApexJarPairs(), " "))
+	}
+	return sb.String()
+}
+
+// DiffBootDexLocations compares the on-device locations of the boot jars in the current config
+// against those in the baseline dexpreopt.config file at the given path, and returns the jars that
+// are in both configs but have moved, in the order of the current config. The locations of each
+// side are resolved with the GlobalConfig.ApexJavalibDirOverrides of that side, and are compared
+// without GlobalConfig.OnDeviceLocationPrefix.
+func DiffBootDexLocations(ctx android.PathContext, baselinePath string) (moved []struct{ Module, From, To string }, err error) {
+	ctx.AddNinjaFileDeps(baselinePath)
+	data, err := os.ReadFile(baselinePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read baseline dexpreopt config: %w", err)
+	}
+	baseline, err := dexpreopt.ParseGlobalConfig(ctx, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse baseline dexpreopt config %s: %w", baselinePath, err)
+	}
+
+	baselineJars := allBootclasspathJars(baseline)
+	baselineLocationByJar := make(map[string]string, baselineJars.Len())
+	for i := 0; i < baselineJars.Len(); i++ {
+		dir, filename, _ := resolveAnnotatedInstalledJar(ctx, baseline, bootclasspathOrigin, baselineJars.Apex(i), baselineJars.Jar(i))
+		baselineLocationByJar[baselineJars.Jar(i)] = filepath.Join(dir, filename)
+	}
+
+	jars := allBootclasspathJars(dexpreopt.GetGlobalConfig(ctx))
+	for i, location := range defaultBootclasspath(ctx) {
+		jar := jars.Jar(i)
+		if from, ok := baselineLocationByJar[jar]; ok && from != location {
+			moved = append(moved, struct{ Module, From, To string }{Module: jar, From: from, To: location})
+		}
+	}
+	return moved, nil
+}
+
+var dexpreoptExplainKey = newDexpreoptOnceKey("dexpreoptExplain")
+
+// dexpreoptExplain returns a list of human readable explanations of the decisions that were made
+// when computing the dexpreopt config, e.g. why a boot jar is not in any boot image.
+func dexpreoptExplain(ctx android.PathContext) []string {
+	return ctx.Config().OnceStringSlice(dexpreoptExplainKey, func() []string {
+		global := dexpreopt.GetGlobalConfig(ctx)
+		var lines []string
+		for _, pair := range global.ClasspathOnlyApexJars.CopyOfApexJarPairs() {
+			lines = append(lines, fmt.Sprintf("%s: not in any boot image: classpath-only apex jar", pair))
+		}
+		lines = append(lines, getDexpreoptStatus(ctx).reasons...)
+		lines = append(lines, updatableBootLocationsDiff(ctx)...)
+		for _, name := range getImageNames() {
+			image := genBootImageConfigs(ctx)[name]
+			for i := 0; i < image.modules.Len(); i++ {
+				if path, ok := image.unstagedJars[image.modules.Jar(i)]; ok {
+					lines = append(lines, fmt.Sprintf("%s:%s: not staged for the %s boot image: uses the module output %s",
+						image.modules.Apex(i), image.modules.Jar(i), name, path))
+				}
+			}
+		}
+		systemServerJars := global.AllSystemServerJars(ctx)
+		denylist := global.PreoptDenylist()
+		for i := 0; i < systemServerJars.Len(); i++ {
+			apex, jar := systemServerJars.Apex(i), systemServerJars.Jar(i)
+			if entry, ok := denylist.Match(jar); ok {
+				lines = append(lines, fmt.Sprintf("%s:%s: not preopted: matches DisablePreoptModules entry %q", apex, jar, entry))
+			}
+			if profile, ok := systemServerProfileInstallPath(ctx, global, apex, jar); ok {
+				lines = append(lines, fmt.Sprintf("%s:%s: profile installed to %s", apex, jar, profile))
+			}
+		}
+		return lines
+	})
+}
+
+// dexpreoptExplainPath returns the path to the file that lists the explanations returned by
+// dexpreoptExplain.
+func dexpreoptExplainPath(ctx android.PathContext) android.WritablePath {
+	return android.PathForOutput(ctx, dexpreopt.GetDexpreoptDirName(ctx), "dexpreopt_explain.txt")
+}
+
+// systemServerJarsManifestEntry describes a system server jar delivered via an apex.
+type systemServerJarsManifestEntry struct {
+	Module   string `json:"module"`
+	Apex     string `json:"apex"`
+	Location string `json:"location"`
+	Profile  string `json:"profile,omitempty"`
+
+	// The 1-based rank of the jar in GlobalConfig.PreoptPriorityJars, or 0 if it is not in it.
+	Priority int `json:"priority,omitempty"`
+}
+
+// priorityFor returns the preopt priority of the given jar, which is its index in
+// GlobalConfig.PreoptPriorityJars, or the length of the list if it is not in it. The rules for the
+// jars with the lowest values are registered first.
+func priorityFor(ctx android.PathContext, jar string) int {
+	priorityJars := dexpreopt.GetGlobalConfig(ctx).PreoptPriorityJars
+	if i := android.IndexList(jar, priorityJars); i >= 0 {
+		return i
+	}
+	return len(priorityJars)
+}
+
+// sortByPreoptPriority sorts the given jars by priorityFor, keeping the order of the jars with the
+// same priority.
+func sortByPreoptPriority(ctx android.PathContext, jars []string) {
+	// Look up each priority once rather than in every comparison.
+	priorities := make(map[string]int, len(jars))
+	for _, jar := range jars {
+		priorities[jar] = priorityFor(ctx, jar)
+	}
+	sort.SliceStable(jars, func(i, j int) bool {
+		return priorities[jars[i]] < priorities[jars[j]]
+	})
+}
+
+// systemServerProfileInstallPath returns the install path of the profile of the given system server
+// jar, if it is listed in GlobalConfig.SystemServerJarsWithProfiles. The profile of a jar delivered
+// via an apex is built by the apex, so its path is relative to the root of the apex. The profile of
+// a platform jar is installed next to the jar.
+func systemServerProfileInstallPath(ctx android.PathContext, global *dexpreopt.GlobalConfig, apex, jar string) (string, bool) {
+	if !android.InList(jar, global.SystemServerJarsWithProfiles) {
+		return "", false
+	}
+	dir, filename := resolveInstalledJar(ctx, systemServerOrigin, apex, jar)
+	if !android.IsConfiguredJarForPlatform(apex) {
+		return filepath.Join(global.ApexJavalibDir(apex), filename+".prof"), true
+	}
+	return filepath.Join(dir, filename) + ".prof", true
+}
+
+// systemServerJarsManifest returns the entries of the system server jars manifest, one for each
+// system server jar delivered via an apex (including standalone ones), in config order.
+func systemServerJarsManifest(ctx android.PathContext) []systemServerJarsManifestEntry {
+	global := dexpreopt.GetGlobalConfig(ctx)
+	jars := global.AllApexSystemServerJars(ctx)
+	entries := make([]systemServerJarsManifestEntry, 0, jars.Len())
+	for i := 0; i < jars.Len(); i++ {
+		profile, _ := systemServerProfileInstallPath(ctx, global, jars.Apex(i), jars.Jar(i))
+		location := installedJarLocation(ctx, systemServerOrigin, jars.Apex(i), jars.Jar(i))
+		if !dexpreoptArtifactsAllowedFor(ctx, partitionOfLocation(location)) {
+			continue
+		}
+		entry := systemServerJarsManifestEntry{
+			Module:   jars.Jar(i),
+			Apex:     jars.Apex(i),
+			Location: location,
+			Profile:  profile,
+		}
+		if priority := priorityFor(ctx, jars.Jar(i)); priority < len(global.PreoptPriorityJars) {
+			entry.Priority = priority + 1
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// systemServerJarsManifestPath returns the path to the machine readable manifest that maps each
+// system server jar delivered via an apex to its apex and on-device location.
+func systemServerJarsManifestPath(ctx android.PathContext) android.WritablePath {
+	return android.PathForOutput(ctx, dexpreopt.GetDexpreoptDirName(ctx), "system_server_jars.json")
+}
+
+// buildSystemServerJarsManifest generates a rule to write the system server jars manifest.
+func buildSystemServerJarsManifest(ctx android.SingletonContext) {
+	data, err := json.MarshalIndent(systemServerJarsManifest(ctx), "", "    ")
+	if err != nil {
+		ctx.Errorf("failed to JSON marshal system server jars manifest: %v", err)
+		return
+	}
+	android.WriteFileRule(ctx, systemServerJarsManifestPath(ctx), string(data))
+}
+
+// classpathExports are the class paths that are exported to the environment of the device, as
+// on-device locations in classpath order.
+type classpathExports struct {
+	bootclasspath         []string // BOOTCLASSPATH
+	dex2oatBootclasspath  []string // DEX2OATBOOTCLASSPATH
+	systemServerClasspath []string // SYSTEMSERVERCLASSPATH
+}
+
+// getClasspathExports returns the class paths that are exported to the environment of the device.
+func getClasspathExports(ctx android.PathContext) classpathExports {
+	_, dex2oatBootclasspath := bcpForDexpreopt(ctx, dexpreopt.GetGlobalConfig(ctx).PreoptWithUpdatableBcp)
+	return classpathExports{
+		bootclasspath:         defaultBootclasspath(ctx),
+		dex2oatBootclasspath:  dex2oatBootclasspath,
+		systemServerClasspath: systemServerClasspath(ctx),
+	}
+}
+
+// initRcFragment returns the init.environ.rc lines that export the class paths. Empty class paths
+// are not exported.
+func (e classpathExports) initRcFragment() string {
+	var sb strings.Builder
+	for _, export := range []struct {
+		name      string
+		classpath []string
+	}{
+		{"BOOTCLASSPATH", e.bootclasspath},
+		{"DEX2OATBOOTCLASSPATH", e.dex2oatBootclasspath},
+		{"SYSTEMSERVERCLASSPATH", e.systemServerClasspath},
+	} {
+		if len(export.classpath) > 0 {
+			fmt.Fprintf(&sb, "export %s %s\n", export.name, strings.Join(export.classpath, ":"))
+		}
+	}
+	return sb.String()
+}
+
+// initClasspathExportsPath returns the path to the init.environ.rc fragment that exports the class
+// paths.
+func initClasspathExportsPath(ctx android.PathContext) android.WritablePath {
+	return android.PathForOutput(ctx, dexpreopt.GetDexpreoptDirName(ctx), "init_classpath_exports.rc")
+}
+
+// buildInitClasspathExports generates a rule to write the init.environ.rc fragment that exports the
+// class paths, unless GlobalConfig.DisableInitClasspathExports is set.
+func buildInitClasspathExports(ctx android.SingletonContext) {
+	if dexpreopt.GetGlobalConfig(ctx).DisableInitClasspathExports {
+		return
+	}
+	android.WriteFileRuleVerbatim(ctx, initClasspathExportsPath(ctx), getClasspathExports(ctx).initRcFragment())
+}
+
+// checkDexpreoptConfig checks the consistency of the dexpreopt config. It is called from the
+// dex_bootjars singleton so that errors are reported once and deterministically.
+func checkDexpreoptConfig(ctx android.SingletonContext) {
+	global := dexpreopt.GetGlobalConfig(ctx)
+	checkDeprecatedFields(ctx, global)
+	checkSupportedPreoptArches(ctx, global)
+	checkExpectedDisablePreopt(ctx, global)
+	checkClasspathOnlyApexJars(ctx, global)
+	checkApexSystemServerJarsInOneApex(ctx, global)
+	checkSystemServerJarsFragments(ctx, global)
+	checkCaseOnlyNameCollisions(ctx, global)
+	checkInstallDirStemCollisions(ctx)
+	checkBootImageModuleLocations(ctx)
+	checkEnabledBootImageVariants(ctx, global)
+	checkDex2oatBinaryByArch(ctx, global)
+	checkDex2oatImageThreads(ctx, global)
+	checkDisablePreoptModulesPatterns(ctx, global)
+	checkBootJarsNotStandaloneSystemServerJars(ctx, global)
+	checkSystemServerClasspathOverride(ctx, global)
+	checkBootclasspathAllowlist(ctx, global)
+	checkBootImageCompilerFilters(ctx, global)
+	checkAllowedBootJarApexes(ctx, global)
+	checkBootJarModuleAliases(ctx, global)
+	checkUncompressedBootJars(ctx, global)
+	checkApexJavalibDirOverrides(ctx, global)
+	checkExtensionModules(ctx, global)
+	checkDualClaims(ctx, global)
+	checkSecondaryBootImageModules(ctx, global)
+	checkPreoptApiLevel(ctx, global)
+	checkRequiredArtModuleOrder(ctx, global)
+	checkUpdatableBootLocations(ctx, global)
+	checkDexpreoptStateCache(ctx)
+	runDexpreoptValidations(ctx)
+}
+
+// checkExpectedDisablePreopt checks that DisablePreopt has the value in the EXPECT_DISABLE_PREOPT
+// environment variable, if it is set, so that CI can assert the preopt policy of a product.
+func checkExpectedDisablePreopt(ctx android.SingletonContext, global *dexpreopt.GlobalConfig) {
+	expected := ctx.Config().Getenv("EXPECT_DISABLE_PREOPT")
+	switch expected {
+	case "":
+	case "true", "false":
+		if actual := strconv.FormatBool(global.DisablePreopt); actual != expected {
+			ctx.Errorf("DisablePreopt is %s, but EXPECT_DISABLE_PREOPT is %s", actual, expected)
+		}
+	default:
+		ctx.Errorf("EXPECT_DISABLE_PREOPT must be true or false, got %q", expected)
+	}
+}
+
+// checkClasspathOnlyApexJars checks that the classpath-only apex jars are in apexes, and that they
+// are not also configured to be compiled into a boot image.
+func checkClasspathOnlyApexJars(ctx android.SingletonContext, global *dexpreopt.GlobalConfig) {
+	otherLists := []struct {
+		name string
+		jars android.ConfiguredJarList
+	}{
+		{"BootJars", global.BootJars},
+		{"ApexBootJars", global.ApexBootJars},
+		{"ArtApexJars", global.ArtApexJars},
+		{"TestOnlyArtBootImageJars", global.TestOnlyArtBootImageJars},
+	}
+	otherJars := make([]map[string]bool, len(otherLists))
+	for i, other := range otherLists {
+		otherJars[i] = stringSet(other.jars.CopyOfJars())
+	}
+	jars := global.ClasspathOnlyApexJars
+	for i := 0; i < jars.Len(); i++ {
+		apex, jar := jars.Apex(i), jars.Jar(i)
+		if android.IsConfiguredJarForPlatform(apex) {
+			ctx.Errorf("Classpath-only apex jar %q must be in an apex, but is in %q", jar, apex)
+		}
+		for j, other := range otherLists {
+			if otherJars[j][jar] {
+				ctx.Errorf("Classpath-only apex jar %q must not also be listed in %s", jar, other.name)
+			}
+		}
+	}
+}
+
+// checkApexSystemServerJarsInOneApex checks that no apex system server jar is listed under more
+// than one apex, which would put the same module on the system server classpath twice.
+func checkApexSystemServerJarsInOneApex(ctx android.SingletonContext, global *dexpreopt.GlobalConfig) {
+	jars := global.AllApexSystemServerJars(ctx)
+	apexOfJar := make(map[string]string, jars.Len())
+	for i := 0; i < jars.Len(); i++ {
+		apex, jar := jars.Apex(i), jars.Jar(i)
+		if other, ok := apexOfJar[jar]; ok && other != apex {
+			ctx.Errorf("Apex system server jar %q is listed under more than one apex: %q and %q", jar, other, apex)
+			continue
+		}
+		apexOfJar[jar] = apex
+	}
+}
+
+// checkCaseOnlyNameCollisions checks that no two jars that are staged into the same directory have
+// file names that differ only by case, as one would silently overwrite the other on a
+// case-insensitive file system.
+func checkCaseOnlyNameCollisions(ctx android.SingletonContext, global *dexpreopt.GlobalConfig) {
+	for _, name := range getImageNames() {
+		modules := genBootImageConfigs(ctx)[name].modules
+		stems := make([]string, modules.Len())
+		for i := 0; i < modules.Len(); i++ {
+			stems[i] = stemOfModule(ctx, nil, modules.Apex(i), modules.Jar(i))
+		}
+		reportCaseOnlyNameCollisions(ctx, name+" boot image", stems)
+	}
+	reportCaseOnlyNameCollisions(ctx, "System server", global.AllSystemServerJars(ctx).CopyOfJars())
+}
+
+func reportCaseOnlyNameCollisions(ctx android.SingletonContext, what string, names []string) {
+	seen := make(map[string]string, len(names))
+	for _, name := range names {
+		key := strings.ToLower(name)
+		if other, ok := seen[key]; ok && other != name {
+			ctx.Errorf("%s jars %q and %q differ only by case", what, other, name)
+			continue
+		}
+		seen[key] = name
+	}
+}
+
+// checkInstallDirStemCollisions checks that no two boot image modules have the same stem and are
+// installed to the same directory on device, as one would overwrite the other. A module that is in
+// more than one boot image is only counted once.
+func checkInstallDirStemCollisions(ctx android.SingletonContext) {
+	moduleByLocation := make(map[string]string)
+	for _, name := range getImageNames() {
+		modules := genBootImageConfigs(ctx)[name].modules
+		locations := installedJarLocations(ctx, bootclasspathOrigin, &modules)
+		for i := 0; i < modules.Len(); i++ {
+			module := modules.Jar(i)
+			if other, ok := moduleByLocation[locations[i]]; ok && other != module {
+				ctx.Errorf("Boot image modules %q and %q have the same stem %q and are both installed to %s",
+					other, module, stemOfModule(ctx, nil, modules.Apex(i), module), filepath.Dir(locations[i]))
+				continue
+			}
+			moduleByLocation[locations[i]] = module
+		}
+	}
+}
+
+// checkBootImageModuleLocations checks that the boot images that share a module resolve it to the
+// same on-device location, as a device loads each jar from one location. The only exception is an
+// ART apex jar in a boot image that is installed into an apex, like the art boot image, which may
+// have a different location from that in the boot images on the system partition.
+func checkBootImageModuleLocations(ctx android.SingletonContext) {
+	artJars := dexpreopt.GetGlobalConfig(ctx).ArtApexJars
+	type resolution struct{ image, location string }
+	resolutions := make(map[string][]resolution)
+	var modules []string
+	for _, name := range getImageNames() {
+		image := genBootImageConfigs(ctx)[name]
+		if image.getAnyAndroidVariant() == nil {
+			continue
+		}
+		for _, pair := range image.ModuleLocations() {
+			if _, ok := resolutions[pair.Module]; !ok {
+				modules = append(modules, pair.Module)
+			}
+			resolutions[pair.Module] = append(resolutions[pair.Module], resolution{name, pair.Location})
+		}
+	}
+
+	for _, module := range modules {
+		var locations, resolved []string
+		for _, r := range resolutions[module] {
+			resolved = append(resolved, r.image+": "+r.location)
+			if genBootImageConfigs(ctx)[r.image].installedInApex() && artJars.ContainsJar(module) {
+				continue
+			}
+			locations = append(locations, r.location)
+		}
+		if len(android.FirstUniqueStrings(locations)) > 1 {
+			ctx.Errorf("Boot images resolve module %q to different locations: %s", module, strings.Join(resolved, ", "))
+		}
+	}
+}
+
+// checkEnabledBootImageVariants checks that GlobalConfig.EnabledBootImageVariants only lists known
+// boot images.
+func checkEnabledBootImageVariants(ctx android.SingletonContext, global *dexpreopt.GlobalConfig) {
+	for _, name := range global.EnabledBootImageVariants {
+		if !android.InList(name, getImageNames()) {
+			ctx.Errorf("EnabledBootImageVariants lists unknown boot image %q, expected one of %s",
+				name, strings.Join(getImageNames(), ", "))
+		}
+	}
+}
+
+// checkDex2oatBinaryByArch checks that the dex2oat binaries configured per architecture have
+// non-empty paths.
+func checkDex2oatBinaryByArch(ctx android.SingletonContext, global *dexpreopt.GlobalConfig) {
+	var arches []string
+	for arch, binary := range global.Dex2oatBinaryByArch {
+		if binary == "" {
+			arches = append(arches, arch.String())
+		}
+	}
+	sort.Strings(arches)
+	for _, arch := range arches {
+		ctx.Errorf("Dex2oatBinaryByArch has an empty path for %s", arch)
+	}
+}
+
+// checkDex2oatImageThreads checks that the dex2oat thread counts for the boot images are positive
+// integers and that the cpu sets are comma separated lists of cpu numbers.
+func checkDex2oatImageThreads(ctx android.SingletonContext, global *dexpreopt.GlobalConfig) {
+	checkThreads := func(name, threads string) {
+		if n, err := strconv.Atoi(threads); threads != "" && (err != nil || n <= 0) {
+			ctx.Errorf("%s: %q is not a positive integer", name, threads)
+		}
+	}
+	checkCpuSet := func(name, cpuSet string) {
+		if cpuSet == "" {
+			return
+		}
+		for _, cpu := range strings.Split(cpuSet, ",") {
+			if n, err := strconv.Atoi(cpu); err != nil || n < 0 || cpu != strconv.Itoa(n) {
+				ctx.Errorf("%s: %q is not a comma separated list of cpu numbers", name, cpuSet)
+				return
+			}
+		}
+	}
+	checkThreads("Dex2oatImageThreads", global.Dex2oatImageThreads)
+	checkCpuSet("Dex2oatImageCpuSet", global.Dex2oatImageCpuSet)
+	for _, arch := range sortedArchTypes(global.Dex2oatImageThreadsByArch) {
+		checkThreads("Dex2oatImageThreadsByArch["+arch.String()+"]", global.Dex2oatImageThreadsByArch[arch])
+	}
+	for _, arch := range sortedArchTypes(global.Dex2oatImageCpuSetByArch) {
+		checkCpuSet("Dex2oatImageCpuSetByArch["+arch.String()+"]", global.Dex2oatImageCpuSetByArch[arch])
+	}
+}
+
+// sortedArchTypes returns the keys of the given map, sorted by name.
+func sortedArchTypes(m map[android.ArchType]string) []android.ArchType {
+	arches := make([]android.ArchType, 0, len(m))
+	for arch := range m {
+		arches = append(arches, arch)
+	}
+	sort.Slice(arches, func(i, j int) bool { return arches[i].String() < arches[j].String() })
+	return arches
+}
+
+// checkDisablePreoptModulesPatterns checks that every pattern in DisablePreoptModules matches at
+// least one module in the build, to catch typos, unless AllowUnmatchedDisablePreoptModules is set.
+func checkDisablePreoptModulesPatterns(ctx android.SingletonContext, global *dexpreopt.GlobalConfig) {
+	denylist := global.PreoptDenylist()
+	patterns := denylist.Patterns()
+	if len(patterns) == 0 || global.AllowUnmatchedDisablePreoptModules {
+		return
+	}
+
+	matched := make(map[string]bool)
+	ctx.VisitAllModules(func(module android.Module) {
+		name := android.RemoveOptionalPrebuiltPrefix(ctx.ModuleName(module))
+		for _, pattern := range denylist.MatchingPatterns(name) {
+			matched[pattern] = true
+		}
+	})
+	for _, pattern := range patterns {
+		if !matched[pattern] {
+			ctx.Errorf("DisablePreoptModules pattern %q does not match any module", pattern)
+		}
+	}
+}
+
+// checkBootJarModuleAliases checks that the modules in BootJarModuleAliases are not themselves
+// aliased, which would make a chain or a cycle, and that they are in the build.
+func checkBootJarModuleAliases(ctx android.SingletonContext, global *dexpreopt.GlobalConfig) {
+	if len(global.BootJarModuleAliases) == 0 {
+		return
+	}
+	for _, jar := range android.SortedKeys(global.BootJarModuleAliases) {
+		module := global.BootJarModuleAliases[jar]
+		if module == jar {
+			ctx.Errorf("BootJarModuleAliases: boot jar %q is aliased to itself", jar)
+		} else if _, ok := global.BootJarModuleAliases[module]; ok {
+			if global.BootJarModuleAliases[module] == jar {
+				ctx.Errorf("BootJarModuleAliases: boot jars %q and %q are aliased to each other", jar, module)
+			} else {
+				ctx.Errorf("BootJarModuleAliases: boot jar %q is aliased to %q, which is itself aliased, aliases must not be chained", jar, module)
+			}
+		}
+	}
+	if ctx.Config().AllowMissingDependencies() {
+		return
+	}
+	inBuild := make(map[string]bool)
+	ctx.VisitAllModules(func(module android.Module) {
+		inBuild[android.RemoveOptionalPrebuiltPrefix(ctx.ModuleName(module))] = true
+	})
+	for _, jar := range android.SortedKeys(global.BootJarModuleAliases) {
+		if module := global.BootJarModuleAliases[jar]; !inBuild[module] {
+			ctx.Errorf("BootJarModuleAliases: module %q of boot jar %q is not in the build", module, jar)
+		}
+	}
+}
+
+// checkBootJarsNotStandaloneSystemServerJars checks that no jar of the default boot image is also a
+// standalone system server jar, as system_server would load it a second time in a separate class
+// loader.
+func checkBootJarsNotStandaloneSystemServerJars(ctx android.SingletonContext, global *dexpreopt.GlobalConfig) {
+	if !getDexpreoptStatus(ctx).systemServerPreopted {
+		return
+	}
+	standaloneJars := global.StandaloneSystemServerJars.AppendList(&global.ApexStandaloneSystemServerJars)
+	standalone := stringSet(standaloneJars.CopyOfJars())
+	modules := defaultBootImageConfig(ctx).modules
+	for i := 0; i < modules.Len(); i++ {
+		if standalone[modules.Jar(i)] {
+			ctx.Errorf("Boot jar %q must not also be a standalone system server jar", modules.Jar(i))
+		}
+	}
+}
+
+// checkSystemServerJarsFragments checks that no jar of a system server jars fragment is also listed
+// in ApexSystemServerJars or in another fragment, see dexpreopt.RegisterSystemServerJarsFragment.
+func checkSystemServerJarsFragments(ctx android.SingletonContext, global *dexpreopt.GlobalConfig) {
+	for _, err := range global.SystemServerJarsFragmentConflicts(ctx) {
+		ctx.Errorf("%s", err)
+	}
+}
+
+// checkSystemServerClasspathOverride checks that every entry of
+// GlobalConfig.SystemServerClasspathOverride is an absolute on-device path.
+func checkSystemServerClasspathOverride(ctx android.SingletonContext, global *dexpreopt.GlobalConfig) {
+	for _, entry := range global.SystemServerClasspathOverride {
+		if !filepath.IsAbs(entry) {
+			ctx.Errorf("SystemServerClasspathOverride entry %q must be an absolute path", entry)
+		}
+	}
+}
+
+// checkBootclasspathAllowlist checks that every jar on the boot class path is listed in the
+// allowlist file configured in GlobalConfig.BootclasspathAllowlist, if any.
+func checkBootclasspathAllowlist(ctx android.SingletonContext, global *dexpreopt.GlobalConfig) {
+	if global.BootclasspathAllowlist == "" {
+		return
+	}
+	ctx.AddNinjaFileDeps(global.BootclasspathAllowlist)
+	data, err := os.ReadFile(global.BootclasspathAllowlist)
+	if err != nil {
+		ctx.Errorf("failed to read boot class path allowlist: %s", err)
+		return
+	}
+	if unapproved := unapprovedBootclasspathJars(ctx, parseBootclasspathAllowlist(string(data))); len(unapproved) > 0 {
+		ctx.Errorf("Boot class path jars are not approved in %s: %s",
+			global.BootclasspathAllowlist, strings.Join(unapproved, ", "))
+	}
+}
+
+// parseBootclasspathAllowlist returns the apex:jar pairs in the contents of an allowlist file, which
+// has one pair per line. Blank lines and "#" comments are ignored.
+func parseBootclasspathAllowlist(data string) []string {
+	var approved []string
+	for _, line := range strings.Split(data, "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		if line = strings.TrimSpace(line); line != "" {
+			approved = append(approved, line)
+		}
+	}
+	return approved
+}
+
+// unapprovedBootclasspathJars returns the jars on the boot class path that are not in the approved
+// list, as apex:jar pairs. The pairs take the configured jar location overrides into account.
+func unapprovedBootclasspathJars(ctx android.PathContext, approved []string) []string {
+	jars := allBootclasspathJars(dexpreopt.GetGlobalConfig(ctx))
+	approvedSet := stringSet(approved)
+	var unapproved []string
+	for i := 0; i < jars.Len(); i++ {
+		apex, jar := android.OverrideConfiguredJarLocationFor(ctx.Config(), jars.Apex(i), jars.Jar(i))
+		if pair := apex + ":" + jar; !approvedSet[pair] {
+			unapproved = append(unapproved, pair)
+		}
+	}
+	return unapproved
+}
+
+// checkAllowedBootJarApexes checks that the apex boot jars are only in the apexes listed in
+// GlobalConfig.AllowedBootJarApexes, if any. The apexes take the configured jar location overrides
+// into account.
+func checkAllowedBootJarApexes(ctx android.SingletonContext, global *dexpreopt.GlobalConfig) {
+	if len(global.AllowedBootJarApexes) == 0 {
+		return
+	}
+	allowed := stringSet(global.AllowedBootJarApexes)
+	jars := global.ApexBootJars
+	for i := 0; i < jars.Len(); i++ {
+		apex, jar := android.OverrideConfiguredJarLocationFor(ctx.Config(), jars.Apex(i), jars.Jar(i))
+		if !allowed[apex] {
+			ctx.Errorf("Apex boot jar %q is in apex %q, which is not in AllowedBootJarApexes", jar, apex)
+		}
+	}
+}
+
+// checkSecondaryBootImageModules checks that each of the modules of the secondary boot image is an
+// apex boot jar, as the other boot jars are in the default boot image already.
+func checkSecondaryBootImageModules(ctx android.SingletonContext, global *dexpreopt.GlobalConfig) {
+	for _, jar := range global.SecondaryBootImageModules {
+		if !global.ApexBootJars.ContainsJar(jar) {
+			ctx.Errorf("Secondary boot image module %q is not an apex boot jar", jar)
+		}
+	}
+}
+
+// checkPreoptApiLevel checks that the dexpreopt targets have the API level in
+// GlobalConfig.ExpectedPreoptApiLevel, if set, as the images compiled for them would otherwise not
+// be compatible with the device. All the targets have the API level of the platform, as there are
+// no per-target API levels.
+func checkPreoptApiLevel(ctx android.SingletonContext, global *dexpreopt.GlobalConfig) {
+	if global.DisablePreopt || global.ExpectedPreoptApiLevel == "" {
+		return
+	}
+	expected, err := android.ApiLevelFromUser(ctx, global.ExpectedPreoptApiLevel)
+	if err != nil {
+		ctx.Errorf("ExpectedPreoptApiLevel: %s", err)
+		return
+	}
+	level := ctx.Config().PlatformSdkVersion()
+	if expected.EqualTo(level) {
+		return
+	}
+	var arches []string
+	for _, target := range dexpreoptTargets(ctx) {
+		if target.Os == android.Android {
+			arches = append(arches, target.Arch.ArchType.String())
+		}
+	}
+	ctx.Errorf("The dexpreopt targets %s have API level %s, but ExpectedPreoptApiLevel is %s",
+		strings.Join(arches, ", "), level, expected)
+}
+
+// checkRequiredArtModuleOrder checks that the modules of the art boot image start with
+// GlobalConfig.RequiredArtModuleOrder, if set, in that order.
+func checkRequiredArtModuleOrder(ctx android.SingletonContext, global *dexpreopt.GlobalConfig) {
+	required := global.RequiredArtModuleOrder
+	if len(required) == 0 {
+		return
+	}
+	modules := genBootImageConfigs(ctx)["art"].modules.CopyOfJars()
+	if len(modules) >= len(required) && slices.Equal(modules[:len(required)], required) {
+		return
+	}
+	ctx.Errorf("The art boot image modules must start with RequiredArtModuleOrder [%s], but they are [%s]",
+		strings.Join(required, " "), strings.Join(modules, " "))
+}
+
+// checkUncompressedBootJars checks that each of the uncompressed boot jars is in a boot image.
+func checkUncompressedBootJars(ctx android.SingletonContext, global *dexpreopt.GlobalConfig) {
+	for _, jar := range global.UncompressedBootJars {
+		found := false
+		for _, name := range getImageNames() {
+			if android.InList(jar, genBootImageConfigs(ctx)[name].uncompressedModules) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			ctx.Errorf("Uncompressed boot jar %q is not in any boot image", jar)
+		}
+	}
+}
+
+// checkApexJavalibDirOverrides checks that each of the overridden directories of the java
+// libraries of apexes is the name of a directory in the root of the apex, so that it cannot escape
+// the apex.
+func checkApexJavalibDirOverrides(ctx android.SingletonContext, global *dexpreopt.GlobalConfig) {
+	for _, apex := range android.SortedKeys(global.ApexJavalibDirOverrides) {
+		dir := global.ApexJavalibDirOverrides[apex]
+		if dir == "" || dir == "." || dir == ".." || strings.Contains(dir, "/") {
+			ctx.Errorf("ApexJavalibDirOverrides of apex %q is %q, which is not the name of a directory in the root of the apex", apex, dir)
+		}
+	}
+}
+
+// extensionModules returns the modules of the default boot image that are not in the art boot
+// image, in the order of the default boot image. They are the contents of the default boot image
+// when it is built as an extension of the art boot image, see GlobalConfig.ExtendArtBootImage.
+func extensionModules(ctx android.PathContext) android.ConfiguredJarList {
+	configs := genBootImageConfigs(ctx)
+	return configs[frameworkBootImageName].modules.RemoveList(configs["art"].modules)
+}
+
+// checkExtensionModules checks that the modules of the art boot image are a strict prefix of those
+// of the default boot image if the latter extends the former. Otherwise the extension would not
+// contain exactly the modules that follow the art boot image on the boot class path, and would fail
+// to load.
+func checkExtensionModules(ctx android.SingletonContext, global *dexpreopt.GlobalConfig) {
+	if !global.ExtendArtBootImage {
+		return
+	}
+	configs := genBootImageConfigs(ctx)
+	if err := extensionPrefixError(configs["art"].modules, configs[frameworkBootImageName].modules); err != nil {
+		ctx.Errorf("%s", err)
+	}
+}
+
+// extensionPrefixError returns an error if the given art modules are not a strict prefix of the
+// given default modules.
+func extensionPrefixError(art, defaultModules android.ConfiguredJarList) error {
+	isPrefix := art.Len() < defaultModules.Len()
+	for i := 0; isPrefix && i < art.Len(); i++ {
+		isPrefix = art.Apex(i) == defaultModules.Apex(i) && art.Jar(i) == defaultModules.Jar(i)
+	}
+	if !isPrefix {
+		return fmt.Errorf("ExtendArtBootImage is set, but the art boot image modules [%s] are not a strict prefix of the default boot image modules [%s]",
+			strings.Join(art.CopyOfApexJarPairs(), " "), strings.Join(defaultModules.CopyOfApexJarPairs(), " "))
+	}
+	return nil
+}
+
+// validateDexpreoptModulesExist checks that the modules of all the boot jars and system server jars
+// in the dexpreopt config are in the build, and reports all the missing ones in a single error. The
+// modules of aliased boot jars are those in BootJarModuleAliases. The checks apply even if the boot
+// images are generated on device, as the jars are still needed on the device.
+func validateDexpreoptModulesExist(ctx android.ModuleContext) {
+	global := dexpreopt.GetGlobalConfig(ctx)
+	if global.DisablePreopt || ctx.Config().AllowMissingDependencies() {
+		return
+	}
+
+	var modules []string
+	for _, jar := range allBootclasspathJars(global).CopyOfJars() {
+		modules = append(modules, global.BootJarModule(jar))
+	}
+	var missing []string
+	for _, module := range append(modules, global.AllSystemServerJars(ctx).CopyOfJars()...) {
+		if !ctx.OtherModuleExists(module) && !ctx.OtherModuleExists(android.PrebuiltNameFromSource(module)) {
+			missing = append(missing, module)
+		}
+	}
+	if len(missing) > 0 {
+		ctx.ModuleErrorf("dexpreopt config references modules that are not in the build: %s",
+			strings.Join(android.FirstUniqueStrings(missing), ", "))
+	}
+}
+
+func init() {
+	android.RegisterMakeVarsProvider(pctx, dexpreoptConfigMakevars)
+}
+
+// dexpreoptConfigVarsInputs are the parts of the config that the make variables exported by
+// dexpreoptConfigMakevars are derived from.
+type dexpreoptConfigVarsInputs struct {
+	// The values returned by classpathMakeVars.
+	classpathVars map[string]string
+	// Whether the dex files and locations of the boot class path are exported, which they are not
+	// if the boot jars are not dexpreopted, see SkipDexpreoptBootJars.
+	bootclasspathDexVars bool
+	totalBootJarCount    int
+	// Whether the boot images are generated on device rather than at build time.
+	onDeviceImageGeneration bool
+	artifactPartitions      []string
+}
+
+// computeDexpreoptConfigVars returns the make variables exported by dexpreoptConfigMakevars for the
+// given inputs, in the order they are exported in. The names are relied upon by Make and must not
+// change.
+func computeDexpreoptConfigVars(in dexpreoptConfigVarsInputs) []struct{ Name, Value string } {
+	vars := []struct{ Name, Value string }{
+		{"DEXPREOPT_BOOT_JARS_MODULES", in.classpathVars["DEXPREOPT_BOOT_JARS_MODULES"]},
+	}
+	if in.bootclasspathDexVars {
+		vars = append(vars,
+			struct{ Name, Value string }{"DEXPREOPT_BOOTCLASSPATH_DEX_FILES", in.classpathVars["DEXPREOPT_BOOTCLASSPATH_DEX_FILES"]},
+			struct{ Name, Value string }{"DEXPREOPT_BOOTCLASSPATH_DEX_LOCATIONS", in.classpathVars["DEXPREOPT_BOOTCLASSPATH_DEX_LOCATIONS"]})
+	}
+	vars = append(vars, struct{ Name, Value string }{"DEXPREOPT_TOTAL_BOOT_JARS_COUNT", strconv.Itoa(in.totalBootJarCount)})
+	if in.onDeviceImageGeneration {
+		vars = append(vars, struct{ Name, Value string }{"DEX_PREOPT_ON_DEVICE_IMAGE_GENERATION", "true"})
+	}
+	return append(vars, struct{ Name, Value string }{"DEX_PREOPT_ARTIFACT_PARTITIONS", strings.Join(in.artifactPartitions, " ")})
+}
+
+// dexpreoptConfigVars returns the make variables exported by dexpreoptConfigMakevars, so that they
+// can be inspected without a MakeVarsContext.
+func dexpreoptConfigVars(ctx android.PathContext) []struct{ Name, Value string } {
+	return computeDexpreoptConfigVars(dexpreoptConfigVarsInputs{
+		classpathVars:           classpathMakeVars(ctx),
+		bootclasspathDexVars:    !SkipDexpreoptBootJars(ctx),
+		totalBootJarCount:       totalBootJarCount(ctx),
+		onDeviceImageGeneration: !getDexpreoptStatus(ctx).bootJarsStaged,
+		artifactPartitions:      dexpreoptArtifactPartitions(ctx),
+	})
+}
+
+func dexpreoptConfigMakevars(ctx android.MakeVarsContext) {
+	if dexpreoptAnalysisOnly(ctx.Config()) {
+		return
+	}
+	for _, v := range dexpreoptConfigVars(ctx) {
+		ctx.Strict(v.Name, v.Value)
+	}
+
+	// The manifest, the dependency file and the boot jars list are written by the dex_bootjars
+	// singleton.
+	ctx.DistForGoal("droidcore", systemServerJarsManifestPath(ctx))
+	ctx.DistForGoal("droidcore", bootImageInputsDepFilePath(ctx))
+	ctx.DistForGoal("droidcore", bootJarsListPath(ctx))
+}
+
+// checkBootImageCompilerFilters checks that the boot images that include updatable apex boot jars
+// do not compile them ahead of time.
+func checkBootImageCompilerFilters(ctx android.SingletonContext, global *dexpreopt.GlobalConfig) {
+	for _, name := range getImageNames() {
+		if err := bootImageCompilerFilterError(genBootImageConfigs(ctx)[name], global.ApexBootJars); err != nil {
+			ctx.Errorf("%s", err)
+		}
+	}
+}
+
+// bootImageCompilerFilterError returns an error if the given boot image includes any of the given
+// updatable jars and has an AOT compiler filter. The code of the updatable jars changes when their
+// apexes are updated, which would invalidate the AOT compiled code, so they are only verified and
+// left to the JIT.
+func bootImageCompilerFilterError(image *bootImageConfig, updatable android.ConfiguredJarList) error {
+	if !image.isAotCompiled() {
+		return nil
+	}
+	updatableJars := stringSet(updatable.CopyOfJars())
+	var included []string
+	for i := 0; i < image.modules.Len(); i++ {
+		if updatableJars[image.modules.Jar(i)] {
+			included = append(included, image.modules.Jar(i))
+		}
+	}
+	if len(included) == 0 {
+		return nil
+	}
+	return fmt.Errorf("Boot image %q includes the updatable apex boot jars %s, so its compiler filter must be %q, not %q",
+		image.name, strings.Join(included, ", "), "verify", image.compilerFilter)
 }
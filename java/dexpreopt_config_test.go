@@ -15,11 +15,17 @@
 package java
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
 	"runtime"
 	"sort"
+	"strings"
 	"testing"
 
 	"android/soong/android"
+	"android/soong/dexpreopt"
 )
 
 func TestBootImageConfig(t *testing.T) {
@@ -55,3 +61,3189 @@ func TestImageNames(t *testing.T) {
 
 	android.AssertArrayString(t, "getImageNames vs genBootImageConfigs", names, namesFromConfigs)
 }
+
+func TestClasspathOnlyApexJars(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		PrepareApexBootJarConfigs,
+		dexpreopt.FixtureSetClasspathOnlyApexJars("com.android.baz:framework-baz"),
+	).RunTest(t)
+
+	ctx := &android.TestPathContext{TestResult: result}
+	android.AssertStringListContains(t, "defaultBootclasspath", defaultBootclasspath(ctx),
+		"/apex/com.android.baz/javalib/framework-baz.jar")
+	android.AssertBoolEquals(t, "isBootclasspathJar", true, isBootclasspathJar(ctx, "framework-baz"))
+
+	for _, name := range getImageNames() {
+		config := genBootImageConfigs(ctx)[name]
+		android.AssertBoolEquals(t, name+" modules", false, config.modules.ContainsJar("framework-baz"))
+		_, staged := config.dexPathsByModule["framework-baz"]
+		android.AssertBoolEquals(t, name+" dexPathsByModule", false, staged)
+	}
+
+	explain := result.SingletonForTests("dex_bootjars").Output("out/soong/dexpreopt_arm64/dexpreopt_explain.txt")
+	android.AssertStringDoesContain(t, "explain log",
+		android.ContentFromFileRuleForTests(t, result.TestContext, explain),
+		"com.android.baz:framework-baz: not in any boot image: classpath-only apex jar")
+}
+
+func TestClasspathOnlyApexJarsConflict(t *testing.T) {
+	android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		PrepareApexBootJarConfigs,
+		dexpreopt.FixtureSetClasspathOnlyApexJars("com.android.foo:framework-foo"),
+	).ExtendWithErrorHandler(android.FixtureExpectsAtLeastOneErrorMatchingPattern(
+		`Classpath-only apex jar "framework-foo" must not also be listed in ApexBootJars`,
+	)).RunTest(t)
+}
+
+func TestExpectedDisablePreopt(t *testing.T) {
+	preparer := func(disablePreopt bool, expected string) android.FixturePreparer {
+		return android.GroupFixturePreparers(
+			PrepareForBootImageConfigTest,
+			dexpreopt.FixtureDisableDexpreopt(disablePreopt),
+			android.FixtureMergeEnv(map[string]string{
+				"EXPECT_DISABLE_PREOPT": expected,
+			}),
+		)
+	}
+
+	t.Run("matching", func(t *testing.T) {
+		preparer(false, "false").RunTest(t)
+		preparer(true, "true").RunTest(t)
+	})
+
+	t.Run("mismatching", func(t *testing.T) {
+		preparer(false, "true").ExtendWithErrorHandler(android.FixtureExpectsAtLeastOneErrorMatchingPattern(
+			`DisablePreopt is false, but EXPECT_DISABLE_PREOPT is true`,
+		)).RunTest(t)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		preparer(false, "yes").ExtendWithErrorHandler(android.FixtureExpectsAtLeastOneErrorMatchingPattern(
+			`EXPECT_DISABLE_PREOPT must be true or false, got "yes"`,
+		)).RunTest(t)
+	})
+}
+
+func TestApexSystemServerJarInMultipleApexes(t *testing.T) {
+	android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		dexpreopt.FixtureSetApexSystemServerJars("com.android.foo:service-foo"),
+		dexpreopt.FixtureSetApexStandaloneSystemServerJars("com.android.bar:service-foo"),
+	).ExtendWithErrorHandler(android.FixtureExpectsAtLeastOneErrorMatchingPattern(
+		`Apex system server jar "service-foo" is listed under more than one apex: "com.android.foo" and "com.android.bar"`,
+	)).RunTest(t)
+
+	android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		dexpreopt.FixtureSetApexSystemServerJars("com.android.foo:service-foo", "com.android.bar:service-foo"),
+	).ExtendWithErrorHandler(android.FixtureExpectsAtLeastOneErrorMatchingPattern(
+		`Apex system server jar "service-foo" is listed under more than one apex: "com.android.foo" and "com.android.bar"`,
+	)).RunTest(t)
+}
+
+func TestBootJarAlsoStandaloneSystemServerJar(t *testing.T) {
+	android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		dexpreopt.FixtureSetStandaloneSystemServerJars("platform:framework"),
+	).ExtendWithErrorHandler(android.FixtureExpectsAtLeastOneErrorMatchingPattern(
+		`Boot jar "framework" must not also be a standalone system server jar`,
+	)).RunTest(t)
+
+	// The check only applies when preopt is enabled.
+	android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		dexpreopt.FixtureSetStandaloneSystemServerJars("platform:framework"),
+		dexpreopt.FixtureDisableDexpreopt(true),
+	).RunTest(t)
+}
+
+func TestSystemServerJarsManifest(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		dexpreopt.FixtureSetSystemServerJars("platform:service-platform"),
+		dexpreopt.FixtureSetApexSystemServerJars("com.android.foo:service-foo"),
+		dexpreopt.FixtureSetApexStandaloneSystemServerJars("com.android.bar:service-bar"),
+	).RunTest(t)
+
+	manifest := result.SingletonForTests("dex_bootjars").Output("out/soong/dexpreopt_arm64/system_server_jars.json")
+	android.AssertStringEquals(t, "manifest", `[
+    {
+        "module": "service-foo",
+        "apex": "com.android.foo",
+        "location": "/apex/com.android.foo/javalib/service-foo.jar"
+    },
+    {
+        "module": "service-bar",
+        "apex": "com.android.bar",
+        "location": "/apex/com.android.bar/javalib/service-bar.jar"
+    }
+]
+`, android.ContentFromFileRuleForTests(t, result.TestContext, manifest))
+}
+
+func TestStemOfModule(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, dexpreoptConfig *dexpreopt.GlobalConfig) {
+			dexpreoptConfig.StemFallbacks = map[string]string{"framework": "framework-fallback"}
+		}),
+	).RunTest(t)
+
+	ctx := &android.TestPathContext{TestResult: result}
+	extra1 := result.ModuleForTests("extra1", "android_common").Module()
+	android.AssertStringEquals(t, "resolved", "extra1", stemOfModule(ctx, extra1, "platform", "extra1"))
+	android.AssertStringEquals(t, "fallback", "framework-fallback", stemOfModule(ctx, nil, "platform", "framework"))
+	android.AssertStringEquals(t, "default", "core1", stemOfModule(ctx, nil, "com.android.art", "core1"))
+
+	// The boot image configs do not know the modules, so the fallback names the staged jar, the
+	// image files and the on-device location of the jar.
+	image := defaultBootImageConfig(ctx)
+	android.AssertPathRelativeToTopEquals(t, "staged jar",
+		"out/soong/dexpreopt_arm64/dex_bootjars_input/framework-fallback.jar", image.dexPathsByModule["framework"])
+	android.AssertStringEquals(t, "image module name", "boot-framework-fallback", image.moduleName(ctx, 2))
+	android.AssertArrayString(t, "dex locations", []string{
+		"/apex/com.android.art/javalib/core1.jar",
+		"/apex/com.android.art/javalib/core2.jar",
+		"/system/framework/framework-fallback.jar",
+	}, image.getAnyAndroidVariant().dexLocations)
+}
+
+func TestDiffBootDexLocations(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		PrepareApexBootJarConfigs,
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.ApexJavalibDirOverrides = map[string]string{"com.android.bar": "javalib64"}
+			c.OnDeviceLocationPrefix = "/tmp/sandbox"
+		}),
+	).RunTest(t)
+
+	ctx := &android.TestPathContext{TestResult: result}
+
+	baselinePath := filepath.Join(t.TempDir(), "dexpreopt.config")
+	baseline := `{
+		"BootJars": ["com.android.art:core1", "com.android.art:core2", "platform:framework", "platform:framework-foo"],
+		"ApexBootJars": ["com.android.bar:framework-bar"],
+		"ApexJavalibDirOverrides": {"com.android.art": "javalib64", "com.android.bar": "javalib64"}
+	}`
+	if err := os.WriteFile(baselinePath, []byte(baseline), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	moved, err := DiffBootDexLocations(ctx, baselinePath)
+	android.AssertDeepEquals(t, "error", nil, err)
+	android.AssertDeepEquals(t, "moved", []struct{ Module, From, To string }{
+		{
+			Module: "core1",
+			From:   "/apex/com.android.art/javalib64/core1.jar",
+			To:     "/apex/com.android.art/javalib/core1.jar",
+		},
+		{
+			Module: "core2",
+			From:   "/apex/com.android.art/javalib64/core2.jar",
+			To:     "/apex/com.android.art/javalib/core2.jar",
+		},
+		{
+			Module: "framework-foo",
+			From:   "/system/framework/framework-foo.jar",
+			To:     "/apex/com.android.foo/javalib/framework-foo.jar",
+		},
+	}, moved)
+
+	_, err = DiffBootDexLocations(ctx, filepath.Join(t.TempDir(), "missing.config"))
+	android.AssertStringDoesContain(t, "error", fmt.Sprint(err), "failed to read baseline dexpreopt config")
+}
+
+func TestDexpreoptDryRunSummary(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		PrepareApexBootJarConfigs,
+		dexpreopt.FixtureSetApexSystemServerJars("com.android.foo:service-foo"),
+	).RunTest(t)
+
+	ctx := &android.TestPathContext{TestResult: result}
+
+	android.AssertStringEquals(t, "summary", `PRODUCT_BOOTCLASSPATH=/apex/com.android.art/javalib/core1.jar:/apex/com.android.art/javalib/core2.jar:/system/framework/framework.jar:/apex/com.android.foo/javalib/framework-foo.jar:/apex/com.android.bar/javalib/framework-bar.jar
+DEX2OAT_BOOTCLASSPATH=/apex/com.android.art/javalib/core1.jar:/apex/com.android.art/javalib/core2.jar:/system/framework/framework.jar
+SYSTEMSERVERCLASSPATH=/apex/com.android.foo/javalib/service-foo.jar
+DEXPREOPT_IMAGE_MODULES_art=com.android.art:core1 com.android.art:core2 platform:extra1
+DEXPREOPT_IMAGE_MODULES_boot=com.android.art:core1 com.android.art:core2 platform:framework
+DEXPREOPT_IMAGE_MODULES_mainline=com.android.foo:framework-foo com.android.bar:framework-bar
+`, dexpreoptDryRunSummary(ctx))
+}
+
+func TestDexpreoptDryRun(t *testing.T) {
+	preparer := android.GroupFixturePreparers(
+		PrepareForTestWithDexpreopt,
+		android.PrepareForTestAccessingMakeVars,
+		FixtureConfigureBootJars("platform:foo"),
+		android.FixtureWithRootAndroidBp(`
+			platform_bootclasspath {
+				name: "platform-bootclasspath",
+			}
+
+			java_library {
+				name: "foo",
+				srcs: ["a.java"],
+				system_modules: "none",
+				sdk_version: "none",
+				compile_dex: true,
+			}
+		`),
+	)
+
+	bootImage := "out/soong/dexpreopt_arm64/dex_bootjars/android/system/framework/arm64/boot.art"
+
+	result := preparer.RunTest(t)
+	dexBootJars := result.ModuleForTests("dex_bootjars", "android_common")
+	android.AssertBoolEquals(t, "boot image rule", true, dexBootJars.MaybeOutput(bootImage).Rule != nil)
+
+	result = android.GroupFixturePreparers(
+		preparer,
+		android.FixtureMergeEnv(map[string]string{
+			"SOONG_DEXPREOPT_DRY_RUN": "1",
+		}),
+	).RunTest(t)
+	dexBootJars = result.ModuleForTests("dex_bootjars", "android_common")
+	android.AssertBoolEquals(t, "boot image rule", false, dexBootJars.MaybeOutput(bootImage).Rule != nil)
+
+	vars := result.MakeVarsForTesting(func(variable android.MakeVarVariable) bool {
+		return variable.Name() == "DEXPREOPT_BOOT_JARS_MODULES"
+	})
+	android.AssertIntEquals(t, "make vars", 1, len(vars))
+	android.AssertStringEquals(t, "DEXPREOPT_BOOT_JARS_MODULES", "platform:foo", vars[0].Value())
+}
+
+func TestDexpreoptAnalysisOnly(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForTestWithDexpreopt,
+		android.PrepareForTestAccessingMakeVars,
+		FixtureConfigureBootJars("platform:foo"),
+		android.FixtureModifyConfig(func(config android.Config) {
+			config.BuildMode = android.GenerateModuleGraph
+		}),
+		android.FixtureWithRootAndroidBp(`
+			platform_bootclasspath {
+				name: "platform-bootclasspath",
+			}
+
+			java_library {
+				name: "foo",
+				srcs: ["a.java"],
+				system_modules: "none",
+				sdk_version: "none",
+				compile_dex: true,
+			}
+		`),
+	).RunTest(t)
+
+	dexBootJars := result.ModuleForTests("dex_bootjars", "android_common")
+	android.AssertBoolEquals(t, "boot image rule", false,
+		dexBootJars.MaybeOutput("out/soong/dexpreopt_arm64/dex_bootjars/android/system/framework/arm64/boot.art").Rule != nil)
+	android.AssertBoolEquals(t, "explain rule", false,
+		result.SingletonForTests("dex_bootjars").MaybeOutput("out/soong/dexpreopt_arm64/dexpreopt_explain.txt").Rule != nil)
+
+	// The make variables of the dexpreopt config, the boot images, the status and the metrics.
+	vars := result.MakeVarsForTesting(func(variable android.MakeVarVariable) bool {
+		return android.InList(variable.Name(), []string{
+			"DEXPREOPT_BOOT_JARS_MODULES",
+			"DEXPREOPT_BOOTCLASSPATH_DEX_FILES",
+			"DEX_PREOPT_BOOT_IMAGE_BUILT",
+			"DEX_PREOPT_EXPECTED_ACTION_COUNT",
+		})
+	})
+	android.AssertIntEquals(t, "make vars", 0, len(vars))
+
+	// The classpaths are still computed on demand.
+	ctx := &android.TestPathContext{TestResult: result}
+	android.AssertDeepEquals(t, "bootclasspath", []string{"/system/framework/foo.jar"}, defaultBootclasspath(ctx))
+	android.AssertStringEquals(t, "DEXPREOPT_BOOT_JARS_MODULES", "platform:foo", classpathMakeVars(ctx)["DEXPREOPT_BOOT_JARS_MODULES"])
+}
+
+func TestVersionedSystemServerClasspath(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		dexpreopt.FixtureSetSystemServerJars("platform:service-platform"),
+		dexpreopt.FixtureSetApexSystemServerJars("com.android.foo:service-foo", "com.android.bar:service-bar"),
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.UpdatableJarVersions = map[string]string{
+				"service-foo":      "340000000",
+				"service-platform": "1",
+			}
+		}),
+	).RunTest(t)
+
+	ctx := &android.TestPathContext{TestResult: result}
+
+	android.AssertDeepEquals(t, "versioned classpath", []string{
+		"/system/framework/service-platform.jar",
+		"/apex/com.android.foo/javalib/service-foo.jar@340000000",
+		"/apex/com.android.bar/javalib/service-bar.jar",
+	}, versionedSystemServerClasspath(ctx))
+	android.AssertDeepEquals(t, "classpath", []string{
+		"/system/framework/service-platform.jar",
+		"/apex/com.android.foo/javalib/service-foo.jar",
+		"/apex/com.android.bar/javalib/service-bar.jar",
+	}, systemServerClasspath(ctx))
+}
+
+func TestVersionedSystemServerClasspathDecoratesClasspath(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		dexpreopt.FixtureSetSystemServerJars("platform:service-platform"),
+		dexpreopt.FixtureSetApexSystemServerJars("com.android.foo:service-foo", "com.android.bar:service-bar"),
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.UpdatableJarVersions = map[string]string{"service-foo": "340000000"}
+			c.ApkInApexSystemServerJars = []string{"com.android.baz:BazService:app/BazService/BazService.apk"}
+			c.SortSystemServerClasspath = true
+			c.OnDeviceLocationPrefix = "/tmp/sandbox"
+		}),
+	).RunTest(t)
+
+	ctx := &android.TestPathContext{TestResult: result}
+
+	android.AssertDeepEquals(t, "versioned classpath", []string{
+		"/tmp/sandbox/apex/com.android.bar/javalib/service-bar.jar",
+		"/tmp/sandbox/apex/com.android.baz/app/BazService/BazService.apk",
+		"/tmp/sandbox/apex/com.android.foo/javalib/service-foo.jar@340000000",
+		"/tmp/sandbox/system/framework/service-platform.jar",
+	}, versionedSystemServerClasspath(ctx))
+}
+
+func TestApkInApexSystemServerJars(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		dexpreopt.FixtureSetSystemServerJars("platform:service-platform"),
+		dexpreopt.FixtureSetApexSystemServerJars("com.android.foo:service-foo"),
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.ApkInApexSystemServerJars = []string{"com.android.bar:BarService:app/BarService/BarService.apk"}
+		}),
+	).RunTest(t)
+	ctx := &android.TestPathContext{TestResult: result}
+
+	android.AssertDeepEquals(t, "classpath", []string{
+		"/system/framework/service-platform.jar",
+		"/apex/com.android.foo/javalib/service-foo.jar",
+		"/apex/com.android.bar/app/BarService/BarService.apk",
+	}, systemServerClasspath(ctx))
+
+	// The apks are relocated like the jars.
+	result = android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		dexpreopt.FixtureSetApexSystemServerJars("com.android.foo:service-foo"),
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.ApkInApexSystemServerJars = []string{
+				"com.android.foo:FooService:javalib/FooService.apk",
+				"com.android.bar:BarService:app/BarService/BarService.apk",
+			}
+			c.ApexJavalibDirOverrides = map[string]string{"com.android.foo": "javalib64"}
+			c.OnDeviceLocationPrefix = "/tmp/sandbox"
+		}),
+	).RunTest(t)
+	ctx = &android.TestPathContext{TestResult: result}
+
+	android.AssertDeepEquals(t, "relocated classpath", []string{
+		"/tmp/sandbox/apex/com.android.foo/javalib64/service-foo.jar",
+		"/tmp/sandbox/apex/com.android.foo/javalib64/FooService.apk",
+		"/tmp/sandbox/apex/com.android.bar/app/BarService/BarService.apk",
+	}, systemServerClasspath(ctx))
+
+	for _, entry := range []string{"com.android.bar:BarService", "com.android.bar:BarService:../BarService.apk"} {
+		if _, _, _, err := parseApkInApexSystemServerJar(entry); err == nil {
+			t.Errorf("expected an error for %q", entry)
+		}
+	}
+}
+
+func TestSystemServerClasspathByApex(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		dexpreopt.FixtureSetSystemServerJars("platform:services", "platform:service-platform"),
+		dexpreopt.FixtureSetApexSystemServerJars("com.android.foo:service-foo2", "com.android.bar:service-bar", "com.android.foo:service-foo1"),
+	).RunTest(t)
+	ctx := &android.TestPathContext{TestResult: result}
+
+	android.AssertDeepEquals(t, "by apex", map[string][]string{
+		"platform":        {"services", "service-platform"},
+		"com.android.foo": {"service-foo2", "service-foo1"},
+		"com.android.bar": {"service-bar"},
+	}, systemServerClasspathByApex(ctx))
+}
+
+func TestApexRef(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+	).RunTest(t)
+
+	ctx := &android.TestPathContext{TestResult: result}
+
+	art := artApexRef(ctx)
+	android.AssertStringEquals(t, "name", "com.android.art", art.name)
+	android.AssertStringEquals(t, "javalibDir", "/apex/com.android.art/javalib", art.javalibDir())
+	android.AssertStringEquals(t, "jarLocation", "/apex/com.android.art/javalib/core1.jar", art.jarLocation("core1"))
+	android.AssertStringEquals(t, "imageDir", "/apex/com.android.art/javalib/arm64", art.imageDir(android.Arm64))
+
+	foo := newApexRef(dexpreopt.GetGlobalConfig(ctx), "com.android.foo")
+	android.AssertStringEquals(t, "jarLocation", "/apex/com.android.foo/javalib/framework-foo.jar", foo.jarLocation("framework-foo"))
+}
+
+func TestCaseOnlyNameCollisions(t *testing.T) {
+	t.Run("boot image", func(t *testing.T) {
+		android.GroupFixturePreparers(
+			PrepareForBootImageConfigTest,
+			FixtureConfigureApexBootJars("com.android.foo:framework-foo", "com.android.bar:Framework-Foo"),
+		).ExtendWithErrorHandler(android.FixtureExpectsAtLeastOneErrorMatchingPattern(
+			`mainline boot image jars "framework-foo" and "Framework-Foo" differ only by case`,
+		)).RunTest(t)
+	})
+
+	t.Run("system server", func(t *testing.T) {
+		android.GroupFixturePreparers(
+			PrepareForBootImageConfigTest,
+			dexpreopt.FixtureSetSystemServerJars("platform:services"),
+			dexpreopt.FixtureSetApexSystemServerJars("com.android.foo:Services"),
+		).ExtendWithErrorHandler(android.FixtureExpectsAtLeastOneErrorMatchingPattern(
+			`System server jars "services" and "Services" differ only by case`,
+		)).RunTest(t)
+	})
+
+	t.Run("distinct", func(t *testing.T) {
+		android.GroupFixturePreparers(
+			PrepareForBootImageConfigTest,
+			FixtureConfigureApexBootJars("com.android.foo:framework-foo", "com.android.bar:framework-foo2"),
+			dexpreopt.FixtureSetSystemServerJars("platform:services"),
+			dexpreopt.FixtureSetApexSystemServerJars("com.android.foo:service-foo"),
+		).RunTest(t)
+	})
+}
+
+func TestSystemServerJarsWithProfiles(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		dexpreopt.FixtureSetSystemServerJars("platform:service-platform", "platform:service-noprof"),
+		dexpreopt.FixtureSetApexSystemServerJars("com.android.foo:service-foo", "com.android.bar:service-bar"),
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.SystemServerJarsWithProfiles = []string{"service-platform", "service-foo"}
+		}),
+	).RunTest(t)
+
+	dexBootJars := result.SingletonForTests("dex_bootjars")
+
+	manifest := dexBootJars.Output("out/soong/dexpreopt_arm64/system_server_jars.json")
+	android.AssertStringEquals(t, "manifest", `[
+    {
+        "module": "service-foo",
+        "apex": "com.android.foo",
+        "location": "/apex/com.android.foo/javalib/service-foo.jar",
+        "profile": "javalib/service-foo.jar.prof"
+    },
+    {
+        "module": "service-bar",
+        "apex": "com.android.bar",
+        "location": "/apex/com.android.bar/javalib/service-bar.jar"
+    }
+]
+`, android.ContentFromFileRuleForTests(t, result.TestContext, manifest))
+
+	explain := dexBootJars.Output("out/soong/dexpreopt_arm64/dexpreopt_explain.txt")
+	android.AssertStringEquals(t, "explain", `platform:service-platform: profile installed to /system/framework/service-platform.jar.prof
+com.android.foo:service-foo: profile installed to javalib/service-foo.jar.prof
+`, android.ContentFromFileRuleForTests(t, result.TestContext, explain))
+}
+
+func TestSortSystemServerClasspath(t *testing.T) {
+	preparer := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		dexpreopt.FixtureSetSystemServerJars("platform:services", "system_ext:service-ext"),
+		dexpreopt.FixtureSetApexSystemServerJars("com.android.foo:service-foo"),
+	)
+
+	t.Run("config order", func(t *testing.T) {
+		result := preparer.RunTest(t)
+		ctx := &android.TestPathContext{TestResult: result}
+		android.AssertDeepEquals(t, "classpath", []string{
+			"/system/framework/services.jar",
+			"/system_ext/framework/service-ext.jar",
+			"/apex/com.android.foo/javalib/service-foo.jar",
+		}, systemServerClasspath(ctx))
+	})
+
+	t.Run("sorted", func(t *testing.T) {
+		result := android.GroupFixturePreparers(
+			preparer,
+			dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+				c.SortSystemServerClasspath = true
+			}),
+		).RunTest(t)
+		ctx := &android.TestPathContext{TestResult: result}
+		android.AssertDeepEquals(t, "classpath", []string{
+			"/apex/com.android.foo/javalib/service-foo.jar",
+			"/system/framework/services.jar",
+			"/system_ext/framework/service-ext.jar",
+		}, systemServerClasspath(ctx))
+	})
+}
+
+func TestAllBootInputJars(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		PrepareApexBootJarConfigs,
+	).RunTest(t)
+
+	ctx := &android.TestPathContext{TestResult: result}
+
+	jars := allBootInputJars(ctx)
+	actual := make(map[string]string, len(jars))
+	for module, path := range jars {
+		actual[module] = path.RelativeToTop().String()
+	}
+	android.AssertDeepEquals(t, "input jars", map[string]string{
+		"core1":         "out/soong/dexpreopt_arm64/dex_bootjars_input/core1.jar",
+		"core2":         "out/soong/dexpreopt_arm64/dex_bootjars_input/core2.jar",
+		"framework":     "out/soong/dexpreopt_arm64/dex_bootjars_input/framework.jar",
+		"framework-foo": "out/soong/dexpreopt_arm64/dex_mainlinejars_input/framework-foo.jar",
+		"framework-bar": "out/soong/dexpreopt_arm64/dex_mainlinejars_input/framework-bar.jar",
+		"extra1":        "out/soong/dexpreopt_arm64/dex_artjars_input/extra1.jar",
+	}, actual)
+
+	depFile := result.SingletonForTests("dex_bootjars").Output("out/soong/dexpreopt_arm64/bootimage.inputs.d")
+	android.AssertStringEquals(t, "dep file", `out/soong/dexpreopt_arm64/bootimage.inputs.d: \
+ out/soong/dexpreopt_arm64/dex_bootjars_input/core1.jar \
+ out/soong/dexpreopt_arm64/dex_bootjars_input/core2.jar \
+ out/soong/dexpreopt_arm64/dex_artjars_input/extra1.jar \
+ out/soong/dexpreopt_arm64/dex_bootjars_input/framework.jar \
+ out/soong/dexpreopt_arm64/dex_mainlinejars_input/framework-bar.jar \
+ out/soong/dexpreopt_arm64/dex_mainlinejars_input/framework-foo.jar
+`, android.StringRelativeToTop(result.Config, android.ContentFromFileRuleForTests(t, result.TestContext, depFile)))
+
+	_, err := mergeBootInputJars([]*bootImageConfig{
+		{dexPathsByModule: map[string]android.WritablePath{"core1": android.PathForOutput(ctx, "a", "core1.jar")}},
+		{dexPathsByModule: map[string]android.WritablePath{"core1": android.PathForOutput(ctx, "b", "core-oj.jar")}},
+	})
+	android.AssertStringDoesContain(t, "error", fmt.Sprint(err), `boot jar "core1" is copied to conflicting destinations`)
+}
+
+func TestBootJarImpact(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.RequiredArtModuleOrder = []string{"core1"}
+		}),
+	).RunTest(t)
+	ctx := &android.TestPathContext{TestResult: result}
+
+	t.Run("libcore", func(t *testing.T) {
+		android.AssertDeepEquals(t, "variants", []string{
+			"art_arm64", "art_arm", "art_host_x86_64", "art_host_x86",
+			"boot_arm64", "boot_arm", "boot_host_x86_64", "boot_host_x86",
+		}, bootJarImpact(ctx, "core1"))
+		android.AssertBoolEquals(t, "breaks RequiredArtModuleOrder", true, removalBreaksRequiredArtModuleOrder(ctx, "core1"))
+	})
+
+	t.Run("framework", func(t *testing.T) {
+		android.AssertDeepEquals(t, "variants", []string{
+			"boot_arm64", "boot_arm", "boot_host_x86_64", "boot_host_x86",
+		}, bootJarImpact(ctx, "framework"))
+		android.AssertBoolEquals(t, "breaks RequiredArtModuleOrder", false, removalBreaksRequiredArtModuleOrder(ctx, "framework"))
+	})
+
+	t.Run("not a boot jar", func(t *testing.T) {
+		android.AssertDeepEquals(t, "variants", []string(nil), bootJarImpact(ctx, "services"))
+	})
+}
+
+func TestOnDeviceImageGeneration(t *testing.T) {
+	preparer := android.GroupFixturePreparers(
+		PrepareForTestWithDexpreopt,
+		android.PrepareForTestAccessingMakeVars,
+		FixtureConfigureBootJars("platform:foo"),
+		android.FixtureWithRootAndroidBp(`
+			platform_bootclasspath {
+				name: "platform-bootclasspath",
+			}
+
+			java_library {
+				name: "foo",
+				srcs: ["a.java"],
+				system_modules: "none",
+				sdk_version: "none",
+				compile_dex: true,
+			}
+
+			java_library {
+				name: "bar",
+				installable: true,
+				srcs: ["a.java"],
+			}
+		`),
+	)
+
+	classpathVars := func(result *android.TestResult) map[string]string {
+		vars := map[string]string{}
+		for _, v := range result.MakeVarsForTesting(func(variable android.MakeVarVariable) bool {
+			return variable.Name() == "DEXPREOPT_BOOT_JARS_MODULES" ||
+				variable.Name() == "DEXPREOPT_BOOTCLASSPATH_DEX_LOCATIONS" ||
+				variable.Name() == "DEX_PREOPT_ON_DEVICE_IMAGE_GENERATION"
+		}) {
+			vars[v.Name()] = v.Value()
+		}
+		return vars
+	}
+
+	bootImage := "out/soong/dexpreopt_arm64/dex_bootjars/android/system/framework/arm64/boot.art"
+	stagedJar := "out/soong/dexpreopt_arm64/dex_bootjars_input/foo.jar"
+
+	result := preparer.RunTest(t)
+	normalVars := classpathVars(result)
+	android.AssertBoolEquals(t, "bar dexpreopt rule", true,
+		result.ModuleForTests("bar", "android_common").MaybeRule("dexpreopt").Rule != nil)
+
+	result = android.GroupFixturePreparers(
+		preparer,
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.OnDeviceImageGeneration = true
+		}),
+	).RunTest(t)
+
+	dexBootJars := result.ModuleForTests("dex_bootjars", "android_common")
+	android.AssertBoolEquals(t, "boot image rule", false, dexBootJars.MaybeOutput(bootImage).Rule != nil)
+	android.AssertBoolEquals(t, "staging rule", false, dexBootJars.MaybeOutput(stagedJar).Rule != nil)
+
+	// Nothing may be compiled against the boot images that are not built.
+	android.AssertBoolEquals(t, "bar dexpreopt rule", false,
+		result.ModuleForTests("bar", "android_common").MaybeRule("dexpreopt").Rule != nil)
+
+	onDeviceVars := classpathVars(result)
+	android.AssertStringEquals(t, "marker", "true", onDeviceVars["DEX_PREOPT_ON_DEVICE_IMAGE_GENERATION"])
+	delete(onDeviceVars, "DEX_PREOPT_ON_DEVICE_IMAGE_GENERATION")
+	android.AssertDeepEquals(t, "classpath make vars", normalVars, onDeviceVars)
+
+	explain := result.SingletonForTests("dex_bootjars").Output("out/soong/dexpreopt_arm64/dexpreopt_explain.txt")
+	android.AssertStringDoesContain(t, "explain", android.ContentFromFileRuleForTests(t, result.TestContext, explain),
+		"boot images: not built: generated on device")
+}
+
+func TestBootJarPrebuiltSelection(t *testing.T) {
+	preparer := android.GroupFixturePreparers(
+		PrepareForTestWithDexpreopt,
+		FixtureConfigureBootJars("platform:foo"),
+		android.FixtureWithRootAndroidBp(`
+			platform_bootclasspath {
+				name: "platform-bootclasspath",
+			}
+		`),
+	)
+
+	source := android.FixtureAddTextFile("source/Android.bp", `
+		java_library {
+			name: "foo",
+			srcs: ["a.java"],
+			system_modules: "none",
+			sdk_version: "none",
+			compile_dex: true,
+		}
+	`)
+
+	prebuilt := func(prefer bool) android.FixturePreparer {
+		return android.FixtureAddTextFile("prebuilt/Android.bp", fmt.Sprintf(`
+			java_import {
+				name: "foo",
+				jars: ["a.jar"],
+				compile_dex: true,
+				prefer: %t,
+			}
+		`, prefer))
+	}
+
+	// stagedJarInput returns the dex jar that is staged for foo, which must come from the module that
+	// is selected by the prebuilt selection.
+	stagedJarInput := func(t *testing.T, preparers ...android.FixturePreparer) string {
+		result := android.GroupFixturePreparers(preparer, android.GroupFixturePreparers(preparers...)).RunTest(t)
+		dexBootJars := result.ModuleForTests("dex_bootjars", "android_common")
+		return dexBootJars.Output("out/soong/dexpreopt_arm64/dex_bootjars_input/foo.jar").RelativeToTop().Input.String()
+	}
+
+	t.Run("source preferred", func(t *testing.T) {
+		android.AssertStringDoesContain(t, "staged jar input", stagedJarInput(t, source, prebuilt(false)),
+			"out/soong/.intermediates/source/foo/")
+	})
+
+	t.Run("prebuilt preferred", func(t *testing.T) {
+		android.AssertStringDoesContain(t, "staged jar input", stagedJarInput(t, source, prebuilt(true)),
+			"out/soong/.intermediates/prebuilt/prebuilt_foo/")
+	})
+
+	t.Run("only prebuilt", func(t *testing.T) {
+		android.AssertStringDoesContain(t, "staged jar input", stagedJarInput(t, prebuilt(false)),
+			"out/soong/.intermediates/prebuilt/prebuilt_foo/")
+	})
+}
+
+func TestBootJarModuleAliases(t *testing.T) {
+	preparer := android.GroupFixturePreparers(
+		PrepareForTestWithDexpreopt,
+		android.PrepareForTestAccessingMakeVars,
+		FixtureConfigureBootJars("platform:foo"),
+		android.FixtureWithRootAndroidBp(`
+			platform_bootclasspath {
+				name: "platform-bootclasspath",
+			}
+		`),
+	)
+
+	library := func(name string) android.FixturePreparer {
+		return android.FixtureAddTextFile(name+"/Android.bp", fmt.Sprintf(`
+			java_library {
+				name: "%s",
+				srcs: ["a.java"],
+				system_modules: "none",
+				sdk_version: "none",
+				compile_dex: true,
+			}
+		`, name))
+	}
+
+	aliases := func(aliases map[string]string) android.FixturePreparer {
+		return dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.BootJarModuleAliases = aliases
+		})
+	}
+
+	t.Run("alias", func(t *testing.T) {
+		result := android.GroupFixturePreparers(preparer, library("foo-minus-apex"),
+			aliases(map[string]string{"foo": "foo-minus-apex"})).RunTest(t)
+		dexBootJars := result.ModuleForTests("dex_bootjars", "android_common")
+		input := dexBootJars.Output("out/soong/dexpreopt_arm64/dex_bootjars_input/foo.jar").RelativeToTop().Input.String()
+		android.AssertStringDoesContain(t, "staged jar input", input, "out/soong/.intermediates/foo-minus-apex/")
+	})
+
+	t.Run("chain", func(t *testing.T) {
+		android.GroupFixturePreparers(preparer, library("bar"), library("baz"),
+			aliases(map[string]string{"foo": "bar", "bar": "baz"})).
+			ExtendWithErrorHandler(android.FixtureExpectsAtLeastOneErrorMatchingPattern(
+				`BootJarModuleAliases: boot jar "foo" is aliased to "bar", which is itself aliased`)).
+			RunTest(t)
+	})
+
+	t.Run("cycle", func(t *testing.T) {
+		android.GroupFixturePreparers(preparer, library("bar"),
+			aliases(map[string]string{"foo": "bar", "bar": "foo"})).
+			ExtendWithErrorHandler(android.FixtureExpectsAtLeastOneErrorMatchingPattern(
+				`BootJarModuleAliases: boot jars "bar" and "foo" are aliased to each other`)).
+			RunTest(t)
+	})
+
+	t.Run("missing module", func(t *testing.T) {
+		android.GroupFixturePreparers(preparer, library("foo"),
+			aliases(map[string]string{"foo": "missing"})).
+			ExtendWithErrorHandler(android.FixtureExpectsAtLeastOneErrorMatchingPattern(
+				`BootJarModuleAliases: module "missing" of boot jar "foo" is not in the build`)).
+			RunTest(t)
+	})
+
+	t.Run("make vars", func(t *testing.T) {
+		classpathVars := func(result *android.TestResult) map[string]string {
+			vars := map[string]string{}
+			for _, v := range result.MakeVarsForTesting(func(variable android.MakeVarVariable) bool {
+				return variable.Name() == "DEXPREOPT_BOOT_JARS_MODULES" ||
+					variable.Name() == "DEXPREOPT_BOOTCLASSPATH_DEX_LOCATIONS" ||
+					variable.Name() == "DEXPREOPT_BOOTCLASSPATH_DEX_FILES"
+			}) {
+				vars[v.Name()] = v.Value()
+			}
+			return vars
+		}
+
+		plain := android.GroupFixturePreparers(preparer, library("foo")).RunTest(t)
+		aliased := android.GroupFixturePreparers(preparer, library("foo-minus-apex"),
+			aliases(map[string]string{"foo": "foo-minus-apex"})).RunTest(t)
+		android.AssertDeepEquals(t, "make vars", classpathVars(plain), classpathVars(aliased))
+	})
+}
+
+// fakeDexpreoptConfigSource is a dexpreoptConfigSource for computing the boot image configs and the
+// classpaths for the given global config and targets, without running a test fixture.
+type fakeDexpreoptConfigSource struct {
+	ctx           android.PathContext
+	global        *dexpreopt.GlobalConfig
+	deviceTargets []android.Target
+	values        map[android.OnceKey]interface{}
+}
+
+func newFakeDexpreoptConfigSource(t testing.TB, targets ...android.Target) *fakeDexpreoptConfigSource {
+	ctx := android.PathContextForTesting(android.TestConfig(t.TempDir(), nil, "", nil))
+	return &fakeDexpreoptConfigSource{
+		ctx:           ctx,
+		global:        dexpreopt.GlobalConfigForTests(ctx),
+		deviceTargets: targets,
+		values:        make(map[android.OnceKey]interface{}),
+	}
+}
+
+func (s *fakeDexpreoptConfigSource) pathContext() android.PathContext {
+	return s.ctx
+}
+
+func (s *fakeDexpreoptConfigSource) globalConfig() *dexpreopt.GlobalConfig {
+	return s.global
+}
+
+func (s *fakeDexpreoptConfigSource) targets() []android.Target {
+	return s.deviceTargets
+}
+
+func (s *fakeDexpreoptConfigSource) dexpreoptDirName() string {
+	return "dexpreopt_fake"
+}
+
+func (s *fakeDexpreoptConfigSource) once(key android.OnceKey, value func() interface{}) interface{} {
+	if v, ok := s.values[key]; ok {
+		return v
+	}
+	v := value()
+	s.values[key] = v
+	return v
+}
+
+var (
+	fakeArm64Target  = android.Target{Os: android.Android, Arch: android.Arch{ArchType: android.Arm64}}
+	fakeX86_64Target = android.Target{Os: android.Linux, Arch: android.Arch{ArchType: android.X86_64}}
+)
+
+func TestBootImageConfigsFromSource(t *testing.T) {
+	src := newFakeDexpreoptConfigSource(t, fakeArm64Target, fakeX86_64Target)
+	src.global.BootJars = android.CreateTestConfiguredJarList([]string{"com.android.art:core1", "platform:framework"})
+	src.global.ApexBootJars = android.CreateTestConfiguredJarList([]string{"com.android.foo:framework-foo"})
+
+	configs := genBootImageConfigsFromSource(src)
+	boot := configs[frameworkBootImageName]
+
+	android.AssertPathRelativeToTopEquals(t, "dir", "out/soong/dexpreopt_fake/dex_bootjars", boot.dir)
+	android.AssertPathRelativeToTopEquals(t, "symbolsDir", "out/soong/dexpreopt_fake/dex_bootjars_unstripped", boot.symbolsDir)
+	android.AssertPathRelativeToTopEquals(t, "zip", "out/soong/dexpreopt_fake/dex_bootjars/boot.zip", boot.zip)
+	android.AssertPathRelativeToTopEquals(t, "mainline zip", "out/soong/dexpreopt_fake/dex_mainlinejars/mainline.zip", configs[mainlineBootImageName].zip)
+
+	imagesByArch := map[android.ArchType]string{}
+	for _, variant := range boot.variants {
+		imagesByArch[variant.target.Arch.ArchType] = variant.imagePathOnHost.RelativeToTop().String()
+	}
+	android.AssertDeepEquals(t, "images by arch", map[android.ArchType]string{
+		android.Arm64:  "out/soong/dexpreopt_fake/dex_bootjars/android/system/framework/arm64/boot.art",
+		android.X86_64: "out/soong/dexpreopt_fake/dex_bootjars/linux_glibc/system/framework/x86_64/boot.art",
+	}, imagesByArch)
+
+	mainline := configs[mainlineBootImageName]
+	android.AssertIntEquals(t, "mainline variants", 2, len(mainline.variants))
+	android.AssertDeepEquals(t, "mainline dexLocationsDeps", []string{
+		"/apex/com.android.art/javalib/core1.jar",
+		"/system/framework/framework.jar",
+		"/apex/com.android.foo/javalib/framework-foo.jar",
+	}, mainline.variants[0].dexLocationsDeps)
+}
+
+func TestBootImageConfigTargets(t *testing.T) {
+	fakeArmTarget := android.Target{Os: android.Android, Arch: android.Arch{ArchType: android.Arm}}
+	src := newFakeDexpreoptConfigSource(t, fakeArm64Target)
+	src.ctx.Config().Targets = map[android.OsType][]android.Target{
+		android.Android: {fakeArm64Target, fakeArmTarget},
+	}
+	src.global.BootJars = android.CreateTestConfiguredJarList([]string{"platform:framework"})
+
+	android.AssertIntEquals(t, "dexpreopt targets", 2, len(dexpreoptTargets(src.ctx)))
+	for name, image := range genBootImageConfigsFromSource(src) {
+		android.AssertDeepEquals(t, name+" targets", []android.Target{fakeArm64Target}, image.Targets())
+	}
+}
+
+func TestSupportedPreoptArches(t *testing.T) {
+	supportedArches := func(arches ...android.ArchType) android.FixturePreparer {
+		return dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.SupportedPreoptArches = arches
+		})
+	}
+
+	t.Run("mixed", func(t *testing.T) {
+		result := android.GroupFixturePreparers(
+			PrepareForBootImageConfigTest,
+			android.PrepareForTestAccessingMakeVars,
+			supportedArches(android.Arm64),
+		).RunTest(t)
+		ctx := &android.TestPathContext{TestResult: result}
+
+		var arches []android.ArchType
+		for _, target := range defaultBootImageConfig(ctx).Targets() {
+			if target.Os == android.Android {
+				arches = append(arches, target.Arch.ArchType)
+			}
+		}
+		android.AssertDeepEquals(t, "boot image arches", []android.ArchType{android.Arm64}, arches)
+
+		warnings := result.SingletonForTests("dex_bootjars").Output("out/soong/dexpreopt_arm64/warnings.json")
+		android.AssertStringDoesContain(t, "warnings", android.ContentFromFileRuleForTests(t, result.TestContext, warnings),
+			`"message": "target arch arm is not in SupportedPreoptArches, it is not dexpreopted"`)
+
+		vars := result.MakeVarsForTesting(func(variable android.MakeVarVariable) bool {
+			return variable.Name() == "DEX_PREOPT_TARGET_ARCHES"
+		})
+		android.AssertIntEquals(t, "make vars", 1, len(vars))
+		android.AssertStringEquals(t, "DEX_PREOPT_TARGET_ARCHES", "arm64", vars[0].Value())
+	})
+
+	t.Run("all supported", func(t *testing.T) {
+		result := android.GroupFixturePreparers(
+			PrepareForBootImageConfigTest,
+			supportedArches(android.Arm64, android.Arm),
+		).RunTest(t)
+		ctx := &android.TestPathContext{TestResult: result}
+		android.AssertIntEquals(t, "dexpreopt targets", 4, len(dexpreoptTargets(ctx)))
+	})
+
+	t.Run("none supported", func(t *testing.T) {
+		config := android.TestArchConfig("out", nil, "", nil)
+		global := dexpreopt.GlobalConfigForTests(android.PathContextForTesting(config))
+		global.SupportedPreoptArches = []android.ArchType{android.Riscv64}
+		dexpreopt.SetTestGlobalConfig(config, global)
+		ctx := android.PathContextForTesting(config)
+
+		android.AssertIntEquals(t, "device targets", 0, len(dexpreoptDeviceTargets(ctx)))
+		android.AssertStringListContains(t, "reasons", getDexpreoptStatus(ctx).reasons,
+			"boot images: not built: no device targets")
+	})
+}
+
+func TestClasspathsFromSource(t *testing.T) {
+	src := newFakeDexpreoptConfigSource(t, fakeArm64Target)
+	src.global.BootJars = android.CreateTestConfiguredJarList([]string{"platform:framework"})
+	src.global.ClasspathOnlyApexJars = android.CreateTestConfiguredJarList([]string{"com.android.foo:framework-foo"})
+	src.global.SystemServerJars = android.CreateTestConfiguredJarList([]string{"platform:services", "system_ext:service-ext"})
+	src.global.ApexSystemServerJars = android.CreateTestConfiguredJarList([]string{"com.android.foo:service-foo"})
+
+	android.AssertDeepEquals(t, "bootclasspath", []string{
+		"/system/framework/framework.jar",
+		"/apex/com.android.foo/javalib/framework-foo.jar",
+	}, defaultBootclasspathFromSource(src))
+	android.AssertDeepEquals(t, "system server classpath", []string{
+		"/system/framework/services.jar",
+		"/system_ext/framework/service-ext.jar",
+		"/apex/com.android.foo/javalib/service-foo.jar",
+	}, systemServerClasspathFromSource(src))
+}
+
+func TestSystemServerJarsFragments(t *testing.T) {
+	preparer := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		dexpreopt.FixtureSetSystemServerJars("platform:services"),
+		dexpreopt.FixtureSetApexSystemServerJars("com.android.foo:service-foo"),
+		dexpreopt.FixtureRegisterSystemServerJarsFragment("com.android.baz", "service-baz"),
+		dexpreopt.FixtureRegisterSystemServerJarsFragment("com.android.bar", "service-bar1", "service-bar2"),
+	)
+
+	t.Run("merged", func(t *testing.T) {
+		result := preparer.RunTest(t)
+		ctx := &android.TestPathContext{TestResult: result}
+		android.AssertDeepEquals(t, "system server classpath", []string{
+			"/system/framework/services.jar",
+			"/apex/com.android.foo/javalib/service-foo.jar",
+			"/apex/com.android.bar/javalib/service-bar1.jar",
+			"/apex/com.android.bar/javalib/service-bar2.jar",
+			"/apex/com.android.baz/javalib/service-baz.jar",
+		}, systemServerClasspath(ctx))
+		android.AssertDeepEquals(t, "system server jars", []string{
+			"platform:services",
+			"com.android.foo:service-foo",
+			"com.android.bar:service-bar1",
+			"com.android.bar:service-bar2",
+			"com.android.baz:service-baz",
+		}, dexpreopt.GetGlobalConfig(ctx).AllSystemServerJars(ctx).CopyOfApexJarPairs())
+	})
+
+	t.Run("priority", func(t *testing.T) {
+		result := android.GroupFixturePreparers(
+			preparer,
+			dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+				c.SystemServerJarsFragmentApexOrder = []string{"com.android.baz"}
+			}),
+		).RunTest(t)
+		android.AssertDeepEquals(t, "system server classpath", []string{
+			"/system/framework/services.jar",
+			"/apex/com.android.foo/javalib/service-foo.jar",
+			"/apex/com.android.baz/javalib/service-baz.jar",
+			"/apex/com.android.bar/javalib/service-bar1.jar",
+			"/apex/com.android.bar/javalib/service-bar2.jar",
+		}, systemServerClasspath(&android.TestPathContext{TestResult: result}))
+	})
+
+	t.Run("conflict", func(t *testing.T) {
+		android.GroupFixturePreparers(
+			preparer,
+			dexpreopt.FixtureRegisterSystemServerJarsFragment("com.android.bar", "service-foo"),
+		).ExtendWithErrorHandler(android.FixtureExpectsAtLeastOneErrorMatchingPattern(
+			`system server jar "service-foo" is claimed by both ApexSystemServerJars, as com.android.foo:service-foo, and the fragment of apex "com.android.bar"`,
+		)).RunTest(t)
+	})
+}
+
+func TestSystemServerClasspathOverride(t *testing.T) {
+	src := newFakeDexpreoptConfigSource(t, fakeArm64Target)
+	src.global.SystemServerJars = android.CreateTestConfiguredJarList([]string{"platform:services"})
+	src.global.SortSystemServerClasspath = true
+	src.global.SystemServerClasspathOverride = []string{
+		"/system/framework/services.jar",
+		"/apex/com.android.foo/javalib/service-foo.jar",
+		"/system/framework/service-bar.jar",
+	}
+	android.AssertDeepEquals(t, "system server classpath", []string{
+		"/system/framework/services.jar",
+		"/apex/com.android.foo/javalib/service-foo.jar",
+		"/system/framework/service-bar.jar",
+	}, systemServerClasspathFromSource(src))
+
+	android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.SystemServerClasspathOverride = []string{"/system/framework/services.jar", "framework/service-bar.jar"}
+		}),
+	).ExtendWithErrorHandler(android.FixtureExpectsAtLeastOneErrorMatchingPattern(
+		`SystemServerClasspathOverride entry "framework/service-bar.jar" must be an absolute path`,
+	)).RunTest(t)
+}
+
+// BenchmarkConfigsFromSource computes the boot image configs and the classpaths of a synthetic
+// config with 1,000 boot jars and 1,000 system server jars, to catch quadratic behaviors.
+func BenchmarkConfigsFromSource(b *testing.B) {
+	syntheticJars := func(apex, prefix string, n int) android.ConfiguredJarList {
+		jars := make([]string, n)
+		for i := range jars {
+			jars[i] = fmt.Sprintf("%s:%s%d", apex, prefix, i)
+		}
+		return android.CreateTestConfiguredJarList(jars)
+	}
+
+	src := newFakeDexpreoptConfigSource(b, fakeArm64Target, fakeX86_64Target)
+	src.global.BootJars = syntheticJars("platform", "framework", 500)
+	src.global.ApexBootJars = syntheticJars("com.android.foo", "framework-foo", 500)
+	src.global.SystemServerJars = syntheticJars("platform", "service", 500)
+	src.global.ApexSystemServerJars = syntheticJars("com.android.foo", "service-foo", 500)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		src.values = make(map[android.OnceKey]interface{})
+		genBootImageConfigsFromSource(src)
+		defaultBootclasspathFromSource(src)
+		systemServerClasspathFromSource(src)
+	}
+}
+
+func TestBootImageInstallDir(t *testing.T) {
+	result := PrepareForBootImageConfigTest.RunTest(t)
+	image := defaultBootImageConfig(&android.TestPathContext{TestResult: result})
+
+	dir, ok := image.InstallDir(android.Arm64)
+	android.AssertBoolEquals(t, "arm64 found", true, ok)
+	android.AssertStringEquals(t, "arm64", "/system/framework/arm64", dir)
+
+	_, ok = image.InstallDir(android.Riscv64)
+	android.AssertBoolEquals(t, "riscv64 found", false, ok)
+}
+
+func TestBootclasspathFragments(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		FixtureConfigureBootJars("com.android.art:core1", "platform:framework", "com.android.art:core2", "system_ext:ext"),
+	).RunTest(t)
+
+	ctx := &android.TestPathContext{TestResult: result}
+
+	android.AssertDeepEquals(t, "fragments", map[string][]string{
+		"com.android.art": {"core1", "core2"},
+		"platform":        {"framework", "ext"},
+	}, bootclasspathFragments(ctx))
+	android.AssertIntEquals(t, "apex count", 2, bootJarApexCount(ctx))
+}
+
+func TestTotalBootJarCount(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		PrepareApexBootJarConfigs,
+	).RunTest(t)
+	ctx := &android.TestPathContext{TestResult: result}
+
+	// core1 and core2 are in both the boot jars and the ART apex jars. framework-foo and
+	// framework-bar are not in the default boot image.
+	android.AssertIntEquals(t, "total boot jar count", 5, totalBootJarCount(ctx))
+
+	vars := result.MakeVarsForTesting(func(variable android.MakeVarVariable) bool {
+		return variable.Name() == "DEXPREOPT_TOTAL_BOOT_JARS_COUNT"
+	})
+	android.AssertIntEquals(t, "make vars", 1, len(vars))
+	android.AssertStringEquals(t, "DEXPREOPT_TOTAL_BOOT_JARS_COUNT", "5", vars[0].Value())
+}
+
+func TestValidateDexpreoptModulesExist(t *testing.T) {
+	android.GroupFixturePreparers(
+		PrepareForTestWithDexpreopt,
+		FixtureConfigureBootJars("platform:foo"),
+		dexpreopt.FixtureSetSystemServerJars("platform:missing1", "platform:foo"),
+		dexpreopt.FixtureSetApexSystemServerJars("com.android.foo:missing2"),
+		dexpreopt.FixtureSetStandaloneSystemServerJars("platform:missing3"),
+		android.FixtureWithRootAndroidBp(`
+			platform_bootclasspath {
+				name: "platform-bootclasspath",
+			}
+
+			java_library {
+				name: "foo",
+				srcs: ["a.java"],
+				system_modules: "none",
+				sdk_version: "none",
+				compile_dex: true,
+			}
+		`),
+	).ExtendWithErrorHandler(android.FixtureExpectsAtLeastOneErrorMatchingPattern(
+		`dexpreopt config references modules that are not in the build: missing1, missing3, missing2`,
+	)).RunTest(t)
+}
+
+func TestValidateDexpreoptModulesExistOnDeviceImageGeneration(t *testing.T) {
+	android.GroupFixturePreparers(
+		PrepareForTestWithDexpreopt,
+		FixtureConfigureBootJars("platform:foo"),
+		dexpreopt.FixtureSetClasspathOnlyApexJars("com.android.baz:missing-boot"),
+		dexpreopt.FixtureSetSystemServerJars("platform:missing1"),
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.OnDeviceImageGeneration = true
+		}),
+		android.FixtureWithRootAndroidBp(`
+			platform_bootclasspath {
+				name: "platform-bootclasspath",
+			}
+
+			java_library {
+				name: "foo",
+				srcs: ["a.java"],
+				system_modules: "none",
+				sdk_version: "none",
+				compile_dex: true,
+			}
+		`),
+	).ExtendWithErrorHandler(android.FixtureExpectsAtLeastOneErrorMatchingPattern(
+		`dexpreopt config references modules that are not in the build: missing-boot, missing1`,
+	)).RunTest(t)
+}
+
+func TestDex2oatBinaryByArch(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.Dex2oatBinaryByArch = map[android.ArchType]string{
+				android.Arm64: "prebuilts/dex2oat/arm64/dex2oat",
+				// Not a dexpreopt target, so it is not surfaced on the boot image configs.
+				android.Riscv64: "prebuilts/dex2oat/riscv64/dex2oat",
+			}
+		}),
+	).RunTest(t)
+
+	ctx := &android.TestPathContext{TestResult: result}
+
+	android.AssertDeepEquals(t, "dex2oat binaries", map[android.ArchType]string{
+		android.Arm64: "prebuilts/dex2oat/arm64/dex2oat",
+	}, defaultBootImageConfig(ctx).dex2oatBinaryByArch)
+
+	android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.Dex2oatBinaryByArch = map[android.ArchType]string{android.Arm: ""}
+		}),
+	).ExtendWithErrorHandler(android.FixtureExpectsAtLeastOneErrorMatchingPattern(
+		`Dex2oatBinaryByArch has an empty path for arm`,
+	)).RunTest(t)
+}
+
+func TestDex2oatImageThreads(t *testing.T) {
+	settings := func(image *bootImageConfig) map[string]string {
+		m := make(map[string]string)
+		for _, variant := range image.variants {
+			if variant.target.Os == android.Android {
+				m[variant.target.Arch.ArchType.String()] = variant.Dex2oatThreads() + " " + variant.Dex2oatCpuSet()
+			}
+		}
+		return m
+	}
+
+	result := PrepareForBootImageConfigTest.RunTest(t)
+	ctx := &android.TestPathContext{TestResult: result}
+	android.AssertDeepEquals(t, "defaults", map[string]string{"arm64": " ", "arm": " "}, settings(defaultBootImageConfig(ctx)))
+
+	result = android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.Dex2oatImageThreads = "8"
+			c.Dex2oatImageCpuSet = "0,1,2,3"
+			c.Dex2oatImageThreadsByArch = map[android.ArchType]string{android.Arm: "2"}
+		}),
+	).RunTest(t)
+	ctx = &android.TestPathContext{TestResult: result}
+
+	// The arm override beats the global default.
+	android.AssertDeepEquals(t, "settings", map[string]string{
+		"arm64": "8 0,1,2,3",
+		"arm":   "2 0,1,2,3",
+	}, settings(defaultBootImageConfig(ctx)))
+
+	vars := result.MakeVarsForTesting(func(variable android.MakeVarVariable) bool {
+		return variable.Name() == "DEXPREOPT_IMAGE_DEX2OAT_THREADS_boot_arm"
+	})
+	android.AssertIntEquals(t, "make vars", 1, len(vars))
+	android.AssertStringEquals(t, "make var", "2", vars[0].Value())
+
+	android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.Dex2oatImageThreads = "0"
+			c.Dex2oatImageCpuSet = "0-3"
+			c.Dex2oatImageCpuSetByArch = map[android.ArchType]string{android.Arm: "1,,2"}
+		}),
+	).ExtendWithErrorHandler(android.FixtureExpectsAllErrorsToMatchAPattern([]string{
+		`Dex2oatImageThreads: "0" is not a positive integer`,
+		`Dex2oatImageCpuSet: "0-3" is not a comma separated list of cpu numbers`,
+		`Dex2oatImageCpuSetByArch\[arm\]: "1,,2" is not a comma separated list of cpu numbers`,
+	})).RunTest(t)
+}
+
+func TestDisablePreoptModulesPatterns(t *testing.T) {
+	preparer := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		android.FixtureAddTextFile("services/Android.bp", `
+			java_library {
+				name: "service-testing",
+				srcs: ["a.java"],
+			}
+		`),
+		android.FixtureAddFile("services/a.java", nil),
+		dexpreopt.FixtureSetSystemServerJars("platform:service-testing", "platform:service-foo", "platform:services"),
+	)
+
+	result := android.GroupFixturePreparers(
+		preparer,
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.DisablePreoptModules = []string{"*-testing", "service-*", "services"}
+		}),
+	).RunTest(t)
+
+	explain := result.SingletonForTests("dex_bootjars").Output("out/soong/dexpreopt_arm64/dexpreopt_explain.txt")
+	android.AssertStringEquals(t, "explain", `platform:service-testing: not preopted: matches DisablePreoptModules entry "*-testing"
+platform:service-foo: not preopted: matches DisablePreoptModules entry "service-*"
+platform:services: not preopted: matches DisablePreoptModules entry "services"
+`, android.ContentFromFileRuleForTests(t, result.TestContext, explain))
+
+	typo := dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+		c.DisablePreoptModules = []string{"*-tseting", "missing-literal"}
+	})
+
+	android.GroupFixturePreparers(
+		preparer,
+		typo,
+	).ExtendWithErrorHandler(android.FixtureExpectsAtLeastOneErrorMatchingPattern(
+		`DisablePreoptModules pattern "\*-tseting" does not match any module`,
+	)).RunTest(t)
+
+	android.GroupFixturePreparers(
+		preparer,
+		typo,
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.AllowUnmatchedDisablePreoptModules = true
+		}),
+	).RunTest(t)
+}
+
+func TestBootImageProfileTextPath(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.BootImageProfileText = map[string]string{
+				"boot": "device/foo/boot-image-profile.txt",
+			}
+		}),
+	).RunTest(t)
+
+	ctx := &android.TestPathContext{TestResult: result}
+
+	path, ok := defaultBootImageConfig(ctx).ProfileTextPath(ctx)
+	android.AssertBoolEquals(t, "ok", true, ok)
+	android.AssertPathRelativeToTopEquals(t, "path", "device/foo/boot-image-profile.txt", path)
+
+	_, ok = mainlineBootImageConfig(ctx).ProfileTextPath(ctx)
+	android.AssertBoolEquals(t, "mainline ok", false, ok)
+}
+
+func TestDisableBootImageSymbols(t *testing.T) {
+	preparer := android.GroupFixturePreparers(
+		PrepareForTestWithDexpreopt,
+		FixtureConfigureBootJars("platform:foo"),
+		android.FixtureWithRootAndroidBp(`
+			platform_bootclasspath {
+				name: "platform-bootclasspath",
+			}
+
+			java_library {
+				name: "foo",
+				srcs: ["a.java"],
+				system_modules: "none",
+				sdk_version: "none",
+				compile_dex: true,
+			}
+		`),
+	)
+
+	bootImage := "out/soong/dexpreopt_arm64/dex_bootjars/android/system/framework/arm64/boot.oat"
+	unstripped := "out/soong/dexpreopt_arm64/dex_bootjars_unstripped/android/system/framework/arm64/boot.oat"
+
+	t.Run("enabled", func(t *testing.T) {
+		result := preparer.RunTest(t)
+		ctx := &android.TestPathContext{TestResult: result}
+		android.AssertBoolEquals(t, "hasSymbols", true, defaultBootImageConfig(ctx).hasSymbols())
+
+		dexBootJars := result.ModuleForTests("dex_bootjars", "android_common")
+		rule := dexBootJars.Output(bootImage)
+		android.AssertStringListContains(t, "outputs", rule.AllOutputs(), unstripped)
+		android.AssertStringDoesContain(t, "command", rule.RuleParams.Command, "--oat-symbols=")
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		result := android.GroupFixturePreparers(
+			preparer,
+			dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+				c.DisableBootImageSymbols = true
+			}),
+		).RunTest(t)
+		ctx := &android.TestPathContext{TestResult: result}
+		android.AssertBoolEquals(t, "hasSymbols", false, defaultBootImageConfig(ctx).hasSymbols())
+
+		dexBootJars := result.ModuleForTests("dex_bootjars", "android_common")
+		rule := dexBootJars.Output(bootImage)
+		android.AssertStringListDoesNotContain(t, "outputs", rule.AllOutputs(), unstripped)
+		android.AssertStringDoesNotContain(t, "command", rule.RuleParams.Command, "--oat-symbols=")
+	})
+}
+
+func TestBootJarPathByLocation(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		dexpreopt.FixtureSetClasspathOnlyApexJars("com.android.baz:framework-baz"),
+	).RunTest(t)
+
+	ctx := &android.TestPathContext{TestResult: result}
+
+	actual := map[string]string{}
+	for location, path := range bootJarPathByLocation(ctx) {
+		if path == nil {
+			actual[location] = "nil"
+		} else {
+			actual[location] = path.RelativeToTop().String()
+		}
+	}
+	android.AssertDeepEquals(t, "paths by location", map[string]string{
+		"/apex/com.android.art/javalib/core1.jar":         "out/soong/dexpreopt_arm64/dex_bootjars_input/core1.jar",
+		"/apex/com.android.art/javalib/core2.jar":         "out/soong/dexpreopt_arm64/dex_bootjars_input/core2.jar",
+		"/system/framework/framework.jar":                 "out/soong/dexpreopt_arm64/dex_bootjars_input/framework.jar",
+		"/apex/com.android.baz/javalib/framework-baz.jar": "nil",
+	}, actual)
+
+	file := result.SingletonForTests("dex_bootjars").Output("out/soong/dexpreopt_arm64/boot_jar_paths_by_location.txt")
+	android.AssertStringEquals(t, "file", `/apex/com.android.art/javalib/core1.jar out/soong/dexpreopt_arm64/dex_bootjars_input/core1.jar
+/apex/com.android.art/javalib/core2.jar out/soong/dexpreopt_arm64/dex_bootjars_input/core2.jar
+/system/framework/framework.jar out/soong/dexpreopt_arm64/dex_bootjars_input/framework.jar
+/apex/com.android.baz/javalib/framework-baz.jar UNAVAILABLE
+`, android.StringRelativeToTop(result.Config, android.ContentFromFileRuleForTests(t, result.TestContext, file)))
+}
+
+func TestBootclasspathIndex(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		PrepareApexBootJarConfigs,
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.ClasspathOnlyApexJars = android.CreateTestConfiguredJarList([]string{"com.android.baz:framework-baz"})
+		}),
+		android.FixtureModifyProductVariables(func(variables android.FixtureProductVariables) {
+			variables.ConfiguredJarLocationOverrides = []string{"com.android.bar:framework-bar:com.android.bar:bar-stem"}
+		}),
+	).RunTest(t)
+	ctx := &android.TestPathContext{TestResult: result}
+
+	for _, tc := range []struct {
+		jar   string
+		index int
+		ok    bool
+	}{
+		{jar: "framework", index: 2, ok: true},
+		{jar: "platform:framework", index: 2, ok: true},
+		{jar: "com.android.art:core1", index: 0, ok: true},
+		{jar: "framework-foo", index: 3, ok: true},
+		{jar: "com.android.bar:framework-bar", index: 4, ok: true},
+		{jar: "bar-stem", index: 4, ok: true},
+		// Classpath-only apex jars are on the boot class path, but not in any boot image.
+		{jar: "com.android.baz:framework-baz", index: 5, ok: true},
+		{jar: "extra1", ok: false},
+		{jar: "platform:core1", ok: false},
+	} {
+		index, ok := bootclasspathIndexOf(ctx, tc.jar)
+		android.AssertBoolEquals(t, tc.jar+" on the boot class path", tc.ok, ok)
+		android.AssertIntEquals(t, tc.jar+" index", tc.index, index)
+	}
+}
+
+func TestAllDexpreoptOutputDirs(t *testing.T) {
+	dirs := func(t *testing.T, preparers ...android.FixturePreparer) []string {
+		result := android.GroupFixturePreparers(PrepareForBootImageConfigTest, android.GroupFixturePreparers(preparers...)).RunTest(t)
+		ctx := &android.TestPathContext{TestResult: result}
+		var paths android.Paths
+		for _, dir := range allDexpreoptOutputDirs(ctx) {
+			paths = append(paths, dir)
+		}
+		return android.PathsRelativeToTop(paths)
+	}
+
+	android.AssertDeepEquals(t, "dirs", []string{
+		"out/soong/dexpreopt_arm64/dex_artjars",
+		"out/soong/dexpreopt_arm64/dex_artjars_input",
+		"out/soong/dexpreopt_arm64/dex_artjars_unstripped",
+		"out/soong/dexpreopt_arm64/dex_bootjars",
+		"out/soong/dexpreopt_arm64/dex_bootjars_input",
+		"out/soong/dexpreopt_arm64/dex_bootjars_unstripped",
+		"out/soong/dexpreopt_arm64/dex_mainlinejars",
+		"out/soong/dexpreopt_arm64/dex_mainlinejars_input",
+		"out/soong/dexpreopt_arm64/dex_mainlinejars_unstripped",
+	}, dirs(t))
+
+	android.AssertDeepEquals(t, "dirs without symbols", []string{
+		"out/soong/dexpreopt_arm64/dex_artjars",
+		"out/soong/dexpreopt_arm64/dex_artjars_input",
+		"out/soong/dexpreopt_arm64/dex_bootjars",
+		"out/soong/dexpreopt_arm64/dex_bootjars_input",
+		"out/soong/dexpreopt_arm64/dex_mainlinejars",
+		"out/soong/dexpreopt_arm64/dex_mainlinejars_input",
+	}, dirs(t, dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+		c.DisableBootImageSymbols = true
+	})))
+}
+
+func TestBootJarsList(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		PrepareApexBootJarConfigs,
+	).RunTest(t)
+
+	// The apex boot jars are not in the default boot image.
+
+	file := result.SingletonForTests("dex_bootjars").Output("out/soong/dexpreopt_arm64/boot_jars.txt")
+	android.AssertStringEquals(t, "file", `core1
+core2
+framework
+`, android.ContentFromFileRuleForTests(t, result.TestContext, file))
+}
+
+func TestSystemServerPreoptTargets(t *testing.T) {
+	arches := func(targets []android.Target) []string {
+		var names []string
+		for _, target := range targets {
+			names = append(names, target.Arch.ArchType.String())
+		}
+		return names
+	}
+
+	result := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+	).RunTest(t)
+	ctx := &android.TestPathContext{TestResult: result}
+	android.AssertDeepEquals(t, "dexpreopt targets", []string{"arm64", "arm", "x86_64", "x86"}, arches(dexpreoptTargets(ctx)))
+	android.AssertDeepEquals(t, "system server targets", []string{"arm64"}, arches(systemServerPreoptTargets(ctx)))
+
+	result = android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.SystemServerPreoptArches = []android.ArchType{android.Arm}
+		}),
+	).RunTest(t)
+	ctx = &android.TestPathContext{TestResult: result}
+	android.AssertDeepEquals(t, "configured system server targets", []string{"arm"}, arches(systemServerPreoptTargets(ctx)))
+}
+
+func TestDexpreoptSystemserverCheckArtifacts(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForTestWithDexpreopt,
+		android.FixtureRegisterWithContext(RegisterDexpreoptCheckBuildComponents),
+		dexpreopt.FixtureSetSystemServerJars("platform:service-platform"),
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.SystemServerPreoptArches = []android.ArchType{android.Arm64, android.Arm}
+		}),
+	).RunTestWithBp(t, `
+		dexpreopt_systemserver_check {
+			name: "dexpreopt_systemserver_check",
+		}`)
+
+	check := result.ModuleForTests("dexpreopt_systemserver_check", "android_common").Module().(*dexpreoptSystemserverCheck)
+	android.AssertDeepEquals(t, "artifacts", []string{
+		"out/soong/target/product/test_device/system/framework/oat/arm64/service-platform.odex",
+		"out/soong/target/product/test_device/system/framework/oat/arm64/service-platform.vdex",
+		"out/soong/target/product/test_device/system/framework/oat/arm/service-platform.odex",
+		"out/soong/target/product/test_device/system/framework/oat/arm/service-platform.vdex",
+	}, check.artifactsByModuleName["service-platform"])
+}
+
+func TestBootclasspathAllowlist(t *testing.T) {
+	android.AssertDeepEquals(t, "parsed", []string{"com.android.art:core1", "platform:framework"},
+		parseBootclasspathAllowlist("# Approved jars.\ncom.android.art:core1  # The core.\n\n  \nplatform:framework\n"))
+
+	writeAllowlist := func(data string) string {
+		path := filepath.Join(t.TempDir(), "allowlist.txt")
+		if err := os.WriteFile(path, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	approved := writeAllowlist("com.android.art:core1\ncom.android.art:core2\nplatform:framework\n")
+	android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.BootclasspathAllowlist = approved
+		}),
+	).RunTest(t)
+
+	unapproved := writeAllowlist("# Only the ART jars.\ncom.android.art:core1\ncom.android.art:core2\n")
+	android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.BootclasspathAllowlist = unapproved
+		}),
+	).ExtendWithErrorHandler(android.FixtureExpectsAtLeastOneErrorMatchingPattern(
+		`Boot class path jars are not approved in .*allowlist.txt: platform:framework`)).
+		RunTest(t)
+}
+
+func TestAllowedBootJarApexes(t *testing.T) {
+	preparer := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		FixtureConfigureApexBootJars("com.android.foo:framework-foo", "com.android.bar:framework-bar"),
+	)
+
+	// An empty allowlist disables the check.
+	preparer.RunTest(t)
+
+	android.GroupFixturePreparers(
+		preparer,
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.AllowedBootJarApexes = []string{"com.android.foo", "com.android.bar"}
+		}),
+	).RunTest(t)
+
+	android.GroupFixturePreparers(
+		preparer,
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.AllowedBootJarApexes = []string{"com.android.foo"}
+		}),
+	).ExtendWithErrorHandler(android.FixtureExpectsAtLeastOneErrorMatchingPattern(
+		`Apex boot jar "framework-bar" is in apex "com.android.bar", which is not in AllowedBootJarApexes`)).
+		RunTest(t)
+}
+
+func TestOnDeviceLocationPrefix(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		dexpreopt.FixtureSetSystemServerJars("platform:services"),
+		dexpreopt.FixtureSetApexSystemServerJars("com.android.foo:service-foo"),
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.OnDeviceLocationPrefix = "/tmp/sandbox"
+		}),
+	).RunTest(t)
+	ctx := &android.TestPathContext{TestResult: result}
+
+	android.AssertDeepEquals(t, "system server classpath", []string{
+		"/tmp/sandbox/system/framework/services.jar",
+		"/tmp/sandbox/apex/com.android.foo/javalib/service-foo.jar",
+	}, systemServerClasspath(ctx))
+
+	android.AssertDeepEquals(t, "boot image locations", []string{
+		"/tmp/sandbox/apex/com.android.art/javalib/core1.jar",
+		"/tmp/sandbox/apex/com.android.art/javalib/core2.jar",
+		"/tmp/sandbox/system/framework/framework.jar",
+	}, defaultBootImageConfig(ctx).getAnyAndroidVariant().dexLocations)
+
+	android.AssertDeepEquals(t, "fragments", map[string][]string{
+		"com.android.art": {"core1", "core2"},
+		"platform":        {"framework"},
+	}, bootclasspathFragments(ctx))
+}
+
+func TestRelativeArtifactPaths(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForTestWithDexpreopt,
+		FixtureConfigureBootJars("platform:foo"),
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.RelativeArtifactPaths = true
+		}),
+		android.FixtureWithRootAndroidBp(`
+			platform_bootclasspath {
+				name: "platform-bootclasspath",
+			}
+
+			java_library {
+				name: "foo",
+				srcs: ["a.java"],
+				system_modules: "none",
+				sdk_version: "none",
+				compile_dex: true,
+			}
+		`),
+	).RunTest(t)
+	ctx := &android.TestPathContext{TestResult: result}
+	outDir := result.Config.OutDir()
+
+	// The dexpreopt config for Make is a verbatim copy of the product config, so it is not checked.
+	dexpreoptDir := filepath.Join(result.Config.SoongOutDir(), dexpreopt.GetDexpreoptDirName(ctx))
+	singleton := result.SingletonForTests("dex_bootjars")
+	checked := 0
+	for _, output := range singleton.AllOutputs() {
+		if filepath.Dir(output) != dexpreoptDir || filepath.Base(output) == "dexpreopt.config" {
+			continue
+		}
+		content := android.ContentFromFileRuleForTests(t, result.TestContext, singleton.Output(output))
+		android.AssertStringDoesNotContain(t, output, content, outDir)
+		checked++
+	}
+	if checked == 0 {
+		t.Errorf("no artifacts found in %s", dexpreoptDir)
+	}
+
+	for _, name := range getImageNames() {
+		path := bootImageModulesStatePath(ctx, genBootImageConfigs(ctx)[name])
+		content := android.ContentFromFileRuleForTests(t, result.TestContext, singleton.Output(path.String()))
+		android.AssertStringDoesNotContain(t, path.String(), content, outDir)
+	}
+
+	file := singleton.Output("out/soong/dexpreopt_arm64/boot_jar_paths_by_location.txt")
+	android.AssertStringEquals(t, "boot jar paths",
+		"/system/framework/foo.jar out/soong/dexpreopt_arm64/dex_bootjars_input/foo.jar\n",
+		android.ContentFromFileRuleForTests(t, result.TestContext, file))
+}
+
+func TestPreoptPriorityJars(t *testing.T) {
+	preparer := android.GroupFixturePreparers(
+		PrepareForTestWithDexpreopt,
+		FixtureConfigureBootJars("platform:bar", "platform:baz", "platform:foo"),
+		android.FixtureWithRootAndroidBp(`
+			platform_bootclasspath {
+				name: "platform-bootclasspath",
+			}
+
+			java_library {
+				name: "bar",
+				srcs: ["a.java"],
+				system_modules: "none",
+				sdk_version: "none",
+				compile_dex: true,
+			}
+
+			java_library {
+				name: "baz",
+				srcs: ["a.java"],
+				system_modules: "none",
+				sdk_version: "none",
+				compile_dex: true,
+			}
+
+			java_library {
+				name: "foo",
+				srcs: ["a.java"],
+				system_modules: "none",
+				sdk_version: "none",
+				compile_dex: true,
+			}
+		`),
+	)
+
+	stagedJars := func(result *android.TestResult) []string {
+		var jars []string
+		for _, output := range result.ModuleForTests("dex_bootjars", "android_common").AllOutputs() {
+			if filepath.Base(filepath.Dir(output)) == "dex_bootjars_input" {
+				jars = append(jars, filepath.Base(output))
+			}
+		}
+		return jars
+	}
+
+	t.Run("default", func(t *testing.T) {
+		result := preparer.RunTest(t)
+		ctx := &android.TestPathContext{TestResult: result}
+		android.AssertIntEquals(t, "priority", 0, priorityFor(ctx, "foo"))
+		android.AssertDeepEquals(t, "staged jars", []string{"bar.jar", "baz.jar", "foo.jar"}, stagedJars(result))
+	})
+
+	t.Run("priority", func(t *testing.T) {
+		result := android.GroupFixturePreparers(
+			preparer,
+			dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+				c.PreoptPriorityJars = []string{"foo", "baz"}
+			}),
+		).RunTest(t)
+		ctx := &android.TestPathContext{TestResult: result}
+		android.AssertIntEquals(t, "foo priority", 0, priorityFor(ctx, "foo"))
+		android.AssertIntEquals(t, "baz priority", 1, priorityFor(ctx, "baz"))
+		android.AssertIntEquals(t, "bar priority", 2, priorityFor(ctx, "bar"))
+		android.AssertDeepEquals(t, "staged jars", []string{"foo.jar", "baz.jar", "bar.jar"}, stagedJars(result))
+	})
+}
+
+func TestPreoptPriorityJarsManifest(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		dexpreopt.FixtureSetApexSystemServerJars("com.android.foo:service-foo", "com.android.bar:service-bar"),
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.PreoptPriorityJars = []string{"service-bar"}
+		}),
+	).RunTest(t)
+	ctx := &android.TestPathContext{TestResult: result}
+
+	android.AssertDeepEquals(t, "manifest", []systemServerJarsManifestEntry{
+		{Module: "service-foo", Apex: "com.android.foo", Location: "/apex/com.android.foo/javalib/service-foo.jar"},
+		{Module: "service-bar", Apex: "com.android.bar", Location: "/apex/com.android.bar/javalib/service-bar.jar", Priority: 1},
+	}, systemServerJarsManifest(ctx))
+}
+
+func TestBootImageModuleLocations(t *testing.T) {
+	withArtBootImageJars := func(jars ...string) android.FixturePreparer {
+		return android.GroupFixturePreparers(
+			PrepareForBootImageConfigTest,
+			dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+				c.TestOnlyArtBootImageJars = android.CreateTestConfiguredJarList(jars)
+			}),
+		)
+	}
+
+	// The art boot image is installed into an apex, so it may load the ART apex jars from another
+	// location than the default boot image does.
+	withArtBootImageJars("platform:core1", "com.android.art:core2").RunTest(t)
+
+	withArtBootImageJars("com.android.art:core1", "com.android.art:core2", "com.android.foo:framework").
+		ExtendWithErrorHandler(android.FixtureExpectsAtLeastOneErrorMatchingPattern(
+			`Boot images resolve module "framework" to different locations: art: /apex/com.android.foo/javalib/framework.jar, boot: /system/framework/framework.jar`)).
+		RunTest(t)
+}
+
+func TestInstallDirStemCollisions(t *testing.T) {
+	android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		FixtureConfigureBootJars("com.android.art:core1", "com.android.art:core2", "platform:framework", "platform:framework-ext"),
+		android.FixtureModifyProductVariables(func(variables android.FixtureProductVariables) {
+			variables.ConfiguredJarLocationOverrides = []string{"platform:framework-ext:platform:framework"}
+		}),
+	).ExtendWithErrorHandler(android.FixtureExpectsAtLeastOneErrorMatchingPattern(
+		`Boot image modules "framework" and "framework-ext" have the same stem "framework" and are both installed to /system/framework`)).
+		RunTest(t)
+}
+
+// TestResolveInstalledJar lists the expected on-device location of representative jars from every
+// dexpreopt config list, with and without ConfiguredJarLocationOverrides. Any change to how jars are
+// mapped to on-device locations must update it.
+func TestResolveInstalledJar(t *testing.T) {
+	overrides := []string{
+		"com.android.art:core-renamed:com.android.art:core-new",
+		"platform:framework-renamed:platform:framework-new",
+		"platform:to-apex:com.android.baz:to-apex",
+		"platform:to-ext:system_ext:to-ext",
+		"com.android.foo:to-platform:platform:to-platform",
+		"com.android.foo:foo-moved:com.android.bar:foo-moved",
+		"com.android.qux:qux-renamed:com.android.qux:qux-new",
+		// The overrides do not apply to system server jars.
+		"platform:services-renamed:platform:services-new",
+		"com.android.foo:service-renamed:com.android.foo:service-new",
+	}
+
+	type entry struct {
+		apexJar  string
+		location string
+	}
+	lists := []struct {
+		name    string
+		origin  jarOrigin
+		entries []entry
+	}{
+		{"BootJars", bootclasspathOrigin, []entry{
+			{"com.android.art:core1", "/apex/com.android.art/javalib/core1.jar"},
+			{"com.android.art:core-renamed", "/apex/com.android.art/javalib/core-new.jar"},
+			{"com.android.i18n:core-icu4j", "/apex/com.android.i18n/javalib/core-icu4j.jar"},
+			{"com.android.conscrypt:conscrypt", "/apex/com.android.conscrypt/javalib/conscrypt.jar"},
+			{"platform:framework", "/system/framework/framework.jar"},
+			{"platform:framework-renamed", "/system/framework/framework-new.jar"},
+			{"platform:to-apex", "/apex/com.android.baz/javalib/to-apex.jar"},
+			{"platform:to-ext", "/system_ext/framework/to-ext.jar"},
+			{"system_ext:ext", "/system_ext/framework/ext.jar"},
+			{"com.android.foo:to-platform", "/system/framework/to-platform.jar"},
+		}},
+		{"ApexBootJars", bootclasspathOrigin, []entry{
+			{"com.android.foo:framework-foo", "/apex/com.android.foo/javalib/framework-foo.jar"},
+			{"com.android.foo:foo-moved", "/apex/com.android.bar/javalib/foo-moved.jar"},
+			{"com.android.bar:framework-bar", "/apex/com.android.bar/javalib/framework-bar.jar"},
+			{"com.android.tethering:framework-tethering", "/apex/com.android.tethering/javalib/framework-tethering.jar"},
+		}},
+		{"ClasspathOnlyApexJars", bootclasspathOrigin, []entry{
+			{"com.android.qux:framework-qux", "/apex/com.android.qux/javalib/framework-qux.jar"},
+			{"com.android.qux:qux-renamed", "/apex/com.android.qux/javalib/qux-new.jar"},
+		}},
+		{"SystemServerJars", systemServerOrigin, []entry{
+			{"platform:services", "/system/framework/services.jar"},
+			{"platform:services-renamed", "/system/framework/services-renamed.jar"},
+			{"platform:wifi-service", "/system/framework/wifi-service.jar"},
+			{"system_ext:service-ext", "/system_ext/framework/service-ext.jar"},
+		}},
+		{"ApexSystemServerJars", systemServerOrigin, []entry{
+			{"com.android.foo:service-foo", "/apex/com.android.foo/javalib/service-foo.jar"},
+			{"com.android.foo:service-renamed", "/apex/com.android.foo/javalib/service-renamed.jar"},
+			{"com.android.bar:service-bar", "/apex/com.android.bar/javalib/service-bar.jar"},
+			{"com.android.art:service-art", "/apex/com.android.art/javalib/service-art.jar"},
+		}},
+		{"StandaloneSystemServerJars", systemServerOrigin, []entry{
+			{"platform:standalone", "/system/framework/standalone.jar"},
+			{"system_ext:standalone-ext", "/system_ext/framework/standalone-ext.jar"},
+		}},
+		{"ApexStandaloneSystemServerJars", systemServerOrigin, []entry{
+			{"com.android.foo:standalone-foo", "/apex/com.android.foo/javalib/standalone-foo.jar"},
+			{"com.android.bar:standalone-bar", "/apex/com.android.bar/javalib/standalone-bar.jar"},
+		}},
+	}
+
+	apexJarsOf := func(name string) []string {
+		var apexJars []string
+		for _, list := range lists {
+			if list.name == name {
+				for _, e := range list.entries {
+					apexJars = append(apexJars, e.apexJar)
+				}
+			}
+		}
+		return apexJars
+	}
+	locationsOf := func(names ...string) []string {
+		var locations []string
+		for _, list := range lists {
+			if android.InList(list.name, names) {
+				for _, e := range list.entries {
+					locations = append(locations, e.location)
+				}
+			}
+		}
+		return locations
+	}
+
+	result := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		FixtureConfigureBootJars(apexJarsOf("BootJars")...),
+		FixtureConfigureApexBootJars(apexJarsOf("ApexBootJars")...),
+		dexpreopt.FixtureSetClasspathOnlyApexJars(apexJarsOf("ClasspathOnlyApexJars")...),
+		dexpreopt.FixtureSetSystemServerJars(apexJarsOf("SystemServerJars")...),
+		dexpreopt.FixtureSetApexSystemServerJars(apexJarsOf("ApexSystemServerJars")...),
+		dexpreopt.FixtureSetStandaloneSystemServerJars(apexJarsOf("StandaloneSystemServerJars")...),
+		dexpreopt.FixtureSetApexStandaloneSystemServerJars(apexJarsOf("ApexStandaloneSystemServerJars")...),
+		android.FixtureModifyProductVariables(func(variables android.FixtureProductVariables) {
+			variables.ConfiguredJarLocationOverrides = overrides
+		}),
+	).RunTest(t)
+	ctx := &android.TestPathContext{TestResult: result}
+	global := dexpreopt.GetGlobalConfig(ctx)
+
+	for _, list := range lists {
+		for _, e := range list.entries {
+			apex, jar, _ := strings.Cut(e.apexJar, ":")
+			dir, filename := resolveInstalledJar(ctx, list.origin, apex, jar)
+			android.AssertStringEquals(t, list.name+" "+e.apexJar, e.location, filepath.Join(dir, filename))
+			if list.origin == systemServerOrigin {
+				android.AssertStringEquals(t, list.name+" "+e.apexJar+" dexpreopt location", e.location,
+					dexpreopt.GetSystemServerDexLocation(ctx, global, jar))
+			}
+		}
+	}
+
+	android.AssertDeepEquals(t, "boot class path",
+		locationsOf("BootJars", "ApexBootJars", "ClasspathOnlyApexJars"), defaultBootclasspath(ctx))
+	android.AssertDeepEquals(t, "default boot image locations",
+		locationsOf("BootJars"), defaultBootImageConfig(ctx).getAnyAndroidVariant().dexLocations)
+	android.AssertDeepEquals(t, "system server class path",
+		locationsOf("SystemServerJars", "ApexSystemServerJars"), systemServerClasspath(ctx))
+
+	var manifestLocations []string
+	for _, e := range systemServerJarsManifest(ctx) {
+		manifestLocations = append(manifestLocations, e.Location)
+	}
+	android.AssertDeepEquals(t, "system server jars manifest",
+		locationsOf("ApexSystemServerJars", "ApexStandaloneSystemServerJars"), manifestLocations)
+}
+
+func TestDexpreoptArtifactPartitions(t *testing.T) {
+	android.AssertStringEquals(t, "system", "system", partitionOfLocation("/system/framework/framework.jar"))
+	android.AssertStringEquals(t, "apex", "system", partitionOfLocation("/apex/com.android.art/javalib/core1.jar"))
+	android.AssertStringEquals(t, "recovery", "recovery", partitionOfLocation("recovery/root/system/framework"))
+
+	preparer := android.GroupFixturePreparers(
+		PrepareForTestWithDexpreopt,
+		FixtureConfigureBootJars("platform:foo"),
+		android.FixtureWithRootAndroidBp(`
+			platform_bootclasspath {
+				name: "platform-bootclasspath",
+			}
+
+			java_library {
+				name: "foo",
+				srcs: ["a.java"],
+				system_modules: "none",
+				sdk_version: "none",
+				compile_dex: true,
+			}
+		`),
+	)
+
+	makeVar := func(result *android.TestResult, name string) string {
+		for _, v := range result.MakeVarsForTesting(func(variable android.MakeVarVariable) bool {
+			return variable.Name() == name
+		}) {
+			return v.Value()
+		}
+		return ""
+	}
+
+	t.Run("system", func(t *testing.T) {
+		result := preparer.RunTest(t)
+		ctx := &android.TestPathContext{TestResult: result}
+		android.AssertBoolEquals(t, "system", true, dexpreoptArtifactsAllowedFor(ctx, "system"))
+		android.AssertBoolEquals(t, "recovery", false, dexpreoptArtifactsAllowedFor(ctx, "recovery"))
+		android.AssertStringEquals(t, "partitions", "system", makeVar(result, "DEX_PREOPT_ARTIFACT_PARTITIONS"))
+		android.AssertStringDoesContain(t, "installs", makeVar(result, "DEXPREOPT_IMAGE_BUILT_INSTALLED_boot_arm64"),
+			"/system/framework/arm64/boot.art")
+	})
+
+	recovery := android.GroupFixturePreparers(
+		preparer,
+		FixtureSetBootImageInstallDirOnDevice("boot", "recovery/root/system/framework"),
+	)
+
+	t.Run("recovery", func(t *testing.T) {
+		result := recovery.RunTest(t)
+		android.AssertStringEquals(t, "installs", "", makeVar(result, "DEXPREOPT_IMAGE_BUILT_INSTALLED_boot_arm64"))
+		android.AssertStringEquals(t, "vdex installs", "", makeVar(result, "DEXPREOPT_IMAGE_VDEX_BUILT_INSTALLED_boot_arm64"))
+	})
+
+	t.Run("enabled partition", func(t *testing.T) {
+		result := android.GroupFixturePreparers(
+			recovery,
+			dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+				c.DexpreoptArtifactPartitions = []string{"recovery"}
+			}),
+		).RunTest(t)
+		ctx := &android.TestPathContext{TestResult: result}
+		android.AssertBoolEquals(t, "recovery", true, dexpreoptArtifactsAllowedFor(ctx, "recovery"))
+		android.AssertStringEquals(t, "partitions", "system recovery", makeVar(result, "DEX_PREOPT_ARTIFACT_PARTITIONS"))
+		android.AssertStringDoesContain(t, "installs", makeVar(result, "DEXPREOPT_IMAGE_BUILT_INSTALLED_boot_arm64"),
+			"/recovery/root/system/framework/arm64/boot.art")
+	})
+}
+
+func TestEnabledBootImageVariants(t *testing.T) {
+	preparer := android.GroupFixturePreparers(
+		PrepareForTestWithDexpreopt,
+		FixtureConfigureBootJars("platform:foo"),
+		android.FixtureWithRootAndroidBp(`
+			platform_bootclasspath {
+				name: "platform-bootclasspath",
+			}
+
+			java_library {
+				name: "foo",
+				srcs: ["a.java"],
+				system_modules: "none",
+				sdk_version: "none",
+				compile_dex: true,
+			}
+		`),
+	)
+
+	enabledImages := func(ctx android.PathContext) []string {
+		var names []string
+		for _, name := range getImageNames() {
+			if genBootImageConfigs(ctx)[name].isEnabledByConfig(ctx) {
+				names = append(names, name)
+			}
+		}
+		return names
+	}
+	imageNames := func(result *android.TestResult) string {
+		for _, v := range result.MakeVarsForTesting(func(variable android.MakeVarVariable) bool {
+			return variable.Name() == "DEXPREOPT_IMAGE_NAMES"
+		}) {
+			return v.Value()
+		}
+		return ""
+	}
+
+	t.Run("all", func(t *testing.T) {
+		result := preparer.RunTest(t)
+		ctx := &android.TestPathContext{TestResult: result}
+		android.AssertDeepEquals(t, "enabled", []string{"art", "boot", "mainline"}, enabledImages(ctx))
+		android.AssertStringEquals(t, "image names", "art boot mainline", imageNames(result))
+	})
+
+	t.Run("mainline disabled", func(t *testing.T) {
+		result := android.GroupFixturePreparers(
+			preparer,
+			dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+				c.EnabledBootImageVariants = []string{"art"}
+			}),
+		).RunTest(t)
+		ctx := &android.TestPathContext{TestResult: result}
+		android.AssertDeepEquals(t, "enabled", []string{"art", "boot"}, enabledImages(ctx))
+		android.AssertStringEquals(t, "image names", "art boot", imageNames(result))
+		android.AssertIntEquals(t, "mainline actions", 0, expectedBootImageActionCount(ctx, mainlineBootImageConfig(ctx)))
+
+		// The default boot image is always built.
+		dexBootJars := result.ModuleForTests("dex_bootjars", "android_common")
+		dexBootJars.Output("out/soong/dexpreopt_arm64/dex_bootjars/android/system/framework/arm64/boot.art")
+	})
+
+	t.Run("no device targets", func(t *testing.T) {
+		// The boot images are not built, but Make still refers to their host variants.
+		result := android.GroupFixturePreparers(
+			preparer,
+			dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+				c.SupportedPreoptArches = []android.ArchType{android.Riscv64}
+			}),
+		).RunTest(t)
+		android.AssertStringEquals(t, "image names", "art boot mainline", imageNames(result))
+	})
+
+	t.Run("on device image generation", func(t *testing.T) {
+		result := android.GroupFixturePreparers(
+			preparer,
+			dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+				c.OnDeviceImageGeneration = true
+			}),
+		).RunTest(t)
+		android.AssertStringEquals(t, "image names", "", imageNames(result))
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		android.GroupFixturePreparers(
+			preparer,
+			dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+				c.EnabledBootImageVariants = []string{"apex"}
+			}),
+		).ExtendWithErrorHandler(android.FixtureExpectsAtLeastOneErrorMatchingPattern(
+			`EnabledBootImageVariants lists unknown boot image "apex"`)).
+			RunTest(t)
+	})
+}
+
+func TestBootImageSeed(t *testing.T) {
+	preparer := android.GroupFixturePreparers(
+		PrepareForTestWithDexpreopt,
+		FixtureConfigureBootJars("platform:foo"),
+		android.FixtureWithRootAndroidBp(`
+			platform_bootclasspath {
+				name: "platform-bootclasspath",
+			}
+
+			java_library {
+				name: "foo",
+				srcs: ["a.java"],
+				system_modules: "none",
+				sdk_version: "none",
+				compile_dex: true,
+			}
+		`),
+	)
+	withSeed := func(seed string) android.FixturePreparer {
+		return android.GroupFixturePreparers(
+			preparer,
+			dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+				c.BootImageSeed = seed
+			}),
+		)
+	}
+	seedHashVar := func(result *android.TestResult) string {
+		for _, v := range result.MakeVarsForTesting(func(variable android.MakeVarVariable) bool {
+			return variable.Name() == "DEXPREOPT_IMAGE_SEED_HASH_boot"
+		}) {
+			return v.Value()
+		}
+		return ""
+	}
+
+	bootImage := "out/soong/dexpreopt_arm64/dex_bootjars/android/system/framework/arm64/boot.art"
+	identity := "out/soong/dexpreopt_arm64/dex_bootjars/boot_identity.json"
+
+	t.Run("no seed", func(t *testing.T) {
+		result := preparer.RunTest(t)
+		dexBootJars := result.ModuleForTests("dex_bootjars", "android_common")
+		android.AssertBoolEquals(t, "identity rule", false, dexBootJars.MaybeOutput(identity).Rule != nil)
+		android.AssertStringListDoesNotContain(t, "implicits", dexBootJars.Output(bootImage).Implicits.Strings(), identity)
+		android.AssertStringEquals(t, "make var", "", seedHashVar(result))
+	})
+
+	result := withSeed("seed1").RunTest(t)
+	ctx := &android.TestPathContext{TestResult: result}
+	hash := defaultBootImageConfig(ctx).seedHash()
+
+	dexBootJars := result.ModuleForTests("dex_bootjars", "android_common")
+	android.AssertStringListContains(t, "implicits", dexBootJars.Output(bootImage).Implicits.Strings(), identity)
+	android.AssertStringEquals(t, "identity", `{
+    "schema_version": 4,
+    "name": "boot",
+    "modules": [
+        "platform:foo"
+    ],
+    "seed": "seed1",
+    "seed_hash": "`+hash+`",
+    "bootclasspath_indices": [
+        0
+    ]
+}
+`, android.ContentFromFileRuleForTests(t, result.TestContext, dexBootJars.Output(identity)))
+	android.AssertStringEquals(t, "make var", hash, seedHashVar(result))
+
+	result = withSeed("seed1").RunTest(t)
+	ctx = &android.TestPathContext{TestResult: result}
+	android.AssertStringEquals(t, "same seed", hash, defaultBootImageConfig(ctx).seedHash())
+
+	result = withSeed("seed2").RunTest(t)
+	ctx = &android.TestPathContext{TestResult: result}
+	if defaultBootImageConfig(ctx).seedHash() == hash {
+		t.Errorf("expected the seed hash to change with the seed")
+	}
+}
+
+func TestModuleLocations(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+	).RunTest(t)
+	ctx := &android.TestPathContext{TestResult: result}
+
+	image := defaultBootImageConfig(ctx)
+	android.AssertDeepEquals(t, "module locations", []moduleLocation{
+		{Module: "core1", Location: "/apex/com.android.art/javalib/core1.jar"},
+		{Module: "core2", Location: "/apex/com.android.art/javalib/core2.jar"},
+		{Module: "framework", Location: "/system/framework/framework.jar"},
+	}, image.ModuleLocations())
+
+	variant := *image.getAnyAndroidVariant()
+	variant.dexLocations = variant.dexLocations[:1]
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("expected a panic for mismatched modules and dex locations")
+		}
+	}()
+	variant.ModuleLocations()
+}
+
+func TestBootImageCompilerFilterError(t *testing.T) {
+	updatable := android.CreateTestConfiguredJarList([]string{"com.android.foo:framework-foo"})
+
+	for _, tc := range []struct {
+		name           string
+		modules        []string
+		compilerFilter string
+		err            string
+	}{
+		{
+			name:           "updatable jars verified",
+			modules:        []string{"com.android.foo:framework-foo"},
+			compilerFilter: "verify",
+		},
+		{
+			name:           "platform jars compiled",
+			modules:        []string{"platform:framework"},
+			compilerFilter: "speed-profile",
+		},
+		{
+			name:           "updatable jars compiled",
+			modules:        []string{"platform:framework", "com.android.foo:framework-foo"},
+			compilerFilter: "speed",
+			err:            `Boot image "test" includes the updatable apex boot jars framework-foo, so its compiler filter must be "verify", not "speed"`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			image := &bootImageConfig{
+				name:           "test",
+				modules:        android.CreateTestConfiguredJarList(tc.modules),
+				compilerFilter: tc.compilerFilter,
+			}
+			err := bootImageCompilerFilterError(image, updatable)
+			if tc.err == "" {
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			} else {
+				android.AssertStringEquals(t, "error", tc.err, fmt.Sprint(err))
+			}
+		})
+	}
+}
+
+func TestProfilePathForArch(t *testing.T) {
+	for _, tc := range []struct {
+		name                   string
+		perArch                bool
+		disableGenerateProfile bool
+		arm64                  string
+		arm                    string
+	}{
+		{
+			name:  "shared",
+			arm64: "out/soong/dexpreopt_arm64/dex_bootjars/boot.prof",
+			arm:   "out/soong/dexpreopt_arm64/dex_bootjars/boot.prof",
+		},
+		{
+			name:    "per arch",
+			perArch: true,
+			arm64:   "out/soong/dexpreopt_arm64/dex_bootjars/android/system/framework/arm64/boot.prof",
+			arm:     "out/soong/dexpreopt_arm64/dex_bootjars/android/system/framework/arm/boot.prof",
+		},
+		{
+			name:                   "disabled",
+			perArch:                true,
+			disableGenerateProfile: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			result := android.GroupFixturePreparers(
+				PrepareForBootImageConfigTest,
+				dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+					c.PerArchBootImageProfiles = tc.perArch
+					c.DisableGenerateProfile = tc.disableGenerateProfile
+				}),
+			).RunTest(t)
+			ctx := &android.TestPathContext{TestResult: result}
+			image := defaultBootImageConfig(ctx)
+
+			for arch, want := range map[android.ArchType]string{android.Arm64: tc.arm64, android.Arm: tc.arm} {
+				path, ok := image.ProfilePathForArch(ctx, arch)
+				android.AssertBoolEquals(t, arch.String()+" ok", want != "", ok)
+				if ok {
+					android.AssertPathRelativeToTopEquals(t, arch.String()+" path", want, path)
+				}
+			}
+		})
+	}
+
+	t.Run("not profile guided", func(t *testing.T) {
+		result := PrepareForBootImageConfigTest.RunTest(t)
+		ctx := &android.TestPathContext{TestResult: result}
+		_, ok := mainlineBootImageConfig(ctx).ProfilePathForArch(ctx, android.Arm64)
+		android.AssertBoolEquals(t, "ok", false, ok)
+	})
+}
+
+func TestAllBootImageProfiles(t *testing.T) {
+	profiles := func(t *testing.T, preparers ...android.FixturePreparer) []string {
+		result := android.GroupFixturePreparers(
+			PrepareForBootImageConfigTest,
+			android.GroupFixturePreparers(preparers...),
+		).RunTest(t)
+		return android.PathsRelativeToTop(allBootImageProfiles(&android.TestPathContext{TestResult: result}))
+	}
+
+	t.Run("all variants", func(t *testing.T) {
+		android.AssertDeepEquals(t, "profiles", []string{
+			"out/soong/dexpreopt_arm64/dex_artjars/boot.prof",
+			"out/soong/dexpreopt_arm64/dex_bootjars/boot.prof",
+		}, profiles(t))
+	})
+
+	t.Run("only the default variant", func(t *testing.T) {
+		// The mainline boot image is not profile guided, and the ART boot image is not enabled.
+		android.AssertDeepEquals(t, "profiles", []string{
+			"out/soong/dexpreopt_arm64/dex_bootjars/boot.prof",
+		}, profiles(t, dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.EnabledBootImageVariants = []string{"mainline"}
+		})))
+	})
+
+	t.Run("per arch", func(t *testing.T) {
+		android.AssertDeepEquals(t, "profiles", []string{
+			"out/soong/dexpreopt_arm64/dex_bootjars/android/system/framework/arm/boot.prof",
+			"out/soong/dexpreopt_arm64/dex_bootjars/android/system/framework/arm64/boot.prof",
+		}, profiles(t, dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.EnabledBootImageVariants = []string{"mainline"}
+			c.PerArchBootImageProfiles = true
+		})))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		android.AssertDeepEquals(t, "profiles", []string(nil), profiles(t,
+			dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+				c.DisableGenerateProfile = true
+			})))
+	})
+}
+
+func TestArchIndependentOutputs(t *testing.T) {
+	outputs := func(t *testing.T, image func(android.PathContext) *bootImageConfig, preparers ...android.FixturePreparer) []string {
+		result := android.GroupFixturePreparers(
+			PrepareForBootImageConfigTest,
+			PrepareApexBootJarConfigs,
+			android.GroupFixturePreparers(preparers...),
+		).RunTest(t)
+		ctx := &android.TestPathContext{TestResult: result}
+		return android.PathsRelativeToTop(image(ctx).ArchIndependentOutputs(ctx))
+	}
+	t.Run("default", func(t *testing.T) {
+		android.AssertDeepEquals(t, "outputs", []string{
+			"out/soong/dexpreopt_arm64/dex_bootjars/boot.zip",
+			"out/soong/dexpreopt_arm64/dex_bootjars/boot.prof",
+		}, outputs(t, defaultBootImageConfig))
+	})
+
+	t.Run("not profile guided", func(t *testing.T) {
+		android.AssertDeepEquals(t, "outputs", []string{
+			"out/soong/dexpreopt_arm64/dex_mainlinejars/mainline.zip",
+		}, outputs(t, mainlineBootImageConfig))
+	})
+
+	t.Run("per arch profiles", func(t *testing.T) {
+		android.AssertDeepEquals(t, "outputs", []string{
+			"out/soong/dexpreopt_arm64/dex_bootjars/boot.zip",
+		}, outputs(t, defaultBootImageConfig, dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.PerArchBootImageProfiles = true
+		})))
+	})
+
+	t.Run("only art preopted", func(t *testing.T) {
+		// The default boot image is not compiled, so it has no zip.
+		android.AssertDeepEquals(t, "outputs", []string{
+			"out/soong/dexpreopt_arm64/dex_bootjars/boot.prof",
+		}, outputs(t, defaultBootImageConfig, dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.OnlyPreoptArtBootImage = true
+		})))
+	})
+}
+
+func TestBootImageZipOnlyWhenGenerated(t *testing.T) {
+	zip := func(t *testing.T, modify func(c *dexpreopt.GlobalConfig)) android.WritablePath {
+		result := android.GroupFixturePreparers(
+			PrepareForBootImageConfigTest,
+			dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+				modify(c)
+			}),
+		).RunTest(t)
+		return defaultBootImageConfig(&android.TestPathContext{TestResult: result}).zip
+	}
+
+	t.Run("preopt disabled", func(t *testing.T) {
+		// DisablePreopt does not apply to the boot images, so they are still zipped.
+		android.AssertPathRelativeToTopEquals(t, "zip", "out/soong/dexpreopt_arm64/dex_bootjars/boot.zip",
+			zip(t, func(c *dexpreopt.GlobalConfig) { c.DisablePreopt = true }))
+	})
+
+	t.Run("boot images disabled", func(t *testing.T) {
+		android.AssertBoolEquals(t, "has zip", false,
+			zip(t, func(c *dexpreopt.GlobalConfig) { c.DisablePreoptBootImages = true }) != nil)
+	})
+}
+
+func TestBootImageIdentityInputs(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForTestWithDexpreopt,
+		FixtureConfigureBootJars("platform:foo"),
+		dexpreopt.FixtureSetBootImageProfiles("vendor/boot-image-profile.txt"),
+		android.FixtureAddFile("vendor/boot-image-profile.txt", nil),
+		android.FixtureAddFile("frameworks/base/config/dirty-image-objects", nil),
+		android.FixtureAddFile("vendor/boot-profile-text.txt", nil),
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.BootImageSeed = "seed1"
+			c.BootImageProfileText = map[string]string{"boot": "vendor/boot-profile-text.txt"}
+		}),
+		android.FixtureWithRootAndroidBp(`
+			platform_bootclasspath {
+				name: "platform-bootclasspath",
+			}
+
+			java_library {
+				name: "foo",
+				srcs: ["a.java"],
+				system_modules: "none",
+				sdk_version: "none",
+				compile_dex: true,
+			}
+		`),
+	).RunTest(t)
+
+	dexBootJars := result.ModuleForTests("dex_bootjars", "android_common")
+	content := android.ContentFromFileRuleForTests(t, result.TestContext,
+		dexBootJars.Output("out/soong/dexpreopt_arm64/dex_bootjars/boot_identity.json"))
+	identity, err := parseBootImageIdentity([]byte(content))
+	if err != nil {
+		t.Fatalf("Failed to parse identity: %v", err)
+	}
+	android.AssertIntEquals(t, "schema version", 4, identity.SchemaVersion)
+	android.AssertDeepEquals(t, "inputs", map[string]bootImageInput{
+		"profile": {
+			Paths:      []string{"vendor/boot-image-profile.txt"},
+			Provenance: "product_config",
+		},
+		"profile_text": {
+			Paths:      []string{"vendor/boot-profile-text.txt"},
+			Provenance: "override",
+		},
+		"dirty_image_objects": {
+			Paths:      []string{"frameworks/base/config/dirty-image-objects"},
+			Provenance: "default",
+		},
+	}, identity.Inputs)
+}
+
+func TestParseBootImageIdentity(t *testing.T) {
+	t.Run("version 1", func(t *testing.T) {
+		identity, err := parseBootImageIdentity([]byte(`{
+			"name": "boot",
+			"modules": ["platform:foo"],
+			"seed": "seed1",
+			"seed_hash": "abc"
+		}`))
+		if err != nil {
+			t.Fatalf("Failed to parse identity: %v", err)
+		}
+		android.AssertDeepEquals(t, "identity", bootImageIdentity{
+			SchemaVersion: 1,
+			Name:          "boot",
+			Modules:       []string{"platform:foo"},
+			Seed:          "seed1",
+			SeedHash:      "abc",
+		}, identity)
+	})
+
+	t.Run("version 2", func(t *testing.T) {
+		identity, err := parseBootImageIdentity([]byte(`{
+			"schema_version": 2,
+			"name": "boot",
+			"modules": ["platform:foo"],
+			"seed": "seed1",
+			"seed_hash": "abc",
+			"inputs": {
+				"dirty_image_objects": {
+					"paths": ["frameworks/base/config/dirty-image-objects"],
+					"provenance": "default"
+				}
+			}
+		}`))
+		if err != nil {
+			t.Fatalf("Failed to parse identity: %v", err)
+		}
+		android.AssertIntEquals(t, "schema version", 2, identity.SchemaVersion)
+		android.AssertDeepEquals(t, "inputs", map[string]bootImageInput{
+			"dirty_image_objects": {
+				Paths:      []string{"frameworks/base/config/dirty-image-objects"},
+				Provenance: "default",
+			},
+		}, identity.Inputs)
+	})
+}
+
+func TestUsesApexImage(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		usesApexImage bool
+		artLocations  []string
+		bootInstalled bool
+	}{
+		{
+			name:          "system image",
+			artLocations:  []string{"/apex/art_boot_images/javalib/boot.art"},
+			bootInstalled: true,
+		},
+		{
+			name:          "apex image",
+			usesApexImage: true,
+			artLocations:  []string{"/apex/com.android.art/javalib/boot.art"},
+			bootInstalled: false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			result := android.GroupFixturePreparers(
+				PrepareForBootImageConfigTest,
+				dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+					c.UsesArtApexBootImage = tc.usesApexImage
+				}),
+			).RunTest(t)
+			ctx := &android.TestPathContext{TestResult: result}
+			configs := genBootImageConfigs(ctx)
+
+			art := configs["art"]
+			android.AssertDeepEquals(t, "art locations", tc.artLocations, art.getAnyAndroidVariant().imageLocationsOnDevice(ctx))
+			android.AssertBoolEquals(t, "art installed", true, art.isInstalled(ctx))
+
+			boot := configs[frameworkBootImageName]
+			android.AssertDeepEquals(t, "boot locations", []string{"/system/framework/boot.art"}, boot.getAnyAndroidVariant().imageLocationsOnDevice(ctx))
+			android.AssertBoolEquals(t, "boot installed", tc.bootInstalled, boot.isInstalled(ctx))
+
+			for _, variant := range bootclasspathConfigInfo(ctx).ImageVariants {
+				if variant.Image == "art" {
+					android.AssertDeepEquals(t, "summary art locations", tc.artLocations, variant.ImageLocationsOnDevice)
+				} else if variant.Image == frameworkBootImageName {
+					android.AssertBoolEquals(t, "summary boot installed", tc.bootInstalled, variant.Installed)
+				}
+			}
+		})
+	}
+}
+
+func TestUsesApexImageMakeVars(t *testing.T) {
+	preparer := android.GroupFixturePreparers(
+		PrepareForTestWithDexpreopt,
+		FixtureConfigureBootJars("platform:foo"),
+		android.FixtureWithRootAndroidBp(`
+			platform_bootclasspath {
+				name: "platform-bootclasspath",
+			}
+
+			java_library {
+				name: "foo",
+				srcs: ["a.java"],
+				system_modules: "none",
+				sdk_version: "none",
+				compile_dex: true,
+			}
+		`),
+	)
+	makeVars := func(result *android.TestResult) map[string]string {
+		vars := make(map[string]string)
+		for _, v := range result.MakeVarsForTesting(func(variable android.MakeVarVariable) bool {
+			return strings.HasPrefix(variable.Name(), "DEXPREOPT_IMAGE_")
+		}) {
+			vars[v.Name()] = v.Value()
+		}
+		return vars
+	}
+
+	systemVars := makeVars(preparer.RunTest(t))
+	apexVars := makeVars(android.GroupFixturePreparers(
+		preparer,
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.UsesArtApexBootImage = true
+		}),
+	).RunTest(t))
+
+	android.AssertStringEquals(t, "boot locations", "/system/framework/boot.art", systemVars["DEXPREOPT_IMAGE_LOCATIONS_ON_DEVICEboot"])
+	android.AssertStringEquals(t, "apex mode boot locations", systemVars["DEXPREOPT_IMAGE_LOCATIONS_ON_DEVICEboot"], apexVars["DEXPREOPT_IMAGE_LOCATIONS_ON_DEVICEboot"])
+	android.AssertBoolEquals(t, "boot installed", true, systemVars["DEXPREOPT_IMAGE_BUILT_INSTALLED_boot_arm64"] != "")
+	android.AssertStringEquals(t, "apex mode boot installed", "", apexVars["DEXPREOPT_IMAGE_BUILT_INSTALLED_boot_arm64"])
+}
+
+func TestAllDexLocationsToModules(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		PrepareApexBootJarConfigs,
+		dexpreopt.FixtureSetSystemServerJars("platform:services"),
+		dexpreopt.FixtureSetApexSystemServerJars("com.android.foo:service-foo"),
+	).RunTest(t)
+	ctx := &android.TestPathContext{TestResult: result}
+
+	android.AssertDeepEquals(t, "locations", map[string]string{
+		"/apex/com.android.art/javalib/core1.jar":         "core1",
+		"/apex/com.android.art/javalib/core2.jar":         "core2",
+		"/system/framework/extra1.jar":                    "extra1",
+		"/system/framework/framework.jar":                 "framework",
+		"/apex/com.android.foo/javalib/framework-foo.jar": "framework-foo",
+		"/apex/com.android.bar/javalib/framework-bar.jar": "framework-bar",
+		"/system/framework/services.jar":                  "services",
+		"/apex/com.android.foo/javalib/service-foo.jar":   "service-foo",
+	}, allDexLocationsToModules(ctx))
+
+	_, err := mergeDexLocationsToModules([]moduleLocation{
+		{Module: "framework", Location: "/system/framework/framework.jar"},
+		{Module: "framework", Location: "/system/framework/framework.jar"},
+		{Module: "services", Location: "/system/framework/framework.jar"},
+	})
+	android.AssertStringEquals(t, "conflict",
+		`dex location "/system/framework/framework.jar" is mapped to both "framework" and "services"`, fmt.Sprint(err))
+}
+
+func TestDexpreoptOnceKeys(t *testing.T) {
+	// The names of the Once keys in the android and dexpreopt packages that the dexpreopt code in
+	// this package depends on.
+	dependedOn := []string{
+		"DexpreoptGlobalConfig",
+		"DexpreoptGlobalSoongConfig",
+		"TestDexpreoptGlobalConfig",
+		"allApexSystemServerJars",
+		"allPlatformSystemServerJars",
+		"allSystemServerClasspathJars",
+		"allSystemServerJars",
+		"earlyBootJars",
+		"preoptDenylist",
+	}
+	if len(dexpreoptOnceKeys) == 0 {
+		t.Fatalf("no dexpreopt Once keys are registered")
+	}
+	for _, name := range dependedOn {
+		if site, ok := dexpreoptOnceKeys[name]; ok {
+			t.Errorf("dexpreopt Once key %q defined at %s has the name of a key it depends on", name, site)
+		}
+	}
+
+	keys := map[string]string{}
+	registerDexpreoptOnceKey(keys, "foo", "a.go:1")
+	defer func() {
+		android.AssertStringEquals(t, "panic",
+			`dexpreopt Once key "foo" is defined at both a.go:1 and b.go:2`, fmt.Sprint(recover()))
+	}()
+	registerDexpreoptOnceKey(keys, "foo", "b.go:2")
+}
+
+func TestPrebuiltInputJars(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		PrepareApexBootJarConfigs,
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.PrebuiltBootJarApexes = []string{"com.android.foo"}
+		}),
+	).RunTest(t)
+	ctx := &android.TestPathContext{TestResult: result}
+	configs := genBootImageConfigs(ctx)
+
+	android.AssertDeepEquals(t, "art", map[string]string(nil), configs["art"].prebuiltInputJars)
+	android.AssertDeepEquals(t, "boot", map[string]string(nil), configs[frameworkBootImageName].prebuiltInputJars)
+	android.AssertDeepEquals(t, "mainline", map[string]string{
+		"framework-foo": "javalib/framework-foo.jar",
+	}, configs[mainlineBootImageName].prebuiltInputJars)
+}
+
+func TestSharedInputJars(t *testing.T) {
+	shared := func(t *testing.T, preparers ...android.FixturePreparer) map[string]string {
+		result := android.GroupFixturePreparers(PrepareForBootImageConfigTest, android.GroupFixturePreparers(preparers...)).RunTest(t)
+		ctx := &android.TestPathContext{TestResult: result}
+		configs := genBootImageConfigs(ctx)
+		jars := sharedInputJars(defaultBootImageConfig(ctx), configs["art"])
+		actual := make(map[string]string, len(jars))
+		for module, path := range jars {
+			actual[module] = path.RelativeToTop().String()
+		}
+		return actual
+	}
+
+	t.Run("staged", func(t *testing.T) {
+		// Each boot image stages the libcore jars in its own input directory.
+		android.AssertDeepEquals(t, "shared", map[string]string{}, shared(t))
+	})
+
+	t.Run("stable", func(t *testing.T) {
+		android.AssertDeepEquals(t, "shared", map[string]string{
+			"core1": "out/soong/.intermediates/core1/android_common/core1.jar",
+			"core2": "out/soong/.intermediates/core2/android_common/core2.jar",
+		}, shared(t, dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.SkipStagingOfStableBootJars = true
+			c.StableBootDexJarPaths = map[string]string{
+				"core1":     ".intermediates/core1/android_common/core1.jar",
+				"core2":     ".intermediates/core2/android_common/core2.jar",
+				"framework": ".intermediates/framework/android_common/framework.jar",
+			}
+		})))
+	})
+}
+
+func TestSkipStagingOfStableBootJars(t *testing.T) {
+	stable := map[string]string{
+		"core1":     ".intermediates/core1/android_common/core1.jar",
+		"core2":     ".intermediates/core2/android_common/core2-renamed.jar",
+		"framework": ".intermediates/framework/android_common/framework.jar",
+	}
+	staged := func(jar string) string {
+		return "out/soong/dexpreopt_arm64/dex_bootjars_input/" + jar + ".jar"
+	}
+	module := func(jar string) string {
+		return "out/soong/.intermediates/" + jar + "/android_common/" + jar + ".jar"
+	}
+
+	testCases := []struct {
+		name     string
+		skip     bool
+		stable   []string
+		dexPaths []string
+		unstaged []string
+	}{
+		{
+			name:     "staged",
+			skip:     false,
+			stable:   []string{"core1", "framework"},
+			dexPaths: []string{staged("core1"), staged("core2"), staged("framework")},
+		},
+		{
+			name:     "skipped",
+			skip:     true,
+			stable:   []string{"core1", "framework"},
+			dexPaths: []string{module("core1"), staged("core2"), module("framework")},
+			unstaged: []string{"core1", "framework"},
+		},
+		{
+			// core2 is staged as its module output does not have the name of the staged jar.
+			name:     "mixed",
+			skip:     true,
+			stable:   []string{"core1", "core2"},
+			dexPaths: []string{module("core1"), staged("core2"), staged("framework")},
+			unstaged: []string{"core1"},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			result := android.GroupFixturePreparers(
+				PrepareForBootImageConfigTest,
+				dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+					c.SkipStagingOfStableBootJars = test.skip
+					c.StableBootDexJarPaths = map[string]string{}
+					for _, jar := range test.stable {
+						c.StableBootDexJarPaths[jar] = stable[jar]
+					}
+				}),
+			).RunTest(t)
+			ctx := &android.TestPathContext{TestResult: result}
+			image := defaultBootImageConfig(ctx)
+
+			android.AssertPathsRelativeToTopEquals(t, "dexPaths", test.dexPaths, image.dexPaths.Paths())
+			android.AssertPathsRelativeToTopEquals(t, "dexPathsDeps", test.dexPaths, image.dexPathsDeps.Paths())
+			for i := 0; i < image.modules.Len(); i++ {
+				jar := image.modules.Jar(i)
+				android.AssertPathRelativeToTopEquals(t, "dexPathsByModule "+jar, test.dexPaths[i], image.dexPathsByModule[jar])
+			}
+			android.AssertArrayString(t, "unstaged", test.unstaged, android.SortedKeys(image.unstagedJars))
+		})
+	}
+}
+
+func TestSkipStagingOfStableBootJarsMismatch(t *testing.T) {
+	android.GroupFixturePreparers(
+		PrepareForTestWithDexpreopt,
+		FixtureConfigureBootJars("platform:foo"),
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.SkipStagingOfStableBootJars = true
+			c.StableBootDexJarPaths = map[string]string{"foo": "bogus/foo.jar"}
+		}),
+		android.FixtureWithRootAndroidBp(`
+			platform_bootclasspath {
+				name: "platform-bootclasspath",
+			}
+
+			java_library {
+				name: "foo",
+				srcs: ["a.java"],
+				system_modules: "none",
+				sdk_version: "none",
+				compile_dex: true,
+			}
+		`),
+	).ExtendWithErrorHandler(android.FixtureExpectsAtLeastOneErrorMatchingPattern(
+		`boot jar "foo" is not staged as SkipStagingOfStableBootJars is set, but its module produces .* rather than out/soong/bogus/foo.jar`)).
+		RunTest(t)
+}
+
+func TestUncompressedBootJars(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		PrepareApexBootJarConfigs,
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.UncompressedBootJars = []string{"framework-foo", "core2"}
+		}),
+	).RunTest(t)
+	ctx := &android.TestPathContext{TestResult: result}
+	configs := genBootImageConfigs(ctx)
+
+	android.AssertArrayString(t, "art", []string{"core2"}, configs["art"].uncompressedModules)
+	android.AssertArrayString(t, "boot", []string{"core2"}, configs[frameworkBootImageName].uncompressedModules)
+	android.AssertArrayString(t, "mainline", []string{"framework-foo"}, configs[mainlineBootImageName].uncompressedModules)
+
+	android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.UncompressedBootJars = []string{"core2", "service-foo"}
+		}),
+	).ExtendWithErrorHandler(android.FixtureExpectsAtLeastOneErrorMatchingPattern(
+		`Uncompressed boot jar "service-foo" is not in any boot image`)).
+		RunTest(t)
+}
+
+func TestBootImageConfigLogFields(t *testing.T) {
+	result := PrepareForBootImageConfigTest.RunTest(t)
+	ctx := &android.TestPathContext{TestResult: result}
+
+	android.AssertDeepEquals(t, "log fields", []struct{ Key, Value string }{
+		{"name", "boot"},
+		{"stem", "boot"},
+		{"module_count", "3"},
+		{"arch_count", "4"},
+		{"has_zip", "true"},
+		{"has_symbols", "true"},
+	}, defaultBootImageConfig(ctx).LogFields())
+}
+
+func TestInitClasspathExports(t *testing.T) {
+	preparer := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		PrepareApexBootJarConfigs,
+		dexpreopt.FixtureSetSystemServerJars("platform:services"),
+		dexpreopt.FixtureSetApexSystemServerJars("com.android.foo:service-foo"),
+	)
+	fragment := "out/soong/dexpreopt_arm64/init_classpath_exports.rc"
+
+	result := preparer.RunTest(t)
+	rule := result.SingletonForTests("dex_bootjars").Output(fragment)
+	android.AssertStringEquals(t, "fragment", `export BOOTCLASSPATH /apex/com.android.art/javalib/core1.jar:/apex/com.android.art/javalib/core2.jar:/system/framework/framework.jar:/apex/com.android.foo/javalib/framework-foo.jar:/apex/com.android.bar/javalib/framework-bar.jar
+export DEX2OATBOOTCLASSPATH /apex/com.android.art/javalib/core1.jar:/apex/com.android.art/javalib/core2.jar:/system/framework/framework.jar
+export SYSTEMSERVERCLASSPATH /system/framework/services.jar:/apex/com.android.foo/javalib/service-foo.jar
+`, android.ContentFromFileRuleForTests(t, result.TestContext, rule))
+
+	result = android.GroupFixturePreparers(
+		preparer,
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.DisableInitClasspathExports = true
+		}),
+	).RunTest(t)
+	android.AssertBoolEquals(t, "fragment rule", false,
+		result.SingletonForTests("dex_bootjars").MaybeOutput(fragment).Rule != nil)
+}
+
+func TestApexJavalibDirOverrides(t *testing.T) {
+	preparer := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		PrepareApexBootJarConfigs,
+		dexpreopt.FixtureSetApexSystemServerJars("com.android.foo:service-foo", "com.android.bar:service-bar"),
+	)
+
+	result := android.GroupFixturePreparers(
+		preparer,
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.ApexJavalibDirOverrides = map[string]string{"com.android.foo": "javalib64"}
+		}),
+	).RunTest(t)
+	ctx := &android.TestPathContext{TestResult: result}
+
+	android.AssertArrayString(t, "bootclasspath", []string{
+		"/apex/com.android.art/javalib/core1.jar",
+		"/apex/com.android.art/javalib/core2.jar",
+		"/system/framework/framework.jar",
+		"/apex/com.android.foo/javalib64/framework-foo.jar",
+		"/apex/com.android.bar/javalib/framework-bar.jar",
+	}, defaultBootclasspath(ctx))
+	android.AssertArrayString(t, "system server classpath", []string{
+		"/apex/com.android.foo/javalib64/service-foo.jar",
+		"/apex/com.android.bar/javalib/service-bar.jar",
+	}, systemServerClasspath(ctx))
+
+	global := dexpreopt.GetGlobalConfig(ctx)
+	android.AssertStringEquals(t, "GetSystemServerDexLocation", "/apex/com.android.foo/javalib64/service-foo.jar",
+		dexpreopt.GetSystemServerDexLocation(ctx, global, "service-foo"))
+
+	for _, dir := range []string{"../javalib", "lib/java", ".."} {
+		android.GroupFixturePreparers(
+			preparer,
+			dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+				c.ApexJavalibDirOverrides = map[string]string{"com.android.foo": dir}
+			}),
+		).ExtendWithErrorHandler(android.FixtureExpectsAtLeastOneErrorMatchingPattern(
+			`ApexJavalibDirOverrides of apex "com.android.foo" is "` + regexp.QuoteMeta(dir) + `", which is not the name of a directory in the root of the apex`)).
+			RunTest(t)
+	}
+}
+
+func TestContentAddressedBootImageDir(t *testing.T) {
+	bootImageDir := func(preparers ...android.FixturePreparer) string {
+		result := android.GroupFixturePreparers(
+			PrepareForBootImageConfigTest,
+			dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+				c.ContentAddressedBootImageDir = true
+			}),
+			android.GroupFixturePreparers(preparers...),
+		).RunTest(t)
+		ctx := &android.TestPathContext{TestResult: result}
+		image := defaultBootImageConfig(ctx)
+		hash := image.ContentHash(dexpreopt.GetGlobalConfig(ctx), dexpreoptTargets(ctx))
+		android.AssertPathRelativeToTopEquals(t, "symbols dir", "out/soong/dexpreopt_arm64/dex_bootjars_unstripped/"+hash, image.symbolsDir)
+		return android.PathRelativeToTop(image.dir)
+	}
+
+	dir := bootImageDir()
+	android.AssertStringDoesContain(t, "dir", dir, "out/soong/dexpreopt_arm64/dex_bootjars/")
+	android.AssertStringEquals(t, "dir of an identical config", dir, bootImageDir())
+	android.AssertStringDoesNotContain(t, "dir of a config with other boot jars", bootImageDir(
+		FixtureConfigureBootJars("com.android.art:core1", "com.android.art:core2", "platform:framework", "platform:services"),
+	), dir)
+	android.AssertStringDoesNotContain(t, "dir of a config with other boot flags", bootImageDir(
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.BootFlags = "--runtime-arg -Xfoo"
+		}),
+	), dir)
+	android.AssertStringDoesNotContain(t, "dir of a config with another seed", bootImageDir(
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.BootImageSeed = "seed"
+		}),
+	), dir)
+	android.AssertStringDoesNotContain(t, "dir of a config with another dex2oat", bootImageDir(
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.Dex2oatBinaryByArch = map[android.ArchType]string{android.Arm64: "dex2oat64"}
+		}),
+	), dir)
+
+	// The hash of an extending image covers the finished config of the image it extends, so it
+	// does not depend on the order the configs are visited in.
+	mainlineDir := func() string {
+		result := android.GroupFixturePreparers(
+			PrepareForBootImageConfigTest,
+			PrepareApexBootJarConfigs,
+			dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+				c.ContentAddressedBootImageDir = true
+				c.BootImageSeed = "seed"
+			}),
+		).RunTest(t)
+		ctx := &android.TestPathContext{TestResult: result}
+		image := mainlineBootImageConfig(ctx)
+		hash := image.ContentHash(dexpreopt.GetGlobalConfig(ctx), dexpreoptTargets(ctx))
+		android.AssertPathRelativeToTopEquals(t, "mainline dir", "out/soong/dexpreopt_arm64/dex_mainlinejars/"+hash, image.dir)
+		return android.PathRelativeToTop(image.dir)
+	}
+	first := mainlineDir()
+	for i := 0; i < 5; i++ {
+		android.AssertStringEquals(t, "mainline dir of an identical config", first, mainlineDir())
+	}
+}
+
+func TestExtensionModules(t *testing.T) {
+	preparer := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.ExtendArtBootImage = true
+		}),
+	)
+
+	t.Run("prefix", func(t *testing.T) {
+		result := android.GroupFixturePreparers(
+			preparer,
+			dexpreopt.FixtureSetTestOnlyArtBootImageJars("com.android.art:core1", "com.android.art:core2"),
+		).RunTest(t)
+		ctx := &android.TestPathContext{TestResult: result}
+
+		extension := extensionModules(ctx)
+		android.AssertArrayString(t, "extension modules", []string{"platform:framework"}, extension.CopyOfApexJarPairs())
+		android.AssertStringDoesContain(t, "dry run summary", dexpreoptDryRunSummary(ctx),
+			"DEXPREOPT_IMAGE_EXTENSION_MODULES=platform:framework\n")
+	})
+
+	t.Run("not a prefix", func(t *testing.T) {
+		preparer.ExtendWithErrorHandler(android.FixtureExpectsAtLeastOneErrorMatchingPattern(
+			`ExtendArtBootImage is set, but the art boot image modules \[com.android.art:core1 com.android.art:core2 platform:extra1\] are not a strict prefix of the default boot image modules`)).
+			RunTest(t)
+	})
+
+	t.Run("not a strict prefix", func(t *testing.T) {
+		android.GroupFixturePreparers(
+			preparer,
+			dexpreopt.FixtureSetTestOnlyArtBootImageJars("com.android.art:core1", "com.android.art:core2", "platform:framework"),
+		).ExtendWithErrorHandler(android.FixtureExpectsAtLeastOneErrorMatchingPattern(
+			`are not a strict prefix of the default boot image modules \[com.android.art:core1 com.android.art:core2 platform:framework\]`)).
+			RunTest(t)
+	})
+}
+
+func TestDexpreoptConfigVars(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		PrepareApexBootJarConfigs,
+	).RunTest(t)
+	ctx := &android.TestPathContext{TestResult: result}
+
+	// This is the full list of the variables, in order. Their names are relied upon by Make.
+	android.AssertDeepEquals(t, "vars", []struct{ Name, Value string }{
+		{"DEXPREOPT_BOOT_JARS_MODULES", "com.android.art:core1:com.android.art:core2:platform:framework"},
+		{"DEXPREOPT_BOOTCLASSPATH_DEX_FILES", classpathMakeVars(ctx)["DEXPREOPT_BOOTCLASSPATH_DEX_FILES"]},
+		{"DEXPREOPT_BOOTCLASSPATH_DEX_LOCATIONS", "/apex/com.android.art/javalib/core1.jar /apex/com.android.art/javalib/core2.jar /system/framework/framework.jar"},
+		{"DEXPREOPT_TOTAL_BOOT_JARS_COUNT", "5"},
+		{"DEX_PREOPT_ARTIFACT_PARTITIONS", "system"},
+	}, dexpreoptConfigVars(ctx))
+
+	android.AssertDeepEquals(t, "on device image generation", []struct{ Name, Value string }{
+		{"DEXPREOPT_BOOT_JARS_MODULES", "platform:foo"},
+		{"DEXPREOPT_TOTAL_BOOT_JARS_COUNT", "1"},
+		{"DEX_PREOPT_ON_DEVICE_IMAGE_GENERATION", "true"},
+		{"DEX_PREOPT_ARTIFACT_PARTITIONS", "system recovery"},
+	}, computeDexpreoptConfigVars(dexpreoptConfigVarsInputs{
+		classpathVars:           map[string]string{"DEXPREOPT_BOOT_JARS_MODULES": "platform:foo"},
+		totalBootJarCount:       1,
+		onDeviceImageGeneration: true,
+		artifactPartitions:      []string{"system", "recovery"},
+	}))
+}
+
+func TestProfiledModules(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		PrepareApexBootJarConfigs,
+	).RunTest(t)
+	ctx := &android.TestPathContext{TestResult: result}
+	android.AssertArrayString(t, "all modules", []string{"core1", "core2", "framework"},
+		defaultBootImageConfig(ctx).ProfiledModules())
+
+	result = android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		PrepareApexBootJarConfigs,
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.ProfiledBootModules = []string{"framework", "core2", "service-foo"}
+		}),
+	).RunTest(t)
+	ctx = &android.TestPathContext{TestResult: result}
+	configs := genBootImageConfigs(ctx)
+
+	android.AssertArrayString(t, "art", []string{"core2"}, configs["art"].ProfiledModules())
+	android.AssertArrayString(t, "boot", []string{"core2", "framework"}, configs[frameworkBootImageName].ProfiledModules())
+	android.AssertArrayString(t, "mainline", []string{}, configs[mainlineBootImageName].ProfiledModules())
+
+	dexPaths, dexLocations := configs[frameworkBootImageName].profiledDexPathsAndLocations()
+	android.AssertPathsRelativeToTopEquals(t, "profiled dex paths", []string{
+		"out/soong/dexpreopt_arm64/dex_bootjars_input/core2.jar",
+		"out/soong/dexpreopt_arm64/dex_bootjars_input/framework.jar",
+	}, dexPaths)
+	android.AssertArrayString(t, "profiled dex locations", []string{
+		"/apex/com.android.art/javalib/core2.jar",
+		"/system/framework/framework.jar",
+	}, dexLocations)
+}
+
+func TestSecondaryBootImageModules(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		PrepareApexBootJarConfigs,
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.SecondaryBootImageModules = []string{"framework-bar"}
+		}),
+	).RunTest(t)
+	ctx := &android.TestPathContext{TestResult: result}
+
+	primary := defaultBootImageConfig(ctx)
+	secondary := mainlineBootImageConfig(ctx)
+	android.AssertArrayString(t, "modules", []string{"com.android.bar:framework-bar"}, secondary.modules.CopyOfApexJarPairs())
+	android.AssertBoolEquals(t, "extends the primary image", true, secondary.extends == primary)
+
+	variant := secondary.getAnyAndroidVariant()
+	primaryVariant := primary.getAnyAndroidVariant()
+	android.AssertArrayString(t, "dexLocations", []string{"/apex/com.android.bar/javalib/framework-bar.jar"}, variant.dexLocations)
+	android.AssertArrayString(t, "dexLocationsDeps",
+		append(append([]string(nil), primaryVariant.dexLocations...), "/apex/com.android.bar/javalib/framework-bar.jar"),
+		variant.dexLocationsDeps)
+	android.AssertPathsRelativeToTopEquals(t, "baseImages",
+		[]string{android.PathRelativeToTop(primaryVariant.imagePathOnHost)}, variant.baseImages.Paths())
+
+	android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		PrepareApexBootJarConfigs,
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.SecondaryBootImageModules = []string{"framework-bar", "framework"}
+		}),
+	).ExtendWithErrorHandler(android.FixtureExpectsAtLeastOneErrorMatchingPattern(
+		`Secondary boot image module "framework" is not an apex boot jar`)).
+		RunTest(t)
+}
+
+func TestExpectedPreoptApiLevel(t *testing.T) {
+	expectApiLevel := func(level string) android.FixturePreparer {
+		return android.GroupFixturePreparers(
+			PrepareForBootImageConfigTest,
+			dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+				c.ExpectedPreoptApiLevel = level
+			}),
+		)
+	}
+
+	// The test config has platform API level 30.
+	expectApiLevel("30").RunTest(t)
+
+	expectApiLevel("29").ExtendWithErrorHandler(android.FixtureExpectsAtLeastOneErrorMatchingPattern(
+		`The dexpreopt targets arm64, arm have API level 30, but ExpectedPreoptApiLevel is 29`)).
+		RunTest(t)
+}
+
+func TestRequiredArtModuleOrder(t *testing.T) {
+	requireOrder := func(order ...string) android.FixturePreparer {
+		return android.GroupFixturePreparers(
+			PrepareForBootImageConfigTest,
+			dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+				c.RequiredArtModuleOrder = order
+			}),
+		)
+	}
+
+	// The art boot image modules of the test config are core1, core2 and extra1.
+	requireOrder("core1", "core2").RunTest(t)
+
+	requireOrder("core2", "core1").ExtendWithErrorHandler(android.FixtureExpectsAtLeastOneErrorMatchingPattern(
+		`The art boot image modules must start with RequiredArtModuleOrder \[core2 core1\], but they are \[core1 core2 extra1\]`)).
+		RunTest(t)
+}
+
+func TestRuntimeBootImageLocation(t *testing.T) {
+	location := func(t *testing.T, arch android.ArchType, preparers ...android.FixturePreparer) string {
+		result := android.GroupFixturePreparers(PrepareForBootImageConfigTest, android.GroupFixturePreparers(preparers...)).RunTest(t)
+		ctx := &android.TestPathContext{TestResult: result}
+		vars := result.MakeVarsForTesting(func(variable android.MakeVarVariable) bool {
+			return variable.Name() == "DEXPREOPT_IMAGE_LOCATIONS_ON_DEVICE_"+arch.String()
+		})
+		android.AssertIntEquals(t, "make vars", 1, len(vars))
+		android.AssertStringEquals(t, "make var", RuntimeBootImageLocation(ctx, arch), vars[0].Value())
+		return vars[0].Value()
+	}
+
+	t.Run("monolithic", func(t *testing.T) {
+		android.AssertStringEquals(t, "arm64", "/system/framework/boot.art", location(t, android.Arm64))
+		android.AssertStringEquals(t, "arm", "/system/framework/boot.art", location(t, android.Arm))
+	})
+
+	t.Run("extension", func(t *testing.T) {
+		android.AssertStringEquals(t, "arm64", "/system/framework/boot.art:/system/framework/boot-framework-foo.art",
+			location(t, android.Arm64, PrepareApexBootJarConfigs))
+	})
+
+	t.Run("apex", func(t *testing.T) {
+		android.AssertStringEquals(t, "arm64", "/apex/com.android.art/javalib/boot.art",
+			location(t, android.Arm64, PrepareApexBootJarConfigs,
+				dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+					c.UsesArtApexBootImage = true
+				})))
+	})
+
+	t.Run("no variant", func(t *testing.T) {
+		result := PrepareForBootImageConfigTest.RunTest(t)
+		ctx := &android.TestPathContext{TestResult: result}
+		android.AssertStringEquals(t, "riscv64", "", RuntimeBootImageLocation(ctx, android.Riscv64))
+	})
+}
+
+func TestDexpreoptDataGoldens(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		result := android.GroupFixturePreparers(
+			PrepareForBootImageConfigTest,
+			PrepareApexBootJarConfigs,
+			dexpreopt.FixtureSetSystemServerJars("platform:services"),
+			dexpreopt.FixtureSetApexSystemServerJars("com.android.foo:service-foo"),
+		).RunTest(t)
+		CheckDexpreoptDataGolden(t, result, "testdata/dexpreopt_data/default.json")
+	})
+
+	t.Run("customized", func(t *testing.T) {
+		result := android.GroupFixturePreparers(
+			PrepareForBootImageConfigTest,
+			FixtureConfigureApexBootJars("com.android.foo:framework-foo"),
+			dexpreopt.FixtureSetClasspathOnlyApexJars("com.android.baz:framework-baz"),
+			dexpreopt.FixtureSetSystemServerJars("platform:services", "system_ext:service-ext"),
+			dexpreopt.FixtureSetApexSystemServerJars("com.android.foo:service-foo"),
+			dexpreopt.FixtureSetStandaloneSystemServerJars("platform:service-standalone"),
+			dexpreopt.FixtureSetApexStandaloneSystemServerJars("com.android.bar:service-bar-standalone"),
+			dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+				c.OnDeviceImageGeneration = true
+			}),
+		).RunTest(t)
+		CheckDexpreoptDataGolden(t, result, "testdata/dexpreopt_data/customized.json")
+	})
+}
@@ -24,7 +24,9 @@
 package java
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
 	"strings"
 	"testing"
 
@@ -1328,6 +1330,8 @@ DEXPREOPT_IMAGE_LICENSE_METADATA_mainline_arm=out/soong/.intermediates/default/j
 DEXPREOPT_IMAGE_LICENSE_METADATA_mainline_arm64=out/soong/.intermediates/default/java/dex_bootjars/android_common/meta_lic
 DEXPREOPT_IMAGE_LICENSE_METADATA_mainline_host_x86=out/soong/.intermediates/default/java/dex_bootjars/android_common/meta_lic
 DEXPREOPT_IMAGE_LICENSE_METADATA_mainline_host_x86_64=out/soong/.intermediates/default/java/dex_bootjars/android_common/meta_lic
+DEXPREOPT_IMAGE_LOCATIONS_ON_DEVICE_arm=/system/framework/boot.art:/system/framework/boot-framework-foo.art
+DEXPREOPT_IMAGE_LOCATIONS_ON_DEVICE_arm64=/system/framework/boot.art:/system/framework/boot-framework-foo.art
 DEXPREOPT_IMAGE_LOCATIONS_ON_DEVICEart=/apex/art_boot_images/javalib/boot.art
 DEXPREOPT_IMAGE_LOCATIONS_ON_DEVICEboot=/system/framework/boot.art
 DEXPREOPT_IMAGE_LOCATIONS_ON_DEVICEmainline=/system/framework/boot.art:/system/framework/boot-framework-foo.art
@@ -1376,8 +1380,56 @@ DEXPREOPT_IMAGE_mainline_arm=out/soong/dexpreopt_arm64/dex_mainlinejars/android/
 DEXPREOPT_IMAGE_mainline_arm64=out/soong/dexpreopt_arm64/dex_mainlinejars/android/system/framework/arm64/boot-framework-foo.art
 DEXPREOPT_IMAGE_mainline_host_x86=out/soong/dexpreopt_arm64/dex_mainlinejars/linux_glibc/system/framework/x86/boot-framework-foo.art
 DEXPREOPT_IMAGE_mainline_host_x86_64=out/soong/dexpreopt_arm64/dex_mainlinejars/linux_glibc/system/framework/x86_64/boot-framework-foo.art
+DEXPREOPT_TOTAL_BOOT_JARS_COUNT=5
 `
 	expected := strings.TrimSpace(fmt.Sprintf(format, expectedLicenseMetadataFile))
 	actual := strings.TrimSpace(out.String())
 	android.AssertStringEquals(t, "vars", expected, actual)
 }
+
+// UpdateDexpreoptGoldensEnv is the environment variable that makes CheckDexpreoptDataGolden rewrite
+// the golden files rather than compare against them.
+const UpdateDexpreoptGoldensEnv = "UPDATE_DEXPREOPT_GOLDENS"
+
+// CheckDexpreoptDataGolden checks the class path and boot image data that is computed for the
+// test result, i.e. the DexpreoptData that is handed to the dexpreopt validations, against the given
+// golden file, which is relative to the directory of the test.
+//
+// If UpdateDexpreoptGoldensEnv is set then the golden file is rewritten instead, so that a change to
+// any of the computations shows up as a reviewable diff of the golden file.
+func CheckDexpreoptDataGolden(t *testing.T, result *android.TestResult, golden string) {
+	t.Helper()
+	checkJSONGolden(t, "dexpreopt data", dexpreoptData(&android.TestPathContext{TestResult: result}), golden)
+}
+
+// CheckBootclasspathProvenanceGolden checks the provenance of the entries of BOOTCLASSPATH that is
+// computed for the test result against the given golden file, like CheckDexpreoptDataGolden.
+func CheckBootclasspathProvenanceGolden(t *testing.T, result *android.TestResult, golden string) {
+	t.Helper()
+	checkJSONGolden(t, "boot class path provenance", bootclasspathProvenanceData(&android.TestPathContext{TestResult: result}), golden)
+}
+
+// checkJSONGolden checks the indented JSON encoding of the value against the given golden file, or
+// rewrites the golden file if UpdateDexpreoptGoldensEnv is set.
+func checkJSONGolden(t *testing.T, what string, value interface{}, golden string) {
+	t.Helper()
+	data, err := json.MarshalIndent(value, "", "    ")
+	if err != nil {
+		t.Fatalf("failed to JSON marshal the %s: %s", what, err)
+	}
+	actual := string(data) + "\n"
+
+	if os.Getenv(UpdateDexpreoptGoldensEnv) != "" {
+		if err := os.WriteFile(golden, []byte(actual), 0666); err != nil {
+			t.Fatalf("failed to update %s: %s", golden, err)
+		}
+		return
+	}
+
+	expected, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("failed to read %s, set %s=1 to create it: %s", golden, UpdateDexpreoptGoldensEnv, err)
+	}
+	android.AssertStringEquals(t, fmt.Sprintf("%s, set %s=1 to update %s", what, UpdateDexpreoptGoldensEnv, golden),
+		string(expected), actual)
+}
@@ -0,0 +1,85 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package java
+
+import (
+	"fmt"
+	"time"
+
+	"android/soong/android"
+	"android/soong/dexpreopt"
+)
+
+// Each jar must be claimed by exactly one classpath owner: either the boot class path or the
+// classpath fragment of an apex. During a migration from one to the other a jar is temporarily
+// claimed by both, which is only allowed for the jars in GlobalConfig.DualClaimAllowlist, and only
+// until the allowlist expires.
+
+// The format of DualClaimAllowlist.Expiry.
+const dualClaimExpiryLayout = "2006-01-02"
+
+// dualClaimNow returns the current time, against which DualClaimAllowlist.Expiry is checked. It is
+// a variable so that tests can fix the date.
+var dualClaimNow = time.Now
+
+// dualClaimFindings returns the warnings about the dual claims that are allowed by
+// DualClaimAllowlist, and the errors about those that are not, or no longer, allowed on the given
+// day. A dual claim is a jar that is both on the boot class path and an apex system server jar.
+func dualClaimFindings(global *dexpreopt.GlobalConfig, now time.Time) (warnings []string, errs []error) {
+	allowlist := global.DualClaimAllowlist
+	expired := false
+	if allowlist.Jars.Len() > 0 {
+		expiry, err := time.Parse(dualClaimExpiryLayout, allowlist.Expiry)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("DualClaimAllowlist.Expiry %q is not a date in the YYYY-MM-DD format", allowlist.Expiry))
+		} else {
+			// The jars may be claimed twice until the end of the expiry day.
+			expired = !now.Before(expiry.AddDate(0, 0, 1))
+		}
+	}
+
+	bootJars := allBootclasspathJars(global)
+	apexJars := global.ApexSystemServerJars.AppendList(&global.ApexStandaloneSystemServerJars)
+	for i := 0; i < apexJars.Len(); i++ {
+		apex, jar := apexJars.Apex(i), apexJars.Jar(i)
+		if !bootJars.ContainsJar(jar) {
+			continue
+		}
+		claim := fmt.Sprintf("%q is claimed by both the boot class path, as %s:%s, and the classpath fragment of apex %q",
+			jar, bootJars.ApexOfJar(jar), jar, apex)
+		switch {
+		case allowlist.Jars.ApexOfJar(jar) != apex:
+			errs = append(errs, fmt.Errorf("%s; each jar must have one classpath owner, add %s:%s to DualClaimAllowlist while it is migrated",
+				claim, apex, jar))
+		case expired:
+			errs = append(errs, fmt.Errorf("%s, but DualClaimAllowlist expired after %s; finish the migration of the jar",
+				claim, allowlist.Expiry))
+		default:
+			warnings = append(warnings, fmt.Sprintf("%s, which DualClaimAllowlist allows until %s", claim, allowlist.Expiry))
+		}
+	}
+	return warnings, errs
+}
+
+// checkDualClaims reports the errors returned by dualClaimFindings, and collects its warnings.
+func checkDualClaims(ctx android.SingletonContext, global *dexpreopt.GlobalConfig) {
+	warnings, errs := dualClaimFindings(global, dualClaimNow())
+	for _, warning := range warnings {
+		getDexpreoptWarnings(ctx).add(dexpreoptWarningDualClaim, "DualClaimAllowlist", warning)
+	}
+	for _, err := range errs {
+		ctx.Errorf("%s", err)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package java
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"android/soong/android"
+	"android/soong/dexpreopt"
+)
+
+func TestDualClaimFindings(t *testing.T) {
+	global := func(allowlist ...string) *dexpreopt.GlobalConfig {
+		return &dexpreopt.GlobalConfig{
+			BootJars:             android.CreateTestConfiguredJarList([]string{"platform:framework"}),
+			ApexBootJars:         android.CreateTestConfiguredJarList([]string{"com.android.foo:framework-foo", "com.android.bar:service-bar"}),
+			ApexSystemServerJars: android.CreateTestConfiguredJarList([]string{"com.android.foo:service-foo", "com.android.bar:service-bar"}),
+			DualClaimAllowlist: dexpreopt.DualClaimAllowlist{
+				Jars:   android.CreateTestConfiguredJarList(allowlist),
+				Expiry: "2026-06-30",
+			},
+		}
+	}
+	day := func(date string) time.Time {
+		now, err := time.Parse(dualClaimExpiryLayout, date)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return now
+	}
+	claim := `"service-bar" is claimed by both the boot class path, as com.android.bar:service-bar, and the classpath fragment of apex "com.android.bar"`
+
+	t.Run("unlisted", func(t *testing.T) {
+		warnings, errs := dualClaimFindings(global(), day("2026-01-01"))
+		android.AssertDeepEquals(t, "warnings", []string(nil), warnings)
+		android.AssertArrayString(t, "errors", []string{
+			claim + "; each jar must have one classpath owner, add com.android.bar:service-bar to DualClaimAllowlist while it is migrated",
+		}, errorStrings(errs))
+	})
+
+	t.Run("listed", func(t *testing.T) {
+		warnings, errs := dualClaimFindings(global("com.android.bar:service-bar"), day("2026-06-30"))
+		android.AssertArrayString(t, "warnings", []string{
+			claim + ", which DualClaimAllowlist allows until 2026-06-30",
+		}, warnings)
+		android.AssertDeepEquals(t, "errors", []error(nil), errs)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		warnings, errs := dualClaimFindings(global("com.android.bar:service-bar"), day("2026-07-01"))
+		android.AssertDeepEquals(t, "warnings", []string(nil), warnings)
+		android.AssertArrayString(t, "errors", []string{
+			claim + ", but DualClaimAllowlist expired after 2026-06-30; finish the migration of the jar",
+		}, errorStrings(errs))
+	})
+
+	t.Run("invalid expiry", func(t *testing.T) {
+		config := global("com.android.bar:service-bar")
+		config.DualClaimAllowlist.Expiry = "June 2026"
+		_, errs := dualClaimFindings(config, day("2026-01-01"))
+		android.AssertArrayString(t, "errors", []string{
+			`DualClaimAllowlist.Expiry "June 2026" is not a date in the YYYY-MM-DD format`,
+		}, errorStrings(errs))
+	})
+}
+
+func TestCheckDualClaims(t *testing.T) {
+	android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		PrepareApexBootJarConfigs,
+		dexpreopt.FixtureSetApexSystemServerJars("com.android.foo:framework-foo"),
+	).ExtendWithErrorHandler(android.FixtureExpectsAtLeastOneErrorMatchingPattern(
+		`add com.android.foo:framework-foo to DualClaimAllowlist while it is migrated`)).
+		RunTest(t)
+}
+
+func errorStrings(errs []error) []string {
+	var strs []string
+	for _, err := range errs {
+		strs = append(strs, fmt.Sprint(err))
+	}
+	return strs
+}
@@ -0,0 +1,89 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package java
+
+import (
+	"fmt"
+
+	"android/soong/android"
+	"android/soong/dexpreopt"
+
+	"github.com/google/blueprint"
+)
+
+// Manifests of the staged boot dex jars, so that hermeticity audits can check that the jars that
+// the boot images are compiled from are exactly the ones that the module build produced. They are
+// only written if GlobalConfig.AuditBootDexInputs is set.
+
+// BootDexJarHashInfo is provided by modules that know the hash of the dex jar that they supply to
+// the boot images. No module provides it yet.
+type BootDexJarHashInfo struct {
+	// The hex encoded sha256 of the dex jar.
+	Sha256 string
+}
+
+var BootDexJarHashInfoProvider = blueprint.NewProvider[BootDexJarHashInfo]()
+
+// bootDexInputsManifestPath returns the path to the manifest of the staged dex jars of the variant.
+// Each line has the name, the sha256 and the size of a jar.
+func (variant *bootImageVariant) bootDexInputsManifestPath(ctx android.PathContext) android.OutputPath {
+	return variant.imagePathOnHost.InSameDir(ctx, "boot_dex_inputs.txt")
+}
+
+// expectedBootDexJarHashes returns the sha256 of the dex jars provided by the given modules through
+// BootDexJarHashInfoProvider, by jar name.
+func expectedBootDexJarHashes(ctx android.ModuleContext, apexJarModulePairs []apexJarModulePair) map[string]string {
+	hashes := make(map[string]string)
+	for _, pair := range apexJarModulePairs {
+		if info, ok := android.OtherModuleProvider(ctx, pair.jarModule, BootDexJarHashInfoProvider); ok {
+			hashes[pair.jar] = info.Sha256
+		}
+	}
+	return hashes
+}
+
+// buildBootDexInputsManifests generates a rule per variant of the image to write the manifest of the
+// staged dex jars of the image. If GlobalConfig.VerifyBootDexInputHashes is set, the rules also fail
+// if a jar does not match the hash in the expected map.
+func buildBootDexInputsManifests(ctx android.ModuleContext, image *bootImageConfig, expected map[string]string) {
+	if !dexpreopt.GetGlobalConfig(ctx).VerifyBootDexInputHashes {
+		expected = nil
+	}
+	for _, variant := range image.variants {
+		manifest := variant.bootDexInputsManifestPath(ctx)
+		rule := android.NewRuleBuilder(pctx, ctx)
+		rule.Command().Text("rm").Flag("-f").Output(manifest)
+		for i := 0; i < image.modules.Len(); i++ {
+			name := image.modules.Jar(i)
+			jar := image.dexPathsByModule[name]
+			rule.Command().Text(bootDexInputHashCommand(name, jar.String(), manifest.String(), expected[name])).
+				Implicit(jar)
+		}
+		rule.Build("bootDexInputs_"+image.name+"_"+variant.target.String(),
+			"boot dex inputs manifest "+image.name+" "+variant.target.Arch.ArchType.String())
+	}
+}
+
+// bootDexInputHashCommand returns a shell command that appends the name, the sha256 and the size of
+// the jar to the manifest. If the expected sha256 is not empty, the command fails with an error
+// with the name of the jar and both hashes if the jar does not match it.
+func bootDexInputHashCommand(name, jar, manifest, expected string) string {
+	cmd := fmt.Sprintf(`sha256=$(sha256sum %s | cut -d' ' -f1) && size=$(wc -c < %s | tr -d ' ')`, jar, jar)
+	if expected != "" {
+		cmd += fmt.Sprintf(` && { [ "$sha256" = %s ] || { echo "boot dex jar %s has sha256 $sha256, but the module that supplies it has sha256 %s" >&2; exit 1; }; }`,
+			expected, name, expected)
+	}
+	return cmd + fmt.Sprintf(` && echo "%s $sha256 $size" >> %s`, name, manifest)
+}
@@ -0,0 +1,119 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package java
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"android/soong/android"
+	"android/soong/dexpreopt"
+)
+
+func TestBootDexInputsManifest(t *testing.T) {
+	preparer := android.GroupFixturePreparers(
+		PrepareForTestWithDexpreopt,
+		FixtureConfigureBootJars("platform:foo"),
+		android.FixtureWithRootAndroidBp(`
+			platform_bootclasspath {
+				name: "platform-bootclasspath",
+			}
+
+			java_library {
+				name: "foo",
+				srcs: ["a.java"],
+				system_modules: "none",
+				sdk_version: "none",
+				compile_dex: true,
+			}
+		`),
+	)
+
+	manifest := "out/soong/dexpreopt_arm64/dex_bootjars/android/system/framework/arm64/boot_dex_inputs.txt"
+	stagedJar := "out/soong/dexpreopt_arm64/dex_bootjars_input/foo.jar"
+
+	result := preparer.RunTest(t)
+	dexBootJars := result.ModuleForTests("dex_bootjars", "android_common")
+	android.AssertBoolEquals(t, "manifest rule", false, dexBootJars.MaybeOutput(manifest).Rule != nil)
+
+	result = android.GroupFixturePreparers(
+		preparer,
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.AuditBootDexInputs = true
+		}),
+	).RunTest(t)
+	dexBootJars = result.ModuleForTests("dex_bootjars", "android_common")
+	rule := dexBootJars.Output(manifest)
+	android.AssertPathsRelativeToTopEquals(t, "implicits", []string{stagedJar}, rule.Implicits)
+	command := android.StringRelativeToTop(result.Config, rule.RuleParams.Command)
+	android.AssertStringDoesContain(t, "command", command, "sha256sum "+stagedJar)
+	android.AssertStringDoesContain(t, "command", command, `echo "foo $sha256 $size" >> `+manifest)
+}
+
+func TestBootDexInputHashCommand(t *testing.T) {
+	if _, err := exec.LookPath("sha256sum"); err != nil {
+		t.Skip("sha256sum is not available")
+	}
+
+	dir := t.TempDir()
+	jar := filepath.Join(dir, "foo.jar")
+	if err := os.WriteFile(jar, []byte("dex"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("dex"))
+	actual := hex.EncodeToString(sum[:])
+
+	run := func(expected string) (string, string, error) {
+		manifest := filepath.Join(dir, expected+"manifest.txt")
+		var stderr strings.Builder
+		cmd := exec.Command("/bin/sh", "-c", bootDexInputHashCommand("foo", jar, manifest, expected))
+		cmd.Stderr = &stderr
+		err := cmd.Run()
+		data, _ := os.ReadFile(manifest)
+		return string(data), stderr.String(), err
+	}
+
+	t.Run("no expected hash", func(t *testing.T) {
+		manifest, _, err := run("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		android.AssertStringEquals(t, "manifest", "foo "+actual+" 3\n", manifest)
+	})
+
+	t.Run("matching hash", func(t *testing.T) {
+		manifest, _, err := run(actual)
+		if err != nil {
+			t.Fatal(err)
+		}
+		android.AssertStringEquals(t, "manifest", "foo "+actual+" 3\n", manifest)
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		// A fake BootDexJarHashInfo for a different jar.
+		sum := sha256.Sum256([]byte("other dex"))
+		expected := hex.EncodeToString(sum[:])
+		manifest, stderr, err := run(expected)
+		android.AssertBoolEquals(t, "failed", true, err != nil)
+		android.AssertStringEquals(t, "manifest", "", manifest)
+		android.AssertStringEquals(t, "stderr",
+			"boot dex jar foo has sha256 "+actual+", but the module that supplies it has sha256 "+expected+"\n", stderr)
+	})
+}
@@ -0,0 +1,221 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package java
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"android/soong/android"
+	"android/soong/dexpreopt"
+)
+
+// A self-check of the make variables that export the boot class path. The values that are handed
+// to Make are parsed back and compared with the BootclasspathConfigInfo and the boot image configs
+// they are derived from, to catch bugs in the exporters.
+
+var classpathMakeVarsHookKey = newDexpreoptOnceKey("classpathMakeVarsHook")
+
+// setClasspathMakeVarsHookForTesting sets a function that is called with the values computed by
+// classpathMakeVars before they are returned, so that tests can corrupt an exporter. It must be
+// called before the first call to classpathMakeVars for the config.
+func setClasspathMakeVarsHookForTesting(config android.Config, hook func(vars map[string]string)) {
+	config.Once(classpathMakeVarsHookKey, func() interface{} { return hook })
+}
+
+// classpathMakeVars returns the values of the make variables that export the boot class path, by
+// variable name.
+func classpathMakeVars(ctx android.PathContext) map[string]string {
+	global := dexpreopt.GetGlobalConfig(ctx)
+	dexPaths, dexLocations := bcpForDexpreopt(ctx, global.PreoptWithUpdatableBcp)
+	vars := map[string]string{
+		"DEXPREOPT_BOOT_JARS_MODULES":           strings.Join(defaultBootImageConfig(ctx).modules.CopyOfApexJarPairs(), ":"),
+		"DEXPREOPT_BOOTCLASSPATH_DEX_FILES":     makeVarPaths(ctx, dexPaths.Paths()),
+		"DEXPREOPT_BOOTCLASSPATH_DEX_LOCATIONS": strings.Join(dexLocations, " "),
+	}
+	hook := ctx.Config().Once(classpathMakeVarsHookKey, func() interface{} {
+		return func(map[string]string) {}
+	}).(func(map[string]string))
+	hook(vars)
+	return vars
+}
+
+// makeVarPath returns the value of a make variable that exports the given build path. It is
+// relative to the out directory if GlobalConfig.MakeVarsRelativePaths is set, unless the path is
+// not in the out directory.
+func makeVarPath(ctx android.PathContext, path android.Path) string {
+	if !dexpreopt.GetGlobalConfig(ctx).MakeVarsRelativePaths {
+		return path.String()
+	}
+	rel, err := filepath.Rel(ctx.Config().OutDir(), path.String())
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return path.String()
+	}
+	return rel
+}
+
+// makeVarPaths returns the value of a make variable that exports the given build paths, see
+// makeVarPath.
+func makeVarPaths(ctx android.PathContext, paths android.Paths) string {
+	values := make([]string, 0, len(paths))
+	for _, path := range paths {
+		values = append(values, makeVarPath(ctx, path))
+	}
+	return strings.Join(values, " ")
+}
+
+// exportedMakeVarsCheckEnabled returns true if the make variables returned by classpathMakeVars are
+// checked, see GlobalConfig.VerifyExportedMakeVars.
+func exportedMakeVarsCheckEnabled(ctx android.PathContext) bool {
+	return ctx.Config().Eng() || dexpreopt.GetGlobalConfig(ctx).VerifyExportedMakeVars
+}
+
+// checkExportedMakeVars reports an error for each difference between the make variables that are
+// handed to Make by dexpreoptConfigMakevars and the config they are derived from, if the check is
+// enabled.
+func checkExportedMakeVars(ctx android.SingletonContext) {
+	if !exportedMakeVarsCheckEnabled(ctx) {
+		return
+	}
+	for _, diff := range diffClasspathMakeVars(ctx, makeVarsByName(dexpreoptConfigVars(ctx))) {
+		ctx.Errorf("Exported make variable does not match the dexpreopt config: %s", diff)
+	}
+}
+
+// makeVarsByName returns the values of the given make variables by variable name.
+func makeVarsByName(vars []struct{ Name, Value string }) map[string]string {
+	byName := make(map[string]string, len(vars))
+	for _, v := range vars {
+		byName[v.Name] = v.Value
+	}
+	return byName
+}
+
+// bootImageChain returns the given boot image and the boot images it extends, starting with the
+// one that does not extend any other.
+func bootImageChain(image *bootImageConfig) []*bootImageConfig {
+	var chain []*bootImageConfig
+	for ; image != nil; image = image.extends {
+		chain = append([]*bootImageConfig{image}, chain...)
+	}
+	return chain
+}
+
+// diffClasspathMakeVars parses the given values of the make variables returned by
+// classpathMakeVars, and returns the differences from the BootclasspathConfigInfo and the boot
+// image configs, one per field. A variable that is missing is reported as not emitted and not
+// compared any further. The dex files and locations are only expected if they are exported, see
+// SkipDexpreoptBootJars.
+func diffClasspathMakeVars(ctx android.PathContext, vars map[string]string) []string {
+	global := dexpreopt.GetGlobalConfig(ctx)
+
+	var diffs []string
+	emitted := func(name string) bool {
+		if _, ok := vars[name]; !ok {
+			diffs = append(diffs, fmt.Sprintf("%s is not emitted", name))
+			return false
+		}
+		return true
+	}
+	diffLists := func(name string, got, want []string) {
+		if len(got) != len(want) {
+			diffs = append(diffs, fmt.Sprintf("%s has %d entries, want %d", name, len(got), len(want)))
+			return
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				diffs = append(diffs, fmt.Sprintf("%s[%d] is %q, want %q", name, i, got[i], want[i]))
+			}
+		}
+	}
+
+	var wantModules []string
+	for _, variant := range bootclasspathConfigInfo(ctx).ImageVariants {
+		if variant.Image == defaultBootImageConfig(ctx).name {
+			wantModules = variant.Modules
+			break
+		}
+	}
+	if emitted("DEXPREOPT_BOOT_JARS_MODULES") {
+		modules, err := parseApexJarPairs(vars["DEXPREOPT_BOOT_JARS_MODULES"])
+		if err != nil {
+			diffs = append(diffs, fmt.Sprintf("DEXPREOPT_BOOT_JARS_MODULES: %s", err))
+		} else {
+			diffLists("DEXPREOPT_BOOT_JARS_MODULES", modules, wantModules)
+		}
+	}
+
+	if SkipDexpreoptBootJars(ctx) {
+		return diffs
+	}
+	image := defaultBootImageConfig(ctx)
+	if global.PreoptWithUpdatableBcp {
+		image = mainlineBootImageConfig(ctx)
+	}
+	var wantFiles, wantLocations []string
+	for _, img := range bootImageChain(image) {
+		wantFiles = append(wantFiles, strings.Fields(makeVarPaths(ctx, img.dexPaths.Paths()))...)
+		wantLocations = append(wantLocations, img.getAnyAndroidVariant().dexLocations...)
+	}
+	if emitted("DEXPREOPT_BOOTCLASSPATH_DEX_FILES") {
+		diffLists("DEXPREOPT_BOOTCLASSPATH_DEX_FILES", strings.Fields(vars["DEXPREOPT_BOOTCLASSPATH_DEX_FILES"]), wantFiles)
+	}
+	if emitted("DEXPREOPT_BOOTCLASSPATH_DEX_LOCATIONS") {
+		diffLists("DEXPREOPT_BOOTCLASSPATH_DEX_LOCATIONS", strings.Fields(vars["DEXPREOPT_BOOTCLASSPATH_DEX_LOCATIONS"]), wantLocations)
+	}
+	return diffs
+}
+
+// verifyMakeVarsConsistency recomputes the make variables that dexpreoptConfigMakevars emits from
+// the dexpreopt config, and returns an error listing the differences, if any. It is for tests, to
+// catch refactors that let the two drift apart.
+func verifyMakeVarsConsistency(ctx android.PathContext) error {
+	return makeVarsConsistencyError(ctx, dexpreoptConfigVars(ctx))
+}
+
+// makeVarsConsistencyError returns an error listing the differences between the given make
+// variables, as emitted by dexpreoptConfigMakevars, and those recomputed from the dexpreopt config.
+func makeVarsConsistencyError(ctx android.PathContext, vars []struct{ Name, Value string }) error {
+	emitted := makeVarsByName(vars)
+	diffs := diffClasspathMakeVars(ctx, emitted)
+	if got, ok := emitted["DEXPREOPT_TOTAL_BOOT_JARS_COUNT"]; !ok {
+		diffs = append(diffs, "DEXPREOPT_TOTAL_BOOT_JARS_COUNT is not emitted")
+	} else if want := strconv.Itoa(totalBootJarCount(ctx)); got != want {
+		diffs = append(diffs, fmt.Sprintf("DEXPREOPT_TOTAL_BOOT_JARS_COUNT is %q, want %q", got, want))
+	}
+
+	if len(diffs) > 0 {
+		return fmt.Errorf("the make variables do not match the dexpreopt config:\n  %s", strings.Join(diffs, "\n  "))
+	}
+	return nil
+}
+
+// parseApexJarPairs parses a ":" separated list of apex:jar pairs, e.g. "platform:foo:com.android.art:bar".
+func parseApexJarPairs(value string) ([]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+	parts := strings.Split(value, ":")
+	if len(parts)%2 != 0 {
+		return nil, fmt.Errorf("%q is not a list of apex:jar pairs", value)
+	}
+	pairs := make([]string, 0, len(parts)/2)
+	for i := 0; i < len(parts); i += 2 {
+		pairs = append(pairs, parts[i]+":"+parts[i+1])
+	}
+	return pairs, nil
+}
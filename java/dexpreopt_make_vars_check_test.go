@@ -0,0 +1,166 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package java
+
+import (
+	"strings"
+	"testing"
+
+	"android/soong/android"
+	"android/soong/dexpreopt"
+)
+
+func TestDiffClasspathMakeVars(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+	).RunTest(t)
+	ctx := &android.TestPathContext{TestResult: result}
+
+	android.AssertDeepEquals(t, "diffs", []string(nil), diffClasspathMakeVars(ctx, classpathMakeVars(ctx)))
+
+	_, dexLocations := bcpForDexpreopt(ctx, false)
+
+	t.Run("wrong entry", func(t *testing.T) {
+		vars := classpathMakeVars(ctx)
+		locations := strings.Fields(vars["DEXPREOPT_BOOTCLASSPATH_DEX_LOCATIONS"])
+		locations[1] = "/system/framework/bogus.jar"
+		vars["DEXPREOPT_BOOTCLASSPATH_DEX_LOCATIONS"] = strings.Join(locations, " ")
+		android.AssertDeepEquals(t, "diffs", []string{
+			`DEXPREOPT_BOOTCLASSPATH_DEX_LOCATIONS[1] is "/system/framework/bogus.jar", want "` + dexLocations[1] + `"`,
+		}, diffClasspathMakeVars(ctx, vars))
+	})
+
+	t.Run("missing entry", func(t *testing.T) {
+		vars := classpathMakeVars(ctx)
+		files := strings.Fields(vars["DEXPREOPT_BOOTCLASSPATH_DEX_FILES"])
+		vars["DEXPREOPT_BOOTCLASSPATH_DEX_FILES"] = strings.Join(files[1:], " ")
+		android.AssertDeepEquals(t, "diffs", []string{
+			"DEXPREOPT_BOOTCLASSPATH_DEX_FILES has 2 entries, want 3",
+		}, diffClasspathMakeVars(ctx, vars))
+	})
+
+	t.Run("malformed pairs", func(t *testing.T) {
+		vars := classpathMakeVars(ctx)
+		vars["DEXPREOPT_BOOT_JARS_MODULES"] = strings.Join(defaultBootImageConfig(ctx).modules.CopyOfJars(), ":")
+		android.AssertDeepEquals(t, "diffs", []string{
+			`DEXPREOPT_BOOT_JARS_MODULES: "core1:core2:framework" is not a list of apex:jar pairs`,
+		}, diffClasspathMakeVars(ctx, vars))
+	})
+}
+
+func TestCheckExportedMakeVars(t *testing.T) {
+	// The check passes on the values that are handed to Make.
+	android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.VerifyExportedMakeVars = true
+		}),
+	).RunTest(t)
+
+	// A corrupted exporter is reported with the field that differs.
+	android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.VerifyExportedMakeVars = true
+		}),
+		android.FixtureModifyConfig(func(config android.Config) {
+			setClasspathMakeVarsHookForTesting(config, func(vars map[string]string) {
+				locations := strings.Fields(vars["DEXPREOPT_BOOTCLASSPATH_DEX_LOCATIONS"])
+				locations[1] = "/system/framework/bogus.jar"
+				vars["DEXPREOPT_BOOTCLASSPATH_DEX_LOCATIONS"] = strings.Join(locations, " ")
+			})
+		}),
+	).ExtendWithErrorHandler(android.FixtureExpectsAtLeastOneErrorMatchingPattern(
+		`Exported make variable does not match the dexpreopt config: DEXPREOPT_BOOTCLASSPATH_DEX_LOCATIONS\[1\] is "/system/framework/bogus.jar", want "/apex/com.android.art/javalib/core2.jar"`)).
+		RunTest(t)
+
+	result := PrepareForBootImageConfigTest.RunTest(t)
+	ctx := &android.TestPathContext{TestResult: result}
+	android.AssertBoolEquals(t, "enabled by default", false, exportedMakeVarsCheckEnabled(ctx))
+}
+
+func TestVerifyMakeVarsConsistency(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+	).RunTest(t)
+	ctx := &android.TestPathContext{TestResult: result}
+
+	android.AssertDeepEquals(t, "error", nil, verifyMakeVarsConsistency(ctx))
+
+	// Inject divergences into the emitted values.
+	var vars []struct{ Name, Value string }
+	for _, v := range dexpreoptConfigVars(ctx) {
+		switch v.Name {
+		case "DEXPREOPT_BOOTCLASSPATH_DEX_FILES":
+			continue
+		case "DEXPREOPT_TOTAL_BOOT_JARS_COUNT":
+			v.Value = "4"
+		}
+		vars = append(vars, v)
+	}
+	err := makeVarsConsistencyError(ctx, vars)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	android.AssertStringEquals(t, "error", `the make variables do not match the dexpreopt config:
+  DEXPREOPT_BOOTCLASSPATH_DEX_FILES is not emitted
+  DEXPREOPT_TOTAL_BOOT_JARS_COUNT is "4", want "3"`, err.Error())
+}
+
+func TestParseApexJarPairs(t *testing.T) {
+	pairs, err := parseApexJarPairs("platform:foo:com.android.art:bar")
+	android.AssertDeepEquals(t, "error", nil, err)
+	android.AssertDeepEquals(t, "pairs", []string{"platform:foo", "com.android.art:bar"}, pairs)
+
+	pairs, err = parseApexJarPairs("")
+	android.AssertDeepEquals(t, "error", nil, err)
+	android.AssertIntEquals(t, "empty", 0, len(pairs))
+
+	_, err = parseApexJarPairs("platform:foo:bar")
+	android.AssertStringEquals(t, "error", `"platform:foo:bar" is not a list of apex:jar pairs`, err.Error())
+}
+
+func TestMakeVarsRelativePaths(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.MakeVarsRelativePaths = true
+			c.VerifyExportedMakeVars = true
+		}),
+	).RunTest(t)
+	ctx := &android.TestPathContext{TestResult: result}
+
+	android.AssertStringEquals(t, "zip", "soong/dexpreopt_arm64/dex_bootjars/boot.zip",
+		makeVarPath(ctx, defaultBootImageConfig(ctx).zip))
+	// Paths outside the out directory are not relativized.
+	android.AssertStringEquals(t, "source path", "frameworks/base/boot-image-profile.txt",
+		makeVarPath(ctx, android.PathForSource(ctx, "frameworks/base/boot-image-profile.txt")))
+
+	vars := make(map[string]string)
+	for _, v := range result.MakeVarsForTesting(func(variable android.MakeVarVariable) bool {
+		return strings.HasPrefix(variable.Name(), "DEXPREOPT_BOOTCLASSPATH_DEX_")
+	}) {
+		vars[v.Name()] = v.Value()
+	}
+	android.AssertStringEquals(t, "DEXPREOPT_BOOTCLASSPATH_DEX_FILES",
+		"soong/dexpreopt_arm64/dex_bootjars_input/core1.jar soong/dexpreopt_arm64/dex_bootjars_input/core2.jar soong/dexpreopt_arm64/dex_bootjars_input/framework.jar",
+		vars["DEXPREOPT_BOOTCLASSPATH_DEX_FILES"])
+	// The on-device locations are unaffected.
+	android.AssertStringEquals(t, "DEXPREOPT_BOOTCLASSPATH_DEX_LOCATIONS",
+		"/apex/com.android.art/javalib/core1.jar /apex/com.android.art/javalib/core2.jar /system/framework/framework.jar",
+		vars["DEXPREOPT_BOOTCLASSPATH_DEX_LOCATIONS"])
+
+	android.AssertDeepEquals(t, "error", nil, verifyMakeVarsConsistency(ctx))
+}
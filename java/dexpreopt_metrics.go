@@ -0,0 +1,248 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package java
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+
+	"android/soong/android"
+	"android/soong/dexpreopt"
+)
+
+// Metrics about the dexpreopt config, for build performance dashboards. They are written to a
+// JSON sidecar file next to the dexpreopt config for Make.
+
+// dexpreoptMetrics returns the metrics about the dexpreopt config, keyed by metric name.
+func dexpreoptMetrics(ctx android.PathContext) map[string]int {
+	added, removed := 0, 0
+	for _, diff := range bootImageModulesChanges(ctx) {
+		added += len(diff.added)
+		removed += len(diff.removed)
+	}
+	mismatch := 0
+	if len(updatableBootLocationsDiff(ctx)) > 0 {
+		mismatch = 1
+	}
+	return map[string]int{
+		"expected_action_count":             expectedDexpreoptActionCount(ctx),
+		"boot_image_modules_added":          added,
+		"boot_image_modules_removed":        removed,
+		"updatable_boot_locations_mismatch": mismatch,
+	}
+}
+
+// dexpreoptMetricsPath returns the path to the dexpreopt metrics sidecar file.
+func dexpreoptMetricsPath(ctx android.PathContext) android.WritablePath {
+	return android.PathForOutput(ctx, dexpreopt.GetDexpreoptDirName(ctx), "dexpreopt_metrics.json")
+}
+
+// buildDexpreoptMetrics generates a rule to write the dexpreopt metrics sidecar file, with the
+// number of modules that are dexpreopted with each compiler filter.
+func buildDexpreoptMetrics(ctx android.SingletonContext) {
+	metrics := dexpreoptMetrics(ctx)
+	for filter, names := range dexpreoptCompilerFilters(ctx) {
+		metrics["compiler_filter_"+filter+"_count"] = len(names)
+	}
+	data, err := json.MarshalIndent(metrics, "", "    ")
+	if err != nil {
+		ctx.Errorf("failed to JSON marshal dexpreopt metrics: %v", err)
+		return
+	}
+	android.WriteFileRule(ctx, dexpreoptMetricsPath(ctx), string(data))
+}
+
+// expectedDexpreoptActionCount returns the number of ninja actions that the boot image configs and
+// the system server jars are expected to generate.
+//
+// It mirrors generateBootImage and the dexpreopting of system server jars, and is derived from the
+// same config structs, so it follows any change in the configured variants and flags. It assumes
+// that the boot image configs that are enabled by the config are enabled in the build, and that the
+// boot image profiles exist.
+func expectedDexpreoptActionCount(ctx android.PathContext) int {
+	global := dexpreopt.GetGlobalConfig(ctx)
+	count := 0
+	for _, name := range getImageNames() {
+		count += expectedBootImageActionCount(ctx, genBootImageConfigs(ctx)[name])
+	}
+	if getDexpreoptStatus(ctx).systemServerPreopted {
+		// System server jars are dexpreopted for systemServerPreoptTargets, except for
+		// "com.android.location.provider", which is also used by apps as a shared library and is
+		// dexpreopted for all the device targets, see dexpreopter.dexpreopt.
+		for _, jar := range global.AllSystemServerJars(ctx).CopyOfJars() {
+			if jar == "com.android.location.provider" {
+				count += len(dexpreoptDeviceTargets(ctx))
+			} else {
+				count += len(systemServerPreoptTargets(ctx))
+			}
+		}
+	}
+	return count
+}
+
+// expectedBootImageActionCount returns the number of ninja actions that generateBootImage is
+// expected to generate for the given boot image config.
+func expectedBootImageActionCount(ctx android.PathContext, image *bootImageConfig) int {
+	global := dexpreopt.GetGlobalConfig(ctx)
+	if !getDexpreoptStatus(ctx).bootJarsStaged || !image.isEnabledByConfig(ctx) {
+		return 0
+	}
+
+	// One copy of each jar that is staged to its predefined location.
+	count := image.modules.Len() - len(image.unstagedJars)
+
+	if image.seed != "" {
+		// The identity file.
+		count++
+	}
+
+	if global.AuditBootDexInputs {
+		// The manifest of the staged dex jars of each variant.
+		count += len(image.variants)
+	}
+
+	if image.isProfileGuided() && !global.DisableGenerateProfile {
+		count++
+	}
+	if image == defaultBootImageConfig(ctx) && !global.DisableGenerateProfile && !ctx.Config().UnbundledBuild() {
+		// The boot framework profile.
+		count++
+	}
+
+	if SkipDexpreoptBootJars(ctx) || (global.OnlyPreoptArtBootImage && image.name != "art") {
+		return count
+	}
+
+	// One dex2oat invocation per variant, and the zip of the android variants.
+	count += len(image.variants) + 1
+
+	// The oatdump rule and its phony for each variant, and the phony for the image.
+	count += 2*len(image.variants) + 1
+
+	return count
+}
+
+// bootImageModulesStatePath returns the path to the file that records the modules of the given boot
+// image, so that the next Soong run can tell whether they changed.
+func bootImageModulesStatePath(ctx android.PathContext, image *bootImageConfig) android.WritablePath {
+	return image.dir.Join(ctx, "boot_image_modules.txt")
+}
+
+// writeBootImageModulesState generates the rules that write the state files of all boot images. The
+// next Soong run compares against the modules of the last build, and Soong itself writes nothing into
+// the output directory.
+func writeBootImageModulesState(ctx android.SingletonContext) {
+	for _, name := range getImageNames() {
+		image := genBootImageConfigs(ctx)[name]
+		android.WriteFileRule(ctx, bootImageModulesStatePath(ctx, image), strings.Join(image.modules.CopyOfApexJarPairs(), "\n"))
+	}
+}
+
+// readBootImageModulesState returns the modules recorded in the given state file by the previous
+// build, and false if there was no previous build.
+func readBootImageModulesState(path string) ([]string, bool, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, fmt.Errorf("failed to read boot image modules state: %w", err)
+	}
+	return strings.Fields(string(data)), true, nil
+}
+
+// bootImageModulesDiff is the change in the modules of a boot image between two builds.
+type bootImageModulesDiff struct {
+	added   []string
+	removed []string
+}
+
+// diffBootImageModules returns the modules that are only in current and only in previous.
+func diffBootImageModules(previous, current []string) bootImageModulesDiff {
+	var diff bootImageModulesDiff
+	previousSet := stringSet(previous)
+	currentSet := stringSet(current)
+	for _, module := range current {
+		if !previousSet[module] {
+			diff.added = append(diff.added, module)
+		}
+	}
+	for _, module := range previous {
+		if !currentSet[module] {
+			diff.removed = append(diff.removed, module)
+		}
+	}
+	return diff
+}
+
+// notice returns a one-line notice about the change in the modules of the named boot image, or an
+// empty string if they did not change.
+func (d bootImageModulesDiff) notice(name string) string {
+	if len(d.added) == 0 && len(d.removed) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("boot image %q modules changed, it will be fully rebuilt: added [%s], removed [%s]",
+		name, strings.Join(d.added, " "), strings.Join(d.removed, " "))
+}
+
+var bootImageModulesChangesKey = newDexpreoptOnceKey("bootImageModulesChanges")
+
+// bootImageModulesChanges returns the changes in the modules of the boot images since the previous
+// build, by image name. Images whose modules did not change, or that were not built before, are
+// omitted.
+func bootImageModulesChanges(ctx android.PathContext) map[string]bootImageModulesDiff {
+	return ctx.Config().Once(bootImageModulesChangesKey, func() interface{} {
+		changes := make(map[string]bootImageModulesDiff)
+		for _, name := range getImageNames() {
+			image := genBootImageConfigs(ctx)[name]
+			previous, ok, err := readBootImageModulesState(bootImageModulesStatePath(ctx, image).String())
+			if err != nil {
+				android.ReportPathErrorf(ctx, "%s", err)
+			}
+			if !ok {
+				continue
+			}
+			diff := diffBootImageModules(previous, image.modules.CopyOfApexJarPairs())
+			if diff.notice(name) != "" {
+				changes[name] = diff
+			}
+		}
+		return changes
+	}).(map[string]bootImageModulesDiff)
+}
+
+// printBootImageModulesChanges prints a notice for each boot image whose modules changed since the
+// previous build.
+func printBootImageModulesChanges(ctx android.PathContext) {
+	changes := bootImageModulesChanges(ctx)
+	for _, name := range android.SortedKeys(changes) {
+		fmt.Fprintln(os.Stderr, changes[name].notice(name))
+	}
+}
+
+func init() {
+	android.RegisterMakeVarsProvider(pctx, dexpreoptMetricsMakeVars)
+}
+
+func dexpreoptMetricsMakeVars(ctx android.MakeVarsContext) {
+	if dexpreoptAnalysisOnly(ctx.Config()) {
+		return
+	}
+	ctx.Strict("DEX_PREOPT_EXPECTED_ACTION_COUNT", strconv.Itoa(expectedDexpreoptActionCount(ctx)))
+}
@@ -0,0 +1,115 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package java
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"android/soong/android"
+	"android/soong/dexpreopt"
+)
+
+func TestExpectedDexpreoptActionCount(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		dexpreopt.FixtureDisableGenerateProfile(true),
+		dexpreopt.FixtureSetSystemServerJars("platform:service-a", "platform:service-b"),
+	).RunTest(t)
+
+	ctx := &android.TestPathContext{TestResult: result}
+
+	// Each image has 4 variants (arm64, arm, x86_64 and x86): 4 dex2oat invocations, 1 zip and
+	// 2*4+1 oatdump rules, plus one copy for each of its jars.
+	//   art:      3 copies (core1, core2, extra1) + 4 + 1 + 9 = 17
+	//   boot:     3 copies (core1, core2, framework) + 4 + 1 + 9 = 17
+	//   mainline: 0 copies + 4 + 1 + 9 = 14
+	// Plus one dexpreopt action for each of the 2 system server jars.
+	android.AssertIntEquals(t, "expected action count", 50, expectedDexpreoptActionCount(ctx))
+
+	metrics := result.SingletonForTests("dex_bootjars").Output("out/soong/dexpreopt_arm64/dexpreopt_metrics.json")
+	android.AssertStringDoesContain(t, "metrics",
+		android.ContentFromFileRuleForTests(t, result.TestContext, metrics),
+		`"expected_action_count": 50`)
+
+	// "com.android.location.provider" is dexpreopted for both device arches (arm64 and arm), the
+	// other system server jars for the primary arch only.
+	result = android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		dexpreopt.FixtureDisableGenerateProfile(true),
+		dexpreopt.FixtureSetSystemServerJars("platform:service-a", "platform:service-b", "platform:com.android.location.provider"),
+	).RunTest(t)
+	ctx = &android.TestPathContext{TestResult: result}
+	android.AssertIntEquals(t, "expected action count with the location provider", 48+1+1+2, expectedDexpreoptActionCount(ctx))
+
+	// With SystemServerPreoptArches, every system server jar is dexpreopted for each configured arch.
+	result = android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		dexpreopt.FixtureDisableGenerateProfile(true),
+		dexpreopt.FixtureSetSystemServerJars("platform:service-a", "platform:service-b", "platform:com.android.location.provider"),
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.SystemServerPreoptArches = []android.ArchType{android.Arm64, android.Arm}
+		}),
+	).RunTest(t)
+	ctx = &android.TestPathContext{TestResult: result}
+	android.AssertIntEquals(t, "expected action count with multiple arches", 48+2+2+2, expectedDexpreoptActionCount(ctx))
+}
+
+func TestBootImageModulesChanges(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+	).RunTest(t)
+
+	ctx := &android.TestPathContext{TestResult: result}
+	image := defaultBootImageConfig(ctx)
+	path := bootImageModulesStatePath(ctx, image)
+	android.AssertPathRelativeToTopEquals(t, "state path", "out/soong/dexpreopt_arm64/dex_bootjars/boot_image_modules.txt", path)
+
+	// The first build writes the baseline without reporting any change.
+	android.AssertIntEquals(t, "changes", 0, len(bootImageModulesChanges(ctx)))
+	baseline := android.ContentFromFileRuleForTests(t, result.TestContext, result.SingletonForTests("dex_bootjars").Output(path.String()))
+	android.AssertStringEquals(t, "baseline", "com.android.art:core1\ncom.android.art:core2\nplatform:framework\n", baseline)
+
+	dir := t.TempDir()
+	statePath := filepath.Join(dir, "boot_image_modules.txt")
+	if err := os.WriteFile(statePath, []byte(baseline), 0666); err != nil {
+		t.Fatal(err)
+	}
+	previous, ok, err := readBootImageModulesState(statePath)
+	android.AssertDeepEquals(t, "error", nil, err)
+	android.AssertBoolEquals(t, "ok", true, ok)
+	android.AssertDeepEquals(t, "previous", []string{"com.android.art:core1", "com.android.art:core2", "platform:framework"}, previous)
+
+	// Simulate a second run in which a jar was replaced.
+	current := []string{"com.android.art:core1", "platform:framework", "platform:framework-new"}
+	diff := diffBootImageModules(previous, current)
+	android.AssertDeepEquals(t, "added", []string{"platform:framework-new"}, diff.added)
+	android.AssertDeepEquals(t, "removed", []string{"com.android.art:core2"}, diff.removed)
+	android.AssertStringEquals(t, "notice",
+		`boot image "boot" modules changed, it will be fully rebuilt: added [platform:framework-new], removed [com.android.art:core2]`,
+		diff.notice("boot"))
+
+	if err := os.WriteFile(statePath, []byte(strings.Join(current, "\n")+"\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	previous, _, _ = readBootImageModulesState(statePath)
+	android.AssertStringEquals(t, "unchanged notice", "", diffBootImageModules(previous, current).notice("boot"))
+
+	_, ok, err = readBootImageModulesState(filepath.Join(dir, "missing.txt"))
+	android.AssertDeepEquals(t, "error", nil, err)
+	android.AssertBoolEquals(t, "ok", false, ok)
+}
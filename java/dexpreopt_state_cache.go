@@ -0,0 +1,203 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package java
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"android/soong/android"
+	"android/soong/dexpreopt"
+)
+
+// An opt-in cache of the class path data that is derived from the dexpreopt config, i.e. the
+// DexpreoptData, so that a soong_build run with an unchanged config and unchanged targets can load
+// it rather than recompute it. It is enabled with DEXPREOPT_STATE_CACHE=true. With
+// DEXPREOPT_STATE_CACHE=verify the data is always recomputed, and the dexpreopt config checks fail
+// if the cache of the previous run does not match it.
+//
+// The cache only holds on-device locations and names, the build paths are cheap to recompute. Any
+// problem with the cache file, including a version or key mismatch, silently falls back to
+// recomputing the data.
+
+// The version of the format of the cache file. It must be bumped whenever DexpreoptData or the way
+// it is computed changes, so that the caches of older builds are not used.
+const dexpreoptStateCacheVersion = 1
+
+// The values of DEXPREOPT_STATE_CACHE.
+const (
+	dexpreoptStateCacheEnabled = "true"
+	dexpreoptStateCacheVerify  = "verify"
+)
+
+// dexpreoptStateCacheMode returns the value of DEXPREOPT_STATE_CACHE, which is empty if the cache is
+// disabled.
+func dexpreoptStateCacheMode(config android.Config) string {
+	return config.Getenv("DEXPREOPT_STATE_CACHE")
+}
+
+// dexpreoptStateCacheFile is the content of the file returned by dexpreoptStateCachePath.
+type dexpreoptStateCacheFile struct {
+	Version int `json:"version"`
+
+	// The key of the config and the targets that the data was computed for, see
+	// dexpreoptStateCacheKey.
+	Key string `json:"key"`
+
+	Data DexpreoptData `json:"data"`
+}
+
+// dexpreoptStateCachePath returns the path to the cache file. It is written by a rule, and read
+// when Soong runs next.
+func dexpreoptStateCachePath(ctx android.PathContext) android.WritablePath {
+	return android.PathForOutput(ctx, dexpreopt.GetDexpreoptDirName(ctx), "dexpreopt_state_cache.json")
+}
+
+// dexpreoptStateCacheKey returns the hash of everything that DexpreoptData is computed from: the
+// dexpreopt config, the registered system server jars fragments, the configured jar location
+// overrides and the targets. It returns an empty string, which matches no cache, if the config
+// cannot be hashed.
+func dexpreoptStateCacheKey(ctx android.PathContext) string {
+	global := dexpreopt.GetGlobalConfig(ctx)
+	inputs, err := json.Marshal(struct {
+		Global                         *dexpreopt.GlobalConfig
+		SystemServerJarsFragments      []dexpreopt.SystemServerJarsFragment
+		ConfiguredJarLocationOverrides []string
+		Targets                        []string
+	}{
+		Global:                         global,
+		SystemServerJarsFragments:      global.SystemServerJarsFragments(ctx),
+		ConfiguredJarLocationOverrides: ctx.Config().ConfiguredJarLocationOverrides(),
+		Targets:                        targetNames(dexpreoptTargets(ctx)),
+	})
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(inputs)
+	return hex.EncodeToString(sum[:])
+}
+
+// targetNames returns the os and arch of each of the given targets, e.g. "android_arm64".
+func targetNames(targets []android.Target) []string {
+	names := make([]string, 0, len(targets))
+	for _, target := range targets {
+		names = append(names, target.Os.String()+"_"+target.Arch.ArchType.String())
+	}
+	return names
+}
+
+// dexpreoptStateCacheContent returns the content of a cache file with the given data, for the given
+// key.
+func dexpreoptStateCacheContent(key string, data DexpreoptData) (string, error) {
+	content, err := json.Marshal(dexpreoptStateCacheFile{
+		Version: dexpreoptStateCacheVersion,
+		Key:     key,
+		Data:    data,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to JSON marshal the dexpreopt state cache: %w", err)
+	}
+	return string(content), nil
+}
+
+// readDexpreoptStateCache returns the data in the cache file at the given path, and false if the
+// file does not exist, cannot be parsed, or was written by another version or for another key.
+func readDexpreoptStateCache(path string, key string) (DexpreoptData, bool) {
+	if key == "" {
+		return DexpreoptData{}, false
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return DexpreoptData{}, false
+	}
+	var cache dexpreoptStateCacheFile
+	if err := json.Unmarshal(content, &cache); err != nil {
+		return DexpreoptData{}, false
+	}
+	if cache.Version != dexpreoptStateCacheVersion || cache.Key != key {
+		return DexpreoptData{}, false
+	}
+	return cache.Data, true
+}
+
+// loadDexpreoptData returns the data in the cache file at the given path if the cache is enabled and
+// the file matches the config and the targets, and true. Otherwise it returns the data computed from
+// the config, and false.
+func loadDexpreoptData(ctx android.PathContext, cachePath string) (DexpreoptData, bool) {
+	if dexpreoptStateCacheMode(ctx.Config()) == dexpreoptStateCacheEnabled {
+		if data, ok := readDexpreoptStateCache(cachePath, dexpreoptStateCacheKey(ctx)); ok {
+			return data, true
+		}
+	}
+	return computeDexpreoptData(ctx), false
+}
+
+// dexpreoptStateCacheMismatch returns an error if the cache file at the given path matches the
+// config and the targets, but its data differs from the data computed from the config. The data is
+// compared in its JSON form, which is what the cache holds.
+func dexpreoptStateCacheMismatch(ctx android.PathContext, cachePath string) error {
+	key := dexpreoptStateCacheKey(ctx)
+	cached, ok := readDexpreoptStateCache(cachePath, key)
+	if !ok {
+		return nil
+	}
+	got, err := dexpreoptStateCacheContent(key, cached)
+	if err != nil {
+		return err
+	}
+	want, err := dexpreoptStateCacheContent(key, computeDexpreoptData(ctx))
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return fmt.Errorf("The dexpreopt state cache %s does not match the data computed from the dexpreopt config, bump dexpreoptStateCacheVersion", cachePath)
+	}
+	return nil
+}
+
+// checkDexpreoptStateCache checks the value of DEXPREOPT_STATE_CACHE, and in verify mode that the
+// cache of the previous run, if it matches the config, has the same data as the one computed now.
+func checkDexpreoptStateCache(ctx android.SingletonContext) {
+	switch mode := dexpreoptStateCacheMode(ctx.Config()); mode {
+	case "", dexpreoptStateCacheEnabled:
+	case dexpreoptStateCacheVerify:
+		if err := dexpreoptStateCacheMismatch(ctx, dexpreoptStateCachePath(ctx).String()); err != nil {
+			ctx.Errorf("%s", err)
+		}
+	default:
+		ctx.Errorf("DEXPREOPT_STATE_CACHE must be %s or %s, got %q", dexpreoptStateCacheEnabled, dexpreoptStateCacheVerify, mode)
+	}
+}
+
+// writeDexpreoptStateCache generates the rule that writes the data of this run to the cache file, if
+// the cache is enabled or verified, for the next run.
+func writeDexpreoptStateCache(ctx android.SingletonContext) {
+	if mode := dexpreoptStateCacheMode(ctx.Config()); mode != dexpreoptStateCacheEnabled && mode != dexpreoptStateCacheVerify {
+		return
+	}
+	key := dexpreoptStateCacheKey(ctx)
+	if key == "" {
+		return
+	}
+	content, err := dexpreoptStateCacheContent(key, dexpreoptData(ctx))
+	if err != nil {
+		ctx.Errorf("%s", err)
+		return
+	}
+	android.WriteFileRule(ctx, dexpreoptStateCachePath(ctx), content)
+}
@@ -0,0 +1,144 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package java
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"android/soong/android"
+	"android/soong/dexpreopt"
+)
+
+func TestDexpreoptStateCache(t *testing.T) {
+	run := func(t *testing.T, mode string, preparers ...android.FixturePreparer) *android.TestPathContext {
+		result := android.GroupFixturePreparers(
+			PrepareForBootImageConfigTest,
+			PrepareApexBootJarConfigs,
+			android.FixtureMergeEnv(map[string]string{"DEXPREOPT_STATE_CACHE": mode}),
+			android.GroupFixturePreparers(preparers...),
+		).RunTest(t)
+		return &android.TestPathContext{TestResult: result}
+	}
+
+	// writeCache writes a cache file with the given data for the given key, and returns its path.
+	writeCache := func(t *testing.T, key string, data DexpreoptData) string {
+		content, err := dexpreoptStateCacheContent(key, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(t.TempDir(), "dexpreopt_state_cache.json")
+		if err := os.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	// fromCache returns the computed data with a marker that shows it was loaded from the cache.
+	fromCache := func(ctx *android.TestPathContext) DexpreoptData {
+		data := computeDexpreoptData(ctx)
+		data.SystemServerJars = []string{"platform:from-cache"}
+		return data
+	}
+
+	t.Run("hit", func(t *testing.T) {
+		ctx := run(t, "true")
+		android.AssertPathRelativeToTopEquals(t, "path", "out/soong/dexpreopt_arm64/dexpreopt_state_cache.json", dexpreoptStateCachePath(ctx))
+
+		path := writeCache(t, dexpreoptStateCacheKey(ctx), fromCache(ctx))
+		data, cached := loadDexpreoptData(ctx, path)
+		android.AssertBoolEquals(t, "cached", true, cached)
+		android.AssertDeepEquals(t, "data", fromCache(ctx), data)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		ctx := run(t, "")
+		path := writeCache(t, dexpreoptStateCacheKey(ctx), fromCache(ctx))
+		data, cached := loadDexpreoptData(ctx, path)
+		android.AssertBoolEquals(t, "cached", false, cached)
+		android.AssertDeepEquals(t, "data", computeDexpreoptData(ctx), data)
+	})
+
+	t.Run("miss on config change", func(t *testing.T) {
+		ctx := run(t, "true")
+		changed := run(t, "true", dexpreopt.FixtureSetApexSystemServerJars("com.android.foo:service-foo"))
+		if dexpreoptStateCacheKey(ctx) == dexpreoptStateCacheKey(changed) {
+			t.Errorf("the key did not change with the config: %s", dexpreoptStateCacheKey(ctx))
+		}
+
+		path := writeCache(t, dexpreoptStateCacheKey(ctx), fromCache(ctx))
+		data, cached := loadDexpreoptData(changed, path)
+		android.AssertBoolEquals(t, "cached", false, cached)
+		android.AssertDeepEquals(t, "data", computeDexpreoptData(changed), data)
+	})
+
+	t.Run("corrupted", func(t *testing.T) {
+		ctx := run(t, "true")
+		path := filepath.Join(t.TempDir(), "dexpreopt_state_cache.json")
+		if err := os.WriteFile(path, []byte(`{"version": 1, "key": `), 0666); err != nil {
+			t.Fatal(err)
+		}
+		data, cached := loadDexpreoptData(ctx, path)
+		android.AssertBoolEquals(t, "cached", false, cached)
+		android.AssertDeepEquals(t, "data", computeDexpreoptData(ctx), data)
+
+		// A missing file also falls back to computing the data.
+		_, cached = loadDexpreoptData(ctx, filepath.Join(t.TempDir(), "missing.json"))
+		android.AssertBoolEquals(t, "cached", false, cached)
+	})
+
+	t.Run("verify", func(t *testing.T) {
+		ctx := run(t, "verify")
+		key := dexpreoptStateCacheKey(ctx)
+
+		android.AssertDeepEquals(t, "matching cache", nil,
+			dexpreoptStateCacheMismatch(ctx, writeCache(t, key, computeDexpreoptData(ctx))))
+		android.AssertStringDoesContain(t, "stale cache",
+			fmt.Sprint(dexpreoptStateCacheMismatch(ctx, writeCache(t, key, fromCache(ctx)))),
+			"does not match the data computed from the dexpreopt config")
+
+		// The data is always computed in verify mode.
+		data, cached := loadDexpreoptData(ctx, writeCache(t, key, fromCache(ctx)))
+		android.AssertBoolEquals(t, "cached", false, cached)
+		android.AssertDeepEquals(t, "data", computeDexpreoptData(ctx), data)
+	})
+
+	t.Run("written by a rule", func(t *testing.T) {
+		ctx := run(t, "verify")
+		output := ctx.SingletonForTests("dex_bootjars").Output(dexpreoptStateCachePath(ctx).String())
+		path := filepath.Join(t.TempDir(), "dexpreopt_state_cache.json")
+		if err := os.WriteFile(path, []byte(android.ContentFromFileRuleForTests(t, ctx.TestContext, output)), 0666); err != nil {
+			t.Fatal(err)
+		}
+		cached, ok := readDexpreoptStateCache(path, dexpreoptStateCacheKey(ctx))
+		android.AssertBoolEquals(t, "ok", true, ok)
+		android.AssertDeepEquals(t, "data", computeDexpreoptData(ctx), cached)
+
+		disabled := run(t, "")
+		android.AssertBoolEquals(t, "rule when disabled", false,
+			disabled.SingletonForTests("dex_bootjars").MaybeOutput(dexpreoptStateCachePath(disabled).String()).Rule != nil)
+	})
+
+	t.Run("invalid mode", func(t *testing.T) {
+		android.GroupFixturePreparers(
+			PrepareForBootImageConfigTest,
+			android.FixtureMergeEnv(map[string]string{"DEXPREOPT_STATE_CACHE": "yes"}),
+		).ExtendWithErrorHandler(android.FixtureExpectsAtLeastOneErrorMatchingPattern(
+			`DEXPREOPT_STATE_CACHE must be true or verify, got "yes"`,
+		)).RunTest(t)
+	})
+}
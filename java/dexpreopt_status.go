@@ -0,0 +1,133 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package java
+
+import (
+	"strconv"
+	"strings"
+
+	"android/soong/android"
+	"android/soong/dexpreopt"
+)
+
+// dexpreoptStatus tells which parts of the build are dexpreopted. It is derived in one place from
+// the dexpreopt config and the build config, so that all the code that depends on whether
+// dexpreopt happens gives the same answer.
+type dexpreoptStatus struct {
+	// Whether the boot images are compiled at build time.
+	bootImageBuilt bool
+
+	// Whether the boot jars are staged and the boot image profiles are generated. That happens even
+	// if the boot images are not compiled, unless they are generated on device.
+	bootJarsStaged bool
+
+	// Whether the system server jars are preopted.
+	systemServerPreopted bool
+
+	// Whether apps and other Java modules are preopted, subject to their own properties.
+	appsPreopted bool
+
+	// Why the parts of the build that are not dexpreopted are not, e.g.
+	// "boot images: not built: generated on device".
+	reasons []string
+}
+
+// dexpreoptStatusInputs are the parts of the config that the dexpreopt status is derived from.
+type dexpreoptStatusInputs struct {
+	disablePreopt           bool
+	disablePreoptBootImages bool
+	onlyPreoptArtBootImage  bool
+	onDeviceImageGeneration bool
+	// Whether this is the second stage of a SANITIZE_LITE build, see shouldBuildBootImages.
+	sanitizeLite     bool
+	unbundledBuild   bool
+	hasDeviceTargets bool
+}
+
+// computeDexpreoptStatus returns the dexpreopt status for the given inputs.
+func computeDexpreoptStatus(in dexpreoptStatusInputs) dexpreoptStatus {
+	status := dexpreoptStatus{
+		bootImageBuilt:       true,
+		bootJarsStaged:       !in.onDeviceImageGeneration,
+		systemServerPreopted: true,
+		appsPreopted:         true,
+	}
+	// disable clears the given part of the status and records the reason if cond is true.
+	disable := func(part *bool, prefix string, cond bool, reason string) {
+		if cond {
+			*part = false
+			status.reasons = append(status.reasons, prefix+": "+reason)
+		}
+	}
+
+	const bootImages = "boot images: not built"
+	disable(&status.bootImageBuilt, bootImages, in.disablePreoptBootImages, "DisablePreoptBootImages is set")
+	disable(&status.bootImageBuilt, bootImages, in.sanitizeLite, "second stage of a SANITIZE_LITE build")
+	disable(&status.bootImageBuilt, bootImages, in.onDeviceImageGeneration, "generated on device")
+	disable(&status.bootImageBuilt, bootImages, !in.hasDeviceTargets, "no device targets")
+
+	const systemServer = "system server jars: not preopted"
+	disable(&status.systemServerPreopted, systemServer, in.disablePreopt, "DisablePreopt is set")
+	disable(&status.systemServerPreopted, systemServer, in.onlyPreoptArtBootImage, "OnlyPreoptArtBootImage is set")
+	disable(&status.systemServerPreopted, systemServer, in.unbundledBuild, "unbundled build")
+	disable(&status.systemServerPreopted, systemServer, in.onDeviceImageGeneration, "boot images generated on device")
+	disable(&status.systemServerPreopted, systemServer, !in.hasDeviceTargets, "no device targets")
+
+	const apps = "apps: not preopted"
+	disable(&status.appsPreopted, apps, in.disablePreopt, "DisablePreopt is set")
+	disable(&status.appsPreopted, apps, in.onlyPreoptArtBootImage, "OnlyPreoptArtBootImage is set")
+	disable(&status.appsPreopted, apps, in.unbundledBuild, "unbundled build")
+	disable(&status.appsPreopted, apps, in.onDeviceImageGeneration, "boot images generated on device")
+
+	return status
+}
+
+var dexpreoptStatusKey = newDexpreoptOnceKey("dexpreoptStatus")
+
+// getDexpreoptStatus returns the dexpreopt status of the build.
+func getDexpreoptStatus(ctx android.PathContext) dexpreoptStatus {
+	return ctx.Config().Once(dexpreoptStatusKey, func() interface{} {
+		global := dexpreopt.GetGlobalConfig(ctx)
+		return computeDexpreoptStatus(dexpreoptStatusInputs{
+			disablePreopt:           global.DisablePreopt,
+			disablePreoptBootImages: global.DisablePreoptBootImages,
+			onlyPreoptArtBootImage:  global.OnlyPreoptArtBootImage,
+			onDeviceImageGeneration: global.OnDeviceImageGeneration,
+			sanitizeLite:            !shouldBuildBootImages(ctx.Config(), global),
+			unbundledBuild:          ctx.Config().UnbundledBuild(),
+			hasDeviceTargets:        len(dexpreoptDeviceTargets(ctx)) > 0,
+		})
+	}).(dexpreoptStatus)
+}
+
+func init() {
+	android.RegisterMakeVarsProvider(pctx, dexpreoptStatusMakeVars)
+}
+
+func dexpreoptStatusMakeVars(ctx android.MakeVarsContext) {
+	if dexpreoptAnalysisOnly(ctx.Config()) {
+		return
+	}
+	status := getDexpreoptStatus(ctx)
+	ctx.Strict("DEX_PREOPT_BOOT_IMAGE_BUILT", strconv.FormatBool(status.bootImageBuilt))
+	ctx.Strict("DEX_PREOPT_SYSTEM_SERVER_PREOPTED", strconv.FormatBool(status.systemServerPreopted))
+	ctx.Strict("DEX_PREOPT_APPS_PREOPTED", strconv.FormatBool(status.appsPreopted))
+
+	var arches []string
+	for _, target := range dexpreoptDeviceTargets(ctx) {
+		arches = append(arches, target.Arch.ArchType.String())
+	}
+	ctx.Strict("DEX_PREOPT_TARGET_ARCHES", strings.Join(arches, " "))
+}
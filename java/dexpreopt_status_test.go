@@ -0,0 +1,168 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package java
+
+import (
+	"testing"
+
+	"android/soong/android"
+	"android/soong/dexpreopt"
+)
+
+func TestComputeDexpreoptStatus(t *testing.T) {
+	enabled := dexpreoptStatusInputs{hasDeviceTargets: true}
+
+	testCases := []struct {
+		name                 string
+		modify               func(in *dexpreoptStatusInputs)
+		bootImageBuilt       bool
+		systemServerPreopted bool
+		appsPreopted         bool
+		reasons              []string
+	}{
+		{
+			name:                 "enabled",
+			modify:               func(in *dexpreoptStatusInputs) {},
+			bootImageBuilt:       true,
+			systemServerPreopted: true,
+			appsPreopted:         true,
+		},
+		{
+			name:                 "DisablePreopt",
+			modify:               func(in *dexpreoptStatusInputs) { in.disablePreopt = true },
+			bootImageBuilt:       true,
+			systemServerPreopted: false,
+			appsPreopted:         false,
+			reasons: []string{
+				"system server jars: not preopted: DisablePreopt is set",
+				"apps: not preopted: DisablePreopt is set",
+			},
+		},
+		{
+			name:                 "DisablePreoptBootImages",
+			modify:               func(in *dexpreoptStatusInputs) { in.disablePreoptBootImages = true },
+			bootImageBuilt:       false,
+			systemServerPreopted: true,
+			appsPreopted:         true,
+			reasons:              []string{"boot images: not built: DisablePreoptBootImages is set"},
+		},
+		{
+			name:                 "OnlyPreoptArtBootImage",
+			modify:               func(in *dexpreoptStatusInputs) { in.onlyPreoptArtBootImage = true },
+			bootImageBuilt:       true,
+			systemServerPreopted: false,
+			appsPreopted:         false,
+			reasons: []string{
+				"system server jars: not preopted: OnlyPreoptArtBootImage is set",
+				"apps: not preopted: OnlyPreoptArtBootImage is set",
+			},
+		},
+		{
+			name:                 "OnDeviceImageGeneration",
+			modify:               func(in *dexpreoptStatusInputs) { in.onDeviceImageGeneration = true },
+			bootImageBuilt:       false,
+			systemServerPreopted: false,
+			appsPreopted:         false,
+			reasons: []string{
+				"boot images: not built: generated on device",
+				"system server jars: not preopted: boot images generated on device",
+				"apps: not preopted: boot images generated on device",
+			},
+		},
+		{
+			name:                 "SANITIZE_LITE",
+			modify:               func(in *dexpreoptStatusInputs) { in.sanitizeLite = true },
+			bootImageBuilt:       false,
+			systemServerPreopted: true,
+			appsPreopted:         true,
+			reasons:              []string{"boot images: not built: second stage of a SANITIZE_LITE build"},
+		},
+		{
+			name:                 "unbundled",
+			modify:               func(in *dexpreoptStatusInputs) { in.unbundledBuild = true },
+			bootImageBuilt:       true,
+			systemServerPreopted: false,
+			appsPreopted:         false,
+			reasons: []string{
+				"system server jars: not preopted: unbundled build",
+				"apps: not preopted: unbundled build",
+			},
+		},
+		{
+			name:                 "no device targets",
+			modify:               func(in *dexpreoptStatusInputs) { in.hasDeviceTargets = false },
+			bootImageBuilt:       false,
+			systemServerPreopted: false,
+			appsPreopted:         true,
+			reasons: []string{
+				"boot images: not built: no device targets",
+				"system server jars: not preopted: no device targets",
+			},
+		},
+		{
+			name: "everything disabled",
+			modify: func(in *dexpreoptStatusInputs) {
+				in.disablePreopt = true
+				in.disablePreoptBootImages = true
+			},
+			bootImageBuilt:       false,
+			systemServerPreopted: false,
+			appsPreopted:         false,
+			reasons: []string{
+				"boot images: not built: DisablePreoptBootImages is set",
+				"system server jars: not preopted: DisablePreopt is set",
+				"apps: not preopted: DisablePreopt is set",
+			},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			in := enabled
+			test.modify(&in)
+			status := computeDexpreoptStatus(in)
+			android.AssertBoolEquals(t, "bootImageBuilt", test.bootImageBuilt, status.bootImageBuilt)
+			android.AssertBoolEquals(t, "bootJarsStaged", !in.onDeviceImageGeneration, status.bootJarsStaged)
+			android.AssertBoolEquals(t, "systemServerPreopted", test.systemServerPreopted, status.systemServerPreopted)
+			android.AssertBoolEquals(t, "appsPreopted", test.appsPreopted, status.appsPreopted)
+			android.AssertDeepEquals(t, "reasons", test.reasons, status.reasons)
+		})
+	}
+}
+
+func TestDexpreoptStatusMakeVars(t *testing.T) {
+	result := android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		dexpreopt.FixtureDisableDexpreopt(true),
+	).RunTest(t)
+
+	vars := map[string]string{}
+	for _, v := range result.MakeVarsForTesting(func(variable android.MakeVarVariable) bool {
+		return variable.Name() == "DEX_PREOPT_BOOT_IMAGE_BUILT" ||
+			variable.Name() == "DEX_PREOPT_SYSTEM_SERVER_PREOPTED" ||
+			variable.Name() == "DEX_PREOPT_APPS_PREOPTED"
+	}) {
+		vars[v.Name()] = v.Value()
+	}
+	android.AssertDeepEquals(t, "make vars", map[string]string{
+		"DEX_PREOPT_BOOT_IMAGE_BUILT":       "true",
+		"DEX_PREOPT_SYSTEM_SERVER_PREOPTED": "false",
+		"DEX_PREOPT_APPS_PREOPTED":          "false",
+	}, vars)
+
+	explain := result.SingletonForTests("dex_bootjars").Output("out/soong/dexpreopt_arm64/dexpreopt_explain.txt")
+	android.AssertStringDoesContain(t, "explain", android.ContentFromFileRuleForTests(t, result.TestContext, explain),
+		"system server jars: not preopted: DisablePreopt is set")
+}
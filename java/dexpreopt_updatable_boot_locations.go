@@ -0,0 +1,83 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package java
+
+import (
+	"fmt"
+
+	"android/soong/android"
+	"android/soong/dexpreopt"
+)
+
+// The transition from the on-device locations of the apex boot jars that Make precomputes in
+// GlobalConfig.ProductUpdatableBootLocations to the locations that are derived from
+// GlobalConfig.ApexBootJars. While the legacy locations are set, both are computed, and any
+// difference is reported as a warning, in the dexpreopt explain log and in the dexpreopt metrics.
+
+// derivedUpdatableBootLocations returns the on-device locations of the apex boot jars, in
+// classpath order, as derived from GlobalConfig.ApexBootJars.
+func derivedUpdatableBootLocations(src dexpreoptConfigSource) []string {
+	return installedJarLocationsFromSource(src, bootclasspathOrigin, &src.globalConfig().ApexBootJars)
+}
+
+// useLegacyUpdatableBootLocations returns true if the boot class path uses the legacy locations of
+// the apex boot jars, rather than the derived ones, see annotatedBootclasspathFromSource. They must
+// have one location for each apex boot jar, which checkUpdatableBootLocations checks.
+func useLegacyUpdatableBootLocations(global *dexpreopt.GlobalConfig) bool {
+	return global.UseLegacyUpdatableBootLocations && global.ProductUpdatableBootLocations != nil &&
+		len(global.ProductUpdatableBootLocations) == global.ApexBootJars.Len()
+}
+
+// diffUpdatableBootLocations returns a line for each entry in which the legacy and the derived
+// locations differ.
+func diffUpdatableBootLocations(legacy, derived []string) []string {
+	entry := func(locations []string, i int) string {
+		if i < len(locations) {
+			return locations[i]
+		}
+		return "<none>"
+	}
+	var lines []string
+	for i := 0; i < max(len(legacy), len(derived)); i++ {
+		if l, d := entry(legacy, i), entry(derived, i); l != d {
+			lines = append(lines, fmt.Sprintf("updatable boot location %d: ProductUpdatableBootLocations has %s, ApexBootJars derives %s", i, l, d))
+		}
+	}
+	return lines
+}
+
+// updatableBootLocationsDiff returns the differences between the legacy and the derived locations
+// of the apex boot jars, or nil if the legacy locations are not set.
+func updatableBootLocationsDiff(ctx android.PathContext) []string {
+	global := dexpreopt.GetGlobalConfig(ctx)
+	if global.ProductUpdatableBootLocations == nil {
+		return nil
+	}
+	return diffUpdatableBootLocations(global.ProductUpdatableBootLocations, derivedUpdatableBootLocations(configSource(ctx)))
+}
+
+// checkUpdatableBootLocations checks that the legacy locations of the apex boot jars can be used if
+// they are selected, and collects a warning if they differ from the derived locations.
+func checkUpdatableBootLocations(ctx android.SingletonContext, global *dexpreopt.GlobalConfig) {
+	if global.UseLegacyUpdatableBootLocations && global.ProductUpdatableBootLocations != nil && !useLegacyUpdatableBootLocations(global) {
+		ctx.Errorf("UseLegacyUpdatableBootLocations is set, but ProductUpdatableBootLocations has %d locations for %d apex boot jars",
+			len(global.ProductUpdatableBootLocations), global.ApexBootJars.Len())
+	}
+	if diff := updatableBootLocationsDiff(ctx); len(diff) > 0 {
+		getDexpreoptWarnings(ctx).add(dexpreoptWarningUpdatableBootLocationsMismatch, "ProductUpdatableBootLocations",
+			fmt.Sprintf("ProductUpdatableBootLocations differs from the locations derived from ApexBootJars in %d entries, see %s",
+				len(diff), dexpreoptExplainPath(ctx)))
+	}
+}
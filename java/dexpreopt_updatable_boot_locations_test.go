@@ -0,0 +1,100 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package java
+
+import (
+	"testing"
+
+	"android/soong/android"
+	"android/soong/dexpreopt"
+)
+
+func TestUpdatableBootLocations(t *testing.T) {
+	derived := []string{
+		"/apex/com.android.foo/javalib/framework-foo.jar",
+		"/apex/com.android.bar/javalib/framework-bar.jar",
+	}
+	legacy := []string{
+		"/system/framework/framework-foo.jar",
+		"/apex/com.android.bar/javalib/framework-bar.jar",
+	}
+	preparer := func(locations []string, useLegacy bool) android.FixturePreparer {
+		return android.GroupFixturePreparers(
+			PrepareForBootImageConfigTest,
+			PrepareApexBootJarConfigs,
+			dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+				c.ProductUpdatableBootLocations = locations
+				c.UseLegacyUpdatableBootLocations = useLegacy
+			}),
+		)
+	}
+	bootclasspath := func(updatable []string) []string {
+		return append([]string{
+			"/apex/com.android.art/javalib/core1.jar",
+			"/apex/com.android.art/javalib/core2.jar",
+			"/system/framework/framework.jar",
+		}, updatable...)
+	}
+	output := func(t *testing.T, result *android.TestResult, path string) string {
+		file := result.SingletonForTests("dex_bootjars").Output(path)
+		return android.ContentFromFileRuleForTests(t, result.TestContext, file)
+	}
+
+	t.Run("matching", func(t *testing.T) {
+		result := preparer(derived, false).RunTest(t)
+		ctx := &android.TestPathContext{TestResult: result}
+		android.AssertDeepEquals(t, "diff", []string(nil), updatableBootLocationsDiff(ctx))
+		android.AssertDeepEquals(t, "bootclasspath", bootclasspath(derived), defaultBootclasspath(ctx))
+		android.AssertStringDoesContain(t, "metrics", output(t, result, "out/soong/dexpreopt_arm64/dexpreopt_metrics.json"),
+			`"updatable_boot_locations_mismatch": 0`)
+	})
+
+	t.Run("mismatching", func(t *testing.T) {
+		result := preparer(legacy, false).RunTest(t)
+		ctx := &android.TestPathContext{TestResult: result}
+		diff := "updatable boot location 0: ProductUpdatableBootLocations has /system/framework/framework-foo.jar, " +
+			"ApexBootJars derives /apex/com.android.foo/javalib/framework-foo.jar"
+		android.AssertDeepEquals(t, "diff", []string{diff}, updatableBootLocationsDiff(ctx))
+		android.AssertDeepEquals(t, "bootclasspath", bootclasspath(derived), defaultBootclasspath(ctx))
+		android.AssertStringDoesContain(t, "explain", output(t, result, "out/soong/dexpreopt_arm64/dexpreopt_explain.txt"), diff)
+		android.AssertStringDoesContain(t, "metrics", output(t, result, "out/soong/dexpreopt_arm64/dexpreopt_metrics.json"),
+			`"updatable_boot_locations_mismatch": 1`)
+	})
+
+	t.Run("legacy selected", func(t *testing.T) {
+		result := preparer(legacy, true).RunTest(t)
+		ctx := &android.TestPathContext{TestResult: result}
+		android.AssertDeepEquals(t, "bootclasspath", bootclasspath(legacy), defaultBootclasspath(ctx))
+	})
+
+	t.Run("legacy selected but not set", func(t *testing.T) {
+		result := preparer(nil, true).RunTest(t)
+		ctx := &android.TestPathContext{TestResult: result}
+		android.AssertDeepEquals(t, "bootclasspath", bootclasspath(derived), defaultBootclasspath(ctx))
+	})
+
+	t.Run("legacy selected with wrong length", func(t *testing.T) {
+		preparer(legacy[:1], true).
+			ExtendWithErrorHandler(android.FixtureExpectsAtLeastOneErrorMatchingPattern(
+				`UseLegacyUpdatableBootLocations is set, but ProductUpdatableBootLocations has 1 locations for 2 apex boot jars`)).
+			RunTest(t)
+	})
+}
+
+func TestDiffUpdatableBootLocations(t *testing.T) {
+	android.AssertDeepEquals(t, "missing", []string{
+		"updatable boot location 1: ProductUpdatableBootLocations has <none>, ApexBootJars derives /apex/b/javalib/b.jar",
+	}, diffUpdatableBootLocations([]string{"/apex/a/javalib/a.jar"}, []string{"/apex/a/javalib/a.jar", "/apex/b/javalib/b.jar"}))
+}
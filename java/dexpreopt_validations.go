@@ -0,0 +1,130 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package java
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+
+	"android/soong/android"
+	"android/soong/dexpreopt"
+)
+
+// Validations of the final class path data that other packages contribute. The packages cannot
+// import the internals of this package, nor control when the data is complete, so they register a
+// validation function at init time and the dexpreopt_config singleton runs it, after all the other
+// checks of the dexpreopt config.
+
+// DexpreoptData is the final class path data that is passed to the validations registered with
+// RegisterDexpreoptValidation.
+type DexpreoptData struct {
+	// The boot class path data.
+	BootclasspathConfigInfo
+
+	// The jars on the system server class path, as apex:jar pairs, in classpath order.
+	SystemServerJars []string
+}
+
+// DexpreoptValidation checks the final class path data and returns the problems that it finds.
+type DexpreoptValidation func(ctx android.PathContext, data DexpreoptData) []error
+
+// dexpreoptValidationRegistry is the list of validations that other packages have registered.
+type dexpreoptValidationRegistry struct {
+	mutex       sync.Mutex
+	validations []registeredDexpreoptValidation
+	ran         bool
+}
+
+// registeredDexpreoptValidation is a validation and the package that registered it.
+type registeredDexpreoptValidation struct {
+	pkg      string
+	validate DexpreoptValidation
+}
+
+func (r *dexpreoptValidationRegistry) register(pkg string, validate DexpreoptValidation) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.ran {
+		panic(fmt.Errorf("package %s registered a dexpreopt validation after the dexpreopt validations ran", pkg))
+	}
+	r.validations = append(r.validations, registeredDexpreoptValidation{pkg, validate})
+}
+
+// run runs the registered validations in registration order, and returns the errors that they
+// return, prefixed with the package that registered the validation.
+func (r *dexpreoptValidationRegistry) run(ctx android.PathContext, data DexpreoptData) []error {
+	r.mutex.Lock()
+	r.ran = true
+	validations := append([]registeredDexpreoptValidation(nil), r.validations...)
+	r.mutex.Unlock()
+
+	var errs []error
+	for _, v := range validations {
+		for _, err := range v.validate(ctx, data) {
+			errs = append(errs, fmt.Errorf("dexpreopt validation from %s: %w", v.pkg, err))
+		}
+	}
+	return errs
+}
+
+var dexpreoptValidations = &dexpreoptValidationRegistry{}
+
+// RegisterDexpreoptValidation registers a validation of the final class path data. It must be
+// called at init time, as it panics if the validations have already run. The errors that the
+// validation returns are reported as build errors, attributed to the calling package.
+func RegisterDexpreoptValidation(validate DexpreoptValidation) {
+	pc, _, _, _ := runtime.Caller(1)
+	dexpreoptValidations.register(packageOfFunc(runtime.FuncForPC(pc).Name()), validate)
+}
+
+// packageOfFunc returns the import path of the package of the function with the given fully
+// qualified name, e.g. "android/soong/apex" for "android/soong/apex.init.0".
+func packageOfFunc(name string) string {
+	slash := strings.LastIndex(name, "/")
+	if dot := strings.Index(name[slash+1:], "."); dot >= 0 {
+		return name[:slash+1+dot]
+	}
+	return name
+}
+
+var dexpreoptDataKey = newDexpreoptOnceKey("dexpreoptData")
+
+// dexpreoptData returns the final class path data for the registered validations. It is loaded from
+// the dexpreopt state cache if the cache is enabled and matches, see loadDexpreoptData.
+func dexpreoptData(ctx android.PathContext) DexpreoptData {
+	return ctx.Config().Once(dexpreoptDataKey, func() interface{} {
+		data, _ := loadDexpreoptData(ctx, dexpreoptStateCachePath(ctx).String())
+		return data
+	}).(DexpreoptData)
+}
+
+// computeDexpreoptData computes the final class path data from the dexpreopt config.
+func computeDexpreoptData(ctx android.PathContext) DexpreoptData {
+	global := dexpreopt.GetGlobalConfig(ctx)
+	return DexpreoptData{
+		BootclasspathConfigInfo: computeBootclasspathConfigInfo(ctx),
+		SystemServerJars:        global.AllSystemServerJars(ctx).CopyOfApexJarPairs(),
+	}
+}
+
+// runDexpreoptValidations runs the validations that other packages registered, and reports the
+// errors that they return.
+func runDexpreoptValidations(ctx android.SingletonContext) {
+	for _, err := range dexpreoptValidations.run(ctx, dexpreoptData(ctx)) {
+		ctx.Errorf("%s", err)
+	}
+}
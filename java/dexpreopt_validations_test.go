@@ -0,0 +1,95 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package java
+
+import (
+	"fmt"
+	"testing"
+
+	"android/soong/android"
+)
+
+// fakeExternalPackage is the package that the validations in these tests are attributed to, as if
+// it registered them with RegisterDexpreoptValidation.
+const fakeExternalPackage = "android/soong/fakeexternal"
+
+// prepareForDexpreoptValidationTest replaces the registered validations with the given ones, as if
+// fakeExternalPackage registered them, for the duration of the test.
+func prepareForDexpreoptValidationTest(t *testing.T, validations ...DexpreoptValidation) *dexpreoptValidationRegistry {
+	registry := &dexpreoptValidationRegistry{}
+	for _, validate := range validations {
+		registry.register(fakeExternalPackage, validate)
+	}
+	saved := dexpreoptValidations
+	dexpreoptValidations = registry
+	t.Cleanup(func() { dexpreoptValidations = saved })
+	return registry
+}
+
+func TestDexpreoptValidations(t *testing.T) {
+	var data DexpreoptData
+	passing := func(_ android.PathContext, d DexpreoptData) []error {
+		data = d
+		return nil
+	}
+	failing := func(_ android.PathContext, d DexpreoptData) []error {
+		var errs []error
+		for _, jar := range d.UpdatableJars {
+			errs = append(errs, fmt.Errorf("updatable jar %s has no stub library", jar))
+		}
+		return errs
+	}
+
+	t.Run("passing", func(t *testing.T) {
+		registry := prepareForDexpreoptValidationTest(t, passing)
+		android.GroupFixturePreparers(PrepareForBootImageConfigTest, PrepareApexBootJarConfigs).RunTest(t)
+		android.AssertBoolEquals(t, "ran", true, registry.ran)
+		android.AssertDeepEquals(t, "updatable jars",
+			[]string{"com.android.foo:framework-foo", "com.android.bar:framework-bar"}, data.UpdatableJars)
+		android.AssertIntEquals(t, "jars", 5, len(data.Jars))
+	})
+
+	t.Run("failing", func(t *testing.T) {
+		prepareForDexpreoptValidationTest(t, passing, failing)
+		android.GroupFixturePreparers(PrepareForBootImageConfigTest, PrepareApexBootJarConfigs).
+			ExtendWithErrorHandler(android.FixtureExpectsAllErrorsToMatchAPattern([]string{
+				`dexpreopt validation from android/soong/fakeexternal: updatable jar com.android.foo:framework-foo has no stub library`,
+				`dexpreopt validation from android/soong/fakeexternal: updatable jar com.android.bar:framework-bar has no stub library`,
+			})).
+			RunTest(t)
+	})
+
+	t.Run("register after run", func(t *testing.T) {
+		registry := prepareForDexpreoptValidationTest(t)
+		registry.run(nil, DexpreoptData{})
+		defer func() {
+			android.AssertStringEquals(t, "panic",
+				"package android/soong/fakeexternal registered a dexpreopt validation after the dexpreopt validations ran",
+				fmt.Sprint(recover()))
+		}()
+		registry.register(fakeExternalPackage, passing)
+	})
+}
+
+func TestPackageOfFunc(t *testing.T) {
+	for name, expected := range map[string]string{
+		"android/soong/apex.init.0":                     "android/soong/apex",
+		"android/soong/java.TestPackageOfFunc.func1":    "android/soong/java",
+		"github.com/google/blueprint.(*Context).Errorf": "github.com/google/blueprint",
+		"main.main": "main",
+	} {
+		android.AssertStringEquals(t, name, expected, packageOfFunc(name))
+	}
+}
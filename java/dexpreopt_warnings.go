@@ -0,0 +1,136 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package java
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"android/soong/android"
+	"android/soong/dexpreopt"
+)
+
+// The warnings about the dexpreopt config. They are collected while the config is checked, rather
+// than printed one by one, and written to a JSON file next to the dexpreopt explain log so that CI
+// can inspect them. Only a one-line summary is printed.
+
+// The severities of the dexpreopt config warnings.
+const (
+	dexpreoptWarningSeverityWarning = "warning"
+)
+
+// The codes of the dexpreopt config warnings. They are stable, so that CI can allowlist them.
+const (
+	// A deprecated field of the dexpreopt config is used.
+	dexpreoptWarningDeprecatedField = "deprecated-field"
+	// A jar is both on the boot class path and an apex system server jar, as DualClaimAllowlist
+	// allows.
+	dexpreoptWarningDualClaim = "dual-claim"
+	// ProductUpdatableBootLocations differs from the locations derived from ApexBootJars.
+	dexpreoptWarningUpdatableBootLocationsMismatch = "updatable-boot-locations-mismatch"
+	// A device target is not dexpreopted for as its arch is not in SupportedPreoptArches.
+	dexpreoptWarningUnsupportedPreoptArch = "unsupported-preopt-arch"
+)
+
+// dexpreoptWarning is a warning about the dexpreopt config.
+type dexpreoptWarning struct {
+	Severity string `json:"severity"`
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+
+	// The part of the dexpreopt config that the warning is about, e.g. "DualClaimAllowlist".
+	Origin string `json:"origin"`
+}
+
+// dexpreoptWarnings collects the warnings about the dexpreopt config.
+type dexpreoptWarnings struct {
+	mutex    sync.Mutex
+	warnings []dexpreoptWarning
+}
+
+// add adds a warning with the given code about the given part of the dexpreopt config.
+func (w *dexpreoptWarnings) add(code, origin, message string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.warnings = append(w.warnings, dexpreoptWarning{
+		Severity: dexpreoptWarningSeverityWarning,
+		Code:     code,
+		Message:  message,
+		Origin:   origin,
+	})
+}
+
+// sorted returns the collected warnings, sorted by code, then origin and then message, so that the
+// order does not depend on the order of the checks.
+func (w *dexpreoptWarnings) sorted() []dexpreoptWarning {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	warnings := append([]dexpreoptWarning(nil), w.warnings...)
+	sort.Slice(warnings, func(i, j int) bool {
+		a, b := warnings[i], warnings[j]
+		if a.Code != b.Code {
+			return a.Code < b.Code
+		}
+		if a.Origin != b.Origin {
+			return a.Origin < b.Origin
+		}
+		return a.Message < b.Message
+	})
+	return warnings
+}
+
+var dexpreoptWarningsKey = newDexpreoptOnceKey("dexpreoptWarnings")
+
+// getDexpreoptWarnings returns the collector of the warnings about the dexpreopt config.
+func getDexpreoptWarnings(ctx android.PathContext) *dexpreoptWarnings {
+	return ctx.Config().Once(dexpreoptWarningsKey, func() interface{} {
+		return &dexpreoptWarnings{}
+	}).(*dexpreoptWarnings)
+}
+
+// checkDeprecatedFields adds a warning for each deprecated field of the dexpreopt config that is
+// used.
+func checkDeprecatedFields(ctx android.PathContext, global *dexpreopt.GlobalConfig) {
+	for _, warning := range global.DeprecationWarnings() {
+		getDexpreoptWarnings(ctx).add(dexpreoptWarningDeprecatedField, "GlobalConfig", warning)
+	}
+}
+
+// dexpreoptWarningsPath returns the path to the file that lists the warnings about the dexpreopt
+// config.
+func dexpreoptWarningsPath(ctx android.PathContext) android.WritablePath {
+	return android.PathForOutput(ctx, dexpreopt.GetDexpreoptDirName(ctx), "warnings.json")
+}
+
+// buildDexpreoptWarnings generates a rule to write the file returned by dexpreoptWarningsPath, and
+// prints how many warnings it has. It must be called after all the checks of the dexpreopt config.
+func buildDexpreoptWarnings(ctx android.SingletonContext) {
+	warnings := getDexpreoptWarnings(ctx).sorted()
+	if warnings == nil {
+		warnings = []dexpreoptWarning{}
+	}
+	data, err := json.MarshalIndent(warnings, "", "    ")
+	if err != nil {
+		ctx.Errorf("failed to JSON marshal dexpreopt warnings: %v", err)
+		return
+	}
+	android.WriteFileRule(ctx, dexpreoptWarningsPath(ctx), string(data))
+	if len(warnings) > 0 {
+		fmt.Fprintf(os.Stderr, "warning: dexpreopt config: %d warnings, see %s\n", len(warnings), dexpreoptWarningsPath(ctx))
+	}
+}
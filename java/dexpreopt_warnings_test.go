@@ -0,0 +1,63 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package java
+
+import (
+	"testing"
+
+	"android/soong/android"
+	"android/soong/dexpreopt"
+)
+
+func TestDexpreoptWarnings(t *testing.T) {
+	warnings := func(t *testing.T, result *android.TestResult) string {
+		file := result.SingletonForTests("dex_bootjars").Output("out/soong/dexpreopt_arm64/warnings.json")
+		return android.StringRelativeToTop(result.Config, android.ContentFromFileRuleForTests(t, result.TestContext, file))
+	}
+
+	result := PrepareForBootImageConfigTest.RunTest(t)
+	android.AssertStringEquals(t, "no warnings", "[]\n", warnings(t, result))
+
+	result = android.GroupFixturePreparers(
+		PrepareForBootImageConfigTest,
+		PrepareApexBootJarConfigs,
+		dexpreopt.FixtureSetApexSystemServerJars("com.android.foo:framework-foo"),
+		dexpreopt.FixtureModifyGlobalConfig(func(_ android.PathContext, c *dexpreopt.GlobalConfig) {
+			c.DualClaimAllowlist = dexpreopt.DualClaimAllowlist{
+				Jars:   android.CreateTestConfiguredJarList([]string{"com.android.foo:framework-foo"}),
+				Expiry: "2099-12-31",
+			}
+			c.ProductUpdatableBootLocations = []string{
+				"/apex/com.android.foo/javalib/framework-foo.jar",
+				"/system/framework/framework-bar.jar",
+			}
+		}),
+	).RunTest(t)
+	android.AssertStringEquals(t, "warnings", `[
+    {
+        "severity": "warning",
+        "code": "dual-claim",
+        "message": "\"framework-foo\" is claimed by both the boot class path, as com.android.foo:framework-foo, and the classpath fragment of apex \"com.android.foo\", which DualClaimAllowlist allows until 2099-12-31",
+        "origin": "DualClaimAllowlist"
+    },
+    {
+        "severity": "warning",
+        "code": "updatable-boot-locations-mismatch",
+        "message": "ProductUpdatableBootLocations differs from the locations derived from ApexBootJars in 1 entries, see out/soong/dexpreopt_arm64/dexpreopt_explain.txt",
+        "origin": "ProductUpdatableBootLocations"
+    }
+]
+`, warnings(t, result))
+}
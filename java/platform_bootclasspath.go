@@ -133,7 +133,7 @@ func (b *platformBootclasspathModule) hiddenAPIDepsMutator(ctx android.BottomUpM
 func (b *platformBootclasspathModule) BootclasspathDepsMutator(ctx android.BottomUpMutatorContext) {
 	// Add dependencies on all the ART jars.
 	global := dexpreopt.GetGlobalConfig(ctx)
-	addDependenciesOntoSelectedBootImageApexes(ctx, "com.android.art")
+	addDependenciesOntoSelectedBootImageApexes(ctx, artApexRef(ctx).name)
 	// TODO: b/308174306 - Remove the mechanism of depending on the java_sdk_library(_import) directly
 	addDependenciesOntoBootImageModules(ctx, global.ArtApexJars, platformBootclasspathArtBootJarDepTag)
 
@@ -156,9 +156,10 @@ func (b *platformBootclasspathModule) BootclasspathDepsMutator(ctx android.Botto
 }
 
 func addDependenciesOntoBootImageModules(ctx android.BottomUpMutatorContext, modules android.ConfiguredJarList, tag bootclasspathDependencyTag) {
+	global := dexpreopt.GetGlobalConfig(ctx)
 	for i := 0; i < modules.Len(); i++ {
 		apex := modules.Apex(i)
-		name := modules.Jar(i)
+		name := global.BootJarModule(modules.Jar(i))
 
 		addDependencyOntoApexModulePair(ctx, apex, name, tag)
 	}
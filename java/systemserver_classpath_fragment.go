@@ -19,6 +19,7 @@ import (
 	"android/soong/dexpreopt"
 
 	"github.com/google/blueprint"
+	"github.com/google/blueprint/proptools"
 )
 
 func init() {
@@ -31,6 +32,10 @@ func registerSystemserverClasspathBuildComponents(ctx android.RegistrationContex
 	ctx.RegisterModuleType("platform_systemserverclasspath", platformSystemServerClasspathFactory)
 	ctx.RegisterModuleType("systemserverclasspath_fragment", systemServerClasspathFactory)
 	ctx.RegisterModuleType("prebuilt_systemserverclasspath_fragment", prebuiltSystemServerClasspathModuleFactory)
+	ctx.PreArchMutators(func(ctx android.RegisterMutatorsContext) {
+		// Not parallel, so that the fragments of an apex are registered in a deterministic order.
+		ctx.BottomUp("system_server_jars_fragments", systemServerJarsFragmentsMutator)
+	})
 }
 
 var SystemServerClasspathFragmentSdkMemberType = &systemServerClasspathFragmentMemberType{
@@ -103,6 +108,12 @@ type systemServerClasspathFragmentProperties struct {
 	//
 	// The order does not matter.
 	Standalone_contents []string
+
+	// The apex that owns the contents. If set, the contents are added to the system server class
+	// path as the system server jars fragment of the apex, so they do not also need to be listed in
+	// PRODUCT_APEX_SYSTEM_SERVER_JARS. Only supported by systemserverclasspath_fragment modules, not
+	// by prebuilts.
+	Owner_apex *string
 }
 
 func systemServerClasspathFactory() android.Module {
@@ -125,6 +136,7 @@ func (s *SystemServerClasspathModule) GenerateAndroidBuildActions(ctx android.Mo
 	standaloneClasspathJars := configuredJarListToClasspathJars(ctx, standaloneConfiguredJars, STANDALONE_SYSTEMSERVER_JARS)
 	configuredJars = configuredJars.AppendList(&standaloneConfiguredJars)
 	classpathJars = append(classpathJars, standaloneClasspathJars...)
+	s.checkConfiguredJarsApex(ctx, configuredJars)
 	s.classpathFragmentBase().generateClasspathProtoBuildActions(ctx, configuredJars, classpathJars)
 }
 
@@ -132,7 +144,8 @@ func (s *SystemServerClasspathModule) configuredJars(ctx android.ModuleContext)
 	global := dexpreopt.GetGlobalConfig(ctx)
 
 	possibleUpdatableModules := gatherPossibleApexModuleNamesAndStems(ctx, s.properties.Contents, systemServerClasspathFragmentContentDepTag)
-	jars, unknown := global.ApexSystemServerJars.Filter(possibleUpdatableModules)
+	apexJars := global.MergedApexSystemServerJars(ctx)
+	jars, unknown := apexJars.Filter(possibleUpdatableModules)
 	// TODO(satayev): remove geotz ssc_fragment, since geotz is not part of SSCP anymore.
 	_, unknown = android.RemoveFromList("geotz", unknown)
 	// This module only exists in car products.
@@ -152,7 +165,7 @@ func (s *SystemServerClasspathModule) configuredJars(ctx android.ModuleContext)
 	// This is an exception to support end-to-end test for ApexdUnitTests, until such support exists.
 	if android.InList("test_service-apexd", possibleUpdatableModules) {
 		jars = jars.Append("com.android.apex.test_package", "test_service-apexd")
-	} else if global.ApexSystemServerJars.Len() > 0 && len(unknown) > 0 {
+	} else if apexJars.Len() > 0 && len(unknown) > 0 {
 		// For non test apexes, make sure that all contents are actually declared in make.
 		ctx.ModuleErrorf("%s in contents must also be declared in PRODUCT_APEX_SYSTEM_SERVER_JARS", unknown)
 	}
@@ -160,6 +173,24 @@ func (s *SystemServerClasspathModule) configuredJars(ctx android.ModuleContext)
 	return jars
 }
 
+// checkConfiguredJarsApex checks that the apex that the config claims each of the given jars is in
+// is one of the apexes that this module is in. The config and the contents of this module only
+// agree on the names of the jars, so a jar that is configured under the wrong apex would otherwise
+// get the wrong on-device location. The platform variant and the variants for test apexes, whose
+// names differ from those in the config, are not checked.
+func (s *SystemServerClasspathModule) checkConfiguredJarsApex(ctx android.ModuleContext, jars android.ConfiguredJarList) {
+	apexInfo, _ := android.ModuleProvider(ctx, android.ApexInfoProvider)
+	if apexInfo.IsForPlatform() || len(apexInfo.TestApexes) > 0 {
+		return
+	}
+	for i := 0; i < jars.Len(); i++ {
+		if apex := jars.Apex(i); !apexInfo.InApexVariant(apex) {
+			ctx.ModuleErrorf("the system server jars configuration expects %q to be in apex %q but this is only in apexes %q",
+				jars.Jar(i), apex, apexInfo.InApexVariants)
+		}
+	}
+}
+
 func (s *SystemServerClasspathModule) standaloneConfiguredJars(ctx android.ModuleContext) android.ConfiguredJarList {
 	global := dexpreopt.GetGlobalConfig(ctx)
 
@@ -232,6 +263,28 @@ func (s *SystemServerClasspathModule) ComponentDepsMutator(ctx android.BottomUpM
 	}
 }
 
+// systemServerJarsFragmentsMutator registers the contents of the systemserverclasspath_fragment
+// modules that have an owner_apex as the system server jars fragments of those apexes. It runs
+// before the arch mutator, and so before the system server jars are first read, see
+// dexpreopt.RegisterSystemServerJarsFragment.
+func systemServerJarsFragmentsMutator(ctx android.BottomUpMutatorContext) {
+	// Prebuilts are skipped so that a source and a prebuilt fragment do not both claim the jars.
+	s, ok := ctx.Module().(*SystemServerClasspathModule)
+	if !ok || s.properties.Owner_apex == nil {
+		return
+	}
+	apex := proptools.String(s.properties.Owner_apex)
+	if apex == "" || android.IsConfiguredJarForPlatform(apex) {
+		ctx.PropertyErrorf("owner_apex", "must be the name of an apex, got %q", apex)
+		return
+	}
+	if len(s.properties.Contents) == 0 {
+		ctx.PropertyErrorf("owner_apex", "is set but contents is empty")
+		return
+	}
+	dexpreopt.RegisterSystemServerJarsFragment(ctx.Config(), apex, s.properties.Contents...)
+}
+
 // Collect information for opening IDE project files in java/jdeps.go.
 func (s *SystemServerClasspathModule) IDEInfo(dpInfo *android.IdeInfo) {
 	dpInfo.Deps = append(dpInfo.Deps, s.properties.Contents...)
@@ -18,6 +18,7 @@ import (
 	"testing"
 
 	"android/soong/android"
+	"android/soong/dexpreopt"
 )
 
 var prepareForTestWithSystemServerClasspath = android.GroupFixturePreparers(
@@ -106,3 +107,55 @@ func TestSystemServerClasspathFragmentWithoutContents(t *testing.T) {
 			}
 		`)
 }
+
+func TestSystemServerClasspathFragmentOwnerApex(t *testing.T) {
+	bp := `
+		systemserverclasspath_fragment {
+			name: "com.android.foo-systemserverclasspath-fragment",
+			owner_apex: "com.android.foo",
+			contents: ["service-foo1", "service-foo2"],
+		}
+
+		java_library {
+			name: "service-foo1",
+			srcs: ["a.java"],
+		}
+
+		java_library {
+			name: "service-foo2",
+			srcs: ["a.java"],
+		}
+	`
+
+	result := android.GroupFixturePreparers(
+		prepareForTestWithSystemServerClasspath,
+		dexpreopt.FixtureSetSystemServerJars("platform:services"),
+		dexpreopt.FixtureSetApexSystemServerJars("com.android.bar:service-bar"),
+	).RunTestWithBp(t, bp)
+
+	ctx := &android.TestPathContext{TestResult: result}
+	android.AssertDeepEquals(t, "system server classpath", []string{
+		"/system/framework/services.jar",
+		"/apex/com.android.bar/javalib/service-bar.jar",
+		"/apex/com.android.foo/javalib/service-foo1.jar",
+		"/apex/com.android.foo/javalib/service-foo2.jar",
+	}, systemServerClasspath(ctx))
+
+	t.Run("platform", func(t *testing.T) {
+		prepareForTestWithSystemServerClasspath.
+			ExtendWithErrorHandler(android.FixtureExpectsAtLeastOneErrorMatchingPattern(
+				`\Qowner_apex: must be the name of an apex, got "platform"\E`)).
+			RunTestWithBp(t, `
+				systemserverclasspath_fragment {
+					name: "systemserverclasspath-fragment",
+					owner_apex: "platform",
+					contents: ["service-foo"],
+				}
+
+				java_library {
+					name: "service-foo",
+					srcs: ["a.java"],
+				}
+			`)
+	})
+}